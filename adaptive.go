@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+// adaptiveBounds returns the adaptive interval range, applying the defaults for an
+// omitted min_interval (1s) and max_interval (check_interval_seconds)
+func (c *Config) adaptiveBounds() (time.Duration, time.Duration) {
+	minSeconds, maxSeconds := c.MinIntervalSeconds, c.MaxIntervalSeconds
+	if minSeconds == 0 {
+		minSeconds = 1
+	}
+	if maxSeconds == 0 {
+		maxSeconds = c.CheckIntervalSeconds
+	}
+	return time.Duration(minSeconds) * time.Second, time.Duration(maxSeconds) * time.Second
+}
+
+// nextInterval decides how long to wait before the next check. With adaptive_interval,
+// a pass that changed something or hit failures drops to min_interval so follow-on
+// changes settle quickly, and each quiet pass doubles the wait up to max_interval.
+func (s *ServiceState) nextInterval(result ReconcileResult) time.Duration {
+	fixed := time.Duration(s.config.CheckIntervalSeconds) * time.Second
+	if !s.config.AdaptiveInterval {
+		s.interval = 0
+		return fixed
+	}
+
+	minInterval, maxInterval := s.config.adaptiveBounds()
+	switch {
+	case result.Changed || result.Failures > 0:
+		s.interval = minInterval
+	case s.interval == 0:
+		s.interval = fixed
+	default:
+		s.interval *= 2
+	}
+
+	if s.interval < minInterval {
+		s.interval = minInterval
+	}
+	if s.interval > maxInterval {
+		s.interval = maxInterval
+	}
+	return s.interval
+}
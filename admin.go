@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// isRunningAsAdmin checks if the current process has admin privileges, i.e. its token
+// is elevated. A filtered UAC token, as an admin gets without "Run as administrator",
+// is not, so this is false exactly when netsh changes would fail for lack of rights.
+func isRunningAsAdmin() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
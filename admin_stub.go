@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// isRunningAsAdmin checks if the current process has admin privileges; off Windows
+// that means running as root
+func isRunningAsAdmin() bool {
+	return os.Geteuid() == 0
+}
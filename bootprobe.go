@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	bootProbeAttempts    = 10                     // bounds the wait to roughly 5s per booting instance
+	bootProbeInterval    = 500 * time.Millisecond // pause between probes
+	bootProbeDialTimeout = 500 * time.Millisecond
+)
+
+// isHostRoutable probes ip:port over TCP. A refused connection counts as routable:
+// the instance answered, the service just isn't listening yet. Overridable in tests.
+var isHostRoutable = func(ip string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), bootProbeDialTimeout)
+	if err != nil {
+		return isConnectionRefused(err)
+	}
+	conn.Close()
+	return true
+}
+
+// waitForRoutable probes until the address answers or the attempts run out
+func waitForRoutable(ip string, port int, attempts int, interval time.Duration, routable func(ip string, port int) bool) bool {
+	for attempt := 0; attempt < attempts; attempt++ {
+		if routable(ip, port) {
+			return true
+		}
+		if attempt < attempts-1 {
+			time.Sleep(interval)
+		}
+	}
+	return false
+}
+
+// probeBootedInstance waits briefly for a freshly started instance's IP to become
+// routable. Right after a distro boots, wsl can report an IP a second or two before
+// traffic to it is delivered, and a forward added then goes nowhere until the next
+// check. The mapping is committed either way; this only delays it.
+func (s *ServiceState) probeBootedInstance(instance Instance, ip string) {
+	if len(instance.Ports) == 0 {
+		return
+	}
+
+	port := instance.Ports[0].InternalPortEffective()
+	if waitForRoutable(ip, port, bootProbeAttempts, bootProbeInterval, isHostRoutable) {
+		return
+	}
+
+	s.logf("Warning: Instance %s at %s not reachable within %v of appearing, forwarding anyway",
+		instance.Name, ip, time.Duration(bootProbeAttempts)*bootProbeInterval)
+	say("  ⚠️  %s: %s not reachable yet after boot", instance.Name, ip)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// firewallRuleExists returns true if Windows Firewall has a rule with the name, in
+// any direction or protocol
+func (s *ServiceState) firewallRuleExists(name string) bool {
+	_, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", name))
+	return err == nil
+}
+
+// CleanupPlan is everything --cleanup removes
+type CleanupPlan struct {
+	ProxyPorts []int    // live forwards: on configured ports, or registered as created by the forwarder
+	RuleNames  []string // existing rules: named for configured ports, or registered
+	QosPorts   []int    // configured ports with a qos_throttle_kbps policy
+}
+
+// planCleanup works out what to remove. Forwards into Docker Desktop are never touched,
+// and registered forwards only count if they still point where the forwarder put them,
+// so a port reused by something else since is left alone.
+func planCleanup(config *Config, mappings map[int]PortMapping, proxies []RegistryPortProxy, rules []RegistryFirewallRule, ruleExists func(string) bool) CleanupPlan {
+	var plan CleanupPlan
+
+	ports := make(map[int]bool)
+	for port, mapping := range mappings {
+		if isDockerDesktopIP(mapping.TargetIP) {
+			continue
+		}
+		if config.configuresExternalPort(port) {
+			ports[port] = true
+		}
+	}
+	for _, proxy := range proxies {
+		if mapping, live := mappings[proxy.ListenPort]; live && mapping.TargetIP == proxy.ConnectAddress && mapping.InternalPort == proxy.ConnectPort {
+			ports[proxy.ListenPort] = true
+		}
+	}
+	for port := range ports {
+		plan.ProxyPorts = append(plan.ProxyPorts, port)
+	}
+	sort.Ints(plan.ProxyPorts)
+
+	names := make(map[string]bool)
+	qos := make(map[int]bool)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			inbound := FirewallRuleSpec{Name: generateFirewallRuleName(port.ExternalPortEffective(), instance.Name)}
+			outbound := FirewallRuleSpec{Name: outboundFirewallRuleName(port.ExternalPortEffective(), instance.Name)}
+			legacy := FirewallRuleSpec{Name: legacyFirewallRuleName(port.ExternalPortEffective(), instance.Name)}
+			for _, rule := range []FirewallRuleSpec{inbound, outbound, legacy} {
+				names[rule.withProtocol(port.ProtocolEffective()).Name] = true
+			}
+			if port.QosThrottleKbps > 0 {
+				qos[port.ExternalPortEffective()] = true
+			}
+		}
+	}
+	for _, rule := range rules {
+		names[rule.RuleName] = true
+	}
+	for name := range names {
+		if ruleExists(name) {
+			plan.RuleNames = append(plan.RuleNames, name)
+		}
+	}
+	sort.Strings(plan.RuleNames)
+
+	for port := range qos {
+		plan.QosPorts = append(plan.QosPorts, port)
+	}
+	sort.Ints(plan.QosPorts)
+
+	return plan
+}
+
+// runCleanup implements --cleanup: remove every forward, firewall rule and QoS policy
+// the forwarder manages for the config, plus anything the registry says it created,
+// then drop registry records left without a resource. Exit codes: 0=ok, 1=error
+func runCleanup(opts *CommandLineOptions) int {
+	config, err := loadConfigFile(opts.ConfigFile, opts.AllowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", opts.ConfigFile, err)
+		return 1
+	}
+	config = config.ManagedConfig().TaggedConfig(opts.Tags)
+
+	fmt.Println("WSL2 Port Forwarder - Cleanup")
+	fmt.Println("=============================")
+
+	service := &ServiceState{config: config, configFile: opts.ConfigFile, dryRun: opts.DryRun}
+	var proxies []RegistryPortProxy
+	var rules []RegistryFirewallRule
+	if registryManager, err := NewRegistryManager(); err == nil {
+		service.registryManager = registryManager
+		defer registryManager.Close()
+		if proxies, err = registryManager.GetRegisteredPortProxies(); err != nil {
+			fmt.Printf("⚠️  Unable to read registered port proxies: %v\n", err)
+		}
+		if rules, err = registryManager.GetRegisteredFirewallRules(); err != nil {
+			fmt.Printf("⚠️  Unable to read registered firewall rules: %v\n", err)
+		}
+	} else {
+		fmt.Printf("⚠️  Registry tracking unavailable, removing configured ports only: %v\n", err)
+	}
+
+	mappings, err := service.getCurrentPortMappings()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	service.currentMappings = mappings
+	plan := planCleanup(config, mappings, proxies, rules, service.firewallRuleExists)
+
+	failures, removedProxies, removedRules := 0, 0, 0
+	for _, port := range plan.ProxyPorts {
+		mapping := mappings[port]
+		if err := service.removePortMapping(port); err != nil {
+			fmt.Printf("  ❌ Port %d: %v\n", port, err)
+			failures++
+			continue
+		}
+		removedProxies++
+		fmt.Printf("  ✓ Port %d -> %s:%d removed%s\n", port, mapping.TargetIP, mapping.InternalPort, service.dryRunTag())
+	}
+	for _, name := range plan.RuleNames {
+		if err := service.removeFirewallRuleByName(name); err != nil {
+			fmt.Printf("  ❌ Firewall rule %s: %v\n", name, err)
+			failures++
+			continue
+		}
+		removedRules++
+		fmt.Printf("  ✓ Firewall rule %s removed%s\n", name, service.dryRunTag())
+	}
+	for _, port := range plan.QosPorts {
+		if err := service.removeQosPolicy(port); err != nil {
+			fmt.Printf("  ❌ QoS throttle for port %d: %v\n", port, err)
+			failures++
+		}
+	}
+
+	// Whatever the registry still tracks no longer exists, so only the records remain
+	if service.registryManager != nil && !service.dryRun {
+		if err := service.registryManager.CleanupOrphanedEntries(); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			failures++
+		}
+	}
+
+	fmt.Printf("\nRemoved %d port proxies and %d firewall rules%s\n", removedProxies, removedRules, service.dryRunTag())
+	if failures > 0 {
+		fmt.Printf("❌ Cleanup finished with %d failures\n", failures)
+		return 1
+	}
+	fmt.Println("✅ Cleanup complete")
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultCommandTimeout is how long a command may run when command_timeout_seconds isn't set
+const defaultCommandTimeout = 30 * time.Second
+
+// commandWaitDelay bounds the wait for a killed command's output: wsl.exe can leave
+// processes behind that hold its pipes open
+const commandWaitDelay = 2 * time.Second
+
+// CommandTimeout returns command_timeout_seconds as a duration, defaulting to 30s
+func (c *Config) CommandTimeout() time.Duration {
+	if c.CommandTimeoutSeconds == 0 {
+		return defaultCommandTimeout
+	}
+	return time.Duration(c.CommandTimeoutSeconds) * time.Second
+}
+
+// CommandRunner runs an external command (netsh, wsl) and returns its stdout. The
+// service's queries and changes go through one, so tests can stand in for Windows.
+type CommandRunner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// execRunner is the CommandRunner that runs commands for real, killing any that outlive
+// its timeout
+type execRunner struct {
+	timeout time.Duration
+}
+
+func (r execRunner) Run(name string, args ...string) ([]byte, error) {
+	return runCommand(r.timeout, false, name, args...)
+}
+
+// runCommand runs a command, killing it if it outlives timeout, and returns its
+// stdout, or with combined its stdout and stderr. A killed command's error wraps
+// context.DeadlineExceeded, so commandError classifies it as KindCommandTimeout.
+func runCommand(timeout time.Duration, combined bool, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = commandWaitDelay
+	var output []byte
+	var err error
+	if combined {
+		output, err = cmd.CombinedOutput()
+	} else {
+		output, err = cmd.Output()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("%s timed out after %s: %w", name, timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		var stderr []byte
+		var exitErr *exec.ExitError
+		if !combined && errors.As(err, &exitErr) {
+			stderr = exitErr.Stderr
+		}
+		return output, commandFailure(err, output, stderr)
+	}
+	return output, nil
+}
+
+// commandFailure adds what a failed command printed to its error, since "exit status 1"
+// alone says nothing. netsh reports failures on stdout, wsl on either, often in UTF-16.
+func commandFailure(err error, stdout, stderr []byte) error {
+	var lines []string
+	for _, output := range [][]byte{stdout, stderr} {
+		text, decodeErr := decodeCommandOutput(output)
+		if decodeErr != nil {
+			continue
+		}
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, strings.Join(lines, " "))
+}
+
+// commands returns the service's CommandRunner, running commands for real (bounded by
+// the command timeout of its config) unless a test set one
+func (s *ServiceState) commands() CommandRunner {
+	if s.runner == nil {
+		return execRunner{timeout: s.commandTimeout()}
+	}
+	return s.runner
+}
+
+// commandTimeout returns how long the service lets a command run: the
+// command_timeout_seconds of the config it is using
+func (s *ServiceState) commandTimeout() time.Duration {
+	if s.config == nil {
+		return defaultCommandTimeout
+	}
+	return s.config.CommandTimeout()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCheckIntervalSeconds is check_interval_seconds when it is omitted or 0
+const defaultCheckIntervalSeconds = 15
+
+// configAllowsComments reports whether comments should be stripped from a config file,
+// either because the caller asked for it or because the file uses the .jsonc extension
+func configAllowsComments(configFile string, allowComments bool) bool {
+	return allowComments || strings.EqualFold(filepath.Ext(configFile), ".jsonc")
+}
+
+// isYAMLConfig reports whether a config file is YAML, by its .yaml or .yml extension
+func isYAMLConfig(configFile string) bool {
+	ext := strings.ToLower(filepath.Ext(configFile))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// isTOMLConfig reports whether a config file is TOML, by its .toml extension
+func isTOMLConfig(configFile string) bool {
+	return strings.EqualFold(filepath.Ext(configFile), ".toml")
+}
+
+// configFormat names a config file's format for messages
+func configFormat(configFile string) string {
+	switch {
+	case isYAMLConfig(configFile):
+		return "YAML"
+	case isTOMLConfig(configFile):
+		return "TOML"
+	}
+	return "JSON"
+}
+
+// parseConfig parses raw config file contents in the format the extension implies:
+// YAML for .yaml and .yml, TOML for .toml, JSON (or JSONC, see configAllowsComments)
+// for anything else
+func parseConfig(configFile string, data []byte, allowComments bool) (*Config, error) {
+	var config *Config
+	if isYAMLConfig(configFile) {
+		config = &Config{}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
+	} else if isTOMLConfig(configFile) {
+		config = &Config{}
+		if _, err := toml.Decode(string(data), config); err != nil {
+			return nil, err
+		}
+	} else {
+		parsed, err := parseConfigData(data, configAllowsComments(configFile, allowComments))
+		if err != nil {
+			return nil, err
+		}
+		config = parsed
+	}
+
+	// Omitting check_interval_seconds (or setting it to 0) means the default, not an error
+	if config.CheckIntervalSeconds == 0 {
+		config.CheckIntervalSeconds = defaultCheckIntervalSeconds
+	}
+	config.applyDefaults()
+	return config, nil
+}
+
+// firewallOff is the firewall value that switches off a firewall inherited from defaults:
+// an omitted (or empty) firewall can't be told apart from one that wasn't set
+const firewallOff = "none"
+
+// PortDefaults holds port settings given once for many ports, at the top level or
+// per instance. Empty fields inherit nothing.
+type PortDefaults struct {
+	Firewall      string `json:"firewall,omitempty" yaml:"firewall,omitempty" toml:"firewall,omitempty"`
+	ListenAddress string `json:"listen_address,omitempty" yaml:"listen_address,omitempty" toml:"listen_address,omitempty"`
+	Protocol      string `json:"protocol,omitempty" yaml:"protocol,omitempty" toml:"protocol,omitempty"`
+}
+
+// applyTo fills the port's unset fields from the defaults
+func (d PortDefaults) applyTo(port *Port) {
+	// firewall_remote_ip replaces firewall, so a default must not add one next to it
+	if port.Firewall == "" && port.FirewallRemote == "" {
+		port.Firewall = d.Firewall
+	}
+	if port.ListenAddress == "" {
+		port.ListenAddress = d.ListenAddress
+	}
+	if port.Protocol == "" {
+		port.Protocol = d.Protocol
+	}
+}
+
+// applyDefaults merges the defaults blocks into every port, so the rest of the code
+// (validation included) sees fully populated ports. A port's own setting wins over
+// its instance's defaults, which win over the top-level defaults.
+func (c *Config) applyDefaults() {
+	for i := range c.Instances {
+		instance := &c.Instances[i]
+		for j := range instance.Ports {
+			port := &instance.Ports[j]
+			instance.Defaults.applyTo(port)
+			c.Defaults.applyTo(port)
+			if port.Firewall == firewallOff {
+				port.Firewall = ""
+			}
+		}
+	}
+}
+
+// parseConfigData parses raw config file contents, optionally stripping JSONC comments first
+func parseConfigData(data []byte, allowComments bool) (*Config, error) {
+	if allowComments {
+		stripped, err := stripJSONComments(data)
+		if err != nil {
+			return nil, err
+		}
+		data = stripped
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line, column := offsetToLineColumn(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %v", line, column, err)
+		}
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// stripJSONComments removes // line comments and /* */ block comments from JSONC input.
+// Comment characters are replaced with spaces (newlines are kept) so byte offsets, and
+// therefore the line numbers reported in parse errors, still match the original file.
+func stripJSONComments(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+
+		if inString {
+			if c == '\\' {
+				i++ // skip escaped character
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				if out[i] != '\r' {
+					out[i] = ' '
+				}
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			start := i
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				line, column := offsetToLineColumn(out, int64(start))
+				return nil, fmt.Errorf("line %d, column %d: unterminated block comment", line, column)
+			}
+			end += i + 4
+			for ; i < end; i++ {
+				if out[i] != '\n' && out[i] != '\r' {
+					out[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+
+	return out, nil
+}
+
+// offsetToLineColumn converts a byte offset into a 1-based line and column
+func offsetToLineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, column := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// fallbackConfigPattern finds the fallback_config value without needing the rest of
+// the file to be valid JSON
+var fallbackConfigPattern = regexp.MustCompile(`"fallback_config"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+
+// extractFallbackConfigPath returns the fallback_config value from raw config data
+func extractFallbackConfigPath(data []byte) string {
+	match := fallbackConfigPattern.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	var path string
+	if err := json.Unmarshal([]byte(`"`+string(match[1])+`"`), &path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// resolveFallbackConfigPath resolves a fallback_config path relative to the primary config
+func resolveFallbackConfigPath(configFile, fallback string) string {
+	if fallback == "" || filepath.IsAbs(fallback) {
+		return fallback
+	}
+	return filepath.Join(filepath.Dir(configFile), fallback)
+}
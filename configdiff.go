@@ -0,0 +1,485 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigDiff describes the differences between two configs, in effective terms
+// (e.g. an omitted internal_port compares equal to an explicit one with the same value)
+type ConfigDiff struct {
+	SettingsChanged  []string         `json:"settings_changed,omitempty"`
+	InstancesAdded   []string         `json:"instances_added,omitempty"`
+	InstancesRemoved []string         `json:"instances_removed,omitempty"`
+	InstanceChanges  []InstanceChange `json:"instance_changes,omitempty"`
+	PortChanges      []PortChange     `json:"port_changes,omitempty"`
+	NewConflicts     []PortConflict   `json:"new_conflicts,omitempty"`
+}
+
+// InstanceChange lists the instance-level settings changed in an instance present in both configs
+type InstanceChange struct {
+	Instance string   `json:"instance"`
+	Details  []string `json:"details"`
+}
+
+// PortChange is a port added to, removed from, or changed within an instance
+type PortChange struct {
+	Instance string   `json:"instance"`
+	Port     int      `json:"port"`
+	Protocol string   `json:"protocol"` // "tcp" or "udp" (the new one, if it changed)
+	Change   string   `json:"change"`   // "added", "removed" or "changed"
+	Details  []string `json:"details,omitempty"`
+}
+
+// PortConflict is an external port claimed by more than one instance
+type PortConflict struct {
+	Port      int      `json:"port"`
+	Instances []string `json:"instances"`
+}
+
+// IsEmpty returns true if the configs are effectively identical
+func (d *ConfigDiff) IsEmpty() bool {
+	return len(d.SettingsChanged) == 0 && len(d.InstancesAdded) == 0 && len(d.InstancesRemoved) == 0 &&
+		len(d.InstanceChanges) == 0 && len(d.PortChanges) == 0 && len(d.NewConflicts) == 0
+}
+
+// diffConfigs compares two configs instance by instance and port by port
+func diffConfigs(oldConfig, newConfig *Config) *ConfigDiff {
+	diff := &ConfigDiff{}
+
+	if oldConfig.CheckIntervalSeconds != newConfig.CheckIntervalSeconds {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("check_interval_seconds %d -> %d",
+			oldConfig.CheckIntervalSeconds, newConfig.CheckIntervalSeconds))
+	}
+	if oldConfig.LogDedupSeconds != newConfig.LogDedupSeconds {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("log_dedup_seconds %d -> %d",
+			oldConfig.LogDedupSeconds, newConfig.LogDedupSeconds))
+	}
+	if oldConfig.Transactional != newConfig.Transactional {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("transactional %v -> %v",
+			oldConfig.Transactional, newConfig.Transactional))
+	}
+	if strings.Join(oldConfig.ManagedInstances, ",") != strings.Join(newConfig.ManagedInstances, ",") {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("managed_instances %v -> %v",
+			oldConfig.ManagedInstances, newConfig.ManagedInstances))
+	}
+
+	if oldConfig.EmptyReadingGrace != newConfig.EmptyReadingGrace {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("empty_reading_grace %d -> %d",
+			oldConfig.EmptyReadingGrace, newConfig.EmptyReadingGrace))
+	}
+	if oldConfig.AdditiveOnly != newConfig.AdditiveOnly {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("additive_only %v -> %v",
+			oldConfig.AdditiveOnly, newConfig.AdditiveOnly))
+	}
+	if oldConfig.PreProvisionFirewall != newConfig.PreProvisionFirewall {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("pre_provision_firewall %v -> %v",
+			oldConfig.PreProvisionFirewall, newConfig.PreProvisionFirewall))
+	}
+	if oldConfig.AdaptiveInterval != newConfig.AdaptiveInterval {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("adaptive_interval %v -> %v",
+			oldConfig.AdaptiveInterval, newConfig.AdaptiveInterval))
+	}
+	if oldConfig.MinIntervalSeconds != newConfig.MinIntervalSeconds || oldConfig.MaxIntervalSeconds != newConfig.MaxIntervalSeconds {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("min_interval/max_interval %d/%d -> %d/%d",
+			oldConfig.MinIntervalSeconds, oldConfig.MaxIntervalSeconds, newConfig.MinIntervalSeconds, newConfig.MaxIntervalSeconds))
+	}
+	if oldConfig.FallbackConfig != newConfig.FallbackConfig {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("fallback_config %q -> %q",
+			oldConfig.FallbackConfig, newConfig.FallbackConfig))
+	}
+	if oldConfig.SyslogAddress != newConfig.SyslogAddress {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("syslog_address %q -> %q",
+			oldConfig.SyslogAddress, newConfig.SyslogAddress))
+	}
+	if oldConfig.StrictPortConflicts != newConfig.StrictPortConflicts {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("strict_port_conflicts %v -> %v",
+			oldConfig.StrictPortConflicts, newConfig.StrictPortConflicts))
+	}
+	if oldConfig.LogFile != newConfig.LogFile {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("log_file %q -> %q",
+			oldConfig.LogFile, newConfig.LogFile))
+	}
+	if oldConfig.LogMaxSizeMB != newConfig.LogMaxSizeMB || oldConfig.LogMaxBackupsEffective() != newConfig.LogMaxBackupsEffective() {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("log_max_size_mb/log_max_backups %d/%d -> %d/%d",
+			oldConfig.LogMaxSizeMB, oldConfig.LogMaxBackupsEffective(), newConfig.LogMaxSizeMB, newConfig.LogMaxBackupsEffective()))
+	}
+	if oldConfig.ReconcileRegistry != newConfig.ReconcileRegistry {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("reconcile_registry_on_start %v -> %v",
+			oldConfig.ReconcileRegistry, newConfig.ReconcileRegistry))
+	}
+	if oldConfig.CommandTimeout() != newConfig.CommandTimeout() {
+		diff.SettingsChanged = append(diff.SettingsChanged, fmt.Sprintf("command_timeout_seconds %d -> %d",
+			int(oldConfig.CommandTimeout().Seconds()), int(newConfig.CommandTimeout().Seconds())))
+	}
+
+	oldInstances := instancesByName(oldConfig)
+	newInstances := instancesByName(newConfig)
+
+	for _, instance := range newConfig.Instances {
+		if _, existed := oldInstances[instance.Name]; !existed {
+			diff.InstancesAdded = append(diff.InstancesAdded, instance.Name)
+		}
+	}
+	for _, instance := range oldConfig.Instances {
+		if _, exists := newInstances[instance.Name]; !exists {
+			diff.InstancesRemoved = append(diff.InstancesRemoved, instance.Name)
+		}
+	}
+
+	// Compare the settings of every instance present in both configs
+	for _, instance := range newConfig.Instances {
+		if oldInstance, existed := oldInstances[instance.Name]; existed {
+			if details := compareInstances(oldInstance, instance); len(details) > 0 {
+				diff.InstanceChanges = append(diff.InstanceChanges, InstanceChange{Instance: instance.Name, Details: details})
+			}
+		}
+	}
+
+	// Compare ports of every instance present in either config
+	names := make([]string, 0, len(oldInstances)+len(newInstances))
+	for name := range oldInstances {
+		names = append(names, name)
+	}
+	for name := range newInstances {
+		if _, seen := oldInstances[name]; !seen {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldPorts := portsByExternal(oldInstances[name])
+		newPorts := portsByExternal(newInstances[name])
+		switched := protocolSwitches(oldPorts, newPorts)
+
+		for _, key := range sortedPortKeys(oldPorts, newPorts) {
+			oldPort, inOld := oldPorts[key]
+			newPort, inNew := newPorts[key]
+			change := PortChange{Instance: name, Port: key.port, Protocol: key.protocol}
+			switch {
+			case switched[key.port] != nil:
+				if !inNew {
+					continue // reported with the port's new protocol
+				}
+				change.Change = "changed"
+				change.Details = append([]string{fmt.Sprintf("protocol %s -> %s", switched[key.port].ProtocolEffective(), key.protocol)},
+					comparePorts(*switched[key.port], newPort)...)
+			case !inOld:
+				change.Change, change.Details = "added", describePort(newPort)
+			case !inNew:
+				change.Change, change.Details = "removed", describePort(oldPort)
+			default:
+				if change.Details = comparePorts(oldPort, newPort); len(change.Details) == 0 {
+					continue
+				}
+				change.Change = "changed"
+			}
+			diff.PortChanges = append(diff.PortChanges, change)
+		}
+	}
+
+	// Report conflicts that the new config introduces
+	oldConflicts := findPortConflicts(oldConfig)
+	for _, conflict := range findPortConflicts(newConfig) {
+		if previous, existed := oldConflicts[conflict.Port]; !existed || strings.Join(previous.Instances, ",") != strings.Join(conflict.Instances, ",") {
+			diff.NewConflicts = append(diff.NewConflicts, conflict)
+		}
+	}
+	sort.Slice(diff.NewConflicts, func(i, j int) bool { return diff.NewConflicts[i].Port < diff.NewConflicts[j].Port })
+
+	return diff
+}
+
+// findPortConflicts returns TCP external ports claimed by more than one instance, keyed
+// by port. Disabled ports are never forwarded, so they claim nothing.
+func findPortConflicts(config *Config) map[int]PortConflict {
+	portToInstances := make(map[int][]string)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if port.IsUDP() {
+				continue // relayed separately, so it never conflicts with a TCP forward
+			}
+			if !port.IsEnabled() {
+				continue
+			}
+			externalPort := port.ExternalPortEffective()
+			portToInstances[externalPort] = append(portToInstances[externalPort], instance.Name)
+		}
+	}
+
+	conflicts := make(map[int]PortConflict)
+	for port, instances := range portToInstances {
+		if len(instances) > 1 {
+			conflicts[port] = PortConflict{Port: port, Instances: instances}
+		}
+	}
+	return conflicts
+}
+
+func instancesByName(config *Config) map[string]Instance {
+	instances := make(map[string]Instance)
+	for _, instance := range config.Instances {
+		instances[instance.Name] = instance
+	}
+	return instances
+}
+
+// portKey identifies a port within an instance: the same port number may be listed
+// once per protocol
+type portKey struct {
+	port     int
+	protocol string
+}
+
+func portsByExternal(instance Instance) map[portKey]Port {
+	ports := make(map[portKey]Port)
+	for _, port := range instance.Ports {
+		ports[portKey{port.ExternalPortEffective(), port.ProtocolEffective()}] = port
+	}
+	return ports
+}
+
+func sortedPortKeys(a, b map[portKey]Port) []portKey {
+	seen := make(map[portKey]bool)
+	var keys []portKey
+	for _, m := range []map[portKey]Port{a, b} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].port < keys[j].port || (keys[i].port == keys[j].port && keys[i].protocol < keys[j].protocol)
+	})
+	return keys
+}
+
+// protocolSwitches finds the port numbers listed once in both versions of an instance,
+// but over another protocol, returning the old version of each: those ports changed
+// protocol rather than being removed and added
+func protocolSwitches(oldPorts, newPorts map[portKey]Port) map[int]*Port {
+	count := func(ports map[portKey]Port) map[int]int {
+		counts := make(map[int]int)
+		for key := range ports {
+			counts[key.port]++
+		}
+		return counts
+	}
+	oldCounts, newCounts := count(oldPorts), count(newPorts)
+
+	switched := make(map[int]*Port)
+	for key, port := range oldPorts {
+		if oldCounts[key.port] != 1 || newCounts[key.port] != 1 {
+			continue
+		}
+		if _, same := newPorts[key]; !same {
+			port := port
+			switched[key.port] = &port
+		}
+	}
+	return switched
+}
+
+// compareInstances lists the effective differences between two versions of the same
+// instance's own settings; its ports are compared separately
+func compareInstances(oldInstance, newInstance Instance) []string {
+	var details []string
+	if oldInstance.IP != newInstance.IP {
+		details = append(details, fmt.Sprintf("ip %s -> %s", displayAuto(oldInstance.IP), displayAuto(newInstance.IP)))
+	}
+	if oldInstance.AddressFamily != newInstance.AddressFamily {
+		details = append(details, fmt.Sprintf("address_family %s -> %s", displayAuto(oldInstance.AddressFamily), displayAuto(newInstance.AddressFamily)))
+	}
+	if oldAliases, newAliases := sortedStrings(oldInstance.Aliases), sortedStrings(newInstance.Aliases); strings.Join(oldAliases, ",") != strings.Join(newAliases, ",") {
+		details = append(details, fmt.Sprintf("aliases %v -> %v", oldAliases, newAliases))
+	}
+	if strings.Join(oldInstance.InterfacePriority, ",") != strings.Join(newInstance.InterfacePriority, ",") {
+		details = append(details, fmt.Sprintf("interface_priority %v -> %v", oldInstance.InterfacePriority, newInstance.InterfacePriority))
+	}
+	if oldInstance.StartupDelaySeconds != newInstance.StartupDelaySeconds {
+		details = append(details, fmt.Sprintf("startup_delay_seconds %d -> %d", oldInstance.StartupDelaySeconds, newInstance.StartupDelaySeconds))
+	}
+	if oldInstance.BootProbe != newInstance.BootProbe {
+		details = append(details, fmt.Sprintf("boot_probe %v -> %v", oldInstance.BootProbe, newInstance.BootProbe))
+	}
+	if oldTags, newTags := sortedStrings(oldInstance.Tags), sortedStrings(newInstance.Tags); strings.Join(oldTags, ",") != strings.Join(newTags, ",") {
+		details = append(details, fmt.Sprintf("tags %v -> %v", oldTags, newTags))
+	}
+	return details
+}
+
+// sortedStrings returns a sorted copy of a list compared as a set
+func sortedStrings(list []string) []string {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// displayAuto renders an omitted setting that is detected at runtime
+func displayAuto(value string) string {
+	if value == "" {
+		return "(auto)"
+	}
+	return value
+}
+
+// describePort summarises the effective settings of an added or removed port
+func describePort(port Port) []string {
+	details := []string{fmt.Sprintf("internal_port %d", port.InternalPortEffective())}
+	if port.Firewall != "" {
+		details = append(details, fmt.Sprintf("firewall %s", port.Firewall))
+	}
+	return details
+}
+
+// comparePorts lists the effective differences between two versions of the same port
+func comparePorts(oldPort, newPort Port) []string {
+	var details []string
+	if oldPort.InternalPortEffective() != newPort.InternalPortEffective() {
+		details = append(details, fmt.Sprintf("internal_port %d -> %d", oldPort.InternalPortEffective(), newPort.InternalPortEffective()))
+	}
+	if oldPort.FirewallMode() != newPort.FirewallMode() {
+		details = append(details, fmt.Sprintf("firewall %s -> %s", displayFirewallMode(oldPort.FirewallMode()), displayFirewallMode(newPort.FirewallMode())))
+	}
+	if oldPort.QosThrottleKbps != newPort.QosThrottleKbps {
+		details = append(details, fmt.Sprintf("qos_throttle_kbps %d -> %d", oldPort.QosThrottleKbps, newPort.QosThrottleKbps))
+	}
+	if !sameListenAddress(oldPort.ListenAddress, newPort.ListenAddress) {
+		details = append(details, fmt.Sprintf("listen_address %s -> %s", displayListenAddress(oldPort.ListenAddress), displayListenAddress(newPort.ListenAddress)))
+	}
+	if oldPort.FirewallDirection() != newPort.FirewallDirection() {
+		details = append(details, fmt.Sprintf("firewall_direction %s -> %s", oldPort.FirewallDirection(), newPort.FirewallDirection()))
+	}
+	if oldPort.UPnP != newPort.UPnP {
+		details = append(details, fmt.Sprintf("upnp %v -> %v", oldPort.UPnP, newPort.UPnP))
+	}
+	if oldPort.IsEnabled() != newPort.IsEnabled() {
+		details = append(details, fmt.Sprintf("enabled %v -> %v", oldPort.IsEnabled(), newPort.IsEnabled()))
+	}
+	if oldPort.ConnectFallback != newPort.ConnectFallback {
+		details = append(details, fmt.Sprintf("connect_fallback %v -> %v", oldPort.ConnectFallback, newPort.ConnectFallback))
+	}
+	if oldPort.Probe != newPort.Probe {
+		details = append(details, fmt.Sprintf("probe %v -> %v", oldPort.Probe, newPort.Probe))
+	}
+	if oldPort.Comment != newPort.Comment {
+		details = append(details, "comment changed")
+	}
+	return details
+}
+
+func displayFirewallMode(mode string) string {
+	if mode == "" {
+		return "(none)"
+	}
+	return mode
+}
+
+// displayListenAddress renders an omitted listen_address as the default it binds to
+func displayListenAddress(address string) string {
+	if address == "" {
+		return defaultListenAddress
+	}
+	return address
+}
+
+// runConfigDiff implements the `diff` subcommand. Exit codes: 0=identical, 1=error, 2=differences
+func runConfigDiff(args []string) int {
+	var jsonOutput, allowComments bool
+	var style jsonStyle
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "--json":
+			jsonOutput = true
+		case isJSONStyleFlag(arg):
+			style.set(arg)
+		case arg == "--allow-comments":
+			allowComments = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 2 {
+		fmt.Println("Usage: wsl2-port-forwarder.exe diff [--json [--pretty|--compact]] [--allow-comments] <old.json> <new.json>")
+		return 1
+	}
+
+	oldConfig, err := loadConfigFile(files[0], allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", files[0], err)
+		return 1
+	}
+	newConfig, err := loadConfigFile(files[1], allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", files[1], err)
+		return 1
+	}
+
+	diff := diffConfigs(oldConfig, newConfig)
+
+	if jsonOutput {
+		data, err := marshalJSON(diff, style.forStdout())
+		if err != nil {
+			fmt.Printf("❌ Failed to encode diff: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+	} else {
+		printConfigDiff(files[0], files[1], diff)
+	}
+
+	if diff.IsEmpty() {
+		return 0
+	}
+	return 2
+}
+
+// printConfigDiff prints the human readable form of a config diff
+func printConfigDiff(oldFile, newFile string, diff *ConfigDiff) {
+	fmt.Printf("--- %s\n+++ %s\n\n", oldFile, newFile)
+
+	if diff.IsEmpty() {
+		fmt.Println("✅ No effective differences")
+		return
+	}
+
+	for _, setting := range diff.SettingsChanged {
+		fmt.Printf("~ %s\n", setting)
+	}
+	for _, name := range diff.InstancesAdded {
+		fmt.Printf("+ instance %s\n", name)
+	}
+	for _, name := range diff.InstancesRemoved {
+		fmt.Printf("- instance %s\n", name)
+	}
+	for _, change := range diff.InstanceChanges {
+		fmt.Printf("~ instance %s (%s)\n", change.Instance, strings.Join(change.Details, ", "))
+	}
+
+	markers := map[string]string{"added": "+", "removed": "-", "changed": "~"}
+	for _, change := range diff.PortChanges {
+		fmt.Printf("%s %s port %d", markers[change.Change], change.Instance, change.Port)
+		if change.Protocol == "udp" {
+			fmt.Print("/udp")
+		}
+		if len(change.Details) > 0 {
+			fmt.Printf(" (%s)", strings.Join(change.Details, ", "))
+		}
+		fmt.Println()
+	}
+
+	if len(diff.NewConflicts) > 0 {
+		fmt.Println("\n⚠️  New external port conflicts:")
+		for _, conflict := range diff.NewConflicts {
+			fmt.Printf("  Port %d: %s\n", conflict.Port, strings.Join(conflict.Instances, ", "))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatchDebounce lets an editor finish saving before the config is reloaded, so a
+// save that takes several writes is read once, whole
+const configWatchDebounce = 250 * time.Millisecond
+
+// startConfigWatch watches the config file so it is reloaded when it changes, rather
+// than re-read every check. If the file can't be watched, it keeps being re-read.
+func (s *ServiceState) startConfigWatch() {
+	path, err := filepath.Abs(s.configFile)
+	if err != nil {
+		log.Printf("Warning: Unable to watch %s, reloading it every check instead: %v", s.configFile, err)
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Warning: Unable to watch %s, reloading it every check instead: %v", s.configFile, err)
+		return
+	}
+	// Watch the directory: editors often save by replacing the file, which ends a watch
+	// on the file itself
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		log.Printf("Warning: Unable to watch %s, reloading it every check instead: %v", s.configFile, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.configChanged = make(chan struct{}, 1)
+	s.stopConfigWatch = cancel
+	go s.watchConfig(ctx, watcher, path)
+}
+
+// watchConfig flags the config for reload and wakes the service loop when the file at
+// path is written, replaced or removed, until ctx is cancelled. The reload itself
+// happens in serviceLoop, which keeps the previous config if the new one is invalid.
+func (s *ServiceState) watchConfig(ctx context.Context, watcher *fsnotify.Watcher, path string) {
+	defer watcher.Close()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if isConfigFileEvent(event, path) {
+				debounce = time.After(configWatchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Warning: Config watcher: %v", err)
+		case <-debounce:
+			debounce = nil
+			s.configStale.Store(true)
+			select {
+			case s.configChanged <- struct{}{}:
+			default: // a wake-up is already pending
+			}
+		}
+	}
+}
+
+// isConfigFileEvent returns true for events that change the contents of the file at
+// path. Names are compared case-insensitively, like Windows paths.
+func isConfigFileEvent(event fsnotify.Event, path string) bool {
+	if !strings.EqualFold(filepath.Clean(event.Name), path) {
+		return false
+	}
+	return event.Has(fsnotify.Write) || event.Has(fsnotify.Create) ||
+		event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove)
+}
+
+// configNeedsReload returns true if serviceLoop should re-read the config: every pass
+// when it isn't watched, otherwise only once the watcher has seen it change
+func (s *ServiceState) configNeedsReload() bool {
+	if s.configChanged == nil {
+		return true
+	}
+	return s.configStale.Swap(false)
+}
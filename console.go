@@ -0,0 +1,69 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// cpUTF8 is the Windows code page identifier for UTF-8
+const cpUTF8 = 65001
+
+// setupConsoleOutput switches the attached console to the UTF-8 code page so the
+// status emoji render correctly instead of as cp437/cp1252 garbage. It returns a
+// function that restores the original code page, since the console outlives us.
+// Redirected output (files, pipes, the service wrapper log) is left untouched.
+func setupConsoleOutput() func() {
+	noop := func() {}
+
+	if !stdoutIsTerminal() {
+		// Not a console - output is redirected and already written as raw UTF-8
+		return noop
+	}
+
+	originalCP, err := windows.GetConsoleOutputCP()
+	if err != nil || originalCP == cpUTF8 {
+		return noop
+	}
+
+	if err := windows.SetConsoleOutputCP(cpUTF8); err != nil {
+		log.Printf("Warning: Failed to switch console to UTF-8 output: %v", err)
+		return noop
+	}
+
+	return func() {
+		windows.SetConsoleOutputCP(originalCP)
+	}
+}
+
+// stdoutIsTerminal returns true if stdout is an interactive console rather than
+// a file or pipe
+func stdoutIsTerminal() bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(os.Stdout.Fd()), &mode) == nil
+}
+
+// enableANSIColors turns on escape sequence processing for the console so colored
+// output renders. It returns false if stdout isn't a console that supports it, and a
+// function restoring the previous console mode.
+func enableANSIColors() (bool, func()) {
+	noop := func() {}
+	handle := windows.Handle(os.Stdout.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return false, noop
+	}
+	if mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING != 0 {
+		return true, noop
+	}
+	if err := windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return false, noop
+	}
+	return true, func() {
+		windows.SetConsoleMode(handle, mode)
+	}
+}
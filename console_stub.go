@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// setupConsoleOutput is a no-op off Windows, where terminals are already UTF-8
+func setupConsoleOutput() func() {
+	return func() {}
+}
+
+// stdoutIsTerminal returns true if stdout is a terminal rather than a file or pipe
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// enableANSIColors reports whether stdout is a terminal; no setup is needed off Windows
+func enableANSIColors() (bool, func()) {
+	return stdoutIsTerminal(), func() {}
+}
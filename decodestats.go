@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// debugLogging enables Debug: log lines (--debug)
+var debugLogging bool
+
+// debugf logs only when --debug is set
+func debugf(format string, args ...interface{}) {
+	if debugLogging {
+		log.Printf("Debug: "+format, args...)
+	}
+}
+
+// decodeStats counts how command output was decoded, so a wrong guess in
+// decodeCommandOutput shows up as an event instead of silently parsing nothing
+var decodeStats struct {
+	utf16       atomic.Int64 // outputs decoded as UTF-16 (LE or BE)
+	utf8        atomic.Int64 // outputs taken as UTF-8/ANSI
+	suspect     atomic.Int64 // decoded outputs containing NULs or replacement characters
+	emptyParses atomic.Int64 // non-empty outputs that parsed to zero entries
+}
+
+// hexPreviewBytes is how much raw output a decode warning shows
+const hexPreviewBytes = 32
+
+// hexPreview formats the first bytes of raw output for a warning
+func hexPreview(raw []byte) string {
+	if len(raw) > hexPreviewBytes {
+		return fmt.Sprintf("% x ...", raw[:hexPreviewBytes])
+	}
+	return fmt.Sprintf("% x", raw)
+}
+
+// recordDecode counts a decode decision and flags results that look mis-decoded
+func recordDecode(raw []byte, decoded string, encoding string) {
+	if strings.HasPrefix(encoding, "UTF-16") {
+		decodeStats.utf16.Add(1)
+	} else {
+		decodeStats.utf8.Add(1)
+	}
+	debugf("decoded %d bytes of command output as %s", len(raw), encoding)
+
+	if strings.ContainsAny(decoded, "\x00�") {
+		decodeStats.suspect.Add(1)
+		log.Printf("Warning: Command output looks mis-decoded (contains NUL or invalid characters); first bytes: %s", hexPreview(raw))
+	}
+}
+
+// checkParsedOutput warns when multi-line command output parsed to nothing, which
+// usually means the decoder guessed the wrong encoding or the format changed
+func checkParsedOutput(source string, raw []byte, decoded string, entries int) {
+	if entries > 0 {
+		return
+	}
+
+	// Single line "nothing found" messages are expected to parse to nothing
+	lines := 0
+	for _, line := range strings.Split(decoded, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+	if lines < 2 {
+		return
+	}
+
+	decodeStats.emptyParses.Add(1)
+	log.Printf("Warning: %s output (%d bytes, %d lines) parsed to 0 entries, possible decode or format problem; first bytes: %s",
+		source, len(raw), lines, hexPreview(raw))
+}
+
+// logDecodeStats reports the decode counters at debug level
+func logDecodeStats() {
+	debugf("command output decoding: %d UTF-16LE, %d UTF-8, %d suspect, %d empty parses",
+		decodeStats.utf16.Load(), decodeStats.utf8.Load(), decodeStats.suspect.Load(), decodeStats.emptyParses.Load())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listInstanceListeners returns `ss -Hltn` output from inside a distro; overridable in tests
+var listInstanceListeners = func(runner CommandRunner, distro string) (string, error) {
+	output, err := runner.Run("wsl", "-d", distro, "--", "ss", "-Hltn")
+	if err != nil {
+		return "", commandError(KindWSL, fmt.Errorf("failed to run ss in %s: %w", distro, err))
+	}
+	return decodeCommandOutput(output)
+}
+
+// parseListeningPorts maps each listening TCP port in `ss -Hltn` output to the
+// addresses it is bound to, e.g. "0.0.0.0:22" or "[::1]:5432" or "127.0.0.53%lo:53"
+func parseListeningPorts(output string) map[int][]string {
+	listeners := make(map[int][]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "LISTEN" {
+			continue
+		}
+		local := fields[3]
+		sep := strings.LastIndex(local, ":")
+		if sep < 0 {
+			continue
+		}
+		port, err := strconv.Atoi(local[sep+1:])
+		if err != nil {
+			continue
+		}
+		host := strings.Trim(local[:sep], "[]")
+		if zone := strings.Index(host, "%"); zone >= 0 {
+			host = host[:zone]
+		}
+		listeners[port] = append(listeners[port], host)
+	}
+	return listeners
+}
+
+// listenerReaches returns true if a service bound to one of addrs accepts
+// connections on the instance IP, which is where the forward connects
+func listenerReaches(addrs []string, instanceIP string) bool {
+	for _, addr := range addrs {
+		if addr == "*" || addr == instanceIP {
+			return true
+		}
+		if ip := net.ParseIP(addr); ip != nil && ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConnectPorts implements --validate --deep: for every configured port of a
+// running instance, report whether something inside the instance listens on the
+// connect port where the forward can reach it. Instances without ss are probed
+// with a TCP dial from Windows instead.
+func checkConnectPorts(config *Config) int {
+	fmt.Println("\nℹ️  Checking that connect ports are listening (--deep)...")
+
+	service := &ServiceState{config: config}
+	running, err := service.getRunningWSLInstances()
+	if err != nil {
+		fmt.Printf("⚠️  Unable to list running instances: %v\n", err)
+		return 2
+	}
+
+	exitCode := 0
+	for _, instance := range config.Instances {
+		distroName, isRunning := resolveInstanceDistro(instance, running)
+		if !isRunning {
+			fmt.Printf("ℹ️  [%s] not running, skipped\n", instance.Name)
+			continue
+		}
+
+		distro := instance
+		distro.Name = distroName
+		ip, err := service.getWSLInstanceIP(distro)
+		if err != nil {
+			fmt.Printf("⚠️  [%s] unable to get IP: %v\n", instance.Name, err)
+			exitCode = 2
+			continue
+		}
+
+		output, ssErr := listInstanceListeners(service.commands(), distroName)
+		listeners := parseListeningPorts(output)
+
+		ports := append([]Port(nil), instance.Ports...)
+		sort.Slice(ports, func(i, j int) bool { return ports[i].ExternalPortEffective() < ports[j].ExternalPortEffective() })
+		for _, port := range ports {
+			target := fmt.Sprintf("%s:%d", ip, port.InternalPortEffective())
+			label := fmt.Sprintf("[%s] port %d -> %s", instance.Name, port.ExternalPortEffective(), target)
+
+			if ssErr != nil {
+				if isTargetReachable(ip, port.InternalPortEffective()) {
+					fmt.Printf("✅ %s: reachable\n", label)
+				} else {
+					fmt.Printf("⚠️  %s: unreachable (ss unavailable: %v)\n", label, ssErr)
+					exitCode = 2
+				}
+				continue
+			}
+
+			addrs, listening := listeners[port.InternalPortEffective()]
+			switch {
+			case !listening:
+				fmt.Printf("⚠️  %s: nothing is listening\n", label)
+				exitCode = 2
+			case !listenerReaches(addrs, ip):
+				fmt.Printf("⚠️  %s: listening on %s only, which the forward can't reach (bind to 0.0.0.0)\n", label, strings.Join(addrs, ", "))
+				exitCode = 2
+			default:
+				fmt.Printf("✅ %s: listening\n", label)
+			}
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dockerDesktopSubnets are the networks Docker Desktop's own VM uses by default; a
+// forward into one of them was set up for Docker, not for a configured instance
+var dockerDesktopSubnets = []string{"192.168.65.0/24"}
+
+// isDockerDesktopIP returns true if ip is in one of Docker Desktop's default networks
+func isDockerDesktopIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range dockerDesktopSubnets {
+		if _, subnet, err := net.ParseCIDR(cidr); err == nil && subnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDockerFirewallRule returns true for the rules Docker Desktop installs, e.g.
+// "Docker Desktop Backend" or "com.docker.backend"
+func isDockerFirewallRule(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "docker") || strings.Contains(lower, "vpnkit")
+}
+
+// DockerMappings returns the installed forwards on configured ports that point into
+// Docker Desktop's network. They belong to Docker, so reconcile neither updates nor
+// removes them.
+func (snap *ReconcileSnapshot) DockerMappings() map[int]PortMapping {
+	instanceIP := make(map[string]bool)
+	for _, ip := range snap.InstanceIPs {
+		instanceIP[ip] = true
+	}
+
+	owned := make(map[int]PortMapping)
+	for port, mapping := range snap.CurrentMappings {
+		if isDockerDesktopIP(mapping.TargetIP) && !instanceIP[mapping.TargetIP] && snap.Config.configuresExternalPort(port) {
+			owned[port] = mapping
+		}
+	}
+	return owned
+}
+
+// isDockerOwned returns true if the forward installed on port belongs to Docker Desktop
+func (snap *ReconcileSnapshot) isDockerOwned(port int) bool {
+	_, owned := snap.DockerMappings()[port]
+	return owned
+}
+
+// dockerGuidance is the advice printed for a port Docker Desktop already uses
+const dockerGuidance = "pick another port in the config, or stop publishing it from Docker (see 'docker ps')"
+
+// checkDockerOverlaps reports Docker Desktop forwards and firewall rules on configured
+// ports. Docker's catch-all rules (LocalPort Any) claim no particular port, so only
+// rules listing ports are reported.
+func checkDockerOverlaps(config *Config) int {
+	service := &ServiceState{}
+	currentMappings, err := service.getCurrentPortMappings()
+	if err != nil {
+		fmt.Printf("⚠️  Unable to check for Docker Desktop forwards: %v\n", err)
+		return 2
+	}
+	rules, err := service.getInboundFirewallRules()
+	if err != nil {
+		fmt.Printf("⚠️  Unable to check for Docker Desktop firewall rules: %v\n", err)
+		return 2
+	}
+
+	var overlaps []string
+	for _, port := range sortedMappingPorts(currentMappings) {
+		mapping := currentMappings[port]
+		if isDockerDesktopIP(mapping.TargetIP) && config.configuresExternalPort(port) {
+			overlaps = append(overlaps, fmt.Sprintf("Port %d is forwarded to Docker Desktop (%s:%d)", port, mapping.TargetIP, mapping.InternalPort))
+		}
+	}
+	for _, rule := range rules {
+		if !isDockerFirewallRule(rule.Name) || !rule.Enabled || rule.LocalPort == "Any" {
+			continue
+		}
+		reported := make(map[int]bool)
+		for _, instance := range config.Instances {
+			for _, port := range instance.Ports {
+				externalPort := port.ExternalPortEffective()
+				if !reported[externalPort] && rule.CoversPort(externalPort) {
+					reported[externalPort] = true
+					overlaps = append(overlaps, fmt.Sprintf("Port %d is opened by Docker's firewall rule '%s'", externalPort, rule.Name))
+				}
+			}
+		}
+	}
+	if len(overlaps) == 0 {
+		return 0
+	}
+
+	fmt.Println("\nℹ️  Checking for Docker Desktop overlap...")
+	for _, overlap := range overlaps {
+		fmt.Printf("⚠️  %s\n", overlap)
+	}
+	fmt.Printf("💡 Docker's forwards are left alone; %s\n", dockerGuidance)
+	return 2
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// drainMarkerPath is the file whose presence keeps the service from forwarding. It
+// lives next to the config so the drain/resume commands and the service agree on it.
+func drainMarkerPath(configFile string) string {
+	return configFile + ".drained"
+}
+
+// drainedSince returns when forwarding was drained, if it currently is
+func drainedSince(configFile string) (time.Time, bool) {
+	data, err := os.ReadFile(drainMarkerPath(configFile))
+	if err != nil {
+		return time.Time{}, false
+	}
+	since, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		// A marker we can't read the time from still means drained
+		return time.Time{}, true
+	}
+	return since, true
+}
+
+// checkDrained reports whether this pass should be skipped because of a drain,
+// logging only when the drained state changes
+func (s *ServiceState) checkDrained() bool {
+	since, drained := drainedSince(s.configFile)
+	if drained != s.drained {
+		if drained {
+			s.logf("Forwarding drained (since %s), not reconciling until resumed", since.Format(time.RFC3339))
+			s.upnpMappings = nil // removed by the drain command, re-added on resume
+			s.stopUDPRelays()    // relays live in this process, so the drain command can't stop them
+		} else {
+			s.logf("Forwarding resumed, reconciling")
+		}
+		s.drained = drained
+	}
+	if drained {
+		fmt.Println("⏸️  Drained: port forwarding is paused, run 'resume' to restore it")
+	}
+	return drained
+}
+
+// runDrain implements the `drain` and `resume` subcommands. Drain records the drained
+// state first (so the service can't re-add anything), then removes every managed
+// mapping and firewall rule. Resume clears the marker; the service restores forwarding
+// on its next check. Exit codes: 0=ok, 1=error
+func runDrain(command string, args []string) int {
+	var allowComments bool
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "--allow-comments":
+			allowComments = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 1 {
+		fmt.Printf("Usage: wsl2-port-forwarder.exe %s [--allow-comments] <config-file.json>\n", command)
+		return 1
+	}
+	configFile := files[0]
+
+	if command == "resume" {
+		if err := os.Remove(drainMarkerPath(configFile)); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Println("ℹ️  Not drained, nothing to resume")
+				return 0
+			}
+			fmt.Printf("❌ Failed to clear drain marker: %v\n", err)
+			return 1
+		}
+		fmt.Println("✅ Resumed: forwarding will be restored on the service's next check")
+		return 0
+	}
+
+	config, err := loadConfigFile(configFile, allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", configFile, err)
+		return 1
+	}
+	config = config.ManagedConfig()
+
+	marker := []byte(time.Now().UTC().Format(time.RFC3339) + "\n")
+	if err := os.WriteFile(drainMarkerPath(configFile), marker, 0644); err != nil {
+		fmt.Printf("❌ Failed to record drain: %v\n", err)
+		return 1
+	}
+
+	service := &ServiceState{config: config, configFile: configFile}
+	if registryManager, err := NewRegistryManager(); err == nil {
+		service.registryManager = registryManager
+		defer registryManager.Close()
+	}
+
+	if service.drainForwarding(config) > 0 {
+		fmt.Println("❌ Drained with errors; the service will not re-add forwards until 'resume'")
+		return 1
+	}
+	fmt.Println("✅ Drained: forwards removed, the service will not re-add them until 'resume'")
+	return 0
+}
+
+// drainForwarding removes every forward and firewall rule belonging to the config,
+// returning the number of failures
+func (s *ServiceState) drainForwarding(config *Config) int {
+	failures := 0
+
+	currentMappings, err := s.getCurrentPortMappings()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	s.currentMappings = currentMappings
+	for port, mapping := range currentMappings {
+		if !config.configuresExternalPort(port) {
+			continue
+		}
+		if err := s.removePortMapping(port); err != nil {
+			fmt.Printf("  ❌ Port %d: %v\n", port, err)
+			failures++
+			continue
+		}
+		fmt.Printf("  ✓ Port %d -> %s:%d removed\n", port, mapping.TargetIP, mapping.InternalPort)
+	}
+
+	existingRules, err := s.getForwarderDirectionRules()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return failures + 1
+	}
+	present := make(map[string]bool)
+	for _, rule := range existingRules {
+		present[rule.Name] = true
+	}
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if !port.ShouldManageFirewall() {
+				continue
+			}
+			for _, ruleName := range []string{generateFirewallRuleName(port.ExternalPortEffective(), instance.Name), outboundFirewallRuleName(port.ExternalPortEffective(), instance.Name)} {
+				if !present[ruleName] {
+					continue
+				}
+				if err := s.removeFirewallRuleByName(ruleName); err != nil {
+					fmt.Printf("  ❌ Firewall rule %s: %v\n", ruleName, err)
+					failures++
+					continue
+				}
+				present[ruleName] = false
+				fmt.Printf("  ✓ Firewall rule %s removed\n", ruleName)
+			}
+		}
+	}
+
+	// Router forwards are best-effort, so they never fail the drain
+	removed := make(map[int]bool)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if !port.UPnP || removed[port.ExternalPortEffective()] {
+				continue
+			}
+			removed[port.ExternalPortEffective()] = true
+			gateway, err := s.gateway()
+			if err == nil {
+				err = gateway.deletePortMapping(port.ExternalPortEffective())
+			}
+			if err != nil {
+				fmt.Printf("  ⚠️  Router mapping for port %d not removed: %v\n", port.ExternalPortEffective(), err)
+				continue
+			}
+			fmt.Printf("  ✓ Router mapping for port %d removed\n", port.ExternalPortEffective())
+		}
+	}
+
+	return failures
+}
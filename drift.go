@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DriftReport is how the live port forwards differ from what the config says they
+// should be, for the instances that are running
+type DriftReport struct {
+	InSync bool         `json:"in_sync"`
+	Drift  []DriftEntry `json:"drift"`
+}
+
+// DriftEntry is one port whose live forward doesn't match the config
+type DriftEntry struct {
+	Port     int    `json:"port"`
+	Kind     string `json:"kind"` // "missing", "wrong" or "unexpected"
+	Instance string `json:"instance,omitempty"`
+	Expected string `json:"expected,omitempty"` // ip:port the config forwards to
+	Actual   string `json:"actual,omitempty"`   // ip:port currently forwarded to
+}
+
+// Drift compares the live forwards with the desired ones. Unlike a plan, it reports
+// what is wrong now rather than what reconcile will do about it, so forwards kept by
+// additive_only are not drift, and neither are Docker Desktop's.
+func (snap *ReconcileSnapshot) Drift() *DriftReport {
+	desiredMappings, _ := snap.DesiredMappings()
+	report := &DriftReport{Drift: []DriftEntry{}}
+
+	for _, desired := range plannedMappings(desiredMappings) {
+		expected := fmt.Sprintf("%s:%d", desired.TargetIP, desired.InternalPort)
+		current, exists := snap.CurrentMappings[desired.Port]
+		if !exists {
+			report.Drift = append(report.Drift, DriftEntry{Port: desired.Port, Kind: "missing", Instance: desired.Instance, Expected: expected})
+		} else if mappingNeedsUpdate(current, desiredMappings[desired.Port]) {
+			report.Drift = append(report.Drift, DriftEntry{Port: desired.Port, Kind: "wrong", Instance: desired.Instance,
+				Expected: expected, Actual: fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort)})
+		}
+	}
+
+	if !snap.Config.AdditiveOnly {
+		for _, current := range plannedMappings(snap.CurrentMappings) {
+			if snap.ShouldRemove(current.Port, desiredMappings) {
+				report.Drift = append(report.Drift, DriftEntry{Port: current.Port, Kind: "unexpected",
+					Actual: fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort)})
+			}
+		}
+	}
+
+	report.InSync = len(report.Drift) == 0
+	return report
+}
+
+// describe is the human readable form of a drift entry
+func (d DriftEntry) describe() string {
+	switch d.Kind {
+	case "missing":
+		return fmt.Sprintf("port %d (%s) is not forwarded, expected -> %s", d.Port, d.Instance, d.Expected)
+	case "wrong":
+		return fmt.Sprintf("port %d (%s) forwards to %s, expected %s", d.Port, d.Instance, d.Actual, d.Expected)
+	default:
+		return fmt.Sprintf("port %d forwards to %s, but no running instance should have it", d.Port, d.Actual)
+	}
+}
+
+// runDrift implements the `drift` subcommand, a read-only check that the live forwards
+// match the config, for CI or a scheduled task. Exit codes: 0=in sync, 1=error, 2=drift
+func runDrift(args []string) int {
+	var jsonOutput, allowComments, strict bool
+	var style jsonStyle
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "--json":
+			jsonOutput = true
+		case isJSONStyleFlag(arg):
+			style.set(arg)
+		case arg == "--allow-comments":
+			allowComments = true
+		case arg == "--strict":
+			strict = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 1 {
+		fmt.Println("Usage: wsl2-port-forwarder.exe drift [--json [--pretty|--compact]] [--allow-comments] [--strict] <config-file.json>")
+		return 1
+	}
+
+	config, err := loadConfigFile(files[0], allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", files[0], err)
+		return 1
+	}
+
+	service := &ServiceState{config: config, strict: strict}
+	snapshot, err := service.captureSnapshot(config.ManagedConfig())
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	report := snapshot.Drift()
+
+	if jsonOutput {
+		data, err := marshalJSON(report, style.forStdout())
+		if err != nil {
+			fmt.Printf("❌ Failed to encode drift report: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+	} else if report.InSync {
+		fmt.Println("✅ Live port forwards match the configuration")
+	} else {
+		fmt.Printf("❌ %d port(s) drifted from the configuration:\n", len(report.Drift))
+		for _, entry := range report.Drift {
+			fmt.Printf("  %s\n", entry.describe())
+		}
+	}
+
+	if report.InSync {
+		return 0
+	}
+	return 2
+}
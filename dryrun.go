@@ -0,0 +1,36 @@
+package main
+
+import "strings"
+
+// formatCommandLine renders a command the way it would be typed, quoting arguments
+// with spaces, e.g. netsh advfirewall firewall add rule "name=WSL2 Port 8080" ...
+func formatCommandLine(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t") {
+			arg = `"` + arg + `"`
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// skipForDryRun reports (and logs) the command that would change system state and
+// returns true under --dry-run, in which case the caller must not run it
+func (s *ServiceState) skipForDryRun(name string, args ...string) bool {
+	if !s.dryRun {
+		return false
+	}
+	command := formatCommandLine(name, args)
+	s.logf("(dry-run) would run: %s", command)
+	say("    (dry-run) %s", command)
+	return true
+}
+
+// dryRunTag labels reconcile output for changes that are only previewed
+func (s *ServiceState) dryRunTag() string {
+	if s.dryRun {
+		return " (dry-run)"
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// ErrorKind classifies failures so callers can branch on them (retry, exit code)
+// without matching message text
+type ErrorKind int
+
+const (
+	KindConfig          ErrorKind = iota + 1 // the config file is unreadable or invalid
+	KindPrivilege                            // the operation needs Administrator rights
+	KindCommandNotFound                      // wsl.exe, netsh.exe or powershell.exe is missing
+	KindCommandTimeout                       // a command didn't finish in time
+	KindNetsh                                // netsh ran but failed
+	KindWSL                                  // wsl ran but failed
+)
+
+// String names the kind, e.g. for logs and metrics labels
+func (k ErrorKind) String() string {
+	switch k {
+	case KindConfig:
+		return "config"
+	case KindPrivilege:
+		return "privilege"
+	case KindCommandNotFound:
+		return "command-not-found"
+	case KindCommandTimeout:
+		return "command-timeout"
+	case KindNetsh:
+		return "netsh"
+	case KindWSL:
+		return "wsl"
+	default:
+		return "unknown"
+	}
+}
+
+// ForwarderError attaches an ErrorKind to an error. The message is the wrapped
+// error's, so classifying an error never changes what gets logged.
+type ForwarderError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ForwarderError) Error() string {
+	if e.Err == nil {
+		return e.Kind.String() + " error"
+	}
+	return e.Err.Error()
+}
+
+func (e *ForwarderError) Unwrap() error { return e.Err }
+
+// Is matches the kind sentinels below, so errors.Is(err, ErrPrivilege) works through
+// any amount of %w wrapping
+func (e *ForwarderError) Is(target error) bool {
+	sentinel, ok := target.(*ForwarderError)
+	return ok && sentinel.Err == nil && sentinel.Kind == e.Kind
+}
+
+// Sentinels for errors.Is
+var (
+	ErrConfig          error = &ForwarderError{Kind: KindConfig}
+	ErrPrivilege       error = &ForwarderError{Kind: KindPrivilege}
+	ErrCommandNotFound error = &ForwarderError{Kind: KindCommandNotFound}
+	ErrCommandTimeout  error = &ForwarderError{Kind: KindCommandTimeout}
+	ErrNetsh           error = &ForwarderError{Kind: KindNetsh}
+	ErrWSL             error = &ForwarderError{Kind: KindWSL}
+)
+
+// withKind classifies err, returning nil for a nil error
+func withKind(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ForwarderError{Kind: kind, Err: err}
+}
+
+// commandError classifies a failed wsl/netsh command as kind, unless the command
+// couldn't be started at all or ran out of time, which are their own kinds
+func commandError(kind ErrorKind, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, exec.ErrNotFound):
+		kind = KindCommandNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = KindCommandTimeout
+	}
+	return withKind(kind, err)
+}
+
+// errorKind returns the kind of a classified error
+func errorKind(err error) (ErrorKind, bool) {
+	var classified *ForwarderError
+	if errors.As(err, &classified) {
+		return classified.Kind, true
+	}
+	return 0, false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// jsonLogging is --log-format=json: the service's events and log messages are written
+// as single-line JSON objects through the standard logger, and the console display
+// meant for people is left out
+var jsonLogging bool
+
+// EventFields are the structured fields of an event; zero values are left out
+type EventFields struct {
+	Port     int
+	Instance string
+	TargetIP string
+}
+
+// logEntry is one line of --log-format=json
+type logEntry struct {
+	TS       string `json:"ts,omitempty"`
+	Level    string `json:"level"` // "info", "warning" or "error"
+	Event    string `json:"event"` // e.g. "mapping_added"; "log" for plain log messages
+	Message  string `json:"message"`
+	Port     int    `json:"port,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	TargetIP string `json:"target_ip,omitempty"`
+	Repeated int    `json:"repeated,omitempty"` // LogDeduplicator's summary of suppressed repeats
+}
+
+// repeatedSummary matches LogDeduplicator's summary of an encoded entry
+var repeatedSummary = regexp.MustCompile(`^(\{.*\}) \(repeated (\d+) times\)$`)
+
+// logLevel classifies a log message by its "Error"/"Warning" prefix, as logf tallies it
+func logLevel(message string) string {
+	switch {
+	case strings.HasPrefix(message, "Error"):
+		return "error"
+	case strings.HasPrefix(strings.ToLower(message), "warning"):
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// eventMessage strips the indentation and emoji of a console line, leaving its text
+func eventMessage(line string) string {
+	return strings.TrimSpace(strings.TrimLeftFunc(line, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '('
+	}))
+}
+
+// encodeLogEntry encodes an entry as one line of JSON. The timestamp is left for
+// jsonLogWriter to add, so repeats of an event still look identical to LogDeduplicator.
+func encodeLogEntry(level, event string, fields EventFields, message string) string {
+	data, _ := json.Marshal(logEntry{Level: level, Event: event, Message: message,
+		Port: fields.Port, Instance: fields.Instance, TargetIP: fields.TargetIP})
+	return string(data)
+}
+
+// jsonLogWriter is the standard logger's output with --log-format=json. Entries pass
+// through with their timestamp added; any other line is wrapped as a "log" event.
+type jsonLogWriter struct {
+	out io.Writer
+	now func() time.Time
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\r\n")
+	repeated := 0
+	if match := repeatedSummary.FindSubmatch(line); match != nil {
+		line = match[1]
+		repeated, _ = strconv.Atoi(string(match[2]))
+	}
+
+	var entry logEntry
+	if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &entry) != nil || entry.Event == "" {
+		message := string(line)
+		entry = logEntry{Level: logLevel(message), Event: "log", Message: message}
+	}
+	entry.TS = w.now().UTC().Format(time.RFC3339Nano)
+	entry.Repeated = repeated
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setLogOutput points the standard logger at out, as JSON lines with --log-format=json
+func setLogOutput(out io.Writer) {
+	if !jsonLogging {
+		log.SetOutput(out)
+		return
+	}
+	log.SetFlags(0)
+	log.SetOutput(jsonLogWriter{out: out, now: time.Now})
+}
+
+// consoleEvent prints a line of the console display. With --log-format=json it is
+// logged as the event instead, with the given level and fields. Important events also
+// go to the Windows Event Log when it is in use.
+func consoleEvent(level, event string, fields EventFields, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if _, important := eventLogEventIDs[event]; important {
+		reportEvent(level, event, eventMessage(line))
+	}
+	if !jsonLogging {
+		fmt.Println(line)
+		return
+	}
+	log.Print(encodeLogEntry(level, event, fields, eventMessage(line)))
+}
+
+// say prints a line of the console display that isn't an event of its own (headings,
+// summaries); --log-format=json leaves it out
+func say(format string, args ...interface{}) {
+	if !jsonLogging {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// logEventf logs a message like logf; with --log-format=json it is logged as the
+// event, with the given fields
+func (s *ServiceState) logEventf(event string, fields EventFields, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	// Tally severities for the --max-runtime exit status
+	level := logLevel(message)
+	switch level {
+	case "error":
+		s.errorsLogged++
+	case "warning":
+		s.warningsLogged++
+	}
+
+	if jsonLogging {
+		message = encodeLogEntry(level, event, fields, message)
+	}
+	if s.logDedup == nil {
+		log.Print(message)
+		return
+	}
+	s.logDedup.Printf("%s", message)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// cleanupOnExitTimeout bounds --cleanup-on-exit, so a hung netsh can't keep the
+// service from stopping
+const cleanupOnExitTimeout = 10 * time.Second
+
+// trackCreatedMapping records a forward this process installed, for --cleanup-on-exit
+func (s *ServiceState) trackCreatedMapping(mapping PortMapping) {
+	if s.createdMappings == nil {
+		s.createdMappings = make(map[int]PortMapping)
+	}
+	s.createdMappings[mapping.ExternalPort] = mapping
+}
+
+// trackCreatedRule records a firewall rule this process created, for --cleanup-on-exit
+func (s *ServiceState) trackCreatedRule(name string) {
+	if s.createdRules == nil {
+		s.createdRules = make(map[string]bool)
+	}
+	s.createdRules[name] = true
+}
+
+// removeCreatedResources removes the forwards and firewall rules this process created
+// and still has, returning the number of failures. Forwards and rules that were already
+// there at startup are left alone.
+func (s *ServiceState) removeCreatedResources() int {
+	if s.currentMappings == nil {
+		s.currentMappings = make(map[int]PortMapping)
+	}
+
+	failures := 0
+	ports := sortedMappingPorts(s.createdMappings)
+	for _, port := range ports {
+		mapping := s.createdMappings[port]
+		s.currentMappings[port] = mapping // so the delete uses the table and address it was added with
+		if err := s.removePortMapping(port); err != nil {
+			s.logf("Error removing port mapping %d on exit: %v", port, err)
+			failures++
+			continue
+		}
+		consoleEvent("info", "mapping_removed", EventFields{Port: port, Instance: mapping.Instance, TargetIP: mapping.TargetIP}, "  ✓ Port %d -> %s:%d removed", port, mapping.TargetIP, mapping.InternalPort)
+	}
+
+	names := make([]string, 0, len(s.createdRules))
+	for name := range s.createdRules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.removeFirewallRuleByName(name); err != nil {
+			s.logf("Error removing firewall rule %s on exit: %v", name, err)
+			failures++
+			continue
+		}
+		consoleEvent("info", "firewall_rule_removed", EventFields{}, "  ✓ Firewall rule %s removed", name)
+	}
+	return failures
+}
+
+// cleanupOnExit runs removeCreatedResources for at most timeout
+func (s *ServiceState) cleanupOnExit(timeout time.Duration) {
+	if len(s.createdMappings) == 0 && len(s.createdRules) == 0 {
+		return
+	}
+	say("Removing the forwards and firewall rules this run created (--cleanup-on-exit)...")
+
+	done := make(chan int, 1)
+	go func() { done <- s.removeCreatedResources() }()
+	select {
+	case failures := <-done:
+		if failures > 0 {
+			s.logf("Warning: %d forwards or firewall rules could not be removed on exit", failures)
+		}
+	case <-time.After(timeout):
+		s.logf("Warning: Cleanup on exit timed out after %s, some forwards or firewall rules may remain", timeout)
+	}
+}
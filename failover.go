@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fallbackDialTimeout bounds each reachability probe made for connect_fallback ports
+const fallbackDialTimeout = time.Second
+
+// isTargetReachable dials ip:port over TCP; overridable in tests
+var isTargetReachable = func(ip string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), fallbackDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// chooseFallbackTarget picks the connect address for a connect_fallback port. The
+// current target is kept while it still answers (so mappings don't flap); otherwise
+// the first reachable candidate in priority order wins. If nothing answers, the
+// primary candidate is used so the mapping still follows the instance.
+func chooseFallbackTarget(candidates []string, currentIP string, port int, reachable func(ip string, port int) bool) string {
+	if len(candidates) == 0 {
+		return currentIP
+	}
+
+	for _, candidate := range candidates {
+		if candidate == currentIP && reachable(currentIP, port) {
+			return currentIP
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate != currentIP && reachable(candidate, port) {
+			return candidate
+		}
+	}
+
+	return candidates[0]
+}
+
+// applyConnectFallback retargets desired mappings for connect_fallback ports at the
+// first reachable candidate IP of their instance
+func (s *ServiceState) applyConnectFallback(snapshot *ReconcileSnapshot, desiredMappings map[int]PortMapping) {
+	for _, instance := range snapshot.Config.Instances {
+		candidates := snapshot.CandidateIPs[instance.Name]
+		if len(candidates) < 2 {
+			continue
+		}
+
+		for _, port := range instance.Ports {
+			externalPort := port.ExternalPortEffective()
+			desired, ok := desiredMappings[externalPort]
+			if !port.ConnectFallback || !ok || desired.Instance != instance.Name {
+				continue
+			}
+
+			currentIP := ""
+			if current, exists := snapshot.CurrentMappings[externalPort]; exists {
+				currentIP = current.TargetIP
+			}
+
+			target := chooseFallbackTarget(candidates, currentIP, desired.InternalPort, isTargetReachable)
+			if target == desired.TargetIP {
+				continue
+			}
+
+			if currentIP != "" && target != currentIP {
+				s.logEventf("failover", EventFields{Port: externalPort, Instance: instance.Name, TargetIP: target}, "FAILOVER: Port %d (%s) target %s:%d not answering, switching to %s:%d",
+					externalPort, instance.Name, currentIP, desired.InternalPort, target, desired.InternalPort)
+				say("  🔀 Failover: port %d %s -> %s", externalPort, currentIP, target)
+			}
+			desired.TargetIP = target
+			desiredMappings[externalPort] = desired
+		}
+	}
+}
+
+// hasConnectFallback returns true if any port of the instance asks for failover
+func (instance Instance) hasConnectFallback() bool {
+	for _, port := range instance.Ports {
+		if port.ConnectFallback {
+			return true
+		}
+	}
+	return false
+}
+
+// wslInstanceCandidateIPs returns every valid address reported by hostname -I,
+// with the primary IP first, as failover candidates
+func wslInstanceCandidateIPs(runner CommandRunner, instanceName, primaryIP string) ([]string, error) {
+	output, err := runner.Run("wsl", "-d", instanceName, "--", "hostname", "-I")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IPs for %s: %v", instanceName, err)
+	}
+	return orderCandidateIPs(primaryIP, strings.Fields(string(output))), nil
+}
+
+// orderCandidateIPs puts the primary IP first followed by the other valid, unique addresses
+func orderCandidateIPs(primaryIP string, addresses []string) []string {
+	candidates := []string{primaryIP}
+	for _, addr := range addresses {
+		if addr != primaryIP && isValidIPAddress(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
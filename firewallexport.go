@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// desiredFirewallRules returns every firewall rule the config would create, one per
+// instance and managed port, sorted by port and rule name
+func desiredFirewallRules(config *Config) ([]FirewallRuleSpec, error) {
+	var rules []FirewallRuleSpec
+	seen := make(map[string]bool)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if !port.ShouldManageFirewall() || !port.IsEnabled() {
+				continue
+			}
+			var specs []FirewallRuleSpec
+			if direction := port.FirewallDirection(); direction == "in" || direction == "both" {
+				rule, err := newFirewallRuleSpec(port.ExternalPortEffective(), instance.Name, port.FirewallMode(), port.QosThrottleKbps)
+				if err != nil {
+					return nil, err
+				}
+				specs = append(specs, rule.withProtocol(port.ProtocolEffective()))
+			}
+			if direction := port.FirewallDirection(); direction == "out" || direction == "both" {
+				specs = append(specs, newOutboundFirewallRuleSpec(port.ExternalPortEffective(), port.InternalPortEffective(), instance.Name).withProtocol(port.ProtocolEffective()))
+			}
+			for _, rule := range specs {
+				if !seen[rule.Name] {
+					seen[rule.Name] = true
+					rules = append(rules, rule)
+				}
+			}
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Port != rules[j].Port {
+			return rules[i].Port < rules[j].Port
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules, nil
+}
+
+// quoteCmdArg quotes a netsh argument the way Windows quotes exec arguments, and
+// escapes % so the line survives being run from a batch file
+func quoteCmdArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if strings.ContainsAny(arg, " \t\"") {
+		return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+	}
+	return arg
+}
+
+// quotePowerShellString returns a single-quoted PowerShell string literal
+func quotePowerShellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// renderNetshScript renders the rules as a batch file of netsh commands
+func renderNetshScript(configFile string, rules []FirewallRuleSpec) string {
+	var b strings.Builder
+	b.WriteString("@echo off\r\n")
+	fmt.Fprintf(&b, "REM Firewall rules for WSL2 port forwarding, generated from %s\r\n", configFile)
+	b.WriteString("REM Run as Administrator, then start the forwarder with --no-firewall\r\n")
+	for _, rule := range rules {
+		args := rule.NetshArgs()
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = quoteCmdArg(arg)
+		}
+		fmt.Fprintf(&b, "netsh %s\r\n", strings.Join(quoted, " "))
+	}
+	return b.String()
+}
+
+// renderPowerShellScript renders the rules as New-NetFirewallRule commands. The
+// DisplayName is what netsh calls the rule name, so the forwarder recognises them.
+func renderPowerShellScript(configFile string, rules []FirewallRuleSpec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Firewall rules for WSL2 port forwarding, generated from %s\r\n", configFile)
+	b.WriteString("# Run as Administrator, then start the forwarder with --no-firewall\r\n")
+	for _, rule := range rules {
+		if rule.Outbound {
+			fmt.Fprintf(&b, "New-NetFirewallRule -DisplayName %s -Direction Outbound -Action Allow -Protocol %s -RemotePort %d -RemoteAddress %s -Description %s | Out-Null\r\n",
+				quotePowerShellString(rule.Name), rule.netshProtocol(), rule.RemotePort, rule.RemoteIP, quotePowerShellString(rule.Description))
+			continue
+		}
+		fmt.Fprintf(&b, "New-NetFirewallRule -DisplayName %s -Direction Inbound -Action Allow -Protocol %s -LocalPort %d -RemoteAddress %s -Description %s | Out-Null\r\n",
+			quotePowerShellString(rule.Name), rule.netshProtocol(), rule.Port, rule.RemoteIP, quotePowerShellString(rule.Description))
+	}
+	return b.String()
+}
+
+// runExportFirewall implements the `export-firewall` subcommand. The script format
+// follows the output file extension: .ps1 for PowerShell, anything else for netsh.
+func runExportFirewall(args []string) int {
+	var allowComments bool
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "--allow-comments":
+			allowComments = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 2 {
+		fmt.Println("Usage: wsl2-port-forwarder.exe export-firewall [--allow-comments] <config-file.json> <script.cmd|script.ps1>")
+		return 1
+	}
+	configFile, outputFile := files[0], files[1]
+
+	config, err := loadConfigFile(configFile, allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", configFile, err)
+		return 1
+	}
+
+	rules, err := desiredFirewallRules(config.ManagedConfig())
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	var script string
+	if strings.EqualFold(filepath.Ext(outputFile), ".ps1") {
+		script = renderPowerShellScript(configFile, rules)
+	} else {
+		script = renderNetshScript(configFile, rules)
+	}
+	if err := os.WriteFile(outputFile, []byte(script), 0644); err != nil {
+		fmt.Printf("❌ Failed to write %s: %v\n", outputFile, err)
+		return 1
+	}
+
+	fmt.Printf("✅ Exported %d firewall rules to %s\n", len(rules), outputFile)
+	return 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// unconfiguredFirewallRules returns the tracked rule names that no enabled port of the
+// config asks for any more, sorted
+func unconfiguredFirewallRules(config *Config, tracked []string) ([]string, error) {
+	desired, err := desiredFirewallRules(config)
+	if err != nil {
+		return nil, err
+	}
+	configured := make(map[string]bool)
+	for _, rule := range desired {
+		configured[rule.Name] = true
+	}
+
+	var stale []string
+	seen := make(map[string]bool)
+	for _, name := range tracked {
+		if !configured[name] && !seen[name] {
+			seen[name] = true
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// removeUnconfiguredFirewallRules removes the firewall rules the forwarder created
+// (this run, or as recorded in the registry) for ports that have left the config or
+// no longer want a rule. Rules of configured ports are kept while their instance is
+// stopped, as are rules the forwarder didn't create. pre_provision_firewall does this
+// itself, and --no-firewall leaves rules to whoever applies them.
+func (s *ServiceState) removeUnconfiguredFirewallRules() {
+	if s.noFirewall || s.config.PreProvisionFirewall {
+		return
+	}
+
+	var tracked []string
+	for name := range s.createdRules {
+		tracked = append(tracked, name)
+	}
+	if s.registryManager != nil {
+		if registered, err := s.registryManager.GetRegisteredFirewallRules(); err == nil {
+			for _, rule := range registered {
+				tracked = append(tracked, rule.RuleName)
+			}
+		}
+	}
+	if len(tracked) == 0 {
+		return
+	}
+
+	stale, err := unconfiguredFirewallRules(s.config, tracked)
+	if err != nil || len(stale) == 0 {
+		return
+	}
+	if !s.dryRun && !isRunningAsAdmin() {
+		s.logf("Warning: Firewall rules for ports no longer configured can't be removed without Administrator rights: %s", strings.Join(stale, ", "))
+		return
+	}
+
+	for _, name := range stale {
+		// A tracked rule that was already deleted by hand only needs forgetting
+		if _, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", name)); err != nil {
+			s.forgetFirewallRule(name)
+			continue
+		}
+		if err := s.removeFirewallRuleByName(name); err != nil {
+			s.logf("Warning: Failed to remove firewall rule %s for a port no longer configured: %v", name, err)
+			continue
+		}
+		consoleEvent("info", "firewall_rule_removed", EventFields{}, "  🔥 Firewall rule removed (port no longer configured): %s%s", name, s.dryRunTag())
+	}
+}
+
+// forgetFirewallRule drops the tracking of a rule that no longer exists
+func (s *ServiceState) forgetFirewallRule(name string) {
+	delete(s.createdRules, name)
+	s.dropPendingRegistryWrites("fw:" + name)
+	if s.registryManager != nil {
+		if err := s.registryManager.UnregisterFirewallRule(name); err != nil {
+			s.logf("Warning: Failed to unregister firewall rule %s from registry: %v", name, err)
+		}
+	}
+}
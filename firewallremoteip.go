@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseFirewallRemoteIPs parses a firewall_remote_ip list: comma-separated IP addresses
+// and CIDR ranges, e.g. "10.8.0.0/24,192.168.1.5". It returns the entries trimmed, in
+// the form netsh's remoteip= takes.
+func parseFirewallRemoteIPs(value string) ([]string, error) {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("firewall_remote_ip '%s' has an empty entry", value)
+		}
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return nil, fmt.Errorf("firewall_remote_ip entry '%s' is not a valid CIDR range", entry)
+			}
+		} else if net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("firewall_remote_ip entry '%s' is not an IP address or CIDR range", entry)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// firewallRuleRemoteIP returns the remoteip= a firewall mode allows: LocalSubnet for
+// "local", any for "full", or the addresses of a firewall_remote_ip list
+func firewallRuleRemoteIP(mode string) (string, bool) {
+	switch mode {
+	case "local":
+		return "LocalSubnet", true
+	case "full":
+		return "any", true
+	case "":
+		return "", false
+	}
+	entries, err := parseFirewallRemoteIPs(mode)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join(entries, ","), true
+}
+
+// firewallAccessDescription describes who a firewall mode lets in, for the console
+func firewallAccessDescription(mode string) string {
+	switch mode {
+	case "local":
+		return "local network"
+	case "full":
+		return "any address"
+	}
+	return mode + " only"
+}
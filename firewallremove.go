@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// getActualFirewallRules retrieves the names of all existing firewall rules
+func getActualFirewallRules() ([]string, error) {
+	rules := []string{}
+
+	output, err := runCommand(defaultCommandTimeout, false, "netsh", "advfirewall", "firewall", "show", "rule", "name=all")
+	if err != nil {
+		return rules, fmt.Errorf("failed to get firewall rules: %v", err)
+	}
+
+	outputStr, err := decodeCommandOutput(output)
+	if err != nil {
+		return rules, fmt.Errorf("failed to decode firewall rules output: %v", err)
+	}
+
+	for _, rule := range parseFirewallRules(outputStr) {
+		if rule.Name != "" {
+			rules = append(rules, rule.Name)
+		}
+	}
+	checkParsedOutput("netsh advfirewall firewall show rule", output, outputStr, len(rules))
+
+	return rules, nil
+}
+
+// forwarderFirewallRules picks the rules the forwarder created out of every rule on the
+// system: those named with its prefix, and any others the registry tracks. Each name
+// is returned once, sorted, since `netsh delete rule name=` removes every rule with it.
+func forwarderFirewallRules(actual []string, tracked []string) []string {
+	isTracked := make(map[string]bool)
+	for _, name := range tracked {
+		isTracked[name] = true
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range actual {
+		if seen[name] || !(strings.HasPrefix(name, managedFirewallRulePrefix) || isTracked[name]) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runRemoveFirewallRules implements --remove-firewall-rules: delete every firewall rule
+// the forwarder created, whatever config it came from, after a confirmation prompt
+// (skipped with --yes). The firewall counterpart of --cleanup-registry.
+// Exit codes: 0=success or nothing to do, 1=error
+func runRemoveFirewallRules(opts *CommandLineOptions) int {
+	actual, err := getActualFirewallRules()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	var tracked []string
+	if registryManager, err := OpenRegistryManagerReadOnly(); err == nil {
+		if rules, err := registryManager.GetRegisteredFirewallRules(); err == nil {
+			for _, rule := range rules {
+				tracked = append(tracked, rule.RuleName)
+			}
+		}
+		registryManager.Close()
+	}
+
+	names := forwarderFirewallRules(actual, tracked)
+	if len(names) == 0 {
+		fmt.Println("✅ No firewall rules created by the forwarder found")
+		return 0
+	}
+
+	fmt.Printf("Found %d firewall rule(s) created by the forwarder:\n", len(names))
+	for _, name := range names {
+		fmt.Printf("  %s\n", name)
+	}
+
+	if !opts.DryRun {
+		if !isRunningAsAdmin() {
+			fmt.Println("❌ --remove-firewall-rules requires Administrator privileges to change the firewall")
+			return 1
+		}
+		if !opts.Yes {
+			wizard := &setupWizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+			remove, err := wizard.askYesNo(fmt.Sprintf("Remove these %d firewall rule(s)?", len(names)), false)
+			if err != nil || !remove {
+				fmt.Println("Nothing removed")
+				return 0
+			}
+		}
+	}
+
+	service := &ServiceState{dryRun: opts.DryRun}
+	if !opts.DryRun {
+		if registryManager, err := NewRegistryManager(); err == nil {
+			service.registryManager = registryManager
+			defer registryManager.Close()
+		}
+	}
+
+	removed, failures := 0, 0
+	for _, name := range names {
+		if err := service.removeFirewallRuleByName(name); err != nil {
+			fmt.Printf("  ❌ Firewall rule %s: %v\n", name, err)
+			failures++
+			continue
+		}
+		removed++
+		fmt.Printf("  ✓ Firewall rule %s removed%s\n", name, service.dryRunTag())
+	}
+
+	fmt.Printf("\nRemoved %d of %d firewall rules%s\n", removed, len(names), service.dryRunTag())
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// existingFirewallRuleChanges compares the rules `netsh advfirewall firewall show rule
+// name=<n>` printed with the rule the config wants, returning what differs (e.g.
+// "remoteip LocalSubnet -> any"), or nothing if they match. Output that can't be parsed
+// (e.g. a localized netsh) counts as matching, so the rule is left alone as before.
+func existingFirewallRuleChanges(output []byte, rule FirewallRuleSpec) []string {
+	outputStr, err := decodeCommandOutput(output)
+	if err != nil {
+		return nil
+	}
+
+	for _, existing := range parseFirewallRules(outputStr) {
+		if changes := firewallRuleChanges(existing, rule); len(changes) > 0 {
+			return changes
+		}
+	}
+	return nil
+}
+
+// firewallRuleChanges returns how an existing rule differs from rule. Fields netsh
+// didn't print are not compared.
+func firewallRuleChanges(existing FirewallRule, rule FirewallRuleSpec) []string {
+	var changes []string
+
+	if existing.Protocol != "" && !strings.EqualFold(existing.Protocol, rule.netshProtocol()) {
+		changes = append(changes, fmt.Sprintf("protocol %s -> %s", existing.Protocol, rule.netshProtocol()))
+	}
+
+	if rule.Outbound {
+		if want := strconv.Itoa(rule.RemotePort); existing.RemotePort != "" && existing.RemotePort != want {
+			changes = append(changes, fmt.Sprintf("remoteport %s -> %s", existing.RemotePort, want))
+		}
+	} else if want := strconv.Itoa(rule.Port); existing.LocalPort != "" && existing.LocalPort != want {
+		changes = append(changes, fmt.Sprintf("localport %s -> %s", existing.LocalPort, want))
+	}
+
+	if existing.RemoteIP != "" && normalizeFirewallRemoteIP(existing.RemoteIP) != normalizeFirewallRemoteIP(rule.RemoteIP) {
+		changes = append(changes, fmt.Sprintf("remoteip %s -> %s", existing.RemoteIP, rule.RemoteIP))
+	}
+
+	return changes
+}
+
+// normalizeFirewallRemoteIP puts a remote IP list in one canonical form, as netsh
+// prints it differently from how it is given: "10.8.0.0/24" is shown as
+// "10.8.0.0/255.255.255.0", a single address as "192.168.1.5/32", and keywords in
+// varying case
+func normalizeFirewallRemoteIP(value string) string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		entries = append(entries, normalizeFirewallAddress(entry))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// normalizeFirewallAddress normalizes one remote IP entry to a CIDR range; keywords and
+// address ranges are only lowercased
+func normalizeFirewallAddress(entry string) string {
+	address, mask, hasMask := strings.Cut(entry, "/")
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return strings.ToLower(entry)
+	}
+
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	ones := bits
+	if hasMask {
+		if length, err := strconv.Atoi(mask); err == nil {
+			ones = length
+		} else if dotted := net.ParseIP(mask).To4(); dotted != nil && bits == 32 {
+			ones, _ = net.IPMask(dotted).Size()
+		} else {
+			return strings.ToLower(entry)
+		}
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	if network.IP == nil {
+		return strings.ToLower(entry)
+	}
+	return network.String()
+}
@@ -2,4 +2,9 @@ module wsl2-port-forwarder
 
 go 1.24.0
 
-require golang.org/x/sys v0.36.0
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/fsnotify/fsnotify v1.7.0
+	golang.org/x/sys v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxIPLookupFailures is how many passes in a row a running instance's IP may fail to
+// read before its forwards are treated as stale and removed
+const maxIPLookupFailures = 3
+
+// heldIPUnreadable is the Held reason of a running instance whose IP lookup failed
+const heldIPUnreadable = "its IP couldn't be read"
+
+// instanceLookupConcurrency bounds how many instances are queried at once; each
+// lookup spawns `wsl -d <name>`, which takes a few hundred milliseconds
+const instanceLookupConcurrency = 4
+
+// instanceLookup is a running instance whose IP a snapshot needs
+type instanceLookup struct {
+	instance Instance // as configured
+	distro   Instance // named as wsl reported it, since wsl -d is case-sensitive
+}
+
+// instanceLookupResult is what one lookup found. Messages are held rather than logged
+// so they come out in config order, however the lookups interleave.
+type instanceLookupResult struct {
+	ip           string
+	err          error
+	candidates   []string // connect_fallback candidates, primary first
+	candidateErr error
+	messages     []string
+}
+
+// lookupInstances queries the instances' IPs (and connect_fallback candidates) with
+// runner, instanceLookupConcurrency at a time, returning the results in the same order
+func lookupInstances(runner CommandRunner, lookups []instanceLookup) []instanceLookupResult {
+	results := make([]instanceLookupResult, len(lookups))
+	slots := make(chan struct{}, instanceLookupConcurrency)
+	var wg sync.WaitGroup
+
+	for i, lookup := range lookups {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(result *instanceLookupResult, lookup instanceLookup) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			logf := func(format string, args ...interface{}) {
+				result.messages = append(result.messages, fmt.Sprintf(format, args...))
+			}
+			result.ip, result.err = wslInstanceIP(runner, lookup.distro, logf)
+			if result.err == nil && lookup.instance.hasConnectFallback() {
+				result.candidates, result.candidateErr = wslInstanceCandidateIPs(runner, lookup.distro.Name, result.ip)
+			}
+		}(&results[i], lookup)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// releaseUnreadableInstances counts consecutive failed IP lookups per instance. A failed
+// lookup holds the instance, keeping its forwards for the moment it's mid-restart; once
+// it has failed maxIPLookupFailures passes in a row the hold is dropped, so forwards
+// still pointing at its old, likely dead, IP are removed like a stopped instance's.
+func (s *ServiceState) releaseUnreadableInstances(snapshot *ReconcileSnapshot) {
+	if s.ipLookupFailures == nil {
+		s.ipLookupFailures = make(map[string]int)
+	}
+
+	for _, instance := range snapshot.Config.Instances {
+		if snapshot.Held[instance.Name] != heldIPUnreadable {
+			delete(s.ipLookupFailures, instance.Name)
+			continue
+		}
+
+		s.ipLookupFailures[instance.Name]++
+		failures := s.ipLookupFailures[instance.Name]
+		if failures < maxIPLookupFailures {
+			continue
+		}
+		if failures == maxIPLookupFailures {
+			s.logf("Warning: IP of instance %s unreadable for %d checks in a row, removing its forwards until it can be read", instance.Name, failures)
+		}
+		delete(snapshot.Held, instance.Name)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+
+// ResourceInventory counts the resources the registry says the forwarder manages, and
+// how many of them still exist on the system
+type ResourceInventory struct {
+	PortProxies       int
+	LivePortProxies   int
+	FirewallRules     int
+	LiveFirewallRules int
+}
+
+// Orphaned returns how many registered resources no longer exist
+func (inv ResourceInventory) Orphaned() int {
+	return inv.PortProxies - inv.LivePortProxies + inv.FirewallRules - inv.LiveFirewallRules
+}
+
+// buildResourceInventory matches registry entries against the live netsh state, the
+// same way the registry audit does
+func buildResourceInventory(proxies []RegistryPortProxy, rules []RegistryFirewallRule, mappings map[int]PortMapping, actualRules []FirewallRule) ResourceInventory {
+	inv := ResourceInventory{PortProxies: len(proxies), FirewallRules: len(rules)}
+	for _, proxy := range proxies {
+		if mapping, exists := mappings[proxy.ListenPort]; exists &&
+			mapping.TargetIP == proxy.ConnectAddress && mapping.InternalPort == proxy.ConnectPort {
+			inv.LivePortProxies++
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, rule := range actualRules {
+		present[rule.Name] = true
+	}
+	for _, rule := range rules {
+		if present[rule.RuleName] {
+			inv.LiveFirewallRules++
+		}
+	}
+	return inv
+}
+
+// printStartupInventory prints what the registry says is managed right after start,
+// so leaked or orphaned resources show up early. fullAudit also runs the registry
+// audit, listing every mismatch.
+func (s *ServiceState) printStartupInventory(fullAudit bool) {
+	if s.registryManager == nil {
+		return
+	}
+
+	proxies, err := s.registryManager.GetRegisteredPortProxies()
+	if err != nil {
+		s.logf("Warning: Unable to read registered port proxies: %v", err)
+		return
+	}
+	rules, err := s.registryManager.GetRegisteredFirewallRules()
+	if err != nil {
+		s.logf("Warning: Unable to read registered firewall rules: %v", err)
+		return
+	}
+
+	mappings, mappingsErr := s.getCurrentPortMappings()
+	actualRules, rulesErr := s.getForwarderDirectionRules()
+	if mappingsErr != nil || rulesErr != nil {
+		consoleEvent("info", "inventory", EventFields{}, "Managed resources: %d port proxies, %d firewall rules (live state unavailable)", len(proxies), len(rules))
+	} else {
+		inv := buildResourceInventory(proxies, rules, mappings, actualRules)
+		consoleEvent("info", "inventory", EventFields{}, "Managed resources: %d port proxies (%d live), %d firewall rules (%d live)",
+			inv.PortProxies, inv.LivePortProxies, inv.FirewallRules, inv.LiveFirewallRules)
+		if orphaned := inv.Orphaned(); orphaned > 0 {
+			s.logf("Warning: %d registered resources no longer exist on the system (cleaned up automatically; --startup-audit lists them)", orphaned)
+		}
+	}
+
+	if fullAudit {
+		fmt.Println()
+		if _, err := s.registryManager.AuditRegistryState(); err != nil {
+			s.logf("Warning: Registry audit failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "encoding/json"
+
+// jsonStyle is the --pretty/--compact choice for JSON output. Without a flag, output
+// for people (a terminal) is pretty and output for machines (files, pipes) is compact.
+type jsonStyle struct {
+	explicit bool
+	pretty   bool
+}
+
+// isJSONStyleFlag returns true for the flags accepted by jsonStyle.set
+func isJSONStyleFlag(arg string) bool {
+	return arg == "--pretty" || arg == "--compact"
+}
+
+// set records an explicit --pretty or --compact flag
+func (j *jsonStyle) set(arg string) {
+	j.explicit = true
+	j.pretty = arg == "--pretty"
+}
+
+// forStdout resolves the style for JSON printed to stdout
+func (j jsonStyle) forStdout() bool {
+	if j.explicit {
+		return j.pretty
+	}
+	return stdoutIsTerminal()
+}
+
+// forFile resolves the style for JSON written to a file, regardless of the terminal
+func (j jsonStyle) forFile() bool {
+	return j.explicit && j.pretty
+}
+
+// marshalJSON encodes v indented or compact
+func marshalJSON(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// RegistryList is the --list --json output: everything the registry says the
+// forwarder created
+type RegistryList struct {
+	PortProxies   []RegistryPortProxy    `json:"port_proxies"`
+	FirewallRules []RegistryFirewallRule `json:"firewall_rules"`
+}
+
+// writeRegistryList prints the registry-tracked port proxies and firewall rules as tables
+func writeRegistryList(out io.Writer, list RegistryList) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Port proxies (%d):\n", len(list.PortProxies))
+	if len(list.PortProxies) > 0 {
+		fmt.Fprintln(w, "  KEY\tPORT\tTARGET\tINSTANCE\tTIMESTAMP")
+		for _, proxy := range list.PortProxies {
+			fmt.Fprintf(w, "  %s\t%d\t%s:%d\t%s\t%s\n", proxy.Key, proxy.ListenPort, proxy.ConnectAddress, proxy.ConnectPort, proxy.Instance, proxy.Timestamp)
+		}
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	fmt.Fprintf(w, "Firewall rules (%d):\n", len(list.FirewallRules))
+	if len(list.FirewallRules) > 0 {
+		fmt.Fprintln(w, "  KEY\tPORT\tRULE\tINSTANCE\tTIMESTAMP")
+		for _, rule := range list.FirewallRules {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", rule.Key, rule.Port, rule.RuleName, rule.Instance, rule.Timestamp)
+		}
+	}
+	w.Flush()
+}
+
+// runList implements --list: print what the registry says the forwarder created,
+// without comparing it to the live system (see --startup-audit for that)
+func runList(opts *CommandLineOptions) int {
+	registryManager, err := OpenRegistryManagerReadOnly()
+	if err != nil {
+		fmt.Printf("❌ Registry tracking unavailable: %v\n", err)
+		return 1
+	}
+	defer registryManager.Close()
+
+	list := RegistryList{PortProxies: []RegistryPortProxy{}, FirewallRules: []RegistryFirewallRule{}}
+	proxies, err := registryManager.GetRegisteredPortProxies()
+	if err != nil {
+		fmt.Printf("❌ Unable to read registered port proxies: %v\n", err)
+		return 1
+	}
+	rules, err := registryManager.GetRegisteredFirewallRules()
+	if err != nil {
+		fmt.Printf("❌ Unable to read registered firewall rules: %v\n", err)
+		return 1
+	}
+	list.PortProxies = append(list.PortProxies, proxies...)
+	list.FirewallRules = append(list.FirewallRules, rules...)
+
+	if opts.JSON {
+		data, err := marshalJSON(list, opts.JSONStyle.forStdout())
+		if err != nil {
+			fmt.Printf("❌ Failed to encode registry entries: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+
+	fmt.Println("WSL2 Port Forwarder - Registry-tracked resources")
+	fmt.Println("================================================")
+	writeRegistryList(os.Stdout, list)
+	return 0
+}
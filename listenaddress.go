@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// defaultListenAddress is what forwards bind to when listen_address is omitted
+const defaultListenAddress = "0.0.0.0"
+
+// listenAddressLAN is the listen_address token for the adapter that holds the default route
+const listenAddressLAN = "lan"
+
+// isListenAddressToken returns true if listen_address names an adapter to resolve
+// ("lan" or an interface name) rather than a literal IP
+func isListenAddressToken(value string) bool {
+	return value != "" && !isValidIPAddress(value)
+}
+
+// validateListenAddress checks the syntax of a listen_address value. Whether a named
+// interface exists is only known at runtime, since adapters come and go.
+func validateListenAddress(value string) error {
+	if value == "" || isValidIPAddress(value) || strings.EqualFold(value, listenAddressLAN) {
+		return nil
+	}
+	if strings.TrimSpace(value) != value {
+		return fmt.Errorf("listen_address '%s' has leading or trailing spaces", value)
+	}
+	if strings.ContainsAny(value, "\"\t\r\n") {
+		return fmt.Errorf("listen_address '%s' is not an IP address, 'lan', or an interface name", value)
+	}
+	return nil
+}
+
+// resolveListenAddress turns a listen_address token into the adapter's current IPv4
+// address; overridable in tests
+var resolveListenAddress = func(token string) (string, error) {
+	if strings.EqualFold(token, listenAddressLAN) {
+		return defaultRouteIPv4()
+	}
+	return interfaceIPv4(token)
+}
+
+// defaultRouteIPv4 returns the host IP of the adapter holding the default route.
+// Connecting a UDP socket sends nothing, but makes the OS pick the source address.
+func defaultRouteIPv4() (string, error) {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return "", fmt.Errorf("no default route: %v", err)
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP.IsUnspecified() {
+		return "", fmt.Errorf("no default route")
+	}
+	return addr.IP.String(), nil
+}
+
+// interfaceIPv4 returns the first non link-local IPv4 address of a network adapter,
+// using the name Windows shows for it (e.g. "Wi-Fi", "Ethernet 2")
+func interfaceIPv4(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("no network interface named '%s'", name)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return "", fmt.Errorf("interface '%s' is down", name)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list addresses of interface '%s': %v", name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil && !ip.IsLinkLocalUnicast() {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("interface '%s' has no IPv4 address", name)
+}
+
+// listenAddressTokens returns the distinct listen_address tokens used in the config
+func listenAddressTokens(config *Config) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if isListenAddressToken(port.ListenAddress) && !seen[port.ListenAddress] {
+				seen[port.ListenAddress] = true
+				tokens = append(tokens, port.ListenAddress)
+			}
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// resolveListenAddresses resolves every listen_address token in the config for this
+// pass. Tokens that don't resolve are left out, so their ports aren't forwarded.
+func (s *ServiceState) resolveListenAddresses(config *Config) map[string]string {
+	resolved := make(map[string]string)
+	for _, token := range listenAddressTokens(config) {
+		ip, err := resolveListenAddress(token)
+		if err != nil {
+			s.logf("Warning: Unable to resolve listen_address '%s': %v", token, err)
+			continue
+		}
+		resolved[token] = ip
+	}
+	return resolved
+}
+
+// ListenAddressFor returns the host address port should bind to this pass, and false
+// if its listen_address token couldn't be resolved
+func (snap *ReconcileSnapshot) ListenAddressFor(port Port) (string, bool) {
+	if port.ListenAddress == "" {
+		return defaultListenAddress, true
+	}
+	if !isListenAddressToken(port.ListenAddress) {
+		return port.ListenAddress, true
+	}
+	ip, ok := snap.ListenAddresses[port.ListenAddress]
+	return ip, ok
+}
+
+// sameListenAddress compares listen addresses, treating empty as the default
+func sameListenAddress(a, b string) bool {
+	if a == "" {
+		a = defaultListenAddress
+	}
+	if b == "" {
+		b = defaultListenAddress
+	}
+	// Spellings of the same IPv6 address, e.g. "::" and "0::0", are the same address
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// checkListenAddresses reports listen_address tokens that don't resolve on this host
+func checkListenAddresses(config *Config) int {
+	tokens := listenAddressTokens(config)
+	if len(tokens) == 0 {
+		return 0
+	}
+
+	fmt.Println("\nℹ️  Checking listen_address interfaces...")
+	exitCode := 0
+	for _, token := range tokens {
+		ip, err := resolveListenAddress(token)
+		if err != nil {
+			fmt.Printf("⚠️  listen_address '%s': %v (ports using it won't be forwarded)\n", token, err)
+			exitCode = 2
+			continue
+		}
+		fmt.Printf("✅ listen_address '%s' -> %s\n", token, ip)
+	}
+	return exitCode
+}
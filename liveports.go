@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// liveTarget describes where a forward listens and points, so a retarget or rebind
+// counts as the port coming up again
+func liveTarget(mapping PortMapping) string {
+	listenAddress := mapping.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
+	}
+	return fmt.Sprintf("%s:%d -> %s:%d (%s)", listenAddress, mapping.ExternalPort, mapping.TargetIP, mapping.InternalPort, mapping.Instance)
+}
+
+// announceLivePorts logs once when a forward becomes live: on its first successful add,
+// after it is retargeted, and after a failure or stop. Steady state stays quiet.
+// Returns the ports announced.
+func (s *ServiceState) announceLivePorts(desired map[int]PortMapping, failed map[int]bool) []int {
+	if s.livePorts == nil {
+		s.livePorts = make(map[int]string)
+	}
+
+	for port := range s.livePorts {
+		if _, forwarding := desired[port]; !forwarding || failed[port] {
+			delete(s.livePorts, port)
+		}
+	}
+
+	ports := make([]int, 0, len(desired))
+	for port := range desired {
+		if !failed[port] {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+
+	var announced []int
+	for _, port := range ports {
+		target := liveTarget(desired[port])
+		if s.livePorts[port] == target {
+			continue
+		}
+		s.livePorts[port] = target
+		log.Printf("Port %d now reachable at %s", port, target)
+		say("  🟢 Port %d now reachable at %s", port, target)
+		announced = append(announced, port)
+	}
+	return announced
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WSL2 forwards localhost:PORT from Windows to listening services in the default distro
+// on its own (the localhostForwarding setting in .wslconfig, on by default). A portproxy
+// on 127.0.0.1 then competes with it for the same address and port.
+
+// parseLocalhostForwarding reads the localhostForwarding setting from .wslconfig
+// contents, returning true unless the [wsl2] section turns it off
+func parseLocalhostForwarding(data string) bool {
+	enabled := true
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || section != "wsl2" || !strings.EqualFold(strings.TrimSpace(key), "localhostForwarding") {
+			continue
+		}
+		// Values may carry a trailing comment
+		value, _, _ = strings.Cut(value, "#")
+		enabled = !strings.EqualFold(strings.TrimSpace(value), "false")
+	}
+	return enabled
+}
+
+// wslLocalhostForwarding reports whether WSL's own localhost forwarding is active for
+// the current user; overridable in tests. Running as a service, the profile is the
+// service account's, which usually has no .wslconfig and so reports the default (on).
+var wslLocalhostForwarding = func() bool {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".wslconfig"))
+	if err != nil {
+		return true
+	}
+	return parseLocalhostForwarding(string(data))
+}
+
+// loopbackForwards lists the configured ports that bind the portproxy to a loopback
+// address, as "instance port N" descriptions
+func loopbackForwards(config *Config) []string {
+	var forwards []string
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			ip := net.ParseIP(port.ListenAddress)
+			if ip == nil || !ip.IsLoopback() {
+				continue
+			}
+			forwards = append(forwards, fmt.Sprintf("%s port %d (%s)", instance.Name, port.ExternalPortEffective(), port.ListenAddress))
+		}
+	}
+	return forwards
+}
+
+// checkLocalhostForwarding warns about loopback forwards that overlap with WSL's
+// built-in localhost forwarding
+func checkLocalhostForwarding(config *Config) int {
+	forwards := loopbackForwards(config)
+	if len(forwards) == 0 || !wslLocalhostForwarding() {
+		return 0
+	}
+
+	fmt.Println("\nℹ️  Checking overlap with WSL localhost forwarding...")
+	for _, forward := range forwards {
+		fmt.Printf("⚠️  %s: WSL already forwards localhost to the default distro, this portproxy may be redundant or conflict with it\n", forward)
+	}
+	fmt.Println("💡 Tip: Bind to 0.0.0.0 or a LAN IP instead, or set localhostForwarding=false under [wsl2] in .wslconfig")
+	return 2
+}
+
+// warnLocalhostForwarding logs the same overlap at service startup
+func (s *ServiceState) warnLocalhostForwarding() {
+	forwards := loopbackForwards(s.config)
+	if len(forwards) == 0 || !wslLocalhostForwarding() {
+		return
+	}
+	for _, forward := range forwards {
+		s.logf("Warning: %s overlaps with WSL's built-in localhost forwarding and may be redundant or conflict; bind to 0.0.0.0 or a LAN IP instead", forward)
+	}
+}
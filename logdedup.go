@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// LogDeduplicator suppresses repeats of identical log messages within a time window,
+// replacing them with a single "(repeated N times)" summary once the window closes
+type LogDeduplicator struct {
+	window  time.Duration
+	entries map[string]*dedupEntry
+	output  func(string) // defaults to log.Print; overridable for tests
+}
+
+type dedupEntry struct {
+	firstSeen  time.Time
+	suppressed int
+}
+
+// NewLogDeduplicator creates a deduplicator; a zero window disables deduplication
+func NewLogDeduplicator(window time.Duration) *LogDeduplicator {
+	return &LogDeduplicator{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+		output:  func(msg string) { log.Print(msg) },
+	}
+}
+
+// SetWindow changes the deduplication window (e.g. after a config reload)
+func (d *LogDeduplicator) SetWindow(window time.Duration) {
+	if window != d.window {
+		d.Flush(time.Now().Add(d.window))
+		d.window = window
+	}
+}
+
+// Printf logs a message unless an identical one was logged within the window
+func (d *LogDeduplicator) Printf(format string, args ...interface{}) {
+	d.printfAt(time.Now(), format, args...)
+}
+
+func (d *LogDeduplicator) printfAt(now time.Time, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	if d.window <= 0 {
+		d.output(msg)
+		return
+	}
+
+	if entry, seen := d.entries[msg]; seen {
+		if now.Sub(entry.firstSeen) < d.window {
+			entry.suppressed++
+			return
+		}
+		d.emitSummary(msg, entry)
+	}
+
+	d.entries[msg] = &dedupEntry{firstSeen: now}
+	d.output(msg)
+}
+
+// Flush emits summaries for every message whose window has closed and forgets it,
+// so an ongoing problem is still reported periodically
+func (d *LogDeduplicator) Flush(now time.Time) {
+	msgs := make([]string, 0, len(d.entries))
+	for msg := range d.entries {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+
+	for _, msg := range msgs {
+		entry := d.entries[msg]
+		if now.Sub(entry.firstSeen) >= d.window {
+			d.emitSummary(msg, entry)
+			delete(d.entries, msg)
+		}
+	}
+}
+
+func (d *LogDeduplicator) emitSummary(msg string, entry *dedupEntry) {
+	if entry.suppressed > 0 {
+		d.output(fmt.Sprintf("%s (repeated %d times)", msg, entry.suppressed))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// defaultLogMaxBackups is how many rotated files are kept when log_max_backups is omitted
+const defaultLogMaxBackups = 3
+
+// LogMaxBackupsEffective returns log_max_backups, defaulting to defaultLogMaxBackups
+func (c *Config) LogMaxBackupsEffective() int {
+	if c.LogMaxBackups <= 0 {
+		return defaultLogMaxBackups
+	}
+	return c.LogMaxBackups
+}
+
+// RotatingFileWriter appends log lines to a file, renaming it to .1, .2, ... and
+// starting a fresh one once it reaches the size limit. Only the newest backups are kept.
+type RotatingFileWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // bytes, 0 = never rotate
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFileWriter opens (or creates) the log file for appending
+func NewRotatingFileWriter(path string, maxSizeMB int, maxBackups int) (*RotatingFileWriter, error) {
+	w := &RotatingFileWriter{path: path}
+	w.SetLimits(maxSizeMB, maxBackups)
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetLimits applies log_max_size_mb and log_max_backups, e.g. after a config reload
+func (w *RotatingFileWriter) SetLimits(maxSizeMB int, maxBackups int) {
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxSize = int64(maxSizeMB) * 1024 * 1024
+	w.maxBackups = maxBackups
+}
+
+func (w *RotatingFileWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %v", w.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file %s: %v", w.path, err)
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write implements io.Writer for use with log.SetOutput. A line is never split across
+// files: the file is rotated before a write that would take it past the limit.
+func (w *RotatingFileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		// A previous rotation couldn't reopen the file; try again
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1, dropping the oldest backup,
+// and reopens an empty file
+func (w *RotatingFileWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	os.Remove(backupLogPath(w.path, w.maxBackups))
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		os.Rename(backupLogPath(w.path, i), backupLogPath(w.path, i+1))
+	}
+	if err := os.Rename(w.path, backupLogPath(w.path, 1)); err != nil && !os.IsNotExist(err) {
+		// Keep logging to the oversized file rather than losing lines
+		if reopenErr := w.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return nil
+	}
+	return w.open()
+}
+
+// Close closes the underlying file
+func (w *RotatingFileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// backupLogPath names the n-th rotated copy of a log file
+func backupLogPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// configureLogFile (re)points file logging at the configured log_file and applies the
+// rotation limits
+func (s *ServiceState) configureLogFile(config *Config) {
+	if config.LogFile == s.logFilePath {
+		if s.logFileWriter != nil {
+			s.logFileWriter.SetLimits(config.LogMaxSizeMB, config.LogMaxBackups)
+		}
+		return
+	}
+
+	if s.logFileWriter != nil {
+		s.logFileWriter.Close()
+		s.logFileWriter = nil
+	}
+	s.logFilePath = config.LogFile
+	s.applyLogOutput()
+
+	if config.LogFile == "" {
+		return
+	}
+
+	writer, err := NewRotatingFileWriter(config.LogFile, config.LogMaxSizeMB, config.LogMaxBackups)
+	if err != nil {
+		log.Printf("Warning: File logging disabled: %v", err)
+		return
+	}
+	s.logFileWriter = writer
+	s.applyLogOutput()
+	log.Printf("Logging to %s", config.LogFile)
+}
+
+// applyLogOutput sends the standard logger to stderr plus whichever of the log file,
+// the syslog collector and the Windows Event Log are in use
+func (s *ServiceState) applyLogOutput() {
+	writers := []io.Writer{os.Stderr}
+	if s.logFileWriter != nil {
+		writers = append(writers, s.logFileWriter)
+	}
+	if s.syslogWriter != nil {
+		writers = append(writers, s.syslogWriter)
+	}
+	if eventLogSink != nil {
+		writers = append(writers, eventLogWriter{})
+	}
+	if len(writers) == 1 {
+		setLogOutput(os.Stderr)
+		return
+	}
+	setLogOutput(io.MultiWriter(writers...))
+}
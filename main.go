@@ -1,27 +1,42 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf16"
 )
 
 // Configuration structures
 type Port struct {
-	Port         int    `json:"port"`
-	InternalPort int    `json:"internal_port,omitempty"`
-	Firewall     string `json:"firewall,omitempty"` // "local", "full", or empty (warn only)
-	Comment      string `json:"comment,omitempty"`
+	Port            int    `json:"port" yaml:"port" toml:"port"`
+	InternalPort    int    `json:"internal_port,omitempty" yaml:"internal_port,omitempty" toml:"internal_port,omitempty"`
+	Firewall        string `json:"firewall,omitempty" yaml:"firewall,omitempty" toml:"firewall,omitempty"` // "local", "full", or empty (warn only)
+	Comment         string `json:"comment,omitempty" yaml:"comment,omitempty" toml:"comment,omitempty"`
+	ConnectFallback bool   `json:"connect_fallback,omitempty" yaml:"connect_fallback,omitempty" toml:"connect_fallback,omitempty"`       // fail over to the first reachable instance IP
+	QosThrottleKbps int    `json:"qos_throttle_kbps,omitempty" yaml:"qos_throttle_kbps,omitempty" toml:"qos_throttle_kbps,omitempty"`    // throttle traffic from this port via a Windows QoS policy
+	ListenAddress   string `json:"listen_address,omitempty" yaml:"listen_address,omitempty" toml:"listen_address,omitempty"`             // host IP, "lan" or an interface name to bind to (default 0.0.0.0)
+	UPnP            bool   `json:"upnp,omitempty" yaml:"upnp,omitempty" toml:"upnp,omitempty"`                                           // best-effort: also ask the router (UPnP IGD) to forward this port
+	FirewallDir     string `json:"firewall_direction,omitempty" yaml:"firewall_direction,omitempty" toml:"firewall_direction,omitempty"` // "in" (default), "out" or "both"
+	Protocol        string `json:"protocol,omitempty" yaml:"protocol,omitempty" toml:"protocol,omitempty"`                               // "tcp" (default) or "udp"; udp is relayed in-process
+	Enabled         *bool  `json:"enabled,omitempty" yaml:"enabled,omitempty" toml:"enabled,omitempty"`                                  // false stops forwarding the port without removing it from the config
+	FirewallRemote  string `json:"firewall_remote_ip,omitempty" yaml:"firewall_remote_ip,omitempty" toml:"firewall_remote_ip,omitempty"` // IPs/CIDR ranges the firewall rule allows, instead of firewall's local/full
+	Probe           bool   `json:"probe,omitempty" yaml:"probe,omitempty" toml:"probe,omitempty"`                                        // warn when nothing answers on the connect port after forwarding
 }
 
 // ExternalPortEffective returns the external (listen) port
@@ -37,171 +52,1107 @@ func (p Port) InternalPortEffective() int {
 	return p.ExternalPortEffective()
 }
 
-// FirewallMode returns the firewall configuration mode
+// FirewallMode returns the firewall configuration mode: "local", "full", or the
+// firewall_remote_ip list (validation keeps the two from being set together)
 func (p Port) FirewallMode() string {
+	if p.FirewallRemote != "" {
+		if entries, err := parseFirewallRemoteIPs(p.FirewallRemote); err == nil {
+			return strings.Join(entries, ",")
+		}
+		return p.FirewallRemote
+	}
 	return p.Firewall
 }
 
 // ShouldManageFirewall returns true if automatic firewall management is requested
 func (p Port) ShouldManageFirewall() bool {
-	return p.Firewall == "local" || p.Firewall == "full"
+	return p.Firewall == "local" || p.Firewall == "full" || p.FirewallRemote != ""
+}
+
+// FirewallDirection returns which rules the port gets: "in", "out" or "both"
+func (p Port) FirewallDirection() string {
+	if p.FirewallDir == "" {
+		return "in"
+	}
+	return p.FirewallDir
+}
+
+// ProtocolEffective returns the forwarded protocol, "tcp" or "udp"
+func (p Port) ProtocolEffective() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// IsUDP returns true for ports relayed by the service itself rather than netsh portproxy
+func (p Port) IsUDP() bool {
+	return p.ProtocolEffective() == "udp"
+}
+
+// IsEnabled returns true unless the port is switched off with "enabled": false
+func (p Port) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
 }
 
 type Instance struct {
-	Name    string `json:"name"`
-	Comment string `json:"comment,omitempty"`
-	Ports   []Port `json:"ports"`
+	Name                string       `json:"name" yaml:"name" toml:"name"`
+	Aliases             []string     `json:"aliases,omitempty" yaml:"aliases,omitempty" toml:"aliases,omitempty"` // other distro names this instance may be registered as, e.g. ["Ubuntu-22.04"]
+	Comment             string       `json:"comment,omitempty" yaml:"comment,omitempty" toml:"comment,omitempty"`
+	Tags                []string     `json:"tags,omitempty" yaml:"tags,omitempty" toml:"tags,omitempty"`                                                    // free-form labels for --tag, e.g. ["web", "team-x"]
+	InterfacePriority   []string     `json:"interface_priority,omitempty" yaml:"interface_priority,omitempty" toml:"interface_priority,omitempty"`          // preferred interfaces for IP selection, e.g. ["eth0", "eth1"]
+	BootProbe           bool         `json:"boot_probe,omitempty" yaml:"boot_probe,omitempty" toml:"boot_probe,omitempty"`                                  // when the instance first appears, wait for its IP to be routable
+	StartupDelaySeconds int          `json:"startup_delay_seconds,omitempty" yaml:"startup_delay_seconds,omitempty" toml:"startup_delay_seconds,omitempty"` // don't forward until the instance has been running this long
+	AddressFamily       string       `json:"address_family,omitempty" yaml:"address_family,omitempty" toml:"address_family,omitempty"`                      // "ipv4" or "ipv6" to forward to that kind of instance IP (default: first routable)
+	IP                  string       `json:"ip,omitempty" yaml:"ip,omitempty" toml:"ip,omitempty"`                                                          // pinned instance IP, used instead of asking wsl (static IP or mirrored networking)
+	Defaults            PortDefaults `json:"defaults,omitempty" yaml:"defaults,omitempty" toml:"defaults,omitempty"`                                        // port settings for this instance's ports that don't set their own
+	Ports               []Port       `json:"ports" yaml:"ports" toml:"ports"`
 }
 
 type Config struct {
-	CheckIntervalSeconds int        `json:"check_interval_seconds"`
-	Instances            []Instance `json:"instances"`
+	CheckIntervalSeconds  int          `json:"check_interval_seconds" yaml:"check_interval_seconds" toml:"check_interval_seconds"`
+	LogDedupSeconds       int          `json:"log_dedup_seconds,omitempty" yaml:"log_dedup_seconds,omitempty" toml:"log_dedup_seconds,omitempty"`                               // suppress identical log lines within this window (0 = off)
+	Transactional         bool         `json:"transactional,omitempty" yaml:"transactional,omitempty" toml:"transactional,omitempty"`                                           // roll back a forward if its firewall rule can't be created
+	ManagedInstances      []string     `json:"managed_instances,omitempty" yaml:"managed_instances,omitempty" toml:"managed_instances,omitempty"`                               // if set, only these distros are ever touched
+	SyslogAddress         string       `json:"syslog_address,omitempty" yaml:"syslog_address,omitempty" toml:"syslog_address,omitempty"`                                        // also send logs to this RFC 5424 collector, e.g. "udp://logs:514"
+	LogFile               string       `json:"log_file,omitempty" yaml:"log_file,omitempty" toml:"log_file,omitempty"`                                                          // also append logs to this file
+	LogMaxSizeMB          int          `json:"log_max_size_mb,omitempty" yaml:"log_max_size_mb,omitempty" toml:"log_max_size_mb,omitempty"`                                     // rotate log_file at this size (0 = never)
+	LogMaxBackups         int          `json:"log_max_backups,omitempty" yaml:"log_max_backups,omitempty" toml:"log_max_backups,omitempty"`                                     // rotated log files to keep, default 3
+	StrictPortConflicts   bool         `json:"strict_port_conflicts,omitempty" yaml:"strict_port_conflicts,omitempty" toml:"strict_port_conflicts,omitempty"`                   // reject duplicate external ports at validation
+	FallbackConfig        string       `json:"fallback_config,omitempty" yaml:"fallback_config,omitempty" toml:"fallback_config,omitempty"`                                     // known-good config used while this one is invalid
+	EmptyReadingGrace     int          `json:"empty_reading_grace,omitempty" yaml:"empty_reading_grace,omitempty" toml:"empty_reading_grace,omitempty"`                         // checks an empty `wsl --list --running` must persist before forwards are removed
+	PreProvisionFirewall  bool         `json:"pre_provision_firewall,omitempty" yaml:"pre_provision_firewall,omitempty" toml:"pre_provision_firewall,omitempty"`                // keep firewall rules for every configured port, running or not
+	AdditiveOnly          bool         `json:"additive_only,omitempty" yaml:"additive_only,omitempty" toml:"additive_only,omitempty"`                                           // never remove forwards, only add and update them
+	ReconcileRegistry     bool         `json:"reconcile_registry_on_start,omitempty" yaml:"reconcile_registry_on_start,omitempty" toml:"reconcile_registry_on_start,omitempty"` // make the registry match live state at startup
+	ExpandEnv             bool         `json:"expand_env,omitempty" yaml:"expand_env,omitempty" toml:"expand_env,omitempty"`                                                    // expand ${NAME} in string values from --var or the environment
+	AdaptiveInterval      bool         `json:"adaptive_interval,omitempty" yaml:"adaptive_interval,omitempty" toml:"adaptive_interval,omitempty"`                               // poll faster after changes, slower while stable
+	MinIntervalSeconds    int          `json:"min_interval,omitempty" yaml:"min_interval,omitempty" toml:"min_interval,omitempty"`                                              // adaptive interval floor, default 1
+	MaxIntervalSeconds    int          `json:"max_interval,omitempty" yaml:"max_interval,omitempty" toml:"max_interval,omitempty"`                                              // adaptive interval ceiling, default check_interval_seconds
+	CommandTimeoutSeconds int          `json:"command_timeout_seconds,omitempty" yaml:"command_timeout_seconds,omitempty" toml:"command_timeout_seconds,omitempty"`             // kill netsh/wsl/powershell commands that run longer, default 30
+	Defaults              PortDefaults `json:"defaults,omitempty" yaml:"defaults,omitempty" toml:"defaults,omitempty"`                                                          // port settings for every port that doesn't set its own
+	Instances             []Instance   `json:"instances" yaml:"instances" toml:"instances"`
+}
+
+// IsManagedInstance returns true if the instance may be managed under the
+// managed_instances allowlist (an empty allowlist permits every instance). Names
+// match regardless of case, like instance names do.
+func (c *Config) IsManagedInstance(name string) bool {
+	if len(c.ManagedInstances) == 0 {
+		return true
+	}
+	for _, managed := range c.ManagedInstances {
+		if strings.EqualFold(managed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// configuresExternalPort returns true if any instance claims the external (TCP) port
+func (c *Config) configuresExternalPort(port int) bool {
+	for _, instance := range c.Instances {
+		for _, configPort := range instance.Ports {
+			if configPort.ExternalPortEffective() == port && !configPort.IsUDP() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ManagedConfig returns a view of the config restricted to allowlisted instances.
+// Excluded instances are invisible to reconcile, so their ports are neither forwarded
+// nor treated as ours when deciding what to remove.
+func (c *Config) ManagedConfig() *Config {
+	if len(c.ManagedInstances) == 0 {
+		return c
+	}
+	managed := *c
+	managed.Instances = nil
+	for _, instance := range c.Instances {
+		if c.IsManagedInstance(instance.Name) {
+			managed.Instances = append(managed.Instances, instance)
+		}
+	}
+	return &managed
+}
+
+// HasAnyTag returns true if the instance carries at least one of the given tags
+func (instance Instance) HasAnyTag(tags []string) bool {
+	for _, tag := range tags {
+		for _, own := range instance.Tags {
+			if strings.EqualFold(own, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TaggedConfig returns a view of the config restricted to instances carrying any of
+// the --tag filters. Like ManagedConfig, the rest are left alone rather than removed.
+func (c *Config) TaggedConfig(tags []string) *Config {
+	if len(tags) == 0 {
+		return c
+	}
+	tagged := *c
+	tagged.Instances = nil
+	for _, instance := range c.Instances {
+		if instance.HasAnyTag(tags) {
+			tagged.Instances = append(tagged.Instances, instance)
+		}
+	}
+	return &tagged
+}
+
+// describeTaggedInstances lists the instances a tag filter selected, with their tags
+func describeTaggedInstances(tagged *Config) string {
+	if len(tagged.Instances) == 0 {
+		return "no instance has these tags"
+	}
+	var names []string
+	for _, instance := range tagged.Instances {
+		names = append(names, fmt.Sprintf("%s [%s]", instance.Name, strings.Join(instance.Tags, ", ")))
+	}
+	return strings.Join(names, "; ")
 }
 
 // Runtime state structures
 type PortMapping struct {
-	ExternalPort int // Listen port on Windows host
-	InternalPort int // Target port in WSL instance
-	TargetIP     string
-	Instance     string
-	Comment      string
-	FirewallMode string // "local", "full", or empty
+	ExternalPort    int // Listen port on Windows host
+	InternalPort    int // Target port in WSL instance
+	TargetIP        string
+	Instance        string
+	Comment         string
+	FirewallMode    string // "local", "full", a firewall_remote_ip list, or empty
+	ListenAddress   string // Listen address as reported by netsh (IPv6 may include %zone)
+	QosThrottleKbps int    // QoS throttle rate, 0 if unthrottled
+	UPnP            bool   // also forwarded by the router via UPnP
+	FirewallDir     string // firewall_direction: "in", "out" or "both"
+	Protocol        string // "tcp" or "udp"
+	Probe           bool   // dial the connect port after forwarding, warning if nothing answers
 }
 
 type ServiceState struct {
 	config           *Config
 	configFile       string
-	runningInstances map[string]string   // instance name -> IP address
-	currentMappings  map[int]PortMapping // port -> mapping info
-	registryManager  *RegistryManager    // Windows registry tracking
+	runningInstances map[string]string      // instance name -> IP address
+	currentMappings  map[int]PortMapping    // port -> mapping info
+	registryManager  *RegistryManager       // Windows registry tracking
+	explain          bool                   // print a per-port decision log each reconcile
+	allowComments    bool                   // strip JSONC comments from the config file
+	strict           bool                   // don't forward ports covered by a firewall block rule
+	noFirewall       bool                   // never create firewall rules (applied externally, see export-firewall)
+	dryRun           bool                   // print the commands that would change system state instead of running them
+	tags             []string               // --tag filters, empty to manage every instance
+	logDedup         *LogDeduplicator       // suppresses repeated warnings (log_dedup_seconds)
+	pendingWrites    []pendingRegistryWrite // registry writes to retry next reconcile
+	syslogAddress    string                 // currently configured syslog_address
+	syslogWriter     *SyslogWriter          // remote log forwarding, nil if disabled
+	logFilePath      string                 // currently configured log_file
+	logFileWriter    *RotatingFileWriter    // file logging, nil if disabled
+	qosPolicies      map[int]int            // port -> qos_throttle_kbps currently applied
+	fallbackPath     string                 // fallback_config of the last valid primary config
+	fallbackActive   bool                   // s.config came from the fallback config
+	drained          bool                   // forwarding paused by the drain command
+	firstSeen        map[string]time.Time   // instance name -> when it was first seen running (startup_delay_seconds)
+	sawRunning       bool                   // a previous pass saw running distros (empty_reading_grace)
+	emptyReadings    int                    // consecutive passes that saw no running distros
+	ipLookupFailures map[string]int         // instance name -> consecutive passes its IP lookup failed
+	passes           int                    // service loop passes run so far
+	errorsLogged     int                    // "Error" messages logged (--max-runtime exit status)
+	warningsLogged   int                    // "Warning" messages logged (--max-runtime exit status)
+	livePorts        map[int]string         // port -> forward last announced as reachable
+	interval         time.Duration          // current adaptive_interval wait, 0 until the first pass
+	upnpGateway      *upnpGateway           // router discovered for upnp ports, nil until needed
+	upnpMappings     map[int]string         // port -> host IP the router forwards it to (upnp)
+	provisionedRules map[string]bool        // firewall rules created by pre_provision_firewall
+	udpRelays        map[int]*UDPRelay      // port -> running relay for a udp port
+	removeOnExit     bool                   // remove what this run created when it exits (--cleanup-on-exit)
+	createdMappings  map[int]PortMapping    // port -> forward this run installed and still has
+	createdRules     map[string]bool        // firewall rules this run created and still has
+	legacyChecked    map[string]bool        // rules whose legacy-named predecessor is known to be gone
+	batchedNetsh     map[string]int         // portproxy commands a netsh -f batch already ran this pass
+	runner           CommandRunner          // runs netsh and wsl, nil to run them for real
+	configChanged    chan struct{}          // wakes the main loop when the watched config changes, nil if unwatched
+	configStale      atomic.Bool            // the watched config changed since it was last loaded
+	stopConfigWatch  context.CancelFunc     // stops the config watcher, nil if unwatched
 }
 
-// decodeCommandOutput converts Windows command output from UTF-16LE to UTF-8 if needed
-func decodeCommandOutput(output []byte) (string, error) {
-	if len(output) == 0 {
-		return "", nil
+// pendingRegistryWrite is a registry tracking write that failed and will be retried,
+// so a briefly locked registry never blocks forwarding but tracking still catches up
+type pendingRegistryWrite struct {
+	key         string // identifies the tracked resource, e.g. "proxy:8080" or "fw:<rule name>"
+	description string
+	apply       func(rm *RegistryManager) error
+}
+
+// ReconcileSnapshot captures everything a single reconcile pass reads so that
+// all sub-steps see one consistent view, even if WSL state changes mid-pass
+type ReconcileSnapshot struct {
+	Config          *Config
+	InstanceIPs     map[string]string   // instance name -> IP address (running, configured instances only)
+	Held            map[string]string   // running instances left as-is this pass -> why (e.g. IP lookup failed)
+	RunningDistros  int                 // number of distros wsl reported running, configured or not
+	CurrentMappings map[int]PortMapping // port -> mapping currently installed in netsh
+	CandidateIPs    map[string][]string // instance name -> failover candidates, primary first (connect_fallback only)
+	BlockedPorts    map[int]string      // port -> name of an enabled inbound firewall block rule
+	SkipBlocked     bool                // leave blocked ports out of the desired state (--strict)
+	ListenAddresses map[string]string   // listen_address token -> host IP it resolved to this pass
+}
+
+// ReconcileResult summarises what a service loop pass did
+type ReconcileResult struct {
+	Changed  bool // forwards were changed, or a change is still settling
+	Failures int  // operations that failed this pass
+}
+
+// newReconcileSnapshot builds a snapshot from the given state, copying the maps
+// so later mutations by the caller don't leak into an in-progress reconcile
+func newReconcileSnapshot(config *Config, instanceIPs map[string]string, currentMappings map[int]PortMapping) *ReconcileSnapshot {
+	snapshot := &ReconcileSnapshot{
+		Config:          config,
+		InstanceIPs:     make(map[string]string, len(instanceIPs)),
+		CurrentMappings: make(map[int]PortMapping, len(currentMappings)),
 	}
+	for name, ip := range instanceIPs {
+		snapshot.InstanceIPs[name] = ip
+	}
+	for port, mapping := range currentMappings {
+		snapshot.CurrentMappings[port] = mapping
+	}
+	return snapshot
+}
 
-	// Handle UTF-16 encoded output from Windows commands
-	var outputStr string
-	if len(output) > 0 && len(output)%2 == 0 {
-		// Check if this looks like UTF-16 (every other byte is null or BOM present)
-		isUTF16 := false
-		
-		// Check for UTF-16LE BOM
-		if len(output) >= 2 && output[0] == 0xFF && output[1] == 0xFE {
-			isUTF16 = true
-			output = output[2:] // Skip BOM
-		} else {
-			// Check for interleaved null bytes (UTF-16LE pattern)
-			for i := 1; i < len(output) && i < 20; i += 2 {
-				if output[i] == 0 {
-					isUTF16 = true
-					break
+// DesiredMappings computes the netsh portproxy (TCP) mappings that should exist for
+// this snapshot. Instances are processed in config file order; the first instance to
+// claim an external port wins and later claimants are reported in the conflicts map.
+func (snap *ReconcileSnapshot) DesiredMappings() (map[int]PortMapping, map[int][]string) {
+	return snap.desiredMappings("tcp")
+}
+
+// DesiredUDPMappings computes the udp ports that should be relayed, with the same
+// first-instance-wins rule. They are separate from the TCP mappings, so a port can be
+// forwarded over both protocols.
+func (snap *ReconcileSnapshot) DesiredUDPMappings() map[int]PortMapping {
+	desiredMappings, _ := snap.desiredMappings("udp")
+	return desiredMappings
+}
+
+// desiredMappings computes the desired mappings of the configured ports using protocol
+func (snap *ReconcileSnapshot) desiredMappings(protocol string) (map[int]PortMapping, map[int][]string) {
+	desiredMappings := make(map[int]PortMapping)
+	conflictedPorts := make(map[int][]string) // track conflicts for logging
+
+	for _, instance := range snap.Config.Instances {
+		ip, isRunning := snap.InstanceIPs[instance.Name]
+		if !isRunning {
+			continue
+		}
+
+		for _, port := range instance.Ports {
+			externalPort := port.ExternalPortEffective()
+			if port.ProtocolEffective() != protocol || !port.IsEnabled() {
+				continue
+			}
+
+			// Docker Desktop's forward on this port is not ours to replace
+			if protocol == "tcp" && snap.isDockerOwned(externalPort) {
+				continue
+			}
+
+			// Forwarding an explicitly blocked port is pointless in strict mode
+			if _, blocked := snap.BlockedPorts[externalPort]; blocked && snap.SkipBlocked && protocol == "tcp" {
+				continue
+			}
+
+			// Check if this external port is already claimed
+			if existing, exists := desiredMappings[externalPort]; exists {
+				if conflictedPorts[externalPort] == nil {
+					conflictedPorts[externalPort] = []string{existing.Instance}
 				}
+				conflictedPorts[externalPort] = append(conflictedPorts[externalPort], instance.Name)
+				continue
+			}
+
+			listenAddress, resolved := snap.ListenAddressFor(port)
+			if !resolved {
+				continue
+			}
+
+			desiredMappings[externalPort] = PortMapping{
+				ExternalPort:    externalPort,
+				InternalPort:    port.InternalPortEffective(),
+				TargetIP:        ip,
+				Instance:        instance.Name,
+				Comment:         port.Comment,
+				FirewallMode:    port.FirewallMode(),
+				QosThrottleKbps: port.QosThrottleKbps,
+				ListenAddress:   listenAddress,
+				UPnP:            port.UPnP,
+				FirewallDir:     port.FirewallDirection(),
+				Protocol:        protocol,
+				Probe:           port.Probe,
 			}
 		}
+	}
 
-		if isUTF16 {
-			// Convert UTF-16LE to UTF-8
-			u16s := make([]uint16, len(output)/2)
-			for i := 0; i < len(u16s); i++ {
+	return desiredMappings, conflictedPorts
+}
+
+// ShouldRemove returns true if the installed forward on port must go: nothing desires
+// it, a managed instance claims the port, and no claimant is merely held (running, but
+// not forwarded this pass). Forwards are only bound while their instance is running,
+// so this is what releases a listen port the pass after an instance stops.
+func (snap *ReconcileSnapshot) ShouldRemove(port int, desired map[int]PortMapping) bool {
+	if _, needed := desired[port]; needed {
+		return false
+	}
+	if _, exists := snap.CurrentMappings[port]; !exists || snap.isDockerOwned(port) {
+		return false
+	}
+
+	claimed := false
+	for _, instance := range snap.Config.Instances {
+		for _, configPort := range instance.Ports {
+			if configPort.ExternalPortEffective() != port || configPort.IsUDP() {
+				continue
+			}
+			if _, held := snap.Held[instance.Name]; held {
+				return false
+			}
+			claimed = true
+		}
+	}
+	return claimed
+}
+
+// mappingNeedsUpdate returns true if an installed forward differs from the desired one.
+// A connect port of 0 means netsh didn't show one, so it is never taken as matching.
+func mappingNeedsUpdate(current, desired PortMapping) bool {
+	return current.InternalPort == 0 ||
+		current.TargetIP != desired.TargetIP ||
+		current.InternalPort != desired.InternalPort ||
+		!sameListenAddress(current.ListenAddress, desired.ListenAddress)
+}
+
+// ExplainPort describes why reconcile will (or won't) act on one configured port
+func (snap *ReconcileSnapshot) ExplainPort(instanceName string, port Port, desired map[int]PortMapping) string {
+	externalPort := port.ExternalPortEffective()
+	internalPort := port.InternalPortEffective()
+	current, hasCurrent := snap.CurrentMappings[externalPort]
+
+	if !port.IsEnabled() {
+		if snap.ShouldRemove(externalPort, desired) && !snap.Config.AdditiveOnly {
+			return fmt.Sprintf("disabled, existing forward to %s:%d will be removed", current.TargetIP, current.InternalPort)
+		}
+		return "disabled, not forwarded"
+	}
+
+	ip, isRunning := snap.InstanceIPs[instanceName]
+	if reason, held := snap.Held[instanceName]; held {
+		if _, claimed := desired[externalPort]; hasCurrent && !claimed {
+			return fmt.Sprintf("instance running but %s, keeping forward to %s:%d", reason, current.TargetIP, current.InternalPort)
+		}
+		return fmt.Sprintf("instance running but %s, nothing to forward yet", reason)
+	}
+	if !isRunning {
+		if snap.ShouldRemove(externalPort, desired) {
+			if snap.Config.AdditiveOnly {
+				return fmt.Sprintf("instance not running, existing forward to %s:%d kept (additive_only)", current.TargetIP, current.InternalPort)
+			}
+			return fmt.Sprintf("instance not running, existing forward to %s:%d will be removed", current.TargetIP, current.InternalPort)
+		}
+		return "instance not running, nothing to forward"
+	}
+
+	if port.IsUDP() {
+		return fmt.Sprintf("udp, relayed by the service -> %s:%d", ip, internalPort)
+	}
+
+	if snap.isDockerOwned(externalPort) {
+		return fmt.Sprintf("forwarded to Docker Desktop (%s:%d), left alone", current.TargetIP, current.InternalPort)
+	}
+
+	if ruleName, blocked := snap.BlockedPorts[externalPort]; blocked && snap.SkipBlocked {
+		return fmt.Sprintf("blocked by firewall rule '%s', skipped (--strict)", ruleName)
+	}
+
+	listenAddress, resolved := snap.ListenAddressFor(port)
+	if !resolved {
+		return fmt.Sprintf("listen_address '%s' couldn't be resolved, not forwarded", port.ListenAddress)
+	}
+
+	if winner, ok := desired[externalPort]; ok && winner.Instance != instanceName {
+		return fmt.Sprintf("lost conflict to instance %s (earlier in config)", winner.Instance)
+	} else if ok {
+		ip = winner.TargetIP // may differ from the primary IP with connect_fallback
+	}
+
+	switch {
+	case !hasCurrent:
+		return fmt.Sprintf("not forwarded yet, will add -> %s:%d", ip, internalPort)
+	case current.TargetIP != ip:
+		return fmt.Sprintf("IP changed from %s to %s, will update", current.TargetIP, ip)
+	case current.InternalPort == 0:
+		return fmt.Sprintf("connect port unknown (netsh showed none), will update -> %s:%d", ip, internalPort)
+	case current.InternalPort != internalPort:
+		return fmt.Sprintf("internal port changed from %d to %d, will update", current.InternalPort, internalPort)
+	case !sameListenAddress(current.ListenAddress, listenAddress):
+		return fmt.Sprintf("listen address changed from %s to %s, will rebind", current.ListenAddress, listenAddress)
+	default:
+		return fmt.Sprintf("already in sync -> %s:%d", ip, internalPort)
+	}
+}
+
+// utf16SamplePairs is how many leading byte pairs decodeCommandOutput inspects when
+// output has no BOM
+const utf16SamplePairs = 16
+
+// decodeCommandOutput converts Windows command output to UTF-8. UTF-16 (LE or BE) is
+// recognised by its BOM, or without one by a consistent NUL high byte in the leading
+// pairs, as wsl.exe writes; a UTF-8 BOM is dropped.
+func decodeCommandOutput(output []byte) (string, error) {
+	if len(output) == 0 {
+		return "", nil
+	}
+
+	raw := output
+	encoding := "UTF-8"
+	switch {
+	case bytes.HasPrefix(output, []byte{0xEF, 0xBB, 0xBF}):
+		output = output[3:] // Skip UTF-8 BOM
+	case len(output)%2 != 0:
+		// UTF-16 output always has an even length
+	case output[0] == 0xFF && output[1] == 0xFE:
+		encoding = "UTF-16LE"
+		output = output[2:] // Skip BOM
+	case output[0] == 0xFE && output[1] == 0xFF:
+		encoding = "UTF-16BE"
+		output = output[2:] // Skip BOM
+	default:
+		encoding = guessUTF16ByteOrder(output)
+	}
+
+	var outputStr string
+	switch encoding {
+	case "UTF-16LE", "UTF-16BE":
+		u16s := make([]uint16, len(output)/2)
+		for i := range u16s {
+			if encoding == "UTF-16LE" {
 				u16s[i] = uint16(output[i*2]) | uint16(output[i*2+1])<<8
+			} else {
+				u16s[i] = uint16(output[i*2])<<8 | uint16(output[i*2+1])
 			}
-			runes := utf16.Decode(u16s)
-			outputStr = string(runes)
-		} else {
-			outputStr = string(output)
 		}
-	} else {
+		outputStr = string(utf16.Decode(u16s))
+	default:
 		outputStr = string(output)
 	}
 
+	recordDecode(raw, outputStr, encoding)
 	return outputStr, nil
 }
 
+// guessUTF16ByteOrder returns "UTF-16LE" or "UTF-16BE" if the leading pairs of BOM-less
+// output look like mostly-ASCII UTF-16: more than half have a NUL high byte and none
+// a NUL low byte. A stray NUL in 8-bit output doesn't pass, so it stays "UTF-8".
+func guessUTF16ByteOrder(output []byte) string {
+	pairs := len(output) / 2
+	if pairs > utf16SamplePairs {
+		pairs = utf16SamplePairs
+	}
+
+	evenNULs, oddNULs := 0, 0
+	for i := 0; i < pairs; i++ {
+		if output[i*2] == 0 {
+			evenNULs++
+		}
+		if output[i*2+1] == 0 {
+			oddNULs++
+		}
+	}
+	switch {
+	case evenNULs == 0 && oddNULs*2 > pairs:
+		return "UTF-16LE"
+	case oddNULs == 0 && evenNULs*2 > pairs:
+		return "UTF-16BE"
+	default:
+		return "UTF-8"
+	}
+}
+
 func main() {
-	// Check command line arguments
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		fmt.Println("Usage: wsl2-port-forwarder.exe [--validate] <config-file.json>")
-		fmt.Println("")
-		fmt.Println("Options:")
-		fmt.Println("  --validate    Validate configuration and firewall rules, then exit")
-		fmt.Println("")
-		fmt.Println("Examples:")
-		fmt.Println("  wsl2-port-forwarder.exe wsl2-config.json")
-		fmt.Println("  wsl2-port-forwarder.exe --validate wsl2-config.json")
+	// Make sure emoji status markers display correctly on interactive consoles
+	restoreConsole := setupConsoleOutput()
+	defer restoreConsole()
+
+	// --var definitions apply to every command's config files, so take them out first
+	args, vars, err := extractConfigVars(os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		printUsage()
+		restoreConsole()
 		os.Exit(1)
 	}
+	configVars = vars
+	os.Args = append(os.Args[:1], args...)
 
-	var validateOnly bool
-	var configFile string
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		exitCode := runConfigDiff(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		exitCode := runPlan(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "drift" {
+		exitCode := runDrift(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-firewall" {
+		exitCode := runExportFirewall(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "drain" || os.Args[1] == "resume") {
+		exitCode := runDrain(os.Args[1], os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		exitCode := runSnapshot(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		exitCode := runSetup(os.Args[2:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
 
-	if len(os.Args) == 3 {
-		if os.Args[1] != "--validate" {
-			fmt.Printf("Unknown option: %s\n", os.Args[1])
-			os.Exit(1)
+	// Check command line arguments
+	opts, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		if err != errUsage {
+			fmt.Println(err)
 		}
-		validateOnly = true
-		configFile = os.Args[2]
-	} else {
-		configFile = os.Args[1]
+		printUsage()
+		restoreConsole()
+		os.Exit(1)
 	}
 
-	if validateOnly {
-		os.Exit(validateConfiguration(configFile))
+	validateOnly := opts.ValidateOnly
+	debugLogging = opts.Debug
+	if opts.LogFormat == "json" {
+		jsonLogging = true
+		setLogOutput(os.Stderr)
 	}
 
+	if validateOnly {
+		exitCode := validateConfiguration(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.Cleanup {
+		exitCode := runCleanup(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.Status {
+		exitCode := runStatus(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.Test {
+		exitCode := runSelfTest(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.List {
+		exitCode := runList(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.Audit {
+		exitCode := runRegistryAudit()
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.CleanupRegistry {
+		exitCode := runRegistryCleanup()
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.RemoveFirewallRules {
+		exitCode := runRemoveFirewallRules(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.PrintSchema {
+		exitCode := runPrintSchema(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.InstallService {
+		exitCode := installWindowsService(opts, os.Args[1:])
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.UninstallService {
+		exitCode := uninstallWindowsService()
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+	if opts.RunService {
+		exitCode := runWindowsService(opts)
+		restoreConsole()
+		os.Exit(exitCode)
+	}
+
+	exitCode := runInConsole(opts)
+	restoreConsole()
+	os.Exit(exitCode)
+}
+
+// runInConsole runs the forwarding service until Ctrl+C or SIGTERM
+func runInConsole(opts *CommandLineOptions) int {
+	// Setup graceful shutdown: the signal is handled between passes, so a pass is never
+	// cut off halfway through its netsh and registry changes
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-c
+		close(stop)
+	}()
+
+	return runForwarder(opts, stop)
+}
+
+// runForwarder runs the forwarding service until stop is closed (or --max-runtime
+// passes) and returns the exit status. Console mode stops it on Ctrl+C, the Windows
+// service harness when the SCM asks the service to stop.
+func runForwarder(opts *CommandLineOptions, stop <-chan struct{}) int {
+	configFile := opts.ConfigFile
+
 	// Initialize service state
 	service := &ServiceState{
 		configFile:       configFile,
 		runningInstances: make(map[string]string),
 		currentMappings:  make(map[int]PortMapping),
+		explain:          opts.Explain,
+		allowComments:    opts.AllowComments,
+		strict:           opts.Strict,
+		noFirewall:       opts.NoFirewall,
+		dryRun:           opts.DryRun,
+		removeOnExit:     opts.CleanupOnExit,
+		tags:             opts.Tags,
 	}
-	
+
 	// Initialize registry manager for resource tracking
 	if rm, err := NewRegistryManager(); err != nil {
 		log.Printf("Warning: Failed to initialize registry manager: %v", err)
 		fmt.Println("Registry tracking disabled - resources won't be tracked for cleanup")
 	} else {
 		service.registryManager = rm
-		defer rm.Close()
 	}
 
-	// Setup graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("\nReceived shutdown signal. Exiting gracefully...")
-		os.Exit(0)
-	}()
+	// Headless, the Event Log is where an administrator will look
+	if opts.EventLog {
+		if closeEventLog, err := openEventLog(); err != nil {
+			log.Printf("Warning: Windows Event Log disabled: %v", err)
+		} else {
+			defer closeEventLog()
+			service.applyLogOutput()
+		}
+	}
 
 	// Validate initial setup
 	if err := service.validateSetup(); err != nil {
-		log.Fatalf("Setup validation failed: %v", err)
+		log.Printf("Setup validation failed: %v", err)
+		reportEvent("error", "log", fmt.Sprintf("Setup validation failed: %v", err))
+		return 1
 	}
 
 	// Load and validate initial configuration
 	if err := service.loadConfiguration(); err != nil {
-		log.Fatalf("Failed to load initial configuration: %v", err)
+		log.Printf("Failed to load initial configuration: %v", err)
+		reportEvent("error", "log", fmt.Sprintf("Failed to load initial configuration: %v", err))
+		return 1
 	}
+	service.configureLogFile(service.config)
+	service.configureSyslog(service.config.SyslogAddress)
+	service.startConfigWatch()
 
-	fmt.Println("WSL2 Port Forwarding Service")
-	fmt.Println("============================")
-	fmt.Printf("Config file: %s\n", configFile)
-	fmt.Printf("Check interval: %d seconds\n", service.config.CheckIntervalSeconds)
-	fmt.Printf("Configured instances: %d\n", len(service.config.Instances))
-	fmt.Println()
+	say("WSL2 Port Forwarding Service")
+	say("============================")
+	consoleEvent("info", "service_start", EventFields{}, "Config file: %s", configFile)
+	if service.fallbackActive {
+		consoleEvent("warning", "fallback_config", EventFields{}, "⚠️  FALLBACK CONFIG ACTIVE: %s", service.fallbackPath)
+	}
+	say("Check interval: %d seconds", service.config.CheckIntervalSeconds)
+	if service.config.AdaptiveInterval {
+		minInterval, maxInterval := service.config.adaptiveBounds()
+		say("Adaptive interval: %d-%d seconds", int(minInterval/time.Second), int(maxInterval/time.Second))
+	}
+	say("Configured instances: %d", len(service.config.Instances))
+	if service.dryRun {
+		say("Dry run: changes are printed, not applied")
+	}
+	if len(service.tags) > 0 {
+		say("Tag filter: %s (%s)", strings.Join(service.tags, ", "),
+			describeTaggedInstances(service.config.TaggedConfig(service.tags)))
+	}
+	if service.config.ReconcileRegistry {
+		service.reconcileRegistryOnStart()
+	}
+	service.printStartupInventory(opts.StartupAudit)
+	service.warnLocalhostForwarding()
+	var deadline time.Time
+	if opts.MaxRuntime > 0 {
+		deadline = time.Now().Add(opts.MaxRuntime)
+		say("Max runtime: %s", opts.MaxRuntime)
+	}
+	say("")
 
 	// Main service loop
 	for {
-		service.serviceLoop()
-		fmt.Printf("Waiting %d seconds...\n\n", service.config.CheckIntervalSeconds)
-		time.Sleep(time.Duration(service.config.CheckIntervalSeconds) * time.Second)
+		result := service.serviceLoop()
+		interval := service.nextInterval(result)
+
+		// Bounded runs stop at the deadline rather than starting a pass past it
+		if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+			time.Sleep(time.Until(deadline))
+			exitCode := service.runExitCode()
+			consoleEvent("info", "service_stop", EventFields{}, "Max runtime reached after %d checks, exiting (status %d)", service.passes, exitCode)
+			service.shutdown()
+			return exitCode
+		}
+
+		say("Waiting %d seconds...\n", int(interval/time.Second))
+		select {
+		case <-stop:
+			consoleEvent("info", "service_stop", EventFields{}, "\nReceived shutdown signal. Exiting gracefully...")
+			service.shutdown()
+			return 0
+		case <-service.configChanged:
+			say("Config file changed, reloading...")
+		case <-time.After(interval):
+		}
 	}
 }
 
+// shutdown releases what the service holds before it exits: the config watcher, the
+// forwards it created (with --cleanup-on-exit), the UDP relays and the registry handle
+func (s *ServiceState) shutdown() {
+	if s.stopConfigWatch != nil {
+		s.stopConfigWatch()
+	}
+	if s.removeOnExit {
+		s.cleanupOnExit(cleanupOnExitTimeout)
+	}
+	s.stopUDPRelays()
+	if s.registryManager != nil {
+		if err := s.registryManager.Close(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		s.registryManager = nil
+	}
+}
+
+// CommandLineOptions holds the parsed command line
+type CommandLineOptions struct {
+	ValidateOnly        bool
+	Explain             bool
+	AllowComments       bool
+	Strict              bool
+	ConfigCheckOnly     bool
+	NoFirewall          bool
+	DryRun              bool // print netsh/firewall changes instead of making them
+	Cleanup             bool // remove everything the forwarder manages, then exit
+	CleanupOnExit       bool // on shutdown, remove the forwards and rules this run created
+	Status              bool // print the live state of every configured port as JSON, then exit
+	Debug               bool
+	MaxRuntime          time.Duration // exit after this long; 0 runs until stopped
+	Test                bool          // dial every forwarded port through the port proxy, then exit
+	TestTimeout         time.Duration // --test dial timeout; 0 uses defaultSelfTestTimeout
+	StartupAudit        bool
+	Deep                bool      // --validate also checks that connect ports are listening
+	Tags                []string  // --tag filters; only instances with one of these are managed
+	LogFormat           string    // "text" (default) or "json"
+	InstallService      bool      // register the forwarder with the SCM as a Windows service, then exit
+	UninstallService    bool      // remove the Windows service, then exit
+	RunService          bool      // run under the SCM (the command line --install-service registers)
+	EventLog            bool      // also write important events to the Windows Event Log (implied under the SCM)
+	List                bool      // print the registry-tracked port proxies and firewall rules, then exit
+	JSON                bool      // --list as JSON
+	JSONStyle           jsonStyle // --pretty/--compact for --list --json
+	Audit               bool      // compare the registry tracking with the live system, then exit
+	CleanupRegistry     bool      // remove registry entries whose resources no longer exist, then exit
+	RemoveFirewallRules bool      // delete every firewall rule the forwarder created, then exit
+	Yes                 bool      // --remove-firewall-rules without the confirmation prompt
+	PrintSchema         bool      // print the config file's JSON Schema, then exit
+	ConfigFile          string
+}
+
+// errUsage signals that the command line was malformed and usage should be shown
+var errUsage = errors.New("invalid usage")
+
+// parseCommandLine parses options (which may appear in any order) followed by the config file
+func parseCommandLine(args []string) (*CommandLineOptions, error) {
+	opts := &CommandLineOptions{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--validate":
+			opts.ValidateOnly = true
+		case arg == "--explain":
+			opts.Explain = true
+		case arg == "--allow-comments":
+			opts.AllowComments = true
+		case arg == "--strict":
+			opts.Strict = true
+		case arg == "--config-check-only":
+			opts.ConfigCheckOnly = true
+			opts.ValidateOnly = true
+		case arg == "--no-firewall":
+			opts.NoFirewall = true
+		case arg == "--dry-run":
+			opts.DryRun = true
+		case arg == "--cleanup":
+			opts.Cleanup = true
+		case arg == "--cleanup-on-exit":
+			opts.CleanupOnExit = true
+		case arg == "--status":
+			opts.Status = true
+		case arg == "--debug":
+			opts.Debug = true
+		case arg == "--startup-audit":
+			opts.StartupAudit = true
+		case arg == "--deep":
+			opts.Deep = true
+		case arg == "--install-service":
+			opts.InstallService = true
+		case arg == "--uninstall-service":
+			opts.UninstallService = true
+		case arg == "--run-service":
+			opts.RunService = true
+		case arg == "--eventlog":
+			opts.EventLog = true
+		case arg == "--list":
+			opts.List = true
+		case arg == "--json":
+			opts.JSON = true
+		case isJSONStyleFlag(arg):
+			opts.JSONStyle.set(arg)
+		case arg == "--audit":
+			opts.Audit = true
+		case arg == "--cleanup-registry":
+			opts.CleanupRegistry = true
+		case arg == "--remove-firewall-rules":
+			opts.RemoveFirewallRules = true
+		case arg == "--yes":
+			opts.Yes = true
+		case arg == "--print-schema":
+			opts.PrintSchema = true
+		case arg == "--test":
+			opts.Test = true
+		case arg == "--test-timeout" || strings.HasPrefix(arg, "--test-timeout="):
+			value, hasValue := strings.CutPrefix(arg, "--test-timeout=")
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("--test-timeout requires a duration, e.g. 5s")
+				}
+				i++
+				value = args[i]
+			}
+			testTimeout, err := time.ParseDuration(value)
+			if err != nil || testTimeout <= 0 {
+				return nil, fmt.Errorf("Invalid --test-timeout duration: %s", value)
+			}
+			opts.TestTimeout = testTimeout
+		case arg == "--max-runtime" || strings.HasPrefix(arg, "--max-runtime="):
+			value, hasValue := strings.CutPrefix(arg, "--max-runtime=")
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("--max-runtime requires a duration, e.g. 30s")
+				}
+				i++
+				value = args[i]
+			}
+			maxRuntime, err := time.ParseDuration(value)
+			if err != nil || maxRuntime <= 0 {
+				return nil, fmt.Errorf("Invalid --max-runtime duration: %s", value)
+			}
+			opts.MaxRuntime = maxRuntime
+		case arg == "--tag" || strings.HasPrefix(arg, "--tag="):
+			value, hasValue := strings.CutPrefix(arg, "--tag=")
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("--tag requires a tag name")
+				}
+				i++
+				value = args[i]
+			}
+			if strings.TrimSpace(value) == "" {
+				return nil, fmt.Errorf("--tag requires a tag name")
+			}
+			opts.Tags = append(opts.Tags, value)
+		case arg == "--log-format" || strings.HasPrefix(arg, "--log-format="):
+			value, hasValue := strings.CutPrefix(arg, "--log-format=")
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("--log-format requires text or json")
+				}
+				i++
+				value = args[i]
+			}
+			if value != "text" && value != "json" {
+				return nil, fmt.Errorf("Invalid --log-format: %s (must be text or json)", value)
+			}
+			opts.LogFormat = value
+		case strings.HasPrefix(arg, "--"):
+			return nil, fmt.Errorf("Unknown option: %s", arg)
+		case opts.ConfigFile == "":
+			opts.ConfigFile = arg
+		default:
+			return nil, errUsage
+		}
+	}
+
+	serviceModes := 0
+	for _, set := range []bool{opts.InstallService, opts.UninstallService, opts.RunService} {
+		if set {
+			serviceModes++
+		}
+	}
+	if serviceModes > 1 {
+		return nil, fmt.Errorf("--install-service, --uninstall-service and --run-service can't be combined")
+	}
+	if serviceModes == 1 && (opts.ValidateOnly || opts.Cleanup || opts.Status) {
+		return nil, fmt.Errorf("Windows service options can't be combined with --validate, --cleanup or --status")
+	}
+
+	registryModes := 0
+	for _, set := range []bool{opts.List, opts.Audit, opts.CleanupRegistry, opts.RemoveFirewallRules, opts.PrintSchema} {
+		if set {
+			registryModes++
+		}
+	}
+	if registryModes > 0 && (registryModes > 1 || opts.ValidateOnly || opts.Cleanup || opts.Status || serviceModes > 0) {
+		return nil, fmt.Errorf("--list, --audit, --cleanup-registry, --remove-firewall-rules and --print-schema can't be combined with each other, --validate, --cleanup, --status or the Windows service options")
+	}
+	if opts.Yes && !opts.RemoveFirewallRules {
+		return nil, fmt.Errorf("--yes requires --remove-firewall-rules")
+	}
+	if opts.JSON && !opts.List {
+		return nil, fmt.Errorf("--json requires --list (see --status for the live state as JSON)")
+	}
+
+	// The service to remove is found by name, the registry modes (and
+	// --remove-firewall-rules) only look at the registry and the live system, and
+	// --print-schema describes config files in general, so none of them needs one
+	if opts.ConfigFile == "" && !opts.UninstallService && registryModes == 0 {
+		return nil, errUsage
+	}
+	if opts.Deep && (!opts.ValidateOnly || opts.ConfigCheckOnly) {
+		return nil, fmt.Errorf("--deep requires --validate (and can't be combined with --config-check-only)")
+	}
+	if opts.Cleanup && opts.ValidateOnly {
+		return nil, fmt.Errorf("--cleanup can't be combined with --validate")
+	}
+	if opts.Status && (opts.ValidateOnly || opts.Cleanup) {
+		return nil, fmt.Errorf("--status can't be combined with --validate or --cleanup")
+	}
+	if opts.Test && (opts.ValidateOnly || opts.Cleanup || opts.Status || registryModes > 0 || serviceModes > 0) {
+		return nil, fmt.Errorf("--test can't be combined with --validate, --cleanup, --status, the registry modes or the Windows service options")
+	}
+	if opts.TestTimeout != 0 && !opts.Test {
+		return nil, fmt.Errorf("--test-timeout requires --test")
+	}
+
+	return opts, nil
+}
+
+// printUsage prints command line help
+func printUsage() {
+	fmt.Println("Usage: wsl2-port-forwarder.exe [options] <config-file.json>")
+	fmt.Println("       wsl2-port-forwarder.exe setup [--force] [config-file.json]")
+	fmt.Println("       wsl2-port-forwarder.exe diff [--json [--pretty|--compact]] [--allow-comments] <old.json> <new.json>")
+	fmt.Println("       wsl2-port-forwarder.exe plan [--json [--pretty|--compact] | --plan-format plain|tf] [--allow-comments] [--strict] <config-file.json>")
+	fmt.Println("       wsl2-port-forwarder.exe drift [--json [--pretty|--compact]] [--allow-comments] [--strict] <config-file.json>")
+	fmt.Println("       wsl2-port-forwarder.exe drain|resume [--allow-comments] <config-file.json>")
+	fmt.Println("       wsl2-port-forwarder.exe snapshot save [--pretty|--compact] <snapshot.json>")
+	fmt.Println("       wsl2-port-forwarder.exe snapshot restore <snapshot.json>")
+	fmt.Println("       wsl2-port-forwarder.exe export-firewall [--allow-comments] <config-file.json> <script.cmd|script.ps1>")
+	fmt.Println("")
+	fmt.Println("Options:")
+	fmt.Println("  --validate        Validate configuration and firewall rules, then exit")
+	fmt.Println("  --deep            With --validate, also check that each running instance's connect")
+	fmt.Println("                    ports are listening where the forward can reach them (slower)")
+	fmt.Println("  --explain         Explain the reconcile decision for every configured port")
+	fmt.Println("  --allow-comments  Allow // and /* */ comments in the config (implied for .jsonc files)")
+	fmt.Println("  --strict          Skip (and fail validation for) ports covered by a firewall block rule;")
+	fmt.Println("                    with --validate, also fail on duplicate external ports")
+	fmt.Println("  --config-check-only  Validate the config file only, without running netsh/wsl or")
+	fmt.Println("                    touching the registry (safe to run anywhere, e.g. CI)")
+	fmt.Println("  --no-firewall     Never create firewall rules (apply them via export-firewall instead)")
+	fmt.Println("  --dry-run         Print the netsh/firewall commands each check would run, without running them")
+	fmt.Println("  --cleanup         Remove every port proxy, firewall rule and QoS policy the forwarder manages")
+	fmt.Println("                    for the config (and any the registry tracks), then exit")
+	fmt.Println("  --cleanup-on-exit On shutdown, remove the forwards and firewall rules this run created")
+	fmt.Println("  --status          Print each configured instance, its IP and the state of its ports as")
+	fmt.Println("                    JSON (active, missing, wrong, stopped, ...), then exit")
+	fmt.Println("  --test [--test-timeout <duration>]  Connect to every forwarded port through the port")
+	fmt.Println("                    proxy, concurrently, and report PASS/FAIL per port with timing, then")
+	fmt.Println("                    exit: 0=all passed, 1=a port failed (default timeout 3s)")
+	fmt.Println("  --list [--json [--pretty|--compact]]  Print the port proxies and firewall rules the")
+	fmt.Println("                    registry says the forwarder created, then exit (no config file needed)")
+	fmt.Println("  --audit           Compare the registry tracking with the live port proxies and firewall")
+	fmt.Println("                    rules, then exit: 0=consistent, 2=inconsistencies (read-only, no admin needed)")
+	fmt.Println("  --cleanup-registry  Remove registry entries whose port proxy or firewall rule no longer")
+	fmt.Println("                    exists, then exit (needs Administrator)")
+	fmt.Println("  --remove-firewall-rules [--yes]  Delete every firewall rule the forwarder created (named")
+	fmt.Println("                    WSL2-Port-* or registry-tracked), whatever config it came from, after")
+	fmt.Println("                    asking to confirm (--yes skips the prompt, --dry-run only lists them)")
+	fmt.Println("  --print-schema [--pretty|--compact]  Print the JSON Schema of the config file (fields,")
+	fmt.Println("                    enums and bounds) for editor completion and checking, then exit")
+	fmt.Println("  --debug           Log debug details, e.g. how each command's output was decoded")
+	fmt.Println("  --log-format json Log the service's events (forwards added/removed, conflicts, errors)")
+	fmt.Println("                    as one JSON object per line on stderr, instead of the console display")
+	fmt.Println("  --startup-audit   List every registry/system mismatch at startup, not just the counts")
+	fmt.Println("  --var NAME=value  Define ${NAME} for the config file (any command; overrides the environment)")
+	fmt.Println("  --tag <tag>       Only manage instances with this tag (repeatable, any tag matches);")
+	fmt.Println("                    other instances' forwards are left as they are")
+	fmt.Println("  --max-runtime <duration>  Run the service loop for this long (e.g. 30s), then exit")
+	fmt.Println("                    with 0=clean, 1=errors logged, 2=warnings logged (CI runs)")
+	fmt.Println("  --install-service Register as a Windows service that starts at boot, running with the")
+	fmt.Println("                    config file and the other options given (needs Administrator)")
+	fmt.Println("  --uninstall-service  Stop and remove the Windows service (no config file needed)")
+	fmt.Println("  --run-service     Run under the Windows service manager; this is the command line")
+	fmt.Println("                    --install-service registers, and runs in the console otherwise")
+	fmt.Println("  --eventlog        Also write service start/stop, forwards and firewall rules added or")
+	fmt.Println("                    removed, warnings and errors to the Windows Application log (always")
+	fmt.Println("                    on when run as a service)")
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Println("  wsl2-port-forwarder.exe setup")
+	fmt.Println("  wsl2-port-forwarder.exe wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe --validate wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe --explain wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe --install-service C:\\wsl2-port-forwarder\\wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe diff wsl2-config.json wsl2-config.new.json")
+	fmt.Println("  wsl2-port-forwarder.exe plan --json wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe plan --plan-format tf wsl2-config.json")
+	fmt.Println("  wsl2-port-forwarder.exe snapshot save before-maintenance.json")
+}
+
 func (s *ServiceState) validateSetup() error {
 	// Check if configuration file exists
 	if _, err := os.Stat(s.configFile); os.IsNotExist(err) {
@@ -222,57 +1173,151 @@ func (s *ServiceState) validateSetup() error {
 }
 
 // handleFirewallRule manages firewall rules for a port mapping
-func (s *ServiceState) handleFirewallRule(mapping PortMapping) {
+func (s *ServiceState) handleFirewallRule(mapping PortMapping) error {
 	if mapping.FirewallMode == "" {
 		// No firewall management requested
-		return
+		return nil
 	}
 
-	if mapping.FirewallMode != "local" && mapping.FirewallMode != "full" {
+	if s.noFirewall {
+		say("    ℹ️  Firewall rule for port %d not created (--no-firewall)", mapping.ExternalPort)
+		return nil
+	}
+
+	remoteIP, valid := firewallRuleRemoteIP(mapping.FirewallMode)
+	if !valid {
 		log.Printf("Warning: Invalid firewall mode '%s' for port %d, skipping firewall rule", mapping.FirewallMode, mapping.ExternalPort)
-		return
+		return nil
+	}
+
+	if mapping.FirewallDir == "out" || mapping.FirewallDir == "both" {
+		if err := s.addOutboundFirewallRule(mapping); err != nil {
+			return err
+		}
+		if mapping.FirewallDir == "out" {
+			return nil
+		}
 	}
 
 	log.Printf("Creating firewall rule for port %d (mode: %s, instance: %s)", mapping.ExternalPort, mapping.FirewallMode, mapping.Instance)
 
-	if err := s.addFirewallRule(mapping.ExternalPort, mapping.Instance, mapping.FirewallMode); err != nil {
+	if err := s.addFirewallRule(mapping.ExternalPort, mapping.Instance, mapping.FirewallMode, mapping.QosThrottleKbps, mapping.Protocol); err != nil {
 		log.Printf("Warning: Failed to create firewall rule for port %d: %v", mapping.ExternalPort, err)
-		fmt.Printf("    ⚠️  Firewall rule creation failed: %v\n", err)
-		fmt.Printf("    💡 Manual command: netsh advfirewall firewall add rule name=\"WSL2 Port %d\" dir=in action=allow protocol=TCP localport=%d remoteip=%s\n",
-			mapping.ExternalPort, mapping.ExternalPort,
-			map[string]string{"local": "LocalSubnet", "full": "any"}[mapping.FirewallMode])
-	} else {
-		log.Printf("Successfully created firewall rule for port %d", mapping.ExternalPort)
-		fmt.Printf("    🔥 Firewall rule created: %s access to port %d\n",
-			map[string]string{"local": "local network", "full": "any address"}[mapping.FirewallMode],
-			mapping.ExternalPort)
+		say("    ⚠️  Firewall rule creation failed: %v", err)
+		say("    💡 Manual command: netsh advfirewall firewall add rule name=\"WSL2 Port %d\" dir=in action=allow protocol=%s localport=%d remoteip=%s",
+			mapping.ExternalPort, FirewallRuleSpec{Protocol: mapping.Protocol}.netshProtocol(), mapping.ExternalPort, remoteIP)
+		return err
 	}
+
+	log.Printf("Successfully created firewall rule for port %d%s", mapping.ExternalPort, s.dryRunTag())
+	consoleEvent("info", "firewall_rule_created", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance},
+		"    🔥 Firewall rule created: %s access to port %d%s",
+		firewallAccessDescription(mapping.FirewallMode), mapping.ExternalPort, s.dryRunTag())
+	return nil
+}
+
+// handleFirewallFailure deals with a port that was forwarded but whose firewall rule
+// could not be created. In transactional mode the forward is rolled back so both steps
+// are retried together next cycle; otherwise the half-state is logged loudly.
+func (s *ServiceState) handleFirewallFailure(mapping PortMapping, firewallErr error) {
+	// Without Administrator rights every retry fails the same way, so rolling back
+	// would only drop a working forward each cycle
+	if errors.Is(firewallErr, ErrPrivilege) {
+		s.logEventf("firewall_failed", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance}, "WARNING: Port %d is forwarded but its firewall rule can't be created without Administrator rights", mapping.ExternalPort)
+		say("    ⚠️  Port %d is forwarded but not ready: firewall rules need Administrator", mapping.ExternalPort)
+		return
+	}
+
+	if !s.config.Transactional {
+		s.logEventf("firewall_failed", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance}, "WARNING: Port %d is forwarded but its firewall rule is missing (%v) - it may be unreachable; set \"transactional\": true to roll back instead",
+			mapping.ExternalPort, firewallErr)
+		say("    ⚠️  Port %d is forwarded but not ready: firewall rule missing", mapping.ExternalPort)
+		return
+	}
+
+	if err := s.rollbackPortMapping(mapping); err != nil {
+		s.logEventf("rollback_failed", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance}, "Error rolling back port mapping %d after firewall failure: %v", mapping.ExternalPort, err)
+		say("    ⚠️  Port %d is forwarded but not ready: firewall rule missing and rollback failed", mapping.ExternalPort)
+		return
+	}
+
+	s.logEventf("rolled_back", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance}, "Rolled back port mapping %d after firewall failure, will retry next cycle", mapping.ExternalPort)
+	say("    ↩️  Port %d forward rolled back (transactional), will retry next cycle", mapping.ExternalPort)
 }
 
 func (s *ServiceState) loadConfiguration() error {
+	config, err := loadConfigFile(s.configFile, s.allowComments)
+	if err == nil {
+		if s.fallbackActive {
+			s.logf("Config %s is valid again, fallback config no longer active", s.configFile)
+			s.fallbackActive = false
+		}
+		s.config = config
+		s.fallbackPath = resolveFallbackConfigPath(s.configFile, config.FallbackConfig)
+		return nil
+	}
+
+	// The broken file may still name its fallback, even if it no longer parses
+	fallbackPath := s.fallbackPath
+	if data, readErr := ioutil.ReadFile(s.configFile); readErr == nil {
+		// An unexpanded ${VAR} path can't be used; keep the one last resolved instead
+		if path := extractFallbackConfigPath(data); path != "" && !strings.Contains(path, "${") {
+			fallbackPath = resolveFallbackConfigPath(s.configFile, path)
+		}
+	}
+	if fallbackPath == "" {
+		return err
+	}
+
+	fallback, fallbackErr := loadConfigFile(fallbackPath, s.allowComments)
+	if fallbackErr != nil {
+		return fmt.Errorf("%v (fallback config %s is also unusable: %v)", err, fallbackPath, fallbackErr)
+	}
+
+	if !s.fallbackActive || s.fallbackPath != fallbackPath {
+		s.logf("WARNING: FALLBACK CONFIG ACTIVE: %s is invalid (%v), using %s until it is fixed", s.configFile, err, fallbackPath)
+		fmt.Printf("⚠️  Fallback config active: %s\n", fallbackPath)
+	}
+	s.config = fallback
+	s.fallbackPath = fallbackPath
+	s.fallbackActive = true
+	return nil
+}
+
+// loadConfigFile reads, parses and validates a config file
+func loadConfigFile(configFile string, allowComments bool) (*Config, error) {
 	// Read configuration file
-	data, err := ioutil.ReadFile(s.configFile)
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %v", err)
+		return nil, withKind(KindConfig, fmt.Errorf("failed to read config file: %v", err))
 	}
 
-	// Parse JSON
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to parse JSON config: %v", err)
+	// Parse JSON or YAML
+	config, err := parseConfig(configFile, data, allowComments)
+	if err != nil {
+		return nil, withKind(KindConfig, fmt.Errorf("failed to parse %s config: %w", configFormat(configFile), err))
+	}
+
+	// Fill ${VAR} references in string values, if the config asks for it
+	if config.ExpandEnv {
+		if err := expandConfigStrings(config, configVars, os.LookupEnv); err != nil {
+			return nil, withKind(KindConfig, err)
+		}
 	}
 
 	// Validate configuration
-	if err := s.validateConfiguration(&config); err != nil {
-		return fmt.Errorf("configuration validation failed: %v", err)
+	service := &ServiceState{}
+	if err := service.validateConfiguration(config); err != nil {
+		return nil, withKind(KindConfig, fmt.Errorf("configuration validation failed: %w", err))
 	}
 
-	s.config = &config
-	return nil
+	return config, nil
 }
 
 // validateConfiguration validates config file and optionally checks firewall rules
-func validateConfiguration(configFile string) int {
+func validateConfiguration(opts *CommandLineOptions) int {
+	configFile := opts.ConfigFile
+
 	fmt.Println("WSL2 Port Forwarder - Configuration Validation")
 	fmt.Println("=============================================")
 	fmt.Printf("Config file: %s\n\n", configFile)
@@ -286,33 +1331,87 @@ func validateConfiguration(configFile string) int {
 	}
 
 	// Load and parse configuration
-	data, err := ioutil.ReadFile(configFile)
+	data, err := os.ReadFile(configFile)
 	if err != nil {
 		fmt.Printf("❌ Failed to read config file: %v\n", err)
 		return 1
 	}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		fmt.Printf("❌ Failed to parse JSON config: %v\n", err)
+	config, err := parseConfig(configFile, data, opts.AllowComments)
+	if err != nil {
+		fmt.Printf("❌ Failed to parse %s config: %v\n", configFormat(configFile), err)
 		return 1
 	}
+	if config.ExpandEnv {
+		if err := expandConfigStrings(config, configVars, os.LookupEnv); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			return 1
+		}
+	}
 
 	// Validate configuration structure
 	service := &ServiceState{}
-	if err := service.validateConfiguration(&config); err != nil {
+	if err := service.validateConfiguration(config); err != nil {
 		fmt.Printf("❌ Configuration validation failed: %v\n", err)
 		return 1
 	}
 
 	fmt.Printf("✅ Configuration syntax and structure: Valid\n")
 	fmt.Printf("✅ Check interval: %d seconds\n", config.CheckIntervalSeconds)
-	fmt.Printf("✅ Configured instances: %d\n\n", len(config.Instances))
+	fmt.Printf("✅ Configured instances: %d\n", len(config.Instances))
+	if config.FallbackConfig != "" {
+		fallbackPath := resolveFallbackConfigPath(configFile, config.FallbackConfig)
+		if _, err := loadConfigFile(fallbackPath, opts.AllowComments); err != nil {
+			fmt.Printf("⚠️  Fallback config %s is not usable: %v\n", fallbackPath, err)
+			exitCode = 2 // warnings
+		} else {
+			fmt.Printf("✅ Fallback config: %s\n", fallbackPath)
+		}
+	}
+	fmt.Println()
+
+	// Warn about instances the managed_instances allowlist excludes
+	excluded := 0
+	for _, instance := range config.Instances {
+		if !config.IsManagedInstance(instance.Name) {
+			fmt.Printf("⚠️  Instance '%s' is not in managed_instances and will be ignored\n", instance.Name)
+			excluded++
+			exitCode = 2 // warnings
+		}
+	}
+	if excluded > 0 {
+		fmt.Println()
+	}
+	config = config.ManagedConfig()
+	if len(opts.Tags) > 0 {
+		config = config.TaggedConfig(opts.Tags)
+		fmt.Printf("ℹ️  --tag %s: %s\n\n", strings.Join(opts.Tags, ", "), describeTaggedInstances(config))
+		if len(config.Instances) == 0 {
+			exitCode = 2 // warnings
+		}
+	}
+
+	// List the ports switched off with "enabled": false, so it's clear what's off
+	disabled := 0
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if !port.IsEnabled() {
+				fmt.Printf("ℹ️  Port %d of instance '%s' is disabled and will not be forwarded\n", port.ExternalPortEffective(), instance.Name)
+				disabled++
+			}
+		}
+	}
+	if disabled > 0 {
+		fmt.Println()
+	}
 
 	// Check for potential external port conflicts
 	portToInstances := make(map[int][]string)
 	for _, instance := range config.Instances {
 		for _, port := range instance.Ports {
+			if !port.IsEnabled() {
+				continue // can't conflict, never forwarded
+			}
 			externalPort := port.ExternalPortEffective()
 			portToInstances[externalPort] = append(portToInstances[externalPort], instance.Name)
 		}
@@ -331,19 +1430,121 @@ func validateConfiguration(configFile string) int {
 		}
 	}
 
-	if conflictsFound {
+	// Conflicting instances that are running right now already lose traffic
+	if conflictsFound && !opts.ConfigCheckOnly {
+		if running, err := (&ServiceState{}).getRunningWSLInstances(); err == nil {
+			for _, port := range sortedPorts(portToInstances) {
+				if live := runningInstanceNames(config, portToInstances[port], running); len(live) > 1 {
+					fmt.Printf("⚠️  Port %d: %s are running simultaneously, only %s is reachable\n",
+						port, strings.Join(live, " and "), live[0])
+				}
+			}
+		}
+	}
+
+	if conflictsFound && opts.Strict {
+		fmt.Println("\n❌ --strict: external port conflicts are treated as errors")
+		exitCode = 1
+	} else if conflictsFound {
 		fmt.Println("\nℹ️  Note: Port conflicts are allowed if instances don't run simultaneously.")
 		fmt.Println("    Examples: dev/staging/prod environments, or seasonal services.")
+		printSharedPortGuidance("    ")
 	} else {
 		fmt.Println("✅ No external port conflicts detected")
 	}
 
+	// Ports open to any address can't be rate limited by the firewall itself
+	if unprotected := unprotectedFullPorts(config); len(unprotected) > 0 {
+		fmt.Printf("\n⚠️  'full' firewall ports without rate protection: %s\n", strings.Join(unprotected, ", "))
+		fmt.Println("    → Consider qos_throttle_kbps to cap their bandwidth on shared machines")
+		exitCode = mergeExitCode(exitCode, 2)
+	}
+
+	// Check live system state unless only the config file itself should be linted
+	if opts.ConfigCheckOnly {
+		fmt.Println("\nℹ️  Skipping firewall and registry checks (--config-check-only)")
+	} else {
+		exitCode = mergeExitCode(exitCode, checkSystemState(config, opts.Strict))
+		if opts.Deep {
+			exitCode = mergeExitCode(exitCode, checkConnectPorts(config))
+		} else {
+			exitCode = mergeExitCode(exitCode, checkProbePorts(config))
+		}
+	}
+
+	// Summary
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	switch exitCode {
+	case 0:
+		fmt.Println("✅ Configuration is valid and ready for use")
+	case 1:
+		fmt.Println("❌ Configuration has errors that must be fixed")
+	case 2:
+		fmt.Println("⚠️  Configuration is valid but has warnings")
+	}
+
+	return exitCode
+}
+
+// printSharedPortGuidance explains why a shared external port can't reach several
+// running instances and what to do instead
+func printSharedPortGuidance(indent string) {
+	fmt.Println(indent + "💡 netsh portproxy forwards by port only, so one external port can't be routed to")
+	fmt.Println(indent + "   several instances by hostname/SNI. For that, run a reverse proxy (e.g. Caddy, or")
+	fmt.Println(indent + "   nginx stream with ssl_preread) on the shared port and give each instance its own")
+	fmt.Println(indent + "   external port for the proxy to target. To reject shared ports outright, set")
+	fmt.Println(indent + "   strict_port_conflicts or run --validate --strict.")
+}
+
+// runningInstanceNames returns the configured instances that are currently running, in config order
+func runningInstanceNames(config *Config, instances []string, running map[string]bool) []string {
+	var live []string
+	for _, name := range instances {
+		instance := Instance{Name: name}
+		for _, configured := range config.Instances {
+			if configured.Name == name {
+				instance = configured
+				break
+			}
+		}
+		if _, isRunning := resolveInstanceDistro(instance, running); isRunning {
+			live = append(live, name)
+		}
+	}
+	return live
+}
+
+// sortedPorts returns the keys of a port map in ascending order
+func sortedPorts(ports map[int][]string) []int {
+	sorted := make([]int, 0, len(ports))
+	for port := range ports {
+		sorted = append(sorted, port)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// checkSystemState validates Windows Firewall and registry tracking state for the config.
+// Unlike the config checks, this runs netsh and opens the registry.
+func checkSystemState(config *Config, strict bool) int {
+	exitCode := 0
+
 	// Validate Windows Firewall rules
 	fmt.Println("\nℹ️  Checking Windows Firewall rules...")
-	firewallExitCode := checkFirewallRules(&config)
-	if firewallExitCode > exitCode {
-		exitCode = firewallExitCode
-	}
+	firewallExitCode := checkFirewallRules(config, strict)
+	exitCode = mergeExitCode(exitCode, firewallExitCode)
+
+	// Forwards whose target IP no running instance has
+	exitCode = mergeExitCode(exitCode, checkStaleMappings(config, strict))
+
+	// Named listen addresses only resolve on a host that has the adapter
+	exitCode = mergeExitCode(exitCode, checkListenAddresses(config))
+
+	// Loopback forwards compete with WSL's own localhost forwarding
+	exitCode = mergeExitCode(exitCode, checkLocalhostForwarding(config))
+
+	// Docker Desktop forwards and rules on the same ports
+	exitCode = mergeExitCode(exitCode, checkDockerOverlaps(config))
 
 	// Audit registry state (if registry manager is available)
 	fmt.Println("\nℹ️  Checking Registry tracking state...")
@@ -359,202 +1560,387 @@ func validateConfiguration(configFile string) int {
 			fmt.Printf("❌ Registry audit failed: %v\n", err)
 			exitCode = 1
 		} else if !allGood {
-			fmt.Println("\n💡 Tip: Run service normally to auto-cleanup, or use registry cleanup tools")
+			fmt.Println("\n💡 Tip: Run service normally to auto-cleanup, or use --cleanup-registry")
 			if exitCode == 0 {
 				exitCode = 2 // warning
 			}
 		}
 	}
 
-	// Summary
-	fmt.Println("\n" + strings.Repeat("=", 50))
-	switch exitCode {
-	case 0:
-		fmt.Println("✅ Configuration is valid and ready for use")
-	case 1:
-		fmt.Println("❌ Configuration has errors that must be fixed")
-	case 2:
-		fmt.Println("⚠️  Configuration is valid but has warnings")
+	return exitCode
+}
+
+// mergeExitCode combines validation exit codes: errors (1) beat warnings (2) beat success (0)
+func mergeExitCode(a, b int) int {
+	if a == 1 || b == 1 {
+		return 1
+	}
+	if a == 2 || b == 2 {
+		return 2
+	}
+	return 0
+}
+
+// FirewallPort is a configured external port and the protocol it is forwarded over;
+// a port forwarded over both protocols is checked against the firewall once for each
+type FirewallPort struct {
+	Port     int
+	Protocol string // "tcp" or "udp"
+}
+
+// String formats the port as e.g. "8080/tcp"
+func (p FirewallPort) String() string {
+	return fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+}
+
+// FirewallCheckResult is the outcome of checking configured ports against Windows Firewall
+type FirewallCheckResult struct {
+	CheckedPorts      []FirewallPort          // every unique configured external port, sorted
+	AllowedPorts      []FirewallPort          // ports covered by an enabled allow rule
+	ExplicitlyBlocked map[FirewallPort]string // port -> name of an enabled block rule covering it
+	BlockedPorts      []FirewallPort          // ports no allow rule covers (blocked by default policy)
+	AutoManagedPorts  map[FirewallPort]string // blocked ports the service will open -> firewall mode
+	ManualPorts       []FirewallPort          // blocked ports that need a manual rule
+	Err               error                   // set if the firewall state could not be read
+}
+
+// ExitCode derives the validation exit code (0=ok, 1=error, 2=warnings) from the result
+func (r *FirewallCheckResult) ExitCode(strict bool) int {
+	switch {
+	case r.Err != nil:
+		return 2
+	case len(r.ExplicitlyBlocked) > 0 && strict:
+		return 1
+	case len(r.ExplicitlyBlocked) > 0 || len(r.BlockedPorts) > 0:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// evaluateFirewallRules classifies the configured external ports against parsed firewall rules
+func evaluateFirewallRules(config *Config, rules []FirewallRule) *FirewallCheckResult {
+	result := &FirewallCheckResult{
+		ExplicitlyBlocked: make(map[FirewallPort]string),
+		AutoManagedPorts:  make(map[FirewallPort]string),
+	}
+
+	// Collect all unique external ports and their firewall settings
+	firewallModes := make(map[FirewallPort]string) // port -> firewall mode
+	seen := make(map[FirewallPort]bool)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if !port.IsEnabled() {
+				continue
+			}
+			checked := FirewallPort{Port: port.ExternalPortEffective(), Protocol: port.ProtocolEffective()}
+			if !seen[checked] {
+				seen[checked] = true
+				result.CheckedPorts = append(result.CheckedPorts, checked)
+			}
+			if port.ShouldManageFirewall() {
+				firewallModes[checked] = port.FirewallMode()
+			}
+		}
+	}
+	sort.Slice(result.CheckedPorts, func(i, j int) bool {
+		a, b := result.CheckedPorts[i], result.CheckedPorts[j]
+		return a.Port < b.Port || (a.Port == b.Port && a.Protocol < b.Protocol)
+	})
+
+	// Find which ports are allowed or explicitly blocked, by rules of their protocol
+	allowed := make(map[FirewallPort]bool)
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, port := range result.CheckedPorts {
+			if !rule.CoversPort(port.Port) || !rule.CoversProtocol(port.Protocol) {
+				continue
+			}
+			if rule.IsBlock() {
+				result.ExplicitlyBlocked[port] = rule.Name
+			} else {
+				allowed[port] = true
+			}
+		}
+	}
+
+	// Explicit block rules take precedence over allow rules in Windows Firewall
+	for _, port := range result.CheckedPorts {
+		if _, blocked := result.ExplicitlyBlocked[port]; blocked {
+			continue
+		}
+		if allowed[port] {
+			result.AllowedPorts = append(result.AllowedPorts, port)
+			continue
+		}
+		result.BlockedPorts = append(result.BlockedPorts, port)
+		if mode, hasAuto := firewallModes[port]; hasAuto {
+			result.AutoManagedPorts[port] = mode
+		} else {
+			result.ManualPorts = append(result.ManualPorts, port)
+		}
 	}
 
-	return exitCode
+	return result
 }
 
-// checkFirewallRules validates that Windows Firewall allows the configured ports
-func checkFirewallRules(config *Config) int {
-	exitCode := 0
+// checkFirewallState reads the inbound firewall rules and evaluates the configured ports
+func (s *ServiceState) checkFirewallState(config *Config) *FirewallCheckResult {
+	result := evaluateFirewallRules(config, nil)
+	if len(result.CheckedPorts) == 0 {
+		return result
+	}
 
-	// Collect all unique external ports and their firewall settings
-	ports := make(map[int]bool)
-	firewallRules := make(map[int]string) // port -> firewall mode
-	for _, instance := range config.Instances {
-		for _, port := range instance.Ports {
-			externalPort := port.ExternalPortEffective()
-			ports[externalPort] = true
-			if port.ShouldManageFirewall() {
-				firewallRules[externalPort] = port.FirewallMode()
-			}
-		}
+	rules, err := s.getInboundFirewallRules()
+	if err != nil {
+		result.Err = err
+		return result
 	}
 
-	if len(ports) == 0 {
-		fmt.Println("✅ No ports to check")
-		return 0
+	return evaluateFirewallRules(config, rules)
+}
+
+// getInboundFirewallRules lists all inbound rules known to Windows Firewall
+func (s *ServiceState) getInboundFirewallRules() ([]FirewallRule, error) {
+	return s.getFirewallRules("in")
+}
+
+// getForwarderDirectionRules lists inbound and outbound rules, for the checks that
+// look for the forwarder's own rules of either direction by name
+func (s *ServiceState) getForwarderDirectionRules() ([]FirewallRule, error) {
+	inbound, err := s.getFirewallRules("in")
+	if err != nil {
+		return nil, err
+	}
+	outbound, err := s.getFirewallRules("out")
+	if err != nil {
+		return nil, err
 	}
+	return append(inbound, outbound...), nil
+}
 
-	// Check Windows Firewall rules using netsh
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=all", "dir=in", "protocol=tcp")
-	output, err := cmd.Output()
+// getFirewallRules lists the rules of one direction ("in" or "out"), of every protocol:
+// udp ports and the forwarder's -udp rules are checked as well as TCP ones
+func (s *ServiceState) getFirewallRules(direction string) ([]FirewallRule, error) {
+	output, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", "name=all", "dir="+direction)
 	if err != nil {
-		fmt.Printf("⚠️  Unable to check firewall rules: %v\n", err)
-		fmt.Println("    Please verify firewall rules manually")
-		return 2
+		return nil, fmt.Errorf("unable to check firewall rules: %v", err)
 	}
 
 	// Decode UTF-16 output from netsh
 	outputStr, err := decodeCommandOutput(output)
 	if err != nil {
-		fmt.Printf("⚠️  Unable to decode firewall rules output: %v\n", err)
-		fmt.Println("    Please verify firewall rules manually")
-		return 2
+		return nil, fmt.Errorf("unable to decode firewall rules output: %v", err)
 	}
 
-	// Parse firewall rules to find which TCP ports are allowed
-	allowedPorts := make(map[int]bool)
-	lines := strings.Split(outputStr, "\n")
-	var currentRule string
-	var isEnabled bool
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	rules := parseFirewallRules(outputStr)
+	checkParsedOutput("netsh advfirewall firewall show rule", output, outputStr, len(rules))
+	return rules, nil
+}
 
-		// Look for rule name
-		if strings.HasPrefix(line, "Rule Name:") {
-			currentRule = strings.TrimPrefix(line, "Rule Name:")
-			currentRule = strings.TrimSpace(currentRule)
-			isEnabled = false
-		}
+// checkFirewallRules validates that Windows Firewall allows the configured ports
+func checkFirewallRules(config *Config, strict bool) int {
+	result := (&ServiceState{}).checkFirewallState(config)
+	printFirewallCheckResult(result, strict)
+	return result.ExitCode(strict)
+}
 
-		// Check if rule is enabled
-		if strings.HasPrefix(line, "Enabled:") && strings.Contains(line, "Yes") {
-			isEnabled = true
-		}
+// printFirewallCheckResult prints the human readable firewall report used by --validate
+func printFirewallCheckResult(result *FirewallCheckResult, strict bool) {
+	if len(result.CheckedPorts) == 0 {
+		fmt.Println("✅ No ports to check")
+		return
+	}
 
-		// Look for local ports
-		if strings.HasPrefix(line, "LocalPort:") && isEnabled {
-			portStr := strings.TrimPrefix(line, "LocalPort:")
-			portStr = strings.TrimSpace(portStr)
+	if result.Err != nil {
+		fmt.Printf("⚠️  Firewall check failed: %v\n", result.Err)
+		fmt.Println("    Please verify firewall rules manually")
+		return
+	}
 
-			// Handle "Any" or specific ports
-			if portStr == "Any" {
-				// All ports are allowed by this rule
-				for port := range ports {
-					allowedPorts[port] = true
-				}
-			} else {
-				// Parse specific ports (could be ranges or single ports)
-				portParts := strings.Split(portStr, ",")
-				for _, part := range portParts {
-					part = strings.TrimSpace(part)
-					if strings.Contains(part, "-") {
-						// Port range
-						rangeParts := strings.Split(part, "-")
-						if len(rangeParts) == 2 {
-							start, err1 := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
-							end, err2 := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
-							if err1 == nil && err2 == nil {
-								for p := start; p <= end; p++ {
-									if ports[p] {
-										allowedPorts[p] = true
-									}
-								}
-							}
-						}
-					} else {
-						// Single port
-						if port, err := strconv.Atoi(part); err == nil {
-							if ports[port] {
-								allowedPorts[port] = true
-							}
-						}
-					}
-				}
+	// Explicit block rules take precedence over allow rules in Windows Firewall
+	if len(result.ExplicitlyBlocked) > 0 {
+		fmt.Printf("⛔ %d port(s) are explicitly blocked by an inbound firewall rule:\n", len(result.ExplicitlyBlocked))
+		for _, port := range result.CheckedPorts {
+			if ruleName, blocked := result.ExplicitlyBlocked[port]; blocked {
+				fmt.Printf("  - Port %d (%s) - blocked by rule '%s', forwarding it will not be reachable\n", port.Port, strings.ToUpper(port.Protocol), ruleName)
 			}
 		}
+		if strict {
+			fmt.Println("    --strict: blocked ports are treated as errors and will not be forwarded")
+		} else {
+			fmt.Println("    Remove or disable the block rule, or drop the port from the config")
+		}
 	}
 
-	// Check which ports need firewall rules
-	blockedPorts := make([]int, 0)
-	for port := range ports {
-		if !allowedPorts[port] {
-			blockedPorts = append(blockedPorts, port)
+	blockedPorts := result.BlockedPorts
+	if len(blockedPorts) == 0 && len(result.ExplicitlyBlocked) > 0 {
+		fmt.Println("✅ All other configured ports are allowed by Windows Firewall")
+		return
+	} else if len(blockedPorts) == 0 {
+		fmt.Println("✅ All configured ports are allowed by Windows Firewall")
+		return
+	}
+
+	fmt.Printf("⚠️  %d port(s) may be blocked by Windows Firewall:\n", len(blockedPorts))
+	for _, port := range blockedPorts {
+		if mode, hasAuto := result.AutoManagedPorts[port]; hasAuto {
+			fmt.Printf("  - Port %d (%s) - Will be automatically managed (%s mode)\n", port.Port, strings.ToUpper(port.Protocol), mode)
+		} else {
+			fmt.Printf("  - Port %d (%s) - Manual firewall rule needed\n", port.Port, strings.ToUpper(port.Protocol))
 		}
 	}
 
-	if len(blockedPorts) == 0 {
-		fmt.Println("✅ All configured ports are allowed by Windows Firewall")
-	} else {
-		fmt.Printf("⚠️  %d port(s) may be blocked by Windows Firewall:\n", len(blockedPorts))
-		for _, port := range blockedPorts {
-			if mode, hasAuto := firewallRules[port]; hasAuto {
-				fmt.Printf("  - Port %d (TCP) - Will be automatically managed (%s mode)\n", port, mode)
-			} else {
-				fmt.Printf("  - Port %d (TCP) - Manual firewall rule needed\n", port)
+	// Show what automatic rules would be created
+	automaticRules := false
+	for _, port := range blockedPorts {
+		if mode, hasAuto := result.AutoManagedPorts[port]; hasAuto {
+			if !automaticRules {
+				fmt.Println("\n🎆 Automatic firewall rules that will be created:")
+				automaticRules = true
 			}
+			remoteIP, _ := firewallRuleRemoteIP(mode)
+			fmt.Printf("  Port %d (%s): %s access (%s)\n", port.Port, strings.ToUpper(port.Protocol), firewallAccessDescription(mode), remoteIP)
 		}
+	}
 
-		// Show what automatic rules would be created
-		automaticRules := false
-		for _, port := range blockedPorts {
-			if mode, hasAuto := firewallRules[port]; hasAuto {
-				if !automaticRules {
-					fmt.Println("\n🎆 Automatic firewall rules that will be created:")
-					automaticRules = true
-				}
-				remoteIP := map[string]string{"local": "LocalSubnet", "full": "any"}[mode]
-				accessType := map[string]string{"local": "local network", "full": "any address"}[mode]
-				fmt.Printf("  Port %d: %s access (%s)\n", port, accessType, remoteIP)
-			}
+	// Show manual commands for ports without automatic management
+	if len(result.ManualPorts) > 0 {
+		fmt.Println("\nℹ️  Manual commands for remaining ports:")
+		for _, port := range result.ManualPorts {
+			fmt.Printf("  netsh advfirewall firewall add rule name=\"WSL2 Port %d\" dir=in action=allow protocol=%s localport=%d\n", port.Port, strings.ToUpper(port.Protocol), port.Port)
 		}
+		fmt.Println("\n  Or use Windows Firewall GUI: Control Panel > System and Security > Windows Firewall > Advanced Settings")
+	}
+
+	if !isRunningAsAdmin() && len(result.AutoManagedPorts) > 0 {
+		fmt.Println("\n⚠️  Note: Admin privileges required for automatic firewall rule creation")
+		fmt.Println("    Run as Administrator for automatic firewall management")
+	}
+}
+
+// FirewallRule is the subset of a `netsh advfirewall firewall show rule` entry we reason about
+type FirewallRule struct {
+	Name       string
+	Enabled    bool
+	Action     string // "Allow" or "Block"
+	LocalPort  string // "Any", or a comma separated list of ports and ranges
+	RemoteIP   string // "Any", "LocalSubnet", or a list of addresses
+	RemotePort string // "Any", or a comma separated list of ports and ranges
+	Protocol   string // "TCP", "UDP", ...
+}
+
+// IsBlock returns true for rules that explicitly block matching traffic
+func (r FirewallRule) IsBlock() bool {
+	return strings.EqualFold(r.Action, "Block")
+}
+
+// CoversProtocol returns true if the rule applies to protocol ("tcp" or "udp"); rules
+// for any protocol, or whose protocol netsh didn't print, apply to both
+func (r FirewallRule) CoversProtocol(protocol string) bool {
+	return r.Protocol == "" || strings.EqualFold(r.Protocol, "Any") || strings.EqualFold(r.Protocol, protocol)
+}
 
-		// Show manual commands for ports without automatic management
-		manualPorts := make([]int, 0)
-		for _, port := range blockedPorts {
-			if _, hasAuto := firewallRules[port]; !hasAuto {
-				manualPorts = append(manualPorts, port)
+// CoversPort returns true if the rule's LocalPort list matches the given port
+func (r FirewallRule) CoversPort(port int) bool {
+	if r.LocalPort == "Any" {
+		return true
+	}
+
+	// Parse specific ports (could be ranges or single ports)
+	for _, part := range strings.Split(r.LocalPort, ",") {
+		part = strings.TrimSpace(part)
+		if strings.Contains(part, "-") {
+			// Port range
+			rangeParts := strings.Split(part, "-")
+			if len(rangeParts) == 2 {
+				start, err1 := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				end, err2 := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err1 == nil && err2 == nil && port >= start && port <= end {
+					return true
+				}
 			}
+		} else if p, err := strconv.Atoi(part); err == nil && p == port {
+			// Single port
+			return true
 		}
+	}
+
+	return false
+}
 
-		if len(manualPorts) > 0 {
-			fmt.Println("\nℹ️  Manual commands for remaining ports:")
-			for _, port := range manualPorts {
-				fmt.Printf("  netsh advfirewall firewall add rule name=\"WSL2 Port %d\" dir=in action=allow protocol=TCP localport=%d\n", port, port)
+// parseFirewallRules parses decoded `netsh advfirewall firewall show rule` output.
+// Fields are accumulated per rule because Action is listed after LocalPort.
+func parseFirewallRules(output string) []FirewallRule {
+	var rules []FirewallRule
+	var current *FirewallRule
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		// Look for rule name
+		if strings.HasPrefix(line, "Rule Name:") {
+			if current != nil {
+				rules = append(rules, *current)
 			}
-			fmt.Println("\n  Or use Windows Firewall GUI: Control Panel > System and Security > Windows Firewall > Advanced Settings")
+			current = &FirewallRule{Name: strings.TrimSpace(strings.TrimPrefix(line, "Rule Name:"))}
+			continue
 		}
-
-		if !isRunningAsAdmin() && len(firewallRules) > 0 {
-			fmt.Println("\n⚠️  Note: Admin privileges required for automatic firewall rule creation")
-			fmt.Println("    Run as Administrator for automatic firewall management")
+		if current == nil {
+			continue
 		}
 
-		exitCode = 2
+		switch {
+		case strings.HasPrefix(line, "Enabled:"):
+			current.Enabled = strings.Contains(line, "Yes")
+		case strings.HasPrefix(line, "LocalPort:"):
+			current.LocalPort = strings.TrimSpace(strings.TrimPrefix(line, "LocalPort:"))
+		case strings.HasPrefix(line, "RemoteIP:"):
+			current.RemoteIP = strings.TrimSpace(strings.TrimPrefix(line, "RemoteIP:"))
+		case strings.HasPrefix(line, "RemotePort:"):
+			current.RemotePort = strings.TrimSpace(strings.TrimPrefix(line, "RemotePort:"))
+		case strings.HasPrefix(line, "Protocol:"):
+			current.Protocol = strings.TrimSpace(strings.TrimPrefix(line, "Protocol:"))
+		case strings.HasPrefix(line, "Action:"):
+			current.Action = strings.TrimSpace(strings.TrimPrefix(line, "Action:"))
+		}
+	}
+	if current != nil {
+		rules = append(rules, *current)
 	}
 
-	return exitCode
+	return rules
 }
 
-// isRunningAsAdmin checks if the current process has admin privileges
-func isRunningAsAdmin() bool {
-	// Try to create a firewall rule in test mode
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=all")
-	err := cmd.Run()
-	return err == nil // If we can run netsh advfirewall commands, we likely have admin rights
+// getBlockedPorts returns the configured external TCP ports covered by an enabled
+// inbound block rule, mapped to the name of the blocking rule
+func (s *ServiceState) getBlockedPorts(config *Config) (map[int]string, error) {
+	result := s.checkFirewallState(config)
+	blocked := make(map[int]string)
+	for port, ruleName := range result.ExplicitlyBlocked {
+		if port.Protocol == "tcp" {
+			blocked[port.Port] = ruleName
+		}
+	}
+	return blocked, result.Err
 }
 
-// generateFirewallRuleName creates a unique firewall rule name
+// generateFirewallRuleName creates a unique firewall rule name. The instance is
+// identified by the full 64-bit FNV-1a hash of its name, so the same port and instance
+// always get the same name, any instance name makes a valid rule name, and different
+// instances don't share rules.
 func generateFirewallRuleName(port int, instance string) string {
-	// Create a short hash from instance name for uniqueness
+	hash := fnv.New64a()
+	hash.Write([]byte(instance))
+	return fmt.Sprintf("WSL2-Port-%d-%016x", port, hash.Sum64())
+}
+
+// legacyFirewallRuleName is the name earlier versions gave a port's rule, from a
+// 4-digit hash of the instance name that different instances could share. The service
+// removes such a rule once the port has its current one, and --cleanup looks for it too.
+func legacyFirewallRuleName(port int, instance string) string {
 	hash := 0
 	for _, char := range instance {
 		hash = hash*31 + int(char)
@@ -565,70 +1951,220 @@ func generateFirewallRuleName(port int, instance string) string {
 	return fmt.Sprintf("WSL2-Port-%d-%d", port, hash%10000)
 }
 
-// addFirewallRule creates a Windows Firewall rule for the specified port
-func (s *ServiceState) addFirewallRule(port int, instance string, mode string) error {
-	if !isRunningAsAdmin() {
-		return fmt.Errorf("admin privileges required for firewall rule creation")
+// outboundFirewallRuleName names the outbound rule of a port, distinct from its inbound rule
+func outboundFirewallRuleName(port int, instance string) string {
+	return generateFirewallRuleName(port, instance) + "-out"
+}
+
+// FirewallRuleSpec is an allow rule this service creates for a forwarded port
+type FirewallRuleSpec struct {
+	Name        string
+	Port        int
+	Instance    string
+	RemoteIP    string
+	Description string
+	Outbound    bool   // allows the host's connections out to the instance instead of in to the port
+	RemotePort  int    // outbound only: the connect port inside the instance
+	Protocol    string // "udp" for relayed udp ports, TCP otherwise
+}
+
+// withProtocol returns the rule for a port forwarded over protocol. UDP rules get their
+// own name, so a port forwarded over both protocols has a rule for each.
+func (r FirewallRuleSpec) withProtocol(protocol string) FirewallRuleSpec {
+	if protocol == "udp" {
+		r.Name += "-udp"
+		r.Protocol = "udp"
 	}
+	return r
+}
 
-	ruleName := generateFirewallRuleName(port, instance)
+// netshProtocol returns the rule's protocol as netsh and PowerShell spell it
+func (r FirewallRuleSpec) netshProtocol() string {
+	if r.Protocol == "udp" {
+		return "UDP"
+	}
+	return "TCP"
+}
 
-	// Check if rule already exists
-	checkCmd := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", ruleName))
-	if checkCmd.Run() == nil {
-		// Rule already exists, no need to create
-		return nil
+// newFirewallRuleSpec resolves the rule name, remote IP and description for a port
+func newFirewallRuleSpec(port int, instance string, mode string, qosKbps int) (FirewallRuleSpec, error) {
+	rule := FirewallRuleSpec{
+		Name:        generateFirewallRuleName(port, instance),
+		Port:        port,
+		Instance:    instance,
+		Description: fmt.Sprintf("WSL2 port forwarding for %s", instance),
 	}
 
 	// Determine remote IP setting based on mode
-	var remoteIP string
-	switch mode {
-	case "local":
-		remoteIP = "LocalSubnet"
-	case "full":
-		remoteIP = "any"
-	default:
-		return fmt.Errorf("invalid firewall mode: %s", mode)
+	remoteIP, valid := firewallRuleRemoteIP(mode)
+	if !valid {
+		return rule, fmt.Errorf("invalid firewall mode: %s", mode)
 	}
+	rule.RemoteIP = remoteIP
 
-	// Create the firewall rule
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
-		fmt.Sprintf("name=%s", ruleName),
+	if qosKbps > 0 {
+		rule.Description += fmt.Sprintf(" [qos_throttle_kbps=%d]", qosKbps)
+	}
+
+	return rule, nil
+}
+
+// newOutboundFirewallRuleSpec resolves the outbound rule that lets the forward connect
+// to the instance. LocalSubnet covers the WSL network, as the host has an adapter on it.
+func newOutboundFirewallRuleSpec(port int, internalPort int, instance string) FirewallRuleSpec {
+	return FirewallRuleSpec{
+		Name:        outboundFirewallRuleName(port, instance),
+		Port:        port,
+		Instance:    instance,
+		RemoteIP:    "LocalSubnet",
+		Description: fmt.Sprintf("WSL2 port forwarding for %s (outbound to the WSL network)", instance),
+		Outbound:    true,
+		RemotePort:  internalPort,
+	}
+}
+
+// NetshArgs returns the netsh arguments that create the rule
+func (r FirewallRuleSpec) NetshArgs() []string {
+	if r.Outbound {
+		return []string{"advfirewall", "firewall", "add", "rule",
+			fmt.Sprintf("name=%s", r.Name),
+			"dir=out",
+			"action=allow",
+			"protocol=" + r.netshProtocol(),
+			fmt.Sprintf("remoteport=%d", r.RemotePort),
+			fmt.Sprintf("remoteip=%s", r.RemoteIP),
+			fmt.Sprintf("description=%s", r.Description)}
+	}
+	return []string{"advfirewall", "firewall", "add", "rule",
+		fmt.Sprintf("name=%s", r.Name),
 		"dir=in",
 		"action=allow",
-		"protocol=TCP",
-		fmt.Sprintf("localport=%d", port),
-		fmt.Sprintf("remoteip=%s", remoteIP),
-		fmt.Sprintf("description=WSL2 port forwarding for %s", instance))
+		"protocol=" + r.netshProtocol(),
+		fmt.Sprintf("localport=%d", r.Port),
+		fmt.Sprintf("remoteip=%s", r.RemoteIP),
+		fmt.Sprintf("description=%s", r.Description)}
+}
+
+// addFirewallRule creates a Windows Firewall rule for the specified port and protocol. A non-zero
+// qosKbps is recorded in the rule description so the throttle is visible in the firewall UI.
+func (s *ServiceState) addFirewallRule(port int, instance string, mode string, qosKbps int, protocol string) error {
+	rule, err := newFirewallRuleSpec(port, instance, mode, qosKbps)
+	if err != nil {
+		return err
+	}
+	return s.createFirewallRule(rule.withProtocol(protocol))
+}
+
+// addOutboundFirewallRule creates the outbound rule of a firewall_direction out/both port
+func (s *ServiceState) addOutboundFirewallRule(mapping PortMapping) error {
+	rule := newOutboundFirewallRuleSpec(mapping.ExternalPort, mapping.InternalPort, mapping.Instance).withProtocol(mapping.Protocol)
+	log.Printf("Creating outbound firewall rule for port %d (connect port %d, instance: %s)", mapping.ExternalPort, mapping.InternalPort, mapping.Instance)
+	if err := s.createFirewallRule(rule); err != nil {
+		log.Printf("Warning: Failed to create outbound firewall rule for port %d: %v", mapping.ExternalPort, err)
+		say("    ⚠️  Outbound firewall rule creation failed: %v", err)
+		say("    💡 Manual command: netsh advfirewall firewall add rule name=\"%s\" dir=out action=allow protocol=%s remoteport=%d remoteip=LocalSubnet",
+			rule.Name, rule.netshProtocol(), mapping.InternalPort)
+		return err
+	}
+	say("    🔥 Outbound firewall rule created: connections to the WSL network on port %d%s", mapping.InternalPort, s.dryRunTag())
+	return nil
+}
+
+// createFirewallRule creates a firewall rule unless one with its name already exists.
+// An existing rule whose port, protocol or remote IPs no longer match is recreated.
+func (s *ServiceState) createFirewallRule(rule FirewallRuleSpec) error {
+	if s.dryRun {
+		if output, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", rule.Name)); err != nil {
+			s.skipForDryRun("netsh", rule.NetshArgs()...)
+		} else if changes := existingFirewallRuleChanges(output, rule); len(changes) > 0 {
+			s.skipForDryRun("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", rule.Name))
+			s.skipForDryRun("netsh", rule.NetshArgs()...)
+		}
+		s.removeLegacyFirewallRule(rule)
+		return nil
+	}
+	if !isRunningAsAdmin() {
+		return withKind(KindPrivilege, fmt.Errorf("admin privileges required for firewall rule creation"))
+	}
+	ruleName, port, instance := rule.Name, rule.Port, rule.Instance
+
+	// Check if rule already exists
+	if output, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", ruleName)); err == nil {
+		changes := existingFirewallRuleChanges(output, rule)
+		if len(changes) == 0 {
+			// Rule already exists as configured, no need to create
+			s.removeLegacyFirewallRule(rule)
+			return nil
+		}
+		log.Printf("Firewall rule %s no longer matches the config (%s), recreating it", ruleName, strings.Join(changes, ", "))
+		if _, err := s.commands().Run("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", ruleName)); err != nil {
+			return commandError(KindNetsh, fmt.Errorf("failed to remove outdated firewall rule: %w", err))
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create firewall rule: %v", err)
+	// Create the firewall rule
+	if _, err := s.commands().Run("netsh", rule.NetshArgs()...); err != nil {
+		return commandError(KindNetsh, fmt.Errorf("failed to create firewall rule: %w", err))
 	}
+	s.trackCreatedRule(ruleName)
 
 	// Register in registry for tracking
 	if s.registryManager != nil {
 		if err := s.registryManager.RegisterFirewallRule(ruleName, port, instance); err != nil {
-			log.Printf("Warning: Failed to register firewall rule in registry: %v", err)
+			s.deferRegistryWrite("fw:"+ruleName, fmt.Sprintf("register firewall rule %s", ruleName), err,
+				func(rm *RegistryManager) error { return rm.RegisterFirewallRule(ruleName, port, instance) })
 		}
 	}
 
+	s.removeLegacyFirewallRule(rule)
 	return nil
 }
 
+// removeLegacyFirewallRule deletes the rule an earlier version created for an inbound
+// rule's port and instance under its legacy name, which would otherwise stay open
+// alongside the current rule. Each rule is only checked until its predecessor is gone.
+func (s *ServiceState) removeLegacyFirewallRule(rule FirewallRuleSpec) {
+	if rule.Outbound || s.legacyChecked[rule.Name] {
+		return
+	}
+	if s.legacyChecked == nil {
+		s.legacyChecked = make(map[string]bool)
+	}
+
+	legacy := FirewallRuleSpec{Name: legacyFirewallRuleName(rule.Port, rule.Instance)}.withProtocol(rule.Protocol).Name
+	if _, err := s.commands().Run("netsh", "advfirewall", "firewall", "show", "rule", fmt.Sprintf("name=%s", legacy)); err != nil {
+		s.legacyChecked[rule.Name] = true
+		return
+	}
+	if err := s.removeFirewallRuleByName(legacy); err != nil {
+		log.Printf("Warning: Failed to remove legacy firewall rule %s for port %d: %v", legacy, rule.Port, err)
+		return
+	}
+	s.legacyChecked[rule.Name] = true
+	log.Printf("Removed legacy firewall rule %s, replaced by %s%s", legacy, rule.Name, s.dryRunTag())
+}
+
 // removeFirewallRule removes a Windows Firewall rule
 func (s *ServiceState) removeFirewallRule(port int, instance string) error {
+	return s.removeFirewallRuleByName(generateFirewallRuleName(port, instance))
+}
+
+// removeFirewallRuleByName removes a Windows Firewall rule and its registry tracking
+func (s *ServiceState) removeFirewallRuleByName(ruleName string) error {
+	if s.skipForDryRun("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", ruleName)) {
+		return nil
+	}
 	if !isRunningAsAdmin() {
-		return fmt.Errorf("admin privileges required for firewall rule removal")
+		return withKind(KindPrivilege, fmt.Errorf("admin privileges required for firewall rule removal"))
 	}
 
-	ruleName := generateFirewallRuleName(port, instance)
-
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", ruleName))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove firewall rule: %v", err)
+	if _, err := s.commands().Run("netsh", "advfirewall", "firewall", "delete", "rule", fmt.Sprintf("name=%s", ruleName)); err != nil {
+		return commandError(KindNetsh, fmt.Errorf("failed to remove firewall rule: %w", err))
 	}
 
 	// Unregister from registry
+	delete(s.createdRules, ruleName)
+	s.dropPendingRegistryWrites("fw:" + ruleName)
 	if s.registryManager != nil {
 		if err := s.registryManager.UnregisterFirewallRule(ruleName); err != nil {
 			log.Printf("Warning: Failed to unregister firewall rule from registry: %v", err)
@@ -641,7 +2177,55 @@ func (s *ServiceState) removeFirewallRule(port int, instance string) error {
 func (s *ServiceState) validateConfiguration(config *Config) error {
 	// Validate check interval
 	if config.CheckIntervalSeconds < 1 || config.CheckIntervalSeconds > 3600 {
-		return fmt.Errorf("check_interval_seconds must be between 1 and 3600")
+		return fmt.Errorf("check_interval_seconds must be between 1 and 3600 (or omitted for %ds)", defaultCheckIntervalSeconds)
+	}
+
+	// Validate log deduplication window
+	if config.LogDedupSeconds < 0 || config.LogDedupSeconds > 86400 {
+		return fmt.Errorf("log_dedup_seconds must be between 0 and 86400")
+	}
+
+	// Validate empty reading grace
+	if config.EmptyReadingGrace < 0 || config.EmptyReadingGrace > maxEmptyReadingGrace {
+		return fmt.Errorf("empty_reading_grace must be between 0 and %d", maxEmptyReadingGrace)
+	}
+
+	// Validate adaptive interval bounds
+	if config.MinIntervalSeconds < 0 || config.MinIntervalSeconds > 3600 || config.MaxIntervalSeconds < 0 || config.MaxIntervalSeconds > 3600 {
+		return fmt.Errorf("min_interval and max_interval must be between 1 and 3600 (or omitted)")
+	}
+	if minInterval, maxInterval := config.adaptiveBounds(); config.AdaptiveInterval && minInterval > maxInterval {
+		return fmt.Errorf("min_interval (%ds) cannot be greater than max_interval (%ds)", int(minInterval/time.Second), int(maxInterval/time.Second))
+	}
+
+	// Validate command timeout
+	if config.CommandTimeoutSeconds < 0 || config.CommandTimeoutSeconds > 600 {
+		return fmt.Errorf("command_timeout_seconds must be between 1 and 600 (or omitted)")
+	}
+
+	// Validate remote syslog address
+	if config.SyslogAddress != "" {
+		if _, _, err := parseSyslogAddress(config.SyslogAddress); err != nil {
+			return err
+		}
+	}
+
+	// Validate log file rotation
+	if config.LogMaxSizeMB < 0 || config.LogMaxSizeMB > 10240 {
+		return fmt.Errorf("log_max_size_mb must be between 1 and 10240 (or omitted)")
+	}
+	if config.LogMaxBackups < 0 || config.LogMaxBackups > 100 {
+		return fmt.Errorf("log_max_backups must be between 1 and 100 (or omitted)")
+	}
+	if config.LogFile == "" && (config.LogMaxSizeMB > 0 || config.LogMaxBackups > 0) {
+		return fmt.Errorf("log_max_size_mb and log_max_backups require log_file")
+	}
+
+	// Validate managed instances allowlist
+	for _, name := range config.ManagedInstances {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("managed_instances entries cannot be empty")
+		}
 	}
 
 	// Validate instances and ports
@@ -650,6 +2234,36 @@ func (s *ServiceState) validateConfiguration(config *Config) error {
 			return fmt.Errorf("instance name cannot be empty")
 		}
 
+		if instance.StartupDelaySeconds < 0 || instance.StartupDelaySeconds > maxStartupDelaySeconds {
+			return fmt.Errorf("startup_delay_seconds must be between 0 and %d in instance %s", maxStartupDelaySeconds, instance.Name)
+		}
+
+		for _, alias := range instance.Aliases {
+			if strings.TrimSpace(alias) == "" {
+				return fmt.Errorf("aliases entries cannot be empty in instance %s", instance.Name)
+			}
+		}
+
+		for _, tag := range instance.Tags {
+			if strings.TrimSpace(tag) == "" {
+				return fmt.Errorf("tags entries cannot be empty in instance %s", instance.Name)
+			}
+		}
+
+		for _, iface := range instance.InterfacePriority {
+			if strings.TrimSpace(iface) == "" {
+				return fmt.Errorf("interface_priority entries cannot be empty in instance %s", instance.Name)
+			}
+		}
+
+		if family := instance.AddressFamily; family != "" && family != addressFamilyIPv4 && family != addressFamilyIPv6 {
+			return fmt.Errorf("invalid address_family '%s' in instance %s (must be 'ipv4' or 'ipv6')", family, instance.Name)
+		}
+
+		if instance.IP != "" && !isValidIPAddress(instance.IP) {
+			return fmt.Errorf("invalid ip '%s' in instance %s (must be an IPv4 or IPv6 address)", instance.IP, instance.Name)
+		}
+
 		for _, port := range instance.Ports {
 			// Validate external port (required)
 			if port.Port < 1 || port.Port > 65535 {
@@ -665,175 +2279,723 @@ func (s *ServiceState) validateConfiguration(config *Config) error {
 			if port.Firewall != "" && port.Firewall != "local" && port.Firewall != "full" {
 				return fmt.Errorf("invalid firewall setting '%s' for port %d in instance %s (must be 'local', 'full', or omitted)", port.Firewall, port.Port, instance.Name)
 			}
+			if port.FirewallDir != "" && port.FirewallDir != "in" && port.FirewallDir != "out" && port.FirewallDir != "both" {
+				return fmt.Errorf("invalid firewall_direction '%s' for port %d in instance %s (must be 'in', 'out', 'both', or omitted)", port.FirewallDir, port.Port, instance.Name)
+			}
+			if port.FirewallRemote != "" {
+				if _, err := parseFirewallRemoteIPs(port.FirewallRemote); err != nil {
+					return fmt.Errorf("invalid firewall_remote_ip for port %d in instance %s: %v", port.Port, instance.Name, err)
+				}
+				if port.Firewall != "" {
+					return fmt.Errorf("port %d in instance %s sets both firewall and firewall_remote_ip (use one: firewall_remote_ip already enables the firewall rule)", port.Port, instance.Name)
+				}
+				if port.FirewallDir == "out" {
+					return fmt.Errorf("firewall_remote_ip for port %d in instance %s only applies to inbound rules and can't be used with firewall_direction 'out'", port.Port, instance.Name)
+				}
+			}
+			if port.FirewallDir != "" && !port.ShouldManageFirewall() {
+				return fmt.Errorf("firewall_direction for port %d in instance %s requires firewall to be set", port.Port, instance.Name)
+			}
+
+			// Validate protocol (optional); netsh portproxy is TCP-only, so udp ports are
+			// relayed by the service and can't use the TCP-only extras
+			if port.Protocol != "" && port.Protocol != "tcp" && port.Protocol != "udp" {
+				return fmt.Errorf("invalid protocol '%s' for port %d in instance %s (must be 'tcp', 'udp', or omitted)", port.Protocol, port.Port, instance.Name)
+			}
+			if port.IsUDP() && (port.QosThrottleKbps != 0 || port.UPnP || port.ConnectFallback || port.Probe) {
+				return fmt.Errorf("qos_throttle_kbps, upnp, connect_fallback and probe are TCP-only and can't be used with udp port %d in instance %s", port.Port, instance.Name)
+			}
+
+			// Validate listen address (optional)
+			if err := validateListenAddress(port.ListenAddress); err != nil {
+				return fmt.Errorf("%v for port %d in instance %s", err, port.Port, instance.Name)
+			}
+
+			// Validate QoS throttle (optional)
+			if port.QosThrottleKbps < 0 || port.QosThrottleKbps > maxQosThrottleKbps {
+				return fmt.Errorf("qos_throttle_kbps for port %d in instance %s must be between 1 and %d (or omitted)", port.Port, instance.Name, maxQosThrottleKbps)
+			}
+
+			// Note: Duplicate external ports are allowed - instances may not run simultaneously
+			// Runtime conflict resolution will handle cases where multiple instances with
+			// the same external port are running at the same time
+		}
+	}
+
+	// Two instances matching the same distro is always a mistake, unlike a shared port
+	if err := distroOverlapError(config); err != nil {
+		return err
+	}
+
+	// Teams running every instance at once can opt into rejecting duplicates
+	if config.StrictPortConflicts {
+		if err := portConflictError(config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// distroOverlapError returns an error if two instances could match the same distro
+// through their names or aliases. Names are compared case-insensitively, like distro
+// matching; an instance repeating its own name as an alias is harmless.
+func distroOverlapError(config *Config) error {
+	owners := make(map[string]int) // lowercased distro name -> index of the instance matching it
+	for i, instance := range config.Instances {
+		for _, name := range instance.distroNames() {
+			key := strings.ToLower(name)
+			if owner, exists := owners[key]; exists && owner != i {
+				return fmt.Errorf("instances %s and %s both match distro %s", config.Instances[owner].Name, instance.Name, name)
+			}
+			owners[key] = i
+		}
+	}
+	return nil
+}
+
+// portConflictError returns an error listing every external port claimed by more than one instance
+func portConflictError(config *Config) error {
+	conflicts := findPortConflicts(config)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	ports := make([]int, 0, len(conflicts))
+	for port := range conflicts {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	details := make([]string, 0, len(ports))
+	for _, port := range ports {
+		details = append(details, fmt.Sprintf("port %d (%s)", port, strings.Join(conflicts[port].Instances, ", ")))
+	}
+	return fmt.Errorf("duplicate external ports are not allowed with strict port conflicts: %s", strings.Join(details, "; "))
+}
+
+func (s *ServiceState) serviceLoop() ReconcileResult {
+	s.passes++
+
+	// Reload configuration (live reload support) when it has changed
+	if s.configNeedsReload() {
+		if err := s.loadConfiguration(); err != nil {
+			s.logf("Warning: Failed to reload configuration: %v", err)
+			say("Using previous configuration...")
+		} else if s.configChanged != nil {
+			s.logf("Reloaded configuration from %s", s.configFile)
+		}
+	}
+
+	// Report messages whose dedup window has closed, then apply the (reloaded) window
+	if s.logDedup == nil {
+		s.logDedup = NewLogDeduplicator(0)
+	}
+	s.logDedup.Flush(time.Now())
+	s.logDedup.SetWindow(time.Duration(s.config.LogDedupSeconds) * time.Second)
+	s.configureLogFile(s.config)
+	s.configureSyslog(s.config.SyslogAddress)
+
+	// A drain (maintenance window) pauses forwarding without stopping the service
+	if s.checkDrained() {
+		return ReconcileResult{}
+	}
+
+	// Instances outside the managed_instances allowlist or the --tag filter are never touched
+	config := s.config.ManagedConfig().TaggedConfig(s.tags)
+
+	// Open firewall rules before instances start, rather than when they're forwarded
+	if config.PreProvisionFirewall {
+		s.provisionFirewallRules(config)
+	}
+
+	// Freeze everything this pass reads into a single snapshot
+	snapshot, err := s.captureSnapshot(config)
+	if err != nil {
+		// A hung wsl or netsh was killed; it's usually fine by the next check
+		if errors.Is(err, ErrCommandTimeout) {
+			s.logf("Warning: %v; will retry next check", err)
+		} else {
+			s.logf("Error: %v", err)
+		}
+		return ReconcileResult{Failures: 1}
+	}
+
+	// Don't tear everything down on a momentary empty reading from wsl
+	if s.isTransientEmptyReading(snapshot, config.EmptyReadingGrace) {
+		return ReconcileResult{Changed: true}
+	}
+
+	// Stop holding on to the forwards of instances whose IP keeps failing to read
+	s.releaseUnreadableInstances(snapshot)
+
+	// Hold back instances still in their startup delay
+	s.applyStartupDelays(snapshot, time.Now())
 
-			// Note: Duplicate external ports are allowed - instances may not run simultaneously
-			// Runtime conflict resolution will handle cases where multiple instances with
-			// the same external port are running at the same time
+	// Only the first pass that forwards an instance pays for its boot probe
+	for _, instance := range config.Instances {
+		ip, running := snapshot.InstanceIPs[instance.Name]
+		if _, seen := s.runningInstances[instance.Name]; running && instance.BootProbe && !seen {
+			s.probeBootedInstance(instance, ip)
 		}
 	}
 
-	return nil
-}
+	s.runningInstances = snapshot.InstanceIPs
+	s.currentMappings = snapshot.CurrentMappings
+
+	// Display current state
+	s.displayCurrentState(snapshot)
 
-func (s *ServiceState) serviceLoop() {
-	// Reload configuration (live reload support)
-	if err := s.loadConfiguration(); err != nil {
-		log.Printf("Warning: Failed to reload configuration: %v", err)
-		fmt.Println("Using previous configuration...")
+	// Calculate and apply required changes
+	result := s.reconcilePortForwarding(snapshot)
+
+	// Catch up on registry tracking writes that failed earlier
+	s.retryPendingRegistryWrites()
+
+	// Perform automatic registry cleanup (remove orphaned entries)
+	if s.registryManager != nil {
+		if err := s.registryManager.CleanupOrphanedEntries(); err != nil {
+			s.logf("Warning: Registry cleanup failed: %v", err)
+		}
 	}
 
+	logDecodeStats()
+	return result
+}
+
+// captureSnapshot reads the running instances, their IPs, the installed port proxies
+// and firewall block rules for the given config into a ReconcileSnapshot
+func (s *ServiceState) captureSnapshot(config *Config) (*ReconcileSnapshot, error) {
 	// Get current running WSL2 instances
 	runningInstances, err := s.getRunningWSLInstances()
 	if err != nil {
-		log.Printf("Error getting running WSL instances: %v", err)
-		return
+		return nil, fmt.Errorf("failed to get running WSL instances: %w", err)
 	}
 
 	// Get IP addresses for running instances that are in our config
-	s.runningInstances = make(map[string]string)
-	for _, instance := range s.config.Instances {
-		if _, isRunning := runningInstances[instance.Name]; isRunning {
-			ip, err := s.getWSLInstanceIP(instance.Name)
-			if err != nil {
-				log.Printf("Warning: Failed to get IP for instance %s: %v", instance.Name, err)
+	instanceIPs := make(map[string]string)
+	matchedBy := make(map[string]string) // distro name -> instance that matched it
+	held := make(map[string]string)
+	candidateIPs := make(map[string][]string)
+	var lookups []instanceLookup
+	for _, instance := range config.Instances {
+		if distroName, isRunning := resolveInstanceDistro(instance, runningInstances); isRunning {
+			if owner, taken := matchedBy[distroName]; taken {
+				s.logf("Error: instances %s and %s both match distro %s, ignoring %s", owner, instance.Name, distroName, instance.Name)
+				continue
+			}
+			matchedBy[distroName] = instance.Name
+
+			if !instance.hasDistroName(distroName) {
+				s.logf("Warning: Instance '%s' matched running distro '%s' by case only; please fix the name in the config", instance.Name, distroName)
+			}
+
+			// A pinned IP is used as is, without asking the instance
+			if instance.IP != "" {
+				instanceIPs[instance.Name] = instance.IP
+				if instance.hasConnectFallback() {
+					candidateIPs[instance.Name] = []string{instance.IP}
+				}
 				continue
 			}
-			s.runningInstances[instance.Name] = ip
+
+			// wsl -d is case-sensitive, so query using the exact name wsl reported
+			distro := instance
+			distro.Name = distroName
+			lookups = append(lookups, instanceLookup{instance: instance, distro: distro})
+		}
+	}
+
+	// Each lookup spawns wsl, so query the instances concurrently
+	for i, result := range lookupInstances(s.commands(), lookups) {
+		instance := lookups[i].instance
+		for _, message := range result.messages {
+			s.logf("%s", message)
+		}
+		if result.err != nil {
+			s.logf("Warning: Failed to get IP for instance %s: %v", instance.Name, result.err)
+			held[instance.Name] = heldIPUnreadable
+			continue
+		}
+		instanceIPs[instance.Name] = result.ip
+
+		if result.candidateErr != nil {
+			s.logf("Warning: Failed to list failover IPs for instance %s: %v", instance.Name, result.candidateErr)
+		} else if instance.hasConnectFallback() {
+			candidateIPs[instance.Name] = result.candidates
 		}
 	}
 
 	// Get current port forwarding state
 	currentMappings, err := s.getCurrentPortMappings()
 	if err != nil {
-		log.Printf("Error getting current port mappings: %v", err)
-		return
+		return nil, fmt.Errorf("failed to get current port mappings: %w", err)
 	}
 
-	// Display current state
-	s.displayCurrentState()
+	// Find configured ports that an explicit firewall block rule makes unreachable
+	blockedPorts, err := s.getBlockedPorts(config)
+	if err != nil {
+		s.logf("Warning: Unable to check firewall block rules: %v", err)
+	}
 
-	// Calculate and apply required changes
-	s.reconcilePortForwarding(currentMappings)
+	snapshot := newReconcileSnapshot(config, instanceIPs, currentMappings)
+	snapshot.Held = held
+	snapshot.RunningDistros = len(runningInstances)
+	snapshot.CandidateIPs = candidateIPs
+	snapshot.BlockedPorts = blockedPorts
+	snapshot.SkipBlocked = s.strict
+	snapshot.ListenAddresses = s.resolveListenAddresses(config)
+	return snapshot, nil
+}
 
-	// Perform automatic registry cleanup (remove orphaned entries)
-	if s.registryManager != nil {
-		if err := s.registryManager.CleanupOrphanedEntries(); err != nil {
-			log.Printf("Warning: Registry cleanup failed: %v", err)
+// resolveRunningInstance finds a configured instance among the running distros, falling
+// back to a case-insensitive match. It returns the exact distro name as wsl reported it.
+func resolveRunningInstance(configName string, running map[string]bool) (string, bool) {
+	if running[configName] {
+		return configName, true
+	}
+	for name := range running {
+		if strings.EqualFold(name, configName) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// distroNames returns the distro names an instance may be registered under: its
+// name, then its aliases
+func (instance Instance) distroNames() []string {
+	return append([]string{instance.Name}, instance.Aliases...)
+}
+
+// hasDistroName returns true if name is exactly the instance name or one of its aliases
+func (instance Instance) hasDistroName(name string) bool {
+	for _, candidate := range instance.distroNames() {
+		if candidate == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveInstanceDistro finds the running distro for an instance, trying its name and
+// then each alias. It returns the exact distro name as wsl reported it.
+func resolveInstanceDistro(instance Instance, running map[string]bool) (string, bool) {
+	for _, name := range instance.distroNames() {
+		if distroName, isRunning := resolveRunningInstance(name, running); isRunning {
+			return distroName, true
 		}
 	}
+	return "", false
+}
+
+// logf logs through the deduplicator so identical warnings repeated every
+// interval don't flood long-running logs
+func (s *ServiceState) logf(format string, args ...interface{}) {
+	s.logEventf("log", EventFields{}, format, args...)
+}
+
+// runExitCode summarises the run so far as an exit status: 0=clean, 1=errors logged,
+// 2=only warnings logged
+func (s *ServiceState) runExitCode() int {
+	switch {
+	case s.errorsLogged > 0:
+		return 1
+	case s.warningsLogged > 0:
+		return 2
+	default:
+		return 0
+	}
 }
 
 func (s *ServiceState) getRunningWSLInstances() (map[string]bool, error) {
-	cmd := exec.Command("wsl", "--list", "--running", "--quiet")
-	output, err := cmd.Output()
+	output, err := s.commands().Run("wsl", "--list", "--running", "--quiet")
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute wsl --list --running: %v", err)
+		return nil, commandError(KindWSL, fmt.Errorf("failed to execute wsl --list --running: %w", err))
 	}
 
-	instances := make(map[string]bool)
-
 	// Decode UTF-16 output from WSL
 	outputStr, err := decodeCommandOutput(output)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode WSL output: %v", err)
 	}
 
-	// Split by Windows line endings first, then Unix line endings as fallback
-	var lines []string
-	if strings.Contains(outputStr, "\r\n") {
-		lines = strings.Split(strings.TrimSpace(outputStr), "\r\n")
-	} else {
-		lines = strings.Split(strings.TrimSpace(outputStr), "\n")
-	}
+	return parseRunningWSLInstances(outputStr), nil
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+// parseRunningWSLInstances parses `wsl --list --running --quiet` output, one distro
+// per line. Names may contain spaces ("Ubuntu 22.04 LTS"), so only the ends of a
+// line are trimmed and the rest is kept as the exact name wsl -d expects.
+func parseRunningWSLInstances(outputStr string) map[string]bool {
+	instances := make(map[string]bool)
+	for _, line := range strings.Split(outputStr, "\n") {
+		line = trimDistroName(line)
 		if line != "" {
 			instances[line] = true
 		}
 	}
+	return instances
+}
 
-	return instances, nil
+// trimDistroName trims what UTF-16 decoding can leave around a distro name besides
+// whitespace: the \r of a \r\n line ending, NUL padding, other control characters
+// and zero-width characters (including a stray byte order mark), none of which can
+// be part of a distro name and all of which stop it matching the configured name.
+func trimDistroName(line string) string {
+	return strings.TrimFunc(line, func(r rune) bool {
+		switch r {
+		case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+			return true
+		}
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
 }
 
-func (s *ServiceState) getWSLInstanceIP(instanceName string) (string, error) {
-	cmd := exec.Command("wsl", "-d", instanceName, "--", "hostname", "-I")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get IP for %s: %v", instanceName, err)
+// getWSLInstanceIP returns a running instance's IP: its pinned ip, or what wsl reports
+func (s *ServiceState) getWSLInstanceIP(instance Instance) (string, error) {
+	if instance.IP != "" {
+		return instance.IP, nil
 	}
+	return wslInstanceIP(s.commands(), instance, s.logf)
+}
 
-	ip := strings.TrimSpace(string(output))
-	// Take first IP if multiple are returned
-	if ips := strings.Fields(ip); len(ips) > 0 {
-		ip = ips[0]
+// wslInstanceIP reads a running instance's IP, from its preferred interfaces or
+// hostname -I, logging through logf
+func wslInstanceIP(runner CommandRunner, instance Instance, logf func(format string, args ...interface{})) (string, error) {
+	instanceName := instance.Name
+
+	// Prefer the configured interfaces, in order, so a reshuffled hostname -I
+	// ordering (e.g. a bridge listed first after a reboot) can't pick the wrong IP
+	if len(instance.InterfacePriority) > 0 {
+		if output, err := runner.Run("wsl", "-d", instanceName, "--", "ip", "-o", "addr", "show", "scope", "global"); err != nil {
+			logf("Warning: Failed to list interfaces for %s, falling back to hostname -I: %v", instanceName, err)
+		} else if iface, ip, ok := selectInterfaceAddress(parseInterfaceAddresses(string(output)), instance.InterfacePriority, instance.AddressFamily); ok {
+			logf("Instance %s: using %s from interface %s", instanceName, ip, iface)
+			return ip, nil
+		} else {
+			logf("Warning: None of the preferred interfaces %v have a global address in %s, falling back to hostname -I",
+				instance.InterfacePriority, instanceName)
+		}
 	}
 
-	// Validate IP format
-	ipRegex := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
-	if !ipRegex.MatchString(ip) {
-		return "", fmt.Errorf("invalid IP address format: %s", ip)
+	output, err := runner.Run("wsl", "-d", instanceName, "--", "hostname", "-I")
+	if err != nil {
+		return "", commandError(KindWSL, fmt.Errorf("failed to get IP for %s: %w", instanceName, err))
 	}
 
+	ip, err := selectHostnameIP(string(output), instance.AddressFamily)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", instanceName, err)
+	}
 	return ip, nil
 }
 
+// selectHostnameIP picks the instance IP from `hostname -I` output: the first valid
+// address of the address family (any, if empty) that isn't loopback or link-local.
+// A link-local address is only used if there is nothing else, and loopback never is.
+func selectHostnameIP(output string, family string) (string, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no IP address reported")
+	}
+
+	linkLocal, valid := "", false
+	for _, addr := range fields {
+		if !isValidIPAddress(addr) {
+			continue
+		}
+		valid = true
+		if !inAddressFamily(addr, family) {
+			continue
+		}
+		host, _ := splitZone(addr)
+		ip := net.ParseIP(host)
+		switch {
+		case ip.IsLoopback() || ip.IsUnspecified():
+		case ip.IsLinkLocalUnicast():
+			if linkLocal == "" {
+				linkLocal = addr
+			}
+		default:
+			return addr, nil
+		}
+	}
+	if linkLocal != "" {
+		return linkLocal, nil
+	}
+	if valid && family != "" {
+		return "", fmt.Errorf("no routable %s address: %s", family, strings.Join(fields, " "))
+	}
+	if valid {
+		return "", fmt.Errorf("no routable IP address: %s", strings.Join(fields, " "))
+	}
+	return "", fmt.Errorf("invalid IP address format: %s", strings.Join(fields, " "))
+}
+
+// parseInterfaceAddresses parses `ip -o addr show` output into interface -> addresses
+// (in listed order, prefix length stripped)
+func parseInterfaceAddresses(output string) map[string][]string {
+	addresses := make(map[string][]string)
+
+	// Format: "2: eth0    inet 172.20.0.2/20 brd 172.20.15.255 scope global eth0 ..."
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") || !strings.Contains(line, "scope global") {
+			continue
+		}
+		iface := strings.TrimSuffix(fields[1], ":")
+		addr := fields[3]
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr = addr[:i]
+		}
+		addresses[iface] = append(addresses[iface], addr)
+	}
+
+	return addresses
+}
+
+// selectInterfaceAddress picks the first address of the first preferred interface that
+// has one in the address family, preferring IPv4 over IPv6 within an interface if the
+// family is empty
+func selectInterfaceAddress(addresses map[string][]string, priority []string, family string) (string, string, bool) {
+	for _, iface := range priority {
+		addrs := addresses[iface]
+		for _, addr := range addrs {
+			if !isIPv6Address(addr) && isValidIPAddress(addr) && inAddressFamily(addr, family) {
+				return iface, addr, true
+			}
+		}
+		for _, addr := range addrs {
+			if isValidIPAddress(addr) && inAddressFamily(addr, family) {
+				return iface, addr, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// Instance address_family values
+const (
+	addressFamilyIPv4 = "ipv4"
+	addressFamilyIPv6 = "ipv6"
+)
+
+// inAddressFamily returns true if addr belongs to the address family; every address
+// belongs to the empty family
+func inAddressFamily(addr, family string) bool {
+	switch family {
+	case addressFamilyIPv4:
+		return !isIPv6Address(addr)
+	case addressFamilyIPv6:
+		return isIPv6Address(addr)
+	default:
+		return true
+	}
+}
+
+// splitZone splits an address like "fe80::1%eth0" into the address and zone ID
+func splitZone(addr string) (string, string) {
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// isValidIPAddress accepts IPv4 and IPv6 addresses; IPv6 addresses may carry a
+// non-empty %zone suffix (zone IDs are meaningless, and rejected, for IPv4)
+func isValidIPAddress(addr string) bool {
+	host, zone := splitZone(addr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if strings.Contains(addr, "%") {
+		return zone != "" && ip.To4() == nil
+	}
+	return true
+}
+
+// isIPv6Address returns true for IPv6 addresses, with or without a zone ID
+func isIPv6Address(addr string) bool {
+	host, _ := splitZone(addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// portProxyType returns the netsh portproxy table ("v4tov4", "v4tov6", ...) for a
+// listen/connect address pair
+func portProxyType(listenAddress, connectAddress string) string {
+	from, to := "v4", "v4"
+	if isIPv6Address(listenAddress) {
+		from = "v6"
+	}
+	if isIPv6Address(connectAddress) {
+		to = "v6"
+	}
+	return from + "to" + to
+}
+
 func (s *ServiceState) getCurrentPortMappings() (map[int]PortMapping, error) {
-	cmd := exec.Command("netsh", "interface", "portproxy", "show", "v4tov4")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute netsh command: %v", err)
+	mappings := make(map[int]PortMapping)
+
+	// Listeners of either family may forward to IPv4 or IPv6 (possibly link-local) targets.
+	// Mappings are keyed by port, so a port listened on in both families is reported once,
+	// from its IPv4 table.
+	for _, proxyType := range portProxyTables {
+		output, err := s.commands().Run("netsh", "interface", "portproxy", "show", proxyType)
+		if err != nil {
+			return nil, commandError(KindNetsh, fmt.Errorf("failed to execute netsh command: %w", err))
+		}
+
+		// Decode UTF-16 output from netsh
+		outputStr, err := decodeCommandOutput(output)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode netsh output: %v", err)
+		}
+
+		parsed := parsePortProxyTable(outputStr, proxyType)
+		checkParsedOutput("netsh portproxy show "+proxyType, output, outputStr, len(parsed))
+		for port, mapping := range parsed {
+			if _, exists := mappings[port]; exists {
+				debugf("port %d is also forwarded from %s (%s table), ignoring it", port, mapping.ListenAddress, proxyType)
+				continue
+			}
+			mappings[port] = mapping
+		}
 	}
 
-	// Decode UTF-16 output from netsh
-	outputStr, err := decodeCommandOutput(output)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode netsh output: %v", err)
+	return mappings, nil
+}
+
+// portProxyTables are the netsh portproxy tables, IPv4 listeners first
+var portProxyTables = []string{"v4tov4", "v4tov6", "v6tov4", "v6tov6"}
+
+// parsePortProxyTable parses one `netsh interface portproxy show <proxyType>` table.
+// The wildcard listen address of an IPv6 table is "::" rather than 0.0.0.0.
+func parsePortProxyTable(outputStr, proxyType string) map[int]PortMapping {
+	mappings := parsePortProxyOutput(outputStr)
+	if !strings.HasPrefix(proxyType, "v6") {
+		return mappings
 	}
+	for port, mapping := range mappings {
+		if mapping.ListenAddress == defaultListenAddress {
+			mapping.ListenAddress = "::"
+			mappings[port] = mapping
+		}
+	}
+	return mappings
+}
 
+// parsePortProxyOutput parses the table printed by `netsh interface portproxy show`.
+// The header lines ("Listen on ipv4:", "Address  Port ...") are translated on
+// localized Windows, so the table is anchored on the dashed separator row below them
+// instead: only the lines after it are rows. Output without a separator (some builds
+// omit it) is parsed whole. Either way a line is only taken as a mapping when its
+// listen and connect fields are addresses, so stray header or footer text is skipped.
+func parsePortProxyOutput(outputStr string) map[int]PortMapping {
 	mappings := make(map[int]PortMapping)
 	lines := strings.Split(outputStr, "\n")
 
-	// Parse netsh output - format varies by Windows version
-	for _, line := range lines {
+	rows := lines
+	for i, line := range lines {
+		if isPortProxySeparator(line) {
+			rows = lines[i+1:]
+			break
+		}
+	}
+
+	// A long address (e.g. IPv6 with a zone ID) can push the connect columns onto
+	// the next line; such a row is held until that line completes it
+	var pending []string
+	for _, line := range rows {
 		line = strings.TrimSpace(line)
-		if line == "" {
+		if line == "" || isPortProxySeparator(line) {
+			pending = nil
 			continue
 		}
 
-		// Look for lines containing port mappings
 		// Format: "0.0.0.0         22          10.10.185.157   22"
 		// Fields: [listenaddress, listenport, connectaddress, connectport]
+		// Addresses may be IPv6 with a zone ID, e.g. "fe80::1%eth0"
+		// The listen address may be shown as "*" for all addresses
+		// Some builds show the connect port as 0 or leave it blank; that is kept as 0
+		// (unknown) so the mapping is always rewritten rather than trusted
 		fields := strings.Fields(line)
-		if len(fields) >= 4 {
-			listenPort, err := strconv.Atoi(fields[1])
-			if err != nil {
+		if len(fields) == 2 && pending == nil && isPortProxyListenAddress(fields[0]) {
+			if _, err := strconv.Atoi(fields[1]); err == nil {
+				pending = fields
 				continue
 			}
+		}
+		if pending != nil {
+			fields = append(pending, fields...)
+			pending = nil
+		}
 
-			connectIP := fields[2]
-			connectPort, err := strconv.Atoi(fields[3])
-			if err != nil {
-				continue
-			}
+		mapping, ok := parsePortProxyRow(fields)
+		if ok {
+			mappings[mapping.ExternalPort] = mapping
+		}
+	}
 
-			mappings[listenPort] = PortMapping{
-				ExternalPort: listenPort,
-				InternalPort: connectPort,
-				TargetIP:     connectIP,
-			}
+	return mappings
+}
+
+// parsePortProxyRow parses the fields of one portproxy table row
+func parsePortProxyRow(fields []string) (PortMapping, bool) {
+	if len(fields) < 3 || len(fields) > 4 {
+		return PortMapping{}, false
+	}
+	if !isPortProxyListenAddress(fields[0]) || !isValidIPAddress(fields[2]) {
+		return PortMapping{}, false
+	}
+
+	listenPort, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return PortMapping{}, false
+	}
+	connectPort := 0
+	if len(fields) == 4 {
+		if connectPort, err = strconv.Atoi(fields[3]); err != nil {
+			return PortMapping{}, false
 		}
 	}
 
-	return mappings, nil
+	// Normalize "*" so it compares equal to the 0.0.0.0 forwards are added with
+	listenAddress := fields[0]
+	if listenAddress == "*" {
+		listenAddress = defaultListenAddress
+	}
+
+	return PortMapping{
+		ExternalPort:  listenPort,
+		InternalPort:  connectPort,
+		TargetIP:      fields[2],
+		ListenAddress: listenAddress,
+	}, true
+}
+
+// isPortProxyListenAddress reports whether a listen address column holds an address
+func isPortProxyListenAddress(field string) bool {
+	return field == "*" || isValidIPAddress(field)
+}
+
+// isPortProxySeparator reports whether a line is the dashed row under the table headers
+func isPortProxySeparator(line string) bool {
+	line = strings.TrimSpace(line)
+	return line != "" && strings.Trim(line, "- \t") == ""
 }
 
-func (s *ServiceState) displayCurrentState() {
+func (s *ServiceState) displayCurrentState(snapshot *ReconcileSnapshot) {
+	// The display is for people; --log-format=json logs the changes instead
+	if jsonLogging {
+		return
+	}
 	fmt.Println("=== Current Port Forwarding State ===")
 
 	// Display running instances
-	runningNames := make([]string, 0, len(s.runningInstances))
-	for name := range s.runningInstances {
+	runningNames := make([]string, 0, len(snapshot.InstanceIPs))
+	for name := range snapshot.InstanceIPs {
 		runningNames = append(runningNames, name)
 	}
 
@@ -846,8 +3008,8 @@ func (s *ServiceState) displayCurrentState() {
 	fmt.Println("Active port forwarding:")
 
 	// Display port mappings by instance
-	for _, instance := range s.config.Instances {
-		ip, isRunning := s.runningInstances[instance.Name]
+	for _, instance := range snapshot.Config.Instances {
+		ip, isRunning := snapshot.InstanceIPs[instance.Name]
 		if !isRunning {
 			continue
 		}
@@ -867,7 +3029,9 @@ func (s *ServiceState) displayCurrentState() {
 
 			externalPort := port.ExternalPortEffective()
 			internalPort := port.InternalPortEffective()
-			if externalPort == internalPort {
+			if !port.IsEnabled() {
+				fmt.Printf("    %d disabled%s\n", externalPort, portComment)
+			} else if externalPort == internalPort {
 				fmt.Printf("    %d -> %s:%d%s\n", externalPort, ip, internalPort, portComment)
 			} else {
 				fmt.Printf("    %d -> %s:%d%s (external:%d -> internal:%d)\n", externalPort, ip, internalPort, portComment, externalPort, internalPort)
@@ -878,186 +3042,313 @@ func (s *ServiceState) displayCurrentState() {
 	fmt.Println()
 }
 
-func (s *ServiceState) reconcilePortForwarding(currentMappings map[int]PortMapping) {
-	fmt.Println("Checking port forwarding sync...")
+func (s *ServiceState) reconcilePortForwarding(snapshot *ReconcileSnapshot) ReconcileResult {
+	consoleEvent("info", "reconcile_start", EventFields{}, "Checking port forwarding sync...")
 
 	changesMade := false
+	currentMappings := snapshot.CurrentMappings
 
 	// Build desired state with conflict resolution
-	desiredMappings := make(map[int]PortMapping)
-	conflictedPorts := make(map[int][]string) // track conflicts for logging
-
-	// Process instances in config file order (deterministic)
-	for _, instance := range s.config.Instances {
-		ip, isRunning := s.runningInstances[instance.Name]
-		if !isRunning {
-			continue
+	desiredMappings, conflictedPorts := snapshot.DesiredMappings()
+	s.applyConnectFallback(snapshot, desiredMappings)
+	for externalPort, instances := range conflictedPorts {
+		for _, ignored := range instances[1:] {
+			s.logEventf("conflict", EventFields{Port: externalPort, Instance: ignored},
+				"WARNING: Instance '%s' port %d conflicts with '%s', ignoring", ignored, externalPort, instances[0])
+			say("  ⚠️  Port conflict: Instance '%s' port %d ignored (conflicts with '%s')",
+				ignored, externalPort, instances[0])
 		}
+	}
 
-		for _, port := range instance.Ports {
-			externalPort := port.ExternalPortEffective()
-			internalPort := port.InternalPortEffective()
-
-			// Check if this external port is already claimed
-			if existing, exists := desiredMappings[externalPort]; exists {
-				// Port conflict! Log warning and ignore this instance's port
-				log.Printf("WARNING: Instance '%s' port %d conflicts with '%s', ignoring",
-					instance.Name, externalPort, existing.Instance)
-				fmt.Printf("  ⚠️  Port conflict: Instance '%s' port %d ignored (conflicts with '%s')\n",
-					instance.Name, externalPort, existing.Instance)
-
-				// Track conflict for summary
-				if conflictedPorts[externalPort] == nil {
-					conflictedPorts[externalPort] = []string{existing.Instance}
-				}
-				conflictedPorts[externalPort] = append(conflictedPorts[externalPort], instance.Name)
-				continue
-			}
-
-			// No conflict, add mapping
-			desiredMappings[externalPort] = PortMapping{
-				ExternalPort: externalPort,
-				InternalPort: internalPort,
-				TargetIP:     ip,
-				Instance:     instance.Name,
-				Comment:      port.Comment,
-				FirewallMode: port.FirewallMode(),
-			}
+	for port, ruleName := range snapshot.BlockedPorts {
+		if _, forwarding := desiredMappings[port]; forwarding {
+			s.logEventf("blocked", EventFields{Port: port}, "WARNING: Port %d is blocked by firewall rule '%s', forward will not be reachable", port, ruleName)
+			say("  ⛔ Port %d is blocked by firewall rule '%s' (use --strict to skip it)", port, ruleName)
+		} else if snapshot.SkipBlocked {
+			consoleEvent("info", "blocked_skipped", EventFields{Port: port}, "  ⛔ Port %d skipped: blocked by firewall rule '%s'", port, ruleName)
 		}
 	}
 
+	if s.explain {
+		printReconcileExplanation(snapshot, desiredMappings)
+	}
+
 	// Display conflict summary if any conflicts occurred
-	if len(conflictedPorts) > 0 {
+	if len(conflictedPorts) > 0 && !jsonLogging {
 		fmt.Println("\n⚠️  External port conflicts detected:")
 		for externalPort, instances := range conflictedPorts {
 			fmt.Printf("  Port %d: %s (winner) vs %s (ignored)\n",
 				externalPort, instances[0], strings.Join(instances[1:], ", "))
 		}
 		fmt.Println("  First instance in config file wins, others ignored at runtime.")
+		printSharedPortGuidance("  ")
 		fmt.Println()
 	}
 
-	// Check for updates needed
+	// Forwards left pointing at an IP no instance has are corrected below
+	for _, stale := range snapshot.StaleMappings() {
+		s.logEventf("stale_mapping", EventFields{Port: stale.Port, Instance: stale.Instance, TargetIP: stale.TargetIP}, "Warning: Stale mapping: %s", stale.describe())
+		say("  ⚠️  Stale mapping: %s", stale.describe())
+	}
+
+	// Docker Desktop's forwards on configured ports are left alone
+	dockerMappings := snapshot.DockerMappings()
+	for _, port := range sortedMappingPorts(dockerMappings) {
+		mapping := dockerMappings[port]
+		s.logEventf("docker_port", EventFields{Port: port, TargetIP: mapping.TargetIP}, "Warning: Port %d is forwarded to Docker Desktop (%s:%d), not touching it; %s", port, mapping.TargetIP, mapping.InternalPort, dockerGuidance)
+		say("  🐳 Port %d belongs to Docker Desktop (%s:%d), left alone: %s", port, mapping.TargetIP, mapping.InternalPort, dockerGuidance)
+	}
+
+	// Apply this pass's netsh changes in one process where possible; the steps below
+	// then only record them (or run them one by one if the batch failed)
+	s.batchPortProxyChanges(snapshot, desiredMappings)
+	defer s.clearPortProxyBatch()
+
+	// Check for updates needed, noting ports that aren't live afterwards
+	failed := make(map[int]bool)
 	for port, desired := range desiredMappings {
 		current, exists := currentMappings[port]
+		fields := EventFields{Port: port, Instance: desired.Instance, TargetIP: desired.TargetIP}
 
 		if !exists {
 			// Add new mapping
 			if desired.ExternalPort == desired.InternalPort {
-				fmt.Printf("  Adding port %d: None -> %s:%d\n", desired.ExternalPort, desired.TargetIP, desired.InternalPort)
+				say("  Adding port %d: None -> %s:%d%s", desired.ExternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
 			} else {
-				fmt.Printf("  Adding port %d -> %d: None -> %s:%d\n", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort)
+				say("  Adding port %d -> %d: None -> %s:%d%s", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
 			}
-			if err := s.addPortMapping(desired.ExternalPort, desired.InternalPort, desired.TargetIP); err != nil {
-				log.Printf("Error adding port mapping %d->%d: %v", desired.ExternalPort, desired.InternalPort, err)
+			if err := s.addPortMapping(desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.Instance, desired.ListenAddress); err != nil {
+				s.logEventf("mapping_add_failed", fields, "Error adding port mapping %d->%d: %v", desired.ExternalPort, desired.InternalPort, err)
+				failed[port] = true
 			} else {
-				fmt.Printf("    ✓ Port %d->%d now forwarded to %s:%d\n", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort)
+				consoleEvent("info", "mapping_added", fields, "    ✓ Port %d->%d now forwarded to %s:%d%s", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
 				changesMade = true
+				s.probeMapping(desired)
 
 				// Handle firewall rule if requested
-				s.handleFirewallRule(desired)
+				if err := s.handleFirewallRule(desired); err != nil {
+					s.handleFirewallFailure(desired, err)
+					failed[port] = true
+				}
 			}
-		} else if current.TargetIP != desired.TargetIP || current.InternalPort != desired.InternalPort {
+		} else if mappingNeedsUpdate(current, desired) {
 			// Update existing mapping
 			if desired.ExternalPort == desired.InternalPort {
-				fmt.Printf("  Updating port %d: %s:%d -> %s:%d\n", desired.ExternalPort, current.TargetIP, current.InternalPort, desired.TargetIP, desired.InternalPort)
+				say("  Updating port %d: %s:%d -> %s:%d%s", desired.ExternalPort, current.TargetIP, current.InternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
 			} else {
-				fmt.Printf("  Updating port %d->%d: %s:%d -> %s:%d\n", desired.ExternalPort, desired.InternalPort, current.TargetIP, current.InternalPort, desired.TargetIP, desired.InternalPort)
+				say("  Updating port %d->%d: %s:%d -> %s:%d%s", desired.ExternalPort, desired.InternalPort, current.TargetIP, current.InternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
+			}
+			if !sameListenAddress(current.ListenAddress, desired.ListenAddress) {
+				say("    Rebinding from %s to %s", current.ListenAddress, desired.ListenAddress)
 			}
-			if err := s.updatePortMapping(desired.ExternalPort, desired.InternalPort, desired.TargetIP); err != nil {
-				log.Printf("Error updating port mapping %d->%d: %v", desired.ExternalPort, desired.InternalPort, err)
+			if err := s.updatePortMapping(desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.Instance, desired.ListenAddress); err != nil {
+				s.logEventf("mapping_update_failed", fields, "Error updating port mapping %d->%d: %v", desired.ExternalPort, desired.InternalPort, err)
+				failed[port] = true
 			} else {
-				fmt.Printf("    ✓ Port %d->%d now forwarded to %s:%d\n", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort)
+				consoleEvent("info", "mapping_updated", fields, "    ✓ Port %d->%d now forwarded to %s:%d%s", desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.InternalPort, s.dryRunTag())
 				changesMade = true
+				s.probeMapping(desired)
 
 				// Handle firewall rule if requested
-				s.handleFirewallRule(desired)
+				if err := s.handleFirewallRule(desired); err != nil {
+					s.handleFirewallFailure(desired, err)
+					failed[port] = true
+				}
 			}
 		}
 	}
 
-	// Check for mappings to remove
-	for port, _ := range currentMappings {
-		if _, needed := desiredMappings[port]; !needed {
-			// Check if this port belongs to one of our managed instances
-			belongsToUs := false
-			for _, instance := range s.config.Instances {
-				for _, configPort := range instance.Ports {
-					if configPort.ExternalPortEffective() == port {
-						belongsToUs = true
-						break
-					}
-				}
-				if belongsToUs {
-					break
-				}
+	// Release listen ports of instances that stopped
+	removeFailures := 0
+	for port, current := range currentMappings {
+		if snapshot.ShouldRemove(port, desiredMappings) {
+			fields := EventFields{Port: port, TargetIP: current.TargetIP}
+			if snapshot.Config.AdditiveOnly {
+				consoleEvent("info", "mapping_kept", fields, "  Keeping port %d (instance no longer running, additive_only set - remove it manually)", port)
+				continue
 			}
-
-			if belongsToUs {
-				fmt.Printf("  Removing port %d (instance no longer running)\n", port)
-				if err := s.removePortMapping(port); err != nil {
-					log.Printf("Error removing port mapping %d: %v", port, err)
-				} else {
-					fmt.Printf("    ✓ Port %d mapping removed\n", port)
-					changesMade = true
-				}
+			say("  Removing port %d (instance no longer running)%s", port, s.dryRunTag())
+			if err := s.removePortMapping(port); err != nil {
+				s.logEventf("mapping_remove_failed", fields, "Error removing port mapping %d: %v", port, err)
+				removeFailures++
+			} else {
+				consoleEvent("info", "mapping_removed", fields, "    ✓ Port %d mapping removed%s", port, s.dryRunTag())
+				changesMade = true
 			}
 		}
 	}
 
+	// Firewall rules outlive their forwards while the port stays configured, but not
+	// once it leaves the config
+	s.removeUnconfiguredFirewallRules()
+
+	// Keep qos_throttle_kbps policies in line with what is forwarded
+	s.reconcileQosPolicies(desiredMappings)
+
+	// Best-effort router forwards for upnp ports
+	s.reconcileUPnPMappings(desiredMappings)
+
+	// udp ports are relayed by the service itself
+	udpResult := s.reconcileUDPRelays(snapshot.DesiredUDPMappings())
+	changesMade = changesMade || udpResult.Changed
+	removeFailures += udpResult.Failures
+
+	// Tell the user when a forward comes up
+	s.announceLivePorts(desiredMappings, failed)
+
 	if !changesMade {
-		fmt.Println("  All port mappings are in sync")
+		consoleEvent("info", "in_sync", EventFields{}, "  All port mappings are in sync")
+	}
+	return ReconcileResult{Changed: changesMade, Failures: len(failed) + removeFailures}
+}
+
+// deferRegistryWrite queues a failed registry write for retry on later reconciles,
+// replacing any older pending write for the same resource
+func (s *ServiceState) deferRegistryWrite(key, description string, cause error, apply func(rm *RegistryManager) error) {
+	s.dropPendingRegistryWrites(key)
+	s.pendingWrites = append(s.pendingWrites, pendingRegistryWrite{key: key, description: description, apply: apply})
+	s.logf("Warning: Failed to %s in registry, deferring to next reconcile: %v", description, cause)
+}
+
+// dropPendingRegistryWrites forgets queued writes for a resource that no longer exists
+func (s *ServiceState) dropPendingRegistryWrites(key string) {
+	kept := s.pendingWrites[:0]
+	for _, write := range s.pendingWrites {
+		if write.key != key {
+			kept = append(kept, write)
+		}
+	}
+	s.pendingWrites = kept
+}
+
+// retryPendingRegistryWrites replays deferred registry writes, keeping any that fail again
+func (s *ServiceState) retryPendingRegistryWrites() {
+	if s.registryManager == nil || len(s.pendingWrites) == 0 {
+		return
+	}
+
+	var stillPending []pendingRegistryWrite
+	for _, write := range s.pendingWrites {
+		if err := write.apply(s.registryManager); err != nil {
+			s.logf("Warning: Deferred registry write still failing (%s): %v", write.description, err)
+			stillPending = append(stillPending, write)
+		} else {
+			log.Printf("Completed deferred registry write: %s", write.description)
+		}
+	}
+	s.pendingWrites = stillPending
+}
+
+// printReconcileExplanation prints the decision log requested with --explain
+func printReconcileExplanation(snapshot *ReconcileSnapshot, desiredMappings map[int]PortMapping) {
+	fmt.Println("  Reconcile decisions:")
+	for _, instance := range snapshot.Config.Instances {
+		for _, port := range instance.Ports {
+			fmt.Printf("    [%s] port %d: %s\n", instance.Name, port.ExternalPortEffective(),
+				snapshot.ExplainPort(instance.Name, port, desiredMappings))
+		}
 	}
 }
 
-func (s *ServiceState) addPortMapping(externalPort int, internalPort int, targetIP string) error {
-	cmd := exec.Command("netsh", "interface", "portproxy", "add", "v4tov4",
+// addPortMappingArgs returns the netsh arguments that add a forward
+func addPortMappingArgs(externalPort int, internalPort int, targetIP string, listenAddress string) []string {
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
+	}
+	return []string{"interface", "portproxy", "add", portProxyType(listenAddress, targetIP),
 		fmt.Sprintf("listenport=%d", externalPort),
-		"listenaddress=0.0.0.0",
+		fmt.Sprintf("listenaddress=%s", listenAddress),
 		fmt.Sprintf("connectport=%d", internalPort),
-		fmt.Sprintf("connectaddress=%s", targetIP))
+		fmt.Sprintf("connectaddress=%s", targetIP)}
+}
+
+func (s *ServiceState) addPortMapping(externalPort int, internalPort int, targetIP string, instance string, listenAddress string) error {
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
+	}
+	args := addPortMappingArgs(externalPort, internalPort, targetIP, listenAddress)
+	if s.skipForDryRun("netsh", args...) {
+		return nil
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("netsh add command failed: %v", err)
+	if err := s.runPortProxyCommand(args); err != nil {
+		return commandError(KindNetsh, fmt.Errorf("netsh add command failed: %w", err))
 	}
+	s.trackCreatedMapping(PortMapping{ExternalPort: externalPort, InternalPort: internalPort, TargetIP: targetIP, Instance: instance, ListenAddress: listenAddress})
 
 	// Register in registry for tracking
 	if s.registryManager != nil {
-		// Find the instance name for this mapping
-		instance := "unknown"
-		for instanceName, ip := range s.runningInstances {
-			if ip == targetIP {
-				instance = instanceName
-				break
-			}
+		if instance == "" {
+			instance = "unknown"
 		}
 		if err := s.registryManager.RegisterPortProxy(externalPort, targetIP, internalPort, instance); err != nil {
-			log.Printf("Warning: Failed to register port proxy in registry: %v", err)
+			s.deferRegistryWrite(fmt.Sprintf("proxy:%d", externalPort), fmt.Sprintf("register port proxy %d", externalPort), err,
+				func(rm *RegistryManager) error {
+					return rm.RegisterPortProxy(externalPort, targetIP, internalPort, instance)
+				})
 		}
 	}
 
 	return nil
 }
 
-func (s *ServiceState) updatePortMapping(externalPort int, internalPort int, targetIP string) error {
+func (s *ServiceState) updatePortMapping(externalPort int, internalPort int, targetIP string, instance string, listenAddress string) error {
 	// Remove existing mapping first
 	if err := s.removePortMapping(externalPort); err != nil {
-		return fmt.Errorf("failed to remove existing mapping: %v", err)
+		return fmt.Errorf("failed to remove existing mapping: %w", err)
 	}
 
 	// Add new mapping
-	return s.addPortMapping(externalPort, internalPort, targetIP)
+	return s.addPortMapping(externalPort, internalPort, targetIP, instance, listenAddress)
+}
+
+// removePortMappingArgs returns the netsh arguments that delete the installed forward
+// on port
+func (s *ServiceState) removePortMappingArgs(port int) []string {
+	// Delete from the table the existing mapping lives in
+	if current, exists := s.currentMappings[port]; exists && current.ListenAddress != "" {
+		return deletePortMappingArgs(port, current.ListenAddress, current.TargetIP)
+	}
+	return deletePortMappingArgs(port, defaultListenAddress, "")
+}
+
+// deletePortMappingArgs returns the netsh arguments that delete the forward on port
+// listening on listenAddress and connecting to targetIP
+func deletePortMappingArgs(port int, listenAddress string, targetIP string) []string {
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
+	}
+	args := []string{"interface", "portproxy", "delete", portProxyType(listenAddress, targetIP), fmt.Sprintf("listenport=%d", port)}
+	// Forwards bound to a specific host IP (listen_address) only match with it
+	if !sameListenAddress(listenAddress, defaultListenAddress) {
+		args = append(args, fmt.Sprintf("listenaddress=%s", listenAddress))
+	}
+	return args
 }
 
 func (s *ServiceState) removePortMapping(port int) error {
-	cmd := exec.Command("netsh", "interface", "portproxy", "delete", "v4tov4",
-		fmt.Sprintf("listenport=%d", port))
+	return s.deletePortMapping(port, s.removePortMappingArgs(port))
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("netsh delete command failed: %v", err)
+// rollbackPortMapping removes a forward this pass just installed. The current mappings
+// were read before it was added (or still describe the forward it replaced), so the
+// delete is built from the mapping itself.
+func (s *ServiceState) rollbackPortMapping(mapping PortMapping) error {
+	return s.deletePortMapping(mapping.ExternalPort, deletePortMappingArgs(mapping.ExternalPort, mapping.ListenAddress, mapping.TargetIP))
+}
+
+// deletePortMapping runs a portproxy delete for port and drops its tracking
+func (s *ServiceState) deletePortMapping(port int, args []string) error {
+	if s.skipForDryRun("netsh", args...) {
+		return nil
+	}
+	if err := s.runPortProxyCommand(args); err != nil {
+		return commandError(KindNetsh, fmt.Errorf("netsh delete command failed: %w", err))
 	}
 
 	// Unregister from registry
+	delete(s.createdMappings, port)
+	s.dropPendingRegistryWrites(fmt.Sprintf("proxy:%d", port))
 	if s.registryManager != nil {
 		if err := s.registryManager.UnregisterPortProxy(port); err != nil {
 			log.Printf("Warning: Failed to unregister port proxy from registry: %v", err)
@@ -1,9 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf16"
 )
 
 func TestPortExternalPortEffective(t *testing.T) {
@@ -179,6 +197,24 @@ func TestValidationValidInternalPortZero(t *testing.T) {
 	}
 }
 
+func TestValidationAddressFamily(t *testing.T) {
+	service := &ServiceState{}
+
+	for family, valid := range map[string]bool{"": true, "ipv4": true, "ipv6": true, "IPv6": false, "inet6": false} {
+		config := &Config{
+			CheckIntervalSeconds: 5,
+			Instances:            []Instance{{Name: "Ubuntu-1", AddressFamily: family, Ports: []Port{{Port: 8080}}}},
+		}
+		err := service.validateConfiguration(config)
+		if valid && err != nil {
+			t.Errorf("address_family %q should be valid, got: %v", family, err)
+		}
+		if !valid && (err == nil || !contains(err.Error(), "invalid address_family")) {
+			t.Errorf("address_family %q should be rejected, got: %v", family, err)
+		}
+	}
+}
+
 func TestRuntimeConflictResolution(t *testing.T) {
 	// This test would require mocking the running instances
 	// For now, we test that the validation allows duplicates
@@ -304,6 +340,12 @@ func TestPortFirewallMethods(t *testing.T) {
 			expectedMode:   "full",
 			expectedManage: true,
 		},
+		{
+			name:           "Remote IP allowlist",
+			port:           Port{Port: 8080, FirewallRemote: "10.8.0.0/24, 192.168.1.5"},
+			expectedMode:   "10.8.0.0/24,192.168.1.5",
+			expectedManage: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -358,6 +400,81 @@ func TestFirewallValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "Valid firewall_remote_ip",
+			config: &Config{
+				CheckIntervalSeconds: 5,
+				Instances: []Instance{
+					{
+						Name: "Test",
+						Ports: []Port{
+							{Port: 8080, FirewallRemote: "10.8.0.0/24,192.168.1.5,fd00::/8", FirewallDir: "both"},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid firewall_remote_ip CIDR",
+			config: &Config{
+				CheckIntervalSeconds: 5,
+				Instances: []Instance{
+					{
+						Name: "Test",
+						Ports: []Port{
+							{Port: 8080, FirewallRemote: "10.8.0.0/33"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "Empty firewall_remote_ip entry",
+			config: &Config{
+				CheckIntervalSeconds: 5,
+				Instances: []Instance{
+					{
+						Name: "Test",
+						Ports: []Port{
+							{Port: 8080, FirewallRemote: "10.8.0.0/24,"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "firewall together with firewall_remote_ip",
+			config: &Config{
+				CheckIntervalSeconds: 5,
+				Instances: []Instance{
+					{
+						Name: "Test",
+						Ports: []Port{
+							{Port: 8080, Firewall: "local", FirewallRemote: "10.8.0.0/24"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "firewall_remote_ip with outbound-only direction",
+			config: &Config{
+				CheckIntervalSeconds: 5,
+				Instances: []Instance{
+					{
+						Name: "Test",
+						Ports: []Port{
+							{Port: 8080, FirewallRemote: "10.8.0.0/24", FirewallDir: "out"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -370,15 +487,80 @@ func TestFirewallValidation(t *testing.T) {
 	}
 }
 
+func TestFirewallRemoteIPRule(t *testing.T) {
+	port := Port{Port: 8080, FirewallRemote: "10.8.0.0/24, 192.168.1.5"}
+	rule, err := newFirewallRuleSpec(8080, "Ubuntu", port.FirewallMode(), 0)
+	if err != nil {
+		t.Fatalf("newFirewallRuleSpec failed: %v", err)
+	}
+	if !contains(strings.Join(rule.NetshArgs(), " "), "localport=8080 remoteip=10.8.0.0/24,192.168.1.5 ") {
+		t.Errorf("unexpected netsh args: %q", rule.NetshArgs())
+	}
+
+	if _, err := newFirewallRuleSpec(8080, "Ubuntu", "10.8.0.0/24,nope", 0); err == nil {
+		t.Error("expected an invalid remote IP list to be rejected")
+	}
+}
+
+func TestExistingFirewallRuleChanges(t *testing.T) {
+	show := func(protocol, localPort, remoteIP string) []byte {
+		return []byte("\r\nRule Name:                            WSL2-Port-8080-x\r\n" +
+			"----------------------------------------------------------------------\r\n" +
+			"Enabled:                              Yes\r\n" +
+			"Direction:                            In\r\n" +
+			"Profiles:                             Domain,Private,Public\r\n" +
+			"LocalIP:                              Any\r\n" +
+			"RemoteIP:                             " + remoteIP + "\r\n" +
+			"Protocol:                             " + protocol + "\r\n" +
+			"LocalPort:                            " + localPort + "\r\n" +
+			"RemotePort:                           Any\r\n" +
+			"Action:                               Allow\r\nOk.\r\n")
+	}
+
+	tests := []struct {
+		name     string
+		output   []byte
+		mode     string
+		expected []string
+	}{
+		{"Unchanged local", show("TCP", "8080", "LocalSubnet"), "local", nil},
+		{"Unchanged full", show("TCP", "8080", "Any"), "full", nil},
+		{"Local to full", show("TCP", "8080", "LocalSubnet"), "full", []string{"remoteip LocalSubnet -> any"}},
+		{"Unchanged allowlist", show("TCP", "8080", "10.8.0.0/255.255.255.0,192.168.1.5/32"), "192.168.1.5,10.8.0.0/24", nil},
+		{"Allowlist changed", show("TCP", "8080", "10.8.0.0/255.255.255.0"), "10.9.0.0/24", []string{"remoteip 10.8.0.0/255.255.255.0 -> 10.9.0.0/24"}},
+		{"Protocol and port", show("UDP", "8081", "LocalSubnet"), "local", []string{"protocol UDP -> TCP", "localport 8081 -> 8080"}},
+		{"Unparseable output", []byte("Keine Regeln gefunden.\r\n"), "full", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := newFirewallRuleSpec(8080, "Ubuntu", tt.mode, 0)
+			if err != nil {
+				t.Fatalf("newFirewallRuleSpec failed: %v", err)
+			}
+			if got := existingFirewallRuleChanges(tt.output, rule); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("existingFirewallRuleChanges() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+
+	// Outbound rules are compared on their remote port
+	outbound := newOutboundFirewallRuleSpec(8080, 80, "Ubuntu")
+	existing := FirewallRule{Protocol: "TCP", LocalPort: "Any", RemotePort: "8080", RemoteIP: "LocalSubnet"}
+	if got := firewallRuleChanges(existing, outbound); !reflect.DeepEqual(got, []string{"remoteport 8080 -> 80"}) {
+		t.Errorf("firewallRuleChanges(outbound) = %q", got)
+	}
+}
+
 func TestFirewallRuleName(t *testing.T) {
 	tests := []struct {
 		port     int
 		instance string
 		expected string
 	}{
-		{8080, "Ubuntu-Dev", "WSL2-Port-8080-4815"}, // Calculated hash
-		{22, "Ubuntu-ML", "WSL2-Port-22-2341"},      // Different instance, different hash
-		{8080, "Ubuntu-Dev", "WSL2-Port-8080-4815"}, // Same input, same output
+		{8080, "Ubuntu-Dev", "WSL2-Port-8080-fcd79344dd6c5674"}, // FNV-1a of the instance name
+		{22, "Ubuntu-ML", "WSL2-Port-22-a6846096d0be3084"},      // Different instance, different hash
+		{8080, "Ubuntu-Dev", "WSL2-Port-8080-fcd79344dd6c5674"}, // Same input, same output
 	}
 
 	for _, tt := range tests {
@@ -391,6 +573,102 @@ func TestFirewallRuleName(t *testing.T) {
 	}
 }
 
+func TestFirewallRuleNameCollisions(t *testing.T) {
+	// These instance names shared a rule name under the old 4-digit hash
+	if legacyFirewallRuleName(8080, "Ubuntu-Dev") != legacyFirewallRuleName(8080, "Debian-gue") {
+		t.Fatal("expected the legacy names to collide")
+	}
+	if generateFirewallRuleName(8080, "Ubuntu-Dev") == generateFirewallRuleName(8080, "Debian-gue") {
+		t.Error("different instances must not share a firewall rule name")
+	}
+
+	seen := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		instance := fmt.Sprintf("distro-%d", i)
+		name := generateFirewallRuleName(8080, instance)
+		if other, exists := seen[name]; exists {
+			t.Fatalf("%s and %s share rule name %s", other, instance, name)
+		}
+		seen[name] = instance
+	}
+}
+
+func TestDryRunFirewallRuleUpdate(t *testing.T) {
+	rule, err := newFirewallRuleSpec(8080, "Ubuntu", "full", 0)
+	if err != nil {
+		t.Fatalf("newFirewallRuleSpec failed: %v", err)
+	}
+
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		if strings.Join(args, " ") == "advfirewall firewall show rule name="+rule.Name {
+			return []byte("Rule Name: " + rule.Name + "\r\nRemoteIP: LocalSubnet\r\nProtocol: TCP\r\nLocalPort: 8080\r\n"), nil
+		}
+		return nil, errors.New("No rules match the specified criteria")
+	}}
+
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	var out bytes.Buffer
+	log.SetOutput(&out)
+
+	// The existing rule is read through the runner, so the dry run reports the update
+	service := &ServiceState{runner: runner, dryRun: true}
+	if err := service.createFirewallRule(rule); err != nil {
+		t.Fatalf("createFirewallRule failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "delete rule name="+rule.Name) || !strings.Contains(out.String(), "remoteip=any") {
+		t.Errorf("expected the dry run to recreate the outdated rule:\n%s", out.String())
+	}
+	if len(runner.commands) == 0 || runner.commands[0] != "netsh advfirewall firewall show rule name="+rule.Name {
+		t.Errorf("expected the rule to be looked up through the runner, ran %q", runner.commands)
+	}
+}
+
+func TestLegacyFirewallRuleMigration(t *testing.T) {
+	rule, err := newFirewallRuleSpec(8080, "Ubuntu", "local", 0)
+	if err != nil {
+		t.Fatalf("newFirewallRuleSpec failed: %v", err)
+	}
+	legacy := legacyFirewallRuleName(8080, "Ubuntu")
+
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+
+	for _, legacyExists := range []bool{true, false} {
+		t.Run(fmt.Sprintf("legacy rule exists %v", legacyExists), func(t *testing.T) {
+			var out bytes.Buffer
+			log.SetOutput(&out)
+
+			runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+				if strings.Join(args, " ") == "advfirewall firewall show rule name="+legacy && legacyExists {
+					return []byte("Rule Name: " + legacy + "\r\n"), nil
+				}
+				return nil, errors.New("No rules match the specified criteria")
+			}}
+			service := &ServiceState{runner: runner, dryRun: true}
+			service.createFirewallRule(rule)
+			service.createFirewallRule(rule)
+
+			if deleted := strings.Contains(out.String(), "delete rule name="+legacy); deleted != legacyExists {
+				t.Errorf("legacy rule deleted = %v, want %v:\n%s", deleted, legacyExists, out.String())
+			}
+			shown := 0
+			for _, command := range runner.commands {
+				if command == "netsh advfirewall firewall show rule name="+legacy {
+					shown++
+				}
+			}
+			if shown != 1 {
+				t.Errorf("legacy rule looked up %d times, want once per rule", shown)
+			}
+		})
+	}
+}
+
 // Helper function for string contains check
 func contains(s, substr string) bool {
 	for i := 0; i <= len(s)-len(substr); i++ {
@@ -475,6 +753,24 @@ func TestDecodeCommandOutput(t *testing.T) {
 			expected: "Helo",
 			descr:    "Even length non-UTF-16 should be treated as UTF-8",
 		},
+		{
+			name:     "UTF-16BE with BOM",
+			input:    []byte{0xFE, 0xFF, 0x00, 0x48, 0x00, 0x69},
+			expected: "Hi",
+			descr:    "UTF-16BE with BOM should be byte-swapped and decoded",
+		},
+		{
+			name:     "UTF-8 with BOM",
+			input:    []byte{0xEF, 0xBB, 0xBF, 'H', 'i'},
+			expected: "Hi",
+			descr:    "A UTF-8 BOM should be stripped",
+		},
+		{
+			name:     "ASCII containing a NUL",
+			input:    []byte{'O', 'K', 0x00, '!'},
+			expected: "OK\x00!",
+			descr:    "A stray NUL should not make ASCII look like UTF-16",
+		},
 	}
 
 	for _, tt := range tests {
@@ -492,3 +788,4550 @@ func TestDecodeCommandOutput(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeCommandOutputEncodings(t *testing.T) {
+	text := "Ubuntu-Dév (Default)\r\nListen on ipv4: 8080\r\n"
+	units := utf16.Encode([]rune(text))
+	le := make([]byte, 0, len(units)*2)
+	be := make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		le = append(le, byte(unit), byte(unit>>8))
+		be = append(be, byte(unit>>8), byte(unit))
+	}
+
+	variants := map[string][]byte{
+		"UTF-8":             []byte(text),
+		"UTF-8 with BOM":    append([]byte{0xEF, 0xBB, 0xBF}, text...),
+		"UTF-16LE":          le,
+		"UTF-16LE with BOM": append([]byte{0xFF, 0xFE}, le...),
+		"UTF-16BE":          be,
+		"UTF-16BE with BOM": append([]byte{0xFE, 0xFF}, be...),
+	}
+	for name, input := range variants {
+		result, err := decodeCommandOutput(input)
+		if err != nil {
+			t.Fatalf("%s: decodeCommandOutput failed: %v", name, err)
+		}
+		if result != text {
+			t.Errorf("%s: got %q, want %q", name, result, text)
+		}
+	}
+}
+
+func TestReconcileSnapshotIsolatedFromMutation(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 2201, InternalPort: 22}}},
+		},
+	}
+	instanceIPs := map[string]string{"Ubuntu-Dev": "172.20.0.2"}
+	currentMappings := map[int]PortMapping{
+		2201: {ExternalPort: 2201, InternalPort: 22, TargetIP: "172.20.0.2"},
+	}
+
+	snapshot := newReconcileSnapshot(config, instanceIPs, currentMappings)
+
+	// Simulate the instance IP changing and netsh state moving mid-reconcile
+	instanceIPs["Ubuntu-Dev"] = "172.20.0.99"
+	delete(currentMappings, 2201)
+
+	desired, _ := snapshot.DesiredMappings()
+	if got := desired[2201].TargetIP; got != "172.20.0.2" {
+		t.Errorf("desired TargetIP = %s, want snapshot value 172.20.0.2", got)
+	}
+	if _, exists := snapshot.CurrentMappings[2201]; !exists {
+		t.Error("snapshot current mappings should not be affected by caller mutation")
+	}
+}
+
+func TestReconcileSnapshotDesiredMappings(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 8080, InternalPort: 80, Firewall: "local"}}},
+			{Name: "Ubuntu-Staging", Ports: []Port{{Port: 8080}}},
+			{Name: "Ubuntu-ML", Ports: []Port{{Port: 8888}}},
+		},
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{
+		"Ubuntu-Dev":     "172.20.0.2",
+		"Ubuntu-Staging": "172.20.0.3",
+	}, nil)
+
+	desired, conflicts := snapshot.DesiredMappings()
+
+	if len(desired) != 1 {
+		t.Fatalf("expected 1 desired mapping, got %d", len(desired))
+	}
+	mapping := desired[8080]
+	if mapping.Instance != "Ubuntu-Dev" || mapping.InternalPort != 80 || mapping.FirewallMode != "local" {
+		t.Errorf("unexpected winning mapping: %+v", mapping)
+	}
+	if got := conflicts[8080]; len(got) != 2 || got[0] != "Ubuntu-Dev" || got[1] != "Ubuntu-Staging" {
+		t.Errorf("conflicts[8080] = %v, want [Ubuntu-Dev Ubuntu-Staging]", got)
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		expected    CommandLineOptions
+		expectError bool
+	}{
+		{
+			name:     "Config file only",
+			args:     []string{"wsl2-config.json"},
+			expected: CommandLineOptions{ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Validate mode",
+			args:     []string{"--validate", "wsl2-config.json"},
+			expected: CommandLineOptions{ValidateOnly: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Explain mode after config file",
+			args:     []string{"wsl2-config.json", "--explain"},
+			expected: CommandLineOptions{Explain: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Debug logging",
+			args:     []string{"--debug", "wsl2-config.json"},
+			expected: CommandLineOptions{Debug: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Firewall management disabled",
+			args:     []string{"--no-firewall", "wsl2-config.json"},
+			expected: CommandLineOptions{NoFirewall: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Dry run",
+			args:     []string{"--dry-run", "wsl2-config.json"},
+			expected: CommandLineOptions{DryRun: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Cleanup",
+			args:     []string{"--cleanup", "--dry-run", "wsl2-config.json"},
+			expected: CommandLineOptions{Cleanup: true, DryRun: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Cleanup on exit",
+			args:     []string{"--cleanup-on-exit", "wsl2-config.json"},
+			expected: CommandLineOptions{CleanupOnExit: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Status",
+			args:     []string{"--status", "wsl2-config.json"},
+			expected: CommandLineOptions{Status: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Max runtime",
+			args:     []string{"--max-runtime", "30s", "wsl2-config.json"},
+			expected: CommandLineOptions{MaxRuntime: 30 * time.Second, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Max runtime with equals",
+			args:     []string{"wsl2-config.json", "--max-runtime=2m"},
+			expected: CommandLineOptions{MaxRuntime: 2 * time.Minute, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Startup audit",
+			args:     []string{"--startup-audit", "wsl2-config.json"},
+			expected: CommandLineOptions{StartupAudit: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Tag filters",
+			args:     []string{"--tag", "web", "--tag=db", "wsl2-config.json"},
+			expected: CommandLineOptions{Tags: []string{"web", "db"}, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Deep validation",
+			args:     []string{"--validate", "--deep", "wsl2-config.json"},
+			expected: CommandLineOptions{ValidateOnly: true, Deep: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "JSON log format",
+			args:     []string{"--log-format", "json", "wsl2-config.json"},
+			expected: CommandLineOptions{LogFormat: "json", ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Install service",
+			args:     []string{"--install-service", "--allow-comments", "wsl2-config.json"},
+			expected: CommandLineOptions{InstallService: true, AllowComments: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Uninstall service without config file",
+			args:     []string{"--uninstall-service"},
+			expected: CommandLineOptions{UninstallService: true},
+		},
+		{
+			name:     "Run service",
+			args:     []string{"--run-service", "C:\\wsl2\\wsl2-config.json"},
+			expected: CommandLineOptions{RunService: true, ConfigFile: "C:\\wsl2\\wsl2-config.json"},
+		},
+		{
+			name:     "Event log",
+			args:     []string{"--eventlog", "wsl2-config.json"},
+			expected: CommandLineOptions{EventLog: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "List registry entries",
+			args:     []string{"--list"},
+			expected: CommandLineOptions{List: true},
+		},
+		{
+			name:     "List registry entries as JSON",
+			args:     []string{"--list", "--json", "--compact"},
+			expected: CommandLineOptions{List: true, JSON: true, JSONStyle: jsonStyle{explicit: true}},
+		},
+		{
+			name:     "Registry audit",
+			args:     []string{"--audit"},
+			expected: CommandLineOptions{Audit: true},
+		},
+		{
+			name:     "Registry cleanup",
+			args:     []string{"--cleanup-registry"},
+			expected: CommandLineOptions{CleanupRegistry: true},
+		},
+		{
+			name:     "Remove firewall rules without prompting",
+			args:     []string{"--remove-firewall-rules", "--yes"},
+			expected: CommandLineOptions{RemoveFirewallRules: true, Yes: true},
+		},
+		{
+			name:     "List firewall rules to remove",
+			args:     []string{"--remove-firewall-rules", "--dry-run"},
+			expected: CommandLineOptions{RemoveFirewallRules: true, DryRun: true},
+		},
+		{name: "Audit with registry cleanup", args: []string{"--audit", "--cleanup-registry"}, expectError: true},
+		{name: "Remove firewall rules with cleanup", args: []string{"--remove-firewall-rules", "--cleanup", "wsl2-config.json"}, expectError: true},
+		{name: "Yes without remove firewall rules", args: []string{"--yes", "wsl2-config.json"}, expectError: true},
+		{
+			name:     "Print schema",
+			args:     []string{"--print-schema", "--pretty"},
+			expected: CommandLineOptions{PrintSchema: true, JSONStyle: jsonStyle{explicit: true, pretty: true}},
+		},
+		{name: "Print schema with list", args: []string{"--print-schema", "--list"}, expectError: true},
+		{
+			name:     "Connectivity self-test",
+			args:     []string{"--test", "wsl2-config.json"},
+			expected: CommandLineOptions{Test: true, ConfigFile: "wsl2-config.json"},
+		},
+		{
+			name:     "Connectivity self-test with timeout",
+			args:     []string{"--test", "--test-timeout=10s", "wsl2-config.json"},
+			expected: CommandLineOptions{Test: true, TestTimeout: 10 * time.Second, ConfigFile: "wsl2-config.json"},
+		},
+		{name: "Self-test without config file", args: []string{"--test"}, expectError: true},
+		{name: "Self-test with validate", args: []string{"--test", "--validate", "wsl2-config.json"}, expectError: true},
+		{name: "Test timeout without test", args: []string{"--test-timeout", "5s", "wsl2-config.json"}, expectError: true},
+		{name: "Test timeout not a duration", args: []string{"--test", "--test-timeout", "0s", "wsl2-config.json"}, expectError: true},
+		{name: "Audit with validate", args: []string{"--audit", "--validate", "wsl2-config.json"}, expectError: true},
+		{name: "JSON without list", args: []string{"--json", "wsl2-config.json"}, expectError: true},
+		{name: "List with status", args: []string{"--list", "--status", "wsl2-config.json"}, expectError: true},
+		{name: "Install service without config file", args: []string{"--install-service"}, expectError: true},
+		{name: "Install and uninstall service", args: []string{"--install-service", "--uninstall-service", "wsl2-config.json"}, expectError: true},
+		{name: "Run service with validate", args: []string{"--run-service", "--validate", "wsl2-config.json"}, expectError: true},
+		{name: "Unknown log format", args: []string{"--log-format=xml", "wsl2-config.json"}, expectError: true},
+		{name: "Deep without validate", args: []string{"--deep", "wsl2-config.json"}, expectError: true},
+		{name: "Deep with config check only", args: []string{"--config-check-only", "--deep", "wsl2-config.json"}, expectError: true},
+		{name: "Tag without name", args: []string{"wsl2-config.json", "--tag"}, expectError: true},
+		{name: "Max runtime without duration", args: []string{"wsl2-config.json", "--max-runtime"}, expectError: true},
+		{name: "Max runtime not a duration", args: []string{"--max-runtime", "soon", "wsl2-config.json"}, expectError: true},
+		{name: "Missing config file", args: []string{"--explain"}, expectError: true},
+		{name: "Unknown option", args: []string{"--bogus", "wsl2-config.json"}, expectError: true},
+		{name: "Two config files", args: []string{"a.json", "b.json"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parseCommandLine(tt.args)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("parseCommandLine() error = %v, expectError = %v", err, tt.expectError)
+			}
+			if err == nil && !reflect.DeepEqual(*opts, tt.expected) {
+				t.Errorf("parseCommandLine() = %+v, want %+v", *opts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServiceCommandLine(t *testing.T) {
+	args := []string{"--install-service", "--tag", "web", "wsl2-config.json", "--allow-comments"}
+	vars := map[string]string{"WEB_PORT": "8080", "DB_PORT": "5432"}
+
+	got, err := serviceCommandLine(args, "wsl2-config.json", vars)
+	if err != nil {
+		t.Fatalf("serviceCommandLine failed: %v", err)
+	}
+	absConfig, _ := filepath.Abs("wsl2-config.json")
+	expected := []string{"--run-service", "--tag", "web", absConfig, "--allow-comments",
+		"--var", "DB_PORT=5432", "--var", "WEB_PORT=8080"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("serviceCommandLine() = %q, want %q", got, expected)
+	}
+}
+
+func TestWriteRegistryList(t *testing.T) {
+	list := RegistryList{
+		PortProxies: []RegistryPortProxy{
+			{Key: "proxy_8080_20250301_103000", ListenPort: 8080, ConnectAddress: "172.20.0.2", ConnectPort: 80, Instance: "Ubuntu", Timestamp: "2025-03-01 10:30:00"},
+		},
+	}
+
+	var out bytes.Buffer
+	writeRegistryList(&out, list)
+	expected := "Port proxies (1):\n" +
+		"  KEY                         PORT  TARGET         INSTANCE  TIMESTAMP\n" +
+		"  proxy_8080_20250301_103000  8080  172.20.0.2:80  Ubuntu    2025-03-01 10:30:00\n" +
+		"\n" +
+		"Firewall rules (0):\n"
+	if out.String() != expected {
+		t.Errorf("writeRegistryList() =\n%s\nwant\n%s", out.String(), expected)
+	}
+
+	data, err := marshalJSON(list, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(string(data), `"port_proxies":[{"key":"proxy_8080_20250301_103000","listen_port":8080,"connect_address":"172.20.0.2"`) {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+}
+
+func TestParseListeningPorts(t *testing.T) {
+	output := `LISTEN 0      4096         0.0.0.0:22        0.0.0.0:*
+LISTEN 0      511        127.0.0.1:5432      0.0.0.0:*
+LISTEN 0      4096   127.0.0.53%lo:53        0.0.0.0:*
+LISTEN 0      511             [::]:80           [::]:*
+LISTEN 0      511         172.20.0.2:8080    0.0.0.0:*
+LISTEN 0      511                *:3000            *:*
+`
+	listeners := parseListeningPorts(output)
+
+	tests := []struct {
+		port      int
+		listening bool
+		reaches   bool
+	}{
+		{22, true, true},
+		{5432, true, false}, // loopback only
+		{53, true, false},
+		{80, true, true},
+		{8080, true, true}, // bound to the instance IP
+		{3000, true, true},
+		{9000, false, false},
+	}
+	for _, tt := range tests {
+		addrs, listening := listeners[tt.port]
+		if listening != tt.listening {
+			t.Errorf("port %d: listening = %v, want %v", tt.port, listening, tt.listening)
+		}
+		if got := listenerReaches(addrs, "172.20.0.2"); got != tt.reaches {
+			t.Errorf("port %d (%v): listenerReaches = %v, want %v", tt.port, addrs, got, tt.reaches)
+		}
+	}
+}
+
+func TestTaggedConfig(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Web", Tags: []string{"web", "team-x"}, Ports: []Port{{Port: 8080}}},
+			{Name: "DB", Tags: []string{"db"}, Ports: []Port{{Port: 5432}}},
+			{Name: "Scratch", Ports: []Port{{Port: 3000}}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		tags     []string
+		expected []string
+	}{
+		{"No filter", nil, []string{"Web", "DB", "Scratch"}},
+		{"One tag", []string{"web"}, []string{"Web"}},
+		{"Any tag matches", []string{"db", "team-x"}, []string{"Web", "DB"}},
+		{"Case insensitive", []string{"DB"}, []string{"DB"}},
+		{"No match", []string{"cache"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for _, instance := range config.TaggedConfig(tt.tags).Instances {
+				names = append(names, instance.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("TaggedConfig(%v) instances = %v, want %v", tt.tags, names, tt.expected)
+			}
+		})
+	}
+
+	// Tagged-out instances' forwards are neither desired nor removed
+	tagged := config.TaggedConfig([]string{"web"})
+	current := map[int]PortMapping{5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}}
+	snapshot := newReconcileSnapshot(tagged, map[string]string{"Web": "172.20.0.2"}, current)
+	desired, _ := snapshot.DesiredMappings()
+	if _, exists := desired[5432]; exists || snapshot.ShouldRemove(5432, desired) {
+		t.Error("a tagged-out instance's forward should be left alone")
+	}
+
+	config.Instances[0].Tags = []string{" "}
+	if err := (&ServiceState{}).validateConfiguration(config); err == nil {
+		t.Error("expected validation error for empty tags entry")
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		expected int
+	}{
+		{"Clean run", nil, 0},
+		{"Warnings only", []string{"Warning: Failed to get IP for instance Ubuntu: exit status 1"}, 2},
+		{"Errors and warnings", []string{"WARNING: Port 8080 is blocked", "Error adding port mapping 8080->80: exit status 1"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &ServiceState{logDedup: NewLogDeduplicator(0)}
+			service.logDedup.output = func(string) {}
+			for _, message := range tt.messages {
+				service.logf("%s", message)
+			}
+			if got := service.runExitCode(); got != tt.expected {
+				t.Errorf("runExitCode() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReconcileSnapshotExplainPort(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 2201, InternalPort: 22}, {Port: 8080}, {Port: 3000}, {Port: 9000, InternalPort: 90}}},
+			{Name: "Ubuntu-Staging", Ports: []Port{{Port: 8080}}},
+			{Name: "Ubuntu-ML", Ports: []Port{{Port: 8888}, {Port: 6006}}},
+		},
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{
+		"Ubuntu-Dev":     "172.20.0.2",
+		"Ubuntu-Staging": "172.20.0.3",
+	}, map[int]PortMapping{
+		2201: {ExternalPort: 2201, InternalPort: 22, TargetIP: "172.20.0.2"},
+		8080: {ExternalPort: 8080, InternalPort: 8080, TargetIP: "172.20.0.1"},
+		9000: {ExternalPort: 9000, InternalPort: 9000, TargetIP: "172.20.0.2"},
+		6006: {ExternalPort: 6006, InternalPort: 6006, TargetIP: "172.20.0.4"},
+	})
+	desired, _ := snapshot.DesiredMappings()
+
+	tests := []struct {
+		instance string
+		port     Port
+		expected string
+	}{
+		{"Ubuntu-Dev", Port{Port: 2201, InternalPort: 22}, "already in sync -> 172.20.0.2:22"},
+		{"Ubuntu-Dev", Port{Port: 8080}, "IP changed from 172.20.0.1 to 172.20.0.2, will update"},
+		{"Ubuntu-Dev", Port{Port: 3000}, "not forwarded yet, will add -> 172.20.0.2:3000"},
+		{"Ubuntu-Dev", Port{Port: 9000, InternalPort: 90}, "internal port changed from 9000 to 90, will update"},
+		{"Ubuntu-Staging", Port{Port: 8080}, "lost conflict to instance Ubuntu-Dev (earlier in config)"},
+		{"Ubuntu-ML", Port{Port: 8888}, "instance not running, nothing to forward"},
+		{"Ubuntu-ML", Port{Port: 6006}, "instance not running, existing forward to 172.20.0.4:6006 will be removed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-%d", tt.instance, tt.port.Port), func(t *testing.T) {
+			if got := snapshot.ExplainPort(tt.instance, tt.port, desired); got != tt.expected {
+				t.Errorf("ExplainPort() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseConfigDataWithComments(t *testing.T) {
+	jsonc := `{
+	// How often to poll WSL
+	"check_interval_seconds": 5, /* seconds */
+	"instances": [
+		{
+			"name": "Ubuntu-Dev",
+			"comment": "see http://example.com/docs // not a comment",
+			"ports": [
+				/* SSH
+				   forwarded from 2201 */
+				{"port": 2201, "internal_port": 22}
+			]
+		}
+	]
+}`
+
+	config, err := parseConfigData([]byte(jsonc), true)
+	if err != nil {
+		t.Fatalf("parseConfigData() failed: %v", err)
+	}
+	if config.CheckIntervalSeconds != 5 || len(config.Instances) != 1 {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	if got := config.Instances[0].Comment; got != "see http://example.com/docs // not a comment" {
+		t.Errorf("comment inside string was altered: %q", got)
+	}
+	if got := config.Instances[0].Ports[0].InternalPort; got != 22 {
+		t.Errorf("InternalPort = %d, want 22", got)
+	}
+
+	if _, err := parseConfigData([]byte(jsonc), false); err == nil {
+		t.Error("expected parse error for comments when comments are not allowed")
+	}
+}
+
+func TestParseConfigDataErrorLineNumbers(t *testing.T) {
+	jsonc := "{\n  // comment\n  /* block\n     comment */\n  \"check_interval_seconds\": 5,,\n}"
+
+	_, err := parseConfigData([]byte(jsonc), true)
+	if err == nil {
+		t.Fatal("expected syntax error")
+	}
+	if !contains(err.Error(), "line 5,") {
+		t.Errorf("expected error to reference line 5, got: %v", err)
+	}
+
+	_, err = parseConfigData([]byte("{\n  /* never closed\n}"), true)
+	if err == nil || !contains(err.Error(), "line 2, column 3: unterminated block comment") {
+		t.Errorf("expected unterminated comment error on line 2, got: %v", err)
+	}
+}
+
+func TestConfigAllowsComments(t *testing.T) {
+	tests := []struct {
+		file     string
+		flag     bool
+		expected bool
+	}{
+		{"wsl2-config.json", false, false},
+		{"wsl2-config.json", true, true},
+		{"wsl2-config.jsonc", false, true},
+		{"WSL2-CONFIG.JSONC", false, true},
+	}
+
+	for _, tt := range tests {
+		if got := configAllowsComments(tt.file, tt.flag); got != tt.expected {
+			t.Errorf("configAllowsComments(%s, %v) = %v, want %v", tt.file, tt.flag, got, tt.expected)
+		}
+	}
+}
+
+func TestDefaultCheckInterval(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		file     string
+		config   string
+		expected int // 0 = rejected
+	}{
+		{"Omitted", "omitted.json", `{"instances": []}`, defaultCheckIntervalSeconds},
+		{"Zero", "zero.json", `{"check_interval_seconds": 0, "instances": []}`, defaultCheckIntervalSeconds},
+		{"Set", "set.json", `{"check_interval_seconds": 30, "instances": []}`, 30},
+		{"Omitted in YAML", "omitted.yaml", "instances: []\n", defaultCheckIntervalSeconds},
+		{"Negative", "negative.json", `{"check_interval_seconds": -5, "instances": []}`, 0},
+		{"Too long", "long.json", `{"check_interval_seconds": 3601, "instances": []}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfigFile(path, false)
+			if tt.expected == 0 {
+				if err == nil || !contains(err.Error(), "check_interval_seconds must be between 1 and 3600") {
+					t.Errorf("expected check_interval_seconds to be rejected, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigFile failed: %v", err)
+			}
+			if config.CheckIntervalSeconds != tt.expected {
+				t.Errorf("check interval = %d, want %d", config.CheckIntervalSeconds, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := parseConfig("config.json", []byte(`{
+		"defaults": {"firewall": "local", "listen_address": "lan", "protocol": "tcp"},
+		"instances": [
+			{"name": "Ubuntu", "defaults": {"firewall": "full"}, "ports": [
+				{"port": 8080},
+				{"port": 8443, "firewall": "local", "listen_address": "127.0.0.1"},
+				{"port": 5353, "protocol": "udp"},
+				{"port": 2222, "firewall_remote_ip": "10.8.0.0/24"},
+				{"port": 9000, "firewall": "none"}
+			]},
+			{"name": "Debian", "ports": [
+				{"port": 3000}
+			]},
+			{"name": "Alpine", "defaults": {"firewall": "none"}, "ports": [
+				{"port": 4000},
+				{"port": 4001, "firewall": "local"}
+			]}
+		]
+	}`), false)
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		port          Port
+		firewall      string
+		listenAddress string
+		protocol      string
+	}{
+		{"Instance over top-level", config.Instances[0].Ports[0], "full", "lan", "tcp"},
+		{"Port over instance and top-level", config.Instances[0].Ports[1], "local", "127.0.0.1", "tcp"},
+		{"Port protocol over top-level", config.Instances[0].Ports[2], "full", "lan", "udp"},
+		{"No firewall next to firewall_remote_ip", config.Instances[0].Ports[3], "", "lan", "tcp"},
+		{"Port opts out of the firewall", config.Instances[0].Ports[4], "", "lan", "tcp"},
+		{"Instance opts out of the firewall", config.Instances[2].Ports[0], "", "lan", "tcp"},
+		{"Port over an instance opt-out", config.Instances[2].Ports[1], "local", "lan", "tcp"},
+		{"Top-level only", config.Instances[1].Ports[0], "local", "lan", "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.port.Firewall != tt.firewall || tt.port.ListenAddress != tt.listenAddress || tt.port.Protocol != tt.protocol {
+				t.Errorf("port %d = firewall %q, listen_address %q, protocol %q; want %q, %q, %q",
+					tt.port.Port, tt.port.Firewall, tt.port.ListenAddress, tt.port.Protocol, tt.firewall, tt.listenAddress, tt.protocol)
+			}
+		})
+	}
+}
+
+func TestParseConfigTOML(t *testing.T) {
+	jsonConfig := `{
+		"check_interval_seconds": 5,
+		"additive_only": true,
+		"defaults": {"firewall": "local"},
+		"instances": [
+			{"name": "Ubuntu", "tags": ["web"], "ports": [
+				{"port": 8080, "internal_port": 80, "comment": "web"},
+				{"port": 5353, "protocol": "udp", "enabled": false}
+			]},
+			{"name": "Debian", "ports": [{"port": 5432, "firewall": "full"}]}
+		]
+	}`
+	tomlConfig := `
+# Comments are allowed
+check_interval_seconds = 5
+additive_only = true
+
+[defaults]
+firewall = "local"
+
+[[instances]]
+name = "Ubuntu"
+tags = ["web"]
+
+  [[instances.ports]]
+  port = 8080
+  internal_port = 80
+  comment = "web"
+
+  [[instances.ports]]
+  port = 5353
+  protocol = "udp"
+  enabled = false
+
+[[instances]]
+name = "Debian"
+ports = [{ port = 5432, firewall = "full" }]
+`
+
+	expected, err := parseConfig("wsl2-config.json", []byte(jsonConfig), false)
+	if err != nil {
+		t.Fatalf("unexpected JSON error: %v", err)
+	}
+	config, err := parseConfig("wsl2-config.toml", []byte(tomlConfig), false)
+	if err != nil {
+		t.Fatalf("unexpected TOML error: %v", err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("got %+v, want %+v", config, expected)
+	}
+
+	// The same logical config validates the same way in either format
+	service := &ServiceState{}
+	for _, mutate := range []func(c *Config){
+		func(c *Config) {},
+		func(c *Config) { c.Instances[1].Ports[0].Port = 70000 },
+		func(c *Config) { c.Instances[0].Ports[0].Firewall = "open" },
+	} {
+		jsonParsed, _ := parseConfig("wsl2-config.json", []byte(jsonConfig), false)
+		tomlParsed, _ := parseConfig("wsl2-config.toml", []byte(tomlConfig), false)
+		mutate(jsonParsed)
+		mutate(tomlParsed)
+		jsonErr, tomlErr := service.validateConfiguration(jsonParsed), service.validateConfiguration(tomlParsed)
+		if fmt.Sprint(jsonErr) != fmt.Sprint(tomlErr) {
+			t.Errorf("validation differs: JSON %v, TOML %v", jsonErr, tomlErr)
+		}
+	}
+
+	if _, err := parseConfig("wsl2-config.toml", []byte("instances = [unclosed"), false); err == nil {
+		t.Error("expected invalid TOML to fail to parse")
+	}
+	if got := configFormat("WSL2-CONFIG.TOML"); got != "TOML" {
+		t.Errorf("configFormat(toml) = %s, want TOML", got)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema()
+	instance, port := schema.Defs["Instance"], schema.Defs["Port"]
+	if instance == nil || port == nil || schema.Defs["PortDefaults"] == nil {
+		t.Fatalf("missing definitions: %v", schema.Defs)
+	}
+	if got := schema.Properties["instances"].Items.Ref; got != "#/$defs/Instance" {
+		t.Errorf("instances items = %q", got)
+	}
+	if p := port.Properties["port"]; p.Type != "integer" || *p.Minimum != 1 || *p.Maximum != 65535 {
+		t.Errorf("unexpected port schema: %+v", p)
+	}
+	if got := port.Properties["firewall"].Enum; !reflect.DeepEqual(got, []string{"local", "full", "none"}) {
+		t.Errorf("firewall enum = %q", got)
+	}
+	if got := schema.Defs["PortDefaults"].Properties["protocol"].Enum; !reflect.DeepEqual(got, []string{"tcp", "udp"}) {
+		t.Errorf("defaults protocol enum = %q", got)
+	}
+	if got := instance.Properties["tags"].Items.MinLength; got == nil || *got != 1 {
+		t.Errorf("tags entries should be non-empty")
+	}
+	if !reflect.DeepEqual(port.Required, []string{"port"}) || !reflect.DeepEqual(instance.Required, []string{"name"}) {
+		t.Errorf("unexpected required fields: %q, %q", port.Required, instance.Required)
+	}
+
+	// Every constrained field exists, so the table can't go stale
+	fields := make(map[string]bool)
+	for _, object := range append([]*JSONSchema{schema}, instance, port, schema.Defs["PortDefaults"]) {
+		for name := range object.Properties {
+			fields[name] = true
+		}
+	}
+	for name := range schemaConstraints {
+		if !fields[name] {
+			t.Errorf("schemaConstraints has %s, which is not a config field", name)
+		}
+	}
+
+	// Every field of the example config is in the schema
+	data, err := os.ReadFile("wsl2-config.example.json")
+	if err != nil {
+		t.Fatalf("reading example config: %v", err)
+	}
+	var example map[string]interface{}
+	if err := json.Unmarshal(data, &example); err != nil {
+		t.Fatalf("parsing example config: %v", err)
+	}
+	var check func(value interface{}, object *JSONSchema, path string)
+	check = func(value interface{}, object *JSONSchema, path string) {
+		for key, child := range value.(map[string]interface{}) {
+			property, ok := object.Properties[key]
+			if !ok {
+				t.Errorf("%s.%s is not in the schema", path, key)
+				continue
+			}
+			if items, isArray := child.([]interface{}); isArray && property.Items != nil && property.Items.Ref != "" {
+				def := schema.Defs[strings.TrimPrefix(property.Items.Ref, "#/$defs/")]
+				for _, item := range items {
+					check(item, def, path+"."+key)
+				}
+			}
+		}
+	}
+	check(example, schema, "config")
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	jsonConfig := `{
+		"check_interval_seconds": 5,
+		"additive_only": true,
+		"instances": [
+			{"name": "Ubuntu", "tags": ["web"], "ports": [
+				{"port": 8080, "internal_port": 80, "firewall": "local"},
+				{"port": 5353, "protocol": "udp"}
+			]}
+		]
+	}`
+	yamlConfig := `
+check_interval_seconds: 5
+additive_only: true
+instances:
+  - name: Ubuntu
+    tags: [web]
+    ports:
+      - port: 8080
+        internal_port: 80
+        firewall: local
+      - port: 5353
+        protocol: udp
+`
+
+	expected, err := parseConfig("wsl2-config.json", []byte(jsonConfig), false)
+	if err != nil {
+		t.Fatalf("unexpected JSON error: %v", err)
+	}
+	for _, file := range []string{"wsl2-config.yaml", "wsl2-config.yml", "WSL2-CONFIG.YAML"} {
+		config, err := parseConfig(file, []byte(yamlConfig), false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", file, err)
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: got %+v, want %+v", file, config, expected)
+		}
+	}
+
+	// JSON stays the default for other extensions, so YAML there is an error
+	if _, err := parseConfig("wsl2-config.txt", []byte(yamlConfig), false); err == nil {
+		t.Error("expected YAML content in a non-YAML file to fail to parse")
+	}
+	if _, err := parseConfig("wsl2-config.yaml", []byte("instances: [unclosed"), false); err == nil {
+		t.Error("expected invalid YAML to fail to parse")
+	}
+	if got := configFormat("wsl2-config.yml"); got != "YAML" {
+		t.Errorf("configFormat(yml) = %s, want YAML", got)
+	}
+}
+
+func TestParseFirewallRules(t *testing.T) {
+	output := `
+Rule Name:                            Allow Web
+----------------------------------------------------------------------
+Enabled:                              Yes
+Direction:                            In
+Protocol:                             TCP
+LocalPort:                            8080,9000-9010
+RemotePort:                           Any
+Action:                               Allow
+
+Rule Name:                            Block Telnet
+----------------------------------------------------------------------
+Enabled:                              Yes
+Direction:                            In
+Protocol:                             TCP
+LocalPort:                            23
+Action:                               Block
+
+Rule Name:                            Disabled Block
+----------------------------------------------------------------------
+Enabled:                              No
+LocalPort:                            Any
+Action:                               Block
+Ok.
+`
+
+	rules := parseFirewallRules(output)
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d: %+v", len(rules), rules)
+	}
+
+	if rules[0].Name != "Allow Web" || !rules[0].Enabled || rules[0].IsBlock() {
+		t.Errorf("unexpected first rule: %+v", rules[0])
+	}
+	if rules[1].Name != "Block Telnet" || !rules[1].Enabled || !rules[1].IsBlock() {
+		t.Errorf("unexpected second rule: %+v", rules[1])
+	}
+	if rules[2].Enabled || !rules[2].IsBlock() {
+		t.Errorf("unexpected third rule: %+v", rules[2])
+	}
+
+	coverage := []struct {
+		rule     FirewallRule
+		port     int
+		expected bool
+	}{
+		{rules[0], 8080, true},
+		{rules[0], 9005, true},
+		{rules[0], 9011, false},
+		{rules[1], 23, true},
+		{rules[1], 2323, false},
+		{rules[2], 12345, true},
+	}
+	for _, tt := range coverage {
+		if got := tt.rule.CoversPort(tt.port); got != tt.expected {
+			t.Errorf("%s.CoversPort(%d) = %v, want %v", tt.rule.Name, tt.port, got, tt.expected)
+		}
+	}
+}
+
+func TestReconcileSnapshotSkipsBlockedPortsInStrictMode(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 23}, {Port: 8080}}},
+		},
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu-Dev": "172.20.0.2"}, nil)
+	snapshot.BlockedPorts = map[int]string{23: "Block Telnet"}
+
+	desired, _ := snapshot.DesiredMappings()
+	if _, exists := desired[23]; !exists {
+		t.Error("blocked port should still be forwarded (with a warning) when not strict")
+	}
+
+	snapshot.SkipBlocked = true
+	desired, _ = snapshot.DesiredMappings()
+	if _, exists := desired[23]; exists {
+		t.Error("blocked port should be skipped in strict mode")
+	}
+	if _, exists := desired[8080]; !exists {
+		t.Error("unblocked port should still be forwarded in strict mode")
+	}
+	if got := snapshot.ExplainPort("Ubuntu-Dev", Port{Port: 23}, desired); got != "blocked by firewall rule 'Block Telnet', skipped (--strict)" {
+		t.Errorf("ExplainPort() = %q", got)
+	}
+}
+
+func TestIPAddressZoneHandling(t *testing.T) {
+	tests := []struct {
+		addr      string
+		valid     bool
+		ipv6      bool
+		proxyType string // portProxyType("0.0.0.0", addr)
+	}{
+		{"172.20.0.2", true, false, "v4tov4"},
+		{"fe80::1", true, true, "v4tov6"},
+		{"fe80::1%eth0", true, true, "v4tov6"},
+		{"fe80::215:5dff:fe01:2%12", true, true, "v4tov6"},
+		{"fe80::1%", false, true, "v4tov6"},
+		{"172.20.0.2%eth0", false, false, "v4tov4"},
+		{"not-an-ip", false, false, "v4tov4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isValidIPAddress(tt.addr); got != tt.valid {
+				t.Errorf("isValidIPAddress(%s) = %v, want %v", tt.addr, got, tt.valid)
+			}
+			if got := isIPv6Address(tt.addr); got != tt.ipv6 {
+				t.Errorf("isIPv6Address(%s) = %v, want %v", tt.addr, got, tt.ipv6)
+			}
+			if got := portProxyType("0.0.0.0", tt.addr); got != tt.proxyType {
+				t.Errorf("portProxyType(0.0.0.0, %s) = %s, want %s", tt.addr, got, tt.proxyType)
+			}
+		})
+	}
+
+	if host, zone := splitZone("fe80::1%eth0"); host != "fe80::1" || zone != "eth0" {
+		t.Errorf("splitZone() = %s, %s", host, zone)
+	}
+	if got := portProxyType("fe80::1%3", "fe80::2%3"); got != "v6tov6" {
+		t.Errorf("portProxyType(v6, v6) = %s, want v6tov6", got)
+	}
+}
+
+func TestParsePortProxyOutput(t *testing.T) {
+	output := "\r\nListen on ipv4:             Connect to ipv6:\r\n\r\n" +
+		"Address         Port        Address         Port\r\n" +
+		"--------------- ----------  --------------- ----------\r\n" +
+		"0.0.0.0         2201        fe80::215:5dff:fe01:2%eth0 22\r\n" +
+		"0.0.0.0         8080        172.20.0.2      80\r\n"
+
+	mappings := parsePortProxyOutput(output)
+	if len(mappings) != 2 {
+		t.Fatalf("expected 2 mappings, got %d: %+v", len(mappings), mappings)
+	}
+	if got := mappings[2201]; got.TargetIP != "fe80::215:5dff:fe01:2%eth0" || got.InternalPort != 22 || got.ListenAddress != "0.0.0.0" {
+		t.Errorf("unexpected zoned mapping: %+v", got)
+	}
+	if got := mappings[8080]; got.TargetIP != "172.20.0.2" || got.InternalPort != 80 {
+		t.Errorf("unexpected IPv4 mapping: %+v", got)
+	}
+}
+
+func TestParsePortProxyOutputWildcardListenAddress(t *testing.T) {
+	output := "\r\nListen on ipv4:             Connect to ipv4:\r\n\r\n" +
+		"Address         Port        Address         Port\r\n" +
+		"--------------- ----------  --------------- ----------\r\n" +
+		"*               8080        172.20.0.2      80\r\n"
+
+	mappings := parsePortProxyOutput(output)
+	got, ok := mappings[8080]
+	if !ok || got.ListenAddress != "0.0.0.0" || got.TargetIP != "172.20.0.2" || got.InternalPort != 80 {
+		t.Fatalf("unexpected wildcard mapping: %+v", mappings)
+	}
+
+	// The forward matches a config bound to the default 0.0.0.0, so nothing to update
+	config := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}}}}}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, mappings)
+	if plan := snapshot.Plan(); !plan.IsEmpty() {
+		t.Errorf("expected no changes for a '*' forward, got %+v", plan.Actions)
+	}
+}
+
+func TestParsePortProxyTableIPv6Listener(t *testing.T) {
+	output := "\r\nListen on ipv6:             Connect to ipv4:\r\n\r\n" +
+		"Address         Port        Address         Port\r\n" +
+		"--------------- ----------  --------------- ----------\r\n" +
+		"*               8080        172.20.0.2      80\r\n" +
+		"2001:db8::1     8443        172.20.0.2      443\r\n"
+
+	mappings := parsePortProxyTable(output, "v6tov4")
+	if got := mappings[8080]; got.ListenAddress != "::" || got.TargetIP != "172.20.0.2" {
+		t.Errorf("wildcard IPv6 listener should be '::', got %+v", got)
+	}
+	if got := mappings[8443]; got.ListenAddress != "2001:db8::1" || got.InternalPort != 443 {
+		t.Errorf("unexpected IPv6 listener mapping: %+v", got)
+	}
+
+	// A forward bound to "::" matches a config that spells it differently
+	desired := PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", ListenAddress: "0::0"}
+	if mappingNeedsUpdate(mappings[8080], desired) {
+		t.Error("'::' and '0::0' are the same listen address")
+	}
+	if got := portProxyType(desired.ListenAddress, desired.TargetIP); got != "v6tov4" {
+		t.Errorf("portProxyType(v6, v4) = %s, want v6tov4", got)
+	}
+}
+
+func TestParsePortProxyOutputUnknownConnectPort(t *testing.T) {
+	output := "Address         Port        Address         Port\r\n" +
+		"--------------- ----------  --------------- ----------\r\n" +
+		"0.0.0.0         8080        172.20.0.2      0\r\n" +
+		"0.0.0.0         2222        172.20.0.3\r\n"
+
+	mappings := parsePortProxyOutput(output)
+	for _, port := range []int{8080, 2222} {
+		got, ok := mappings[port]
+		if !ok || got.InternalPort != 0 {
+			t.Fatalf("expected port %d with unknown connect port, got %+v", port, mappings)
+		}
+		desired := PortMapping{ExternalPort: port, InternalPort: port, TargetIP: got.TargetIP}
+		if !mappingNeedsUpdate(got, desired) {
+			t.Errorf("port %d: an unknown connect port must force an update", port)
+		}
+	}
+}
+
+func TestParsePortProxyOutputLocalized(t *testing.T) {
+	rows := "--------------- ----------  --------------- ----------\r\n" +
+		"0.0.0.0         8080        172.20.0.2      80\r\n" +
+		"127.0.0.1       2222        172.20.0.2      22\r\n"
+
+	fixtures := map[string]string{
+		"en-US": "\r\nListen on ipv4:             Connect to ipv4:\r\n\r\n" +
+			"Address         Port        Address         Port\r\n" + rows,
+		"de-DE": "\r\nAbfragen auf ipv4:             Verbinden mit ipv4:\r\n\r\n" +
+			"Adresse         Port        Adresse         Port\r\n" + rows,
+		"ja-JP": "\r\nipv4 をリッスンする:         ipv4 に接続する:\r\n\r\n" +
+			"アドレス        ポート      アドレス        ポート\r\n" + rows,
+		// Lines above the separator are never rows, even when they look like one
+		"header noise": "10.0.0.1 8 10.0.0.2 9\r\n" +
+			"Address         Port        Address         Port\r\n" + rows +
+			"\r\nNote: 2 entries 172.20.0.2\r\n",
+	}
+
+	for name, output := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			mappings := parsePortProxyOutput(output)
+			expected := map[int]PortMapping{
+				8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", ListenAddress: "0.0.0.0"},
+				2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2", ListenAddress: "127.0.0.1"},
+			}
+			if !reflect.DeepEqual(mappings, expected) {
+				t.Errorf("parsePortProxyOutput() = %+v, want %+v", mappings, expected)
+			}
+		})
+	}
+}
+
+func TestParsePortProxyOutputWrappedRow(t *testing.T) {
+	output := "Address         Port        Address         Port\r\n" +
+		"--------------- ----------  --------------- ----------\r\n" +
+		"fe80::215:5dff:fe01:1%vEthernet 8443\r\n" +
+		"                            fe80::215:5dff:fe01:2%eth0 443\r\n" +
+		"0.0.0.0         8080        172.20.0.2      80\r\n"
+
+	mappings := parsePortProxyOutput(output)
+	if len(mappings) != 2 {
+		t.Fatalf("expected 2 mappings, got %+v", mappings)
+	}
+	got := mappings[8443]
+	if got.ListenAddress != "fe80::215:5dff:fe01:1%vEthernet" || got.TargetIP != "fe80::215:5dff:fe01:2%eth0" || got.InternalPort != 443 {
+		t.Errorf("unexpected wrapped mapping: %+v", got)
+	}
+
+	// Rows whose addresses aren't IPs are not mappings
+	for _, line := range []string{"Address 8080 172.20.0.2 80", "0.0.0.0 8080 Address 80", "0.0.0.0 8080 172.20.0.2 80 extra"} {
+		if _, ok := parsePortProxyRow(strings.Fields(line)); ok {
+			t.Errorf("parsePortProxyRow(%q) should be rejected", line)
+		}
+	}
+}
+
+func TestLogDeduplicator(t *testing.T) {
+	var lines []string
+	dedup := NewLogDeduplicator(30 * time.Second)
+	dedup.output = func(msg string) { lines = append(lines, msg) }
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		dedup.printfAt(start.Add(time.Duration(i*5)*time.Second), "Warning: Failed to get IP for instance %s", "Ubuntu-Dev")
+	}
+	dedup.printfAt(start.Add(6*time.Second), "Warning: something else")
+
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines before window closes, got %d: %v", len(lines), lines)
+	}
+
+	// Window still open: nothing to flush
+	dedup.Flush(start.Add(20 * time.Second))
+	if len(lines) != 2 {
+		t.Fatalf("expected no summary while window is open, got %v", lines)
+	}
+
+	dedup.Flush(start.Add(40 * time.Second))
+	expected := []string{
+		"Warning: Failed to get IP for instance Ubuntu-Dev",
+		"Warning: something else",
+		"Warning: Failed to get IP for instance Ubuntu-Dev (repeated 3 times)",
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("lines = %q, want %q", lines, expected)
+	}
+
+	// After flushing, the next occurrence is logged again immediately
+	dedup.printfAt(start.Add(41*time.Second), "Warning: Failed to get IP for instance %s", "Ubuntu-Dev")
+	if len(lines) != 4 || lines[3] != "Warning: Failed to get IP for instance Ubuntu-Dev" {
+		t.Errorf("expected message to be logged again after flush, got %v", lines)
+	}
+}
+
+func TestLogDeduplicatorDisabled(t *testing.T) {
+	var lines []string
+	dedup := NewLogDeduplicator(0)
+	dedup.output = func(msg string) { lines = append(lines, msg) }
+
+	now := time.Now()
+	dedup.printfAt(now, "same")
+	dedup.printfAt(now, "same")
+	if len(lines) != 2 {
+		t.Errorf("expected every message to be logged with dedup disabled, got %v", lines)
+	}
+}
+
+func TestEvaluateFirewallRules(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 2201, InternalPort: 22, Firewall: "local"}, {Port: 8080}, {Port: 23}}},
+			{Name: "Ubuntu-ML", Ports: []Port{{Port: 8888}, {Port: 8080}}},
+		},
+	}
+	rules := parseFirewallRules(`
+Rule Name:                            Allow Web
+Enabled:                              Yes
+LocalPort:                            8080
+Action:                               Allow
+
+Rule Name:                            Block Telnet
+Enabled:                              Yes
+LocalPort:                            23
+Action:                               Block
+`)
+
+	result := evaluateFirewallRules(config, rules)
+
+	if fmt.Sprint(result.CheckedPorts) != "[23/tcp 2201/tcp 8080/tcp 8888/tcp]" {
+		t.Errorf("CheckedPorts = %v", result.CheckedPorts)
+	}
+	if fmt.Sprint(result.AllowedPorts) != "[8080/tcp]" {
+		t.Errorf("AllowedPorts = %v", result.AllowedPorts)
+	}
+	if result.ExplicitlyBlocked[FirewallPort{23, "tcp"}] != "Block Telnet" || len(result.ExplicitlyBlocked) != 1 {
+		t.Errorf("ExplicitlyBlocked = %v", result.ExplicitlyBlocked)
+	}
+	if fmt.Sprint(result.BlockedPorts) != "[2201/tcp 8888/tcp]" {
+		t.Errorf("BlockedPorts = %v", result.BlockedPorts)
+	}
+	if result.AutoManagedPorts[FirewallPort{2201, "tcp"}] != "local" || len(result.AutoManagedPorts) != 1 {
+		t.Errorf("AutoManagedPorts = %v", result.AutoManagedPorts)
+	}
+	if fmt.Sprint(result.ManualPorts) != "[8888/tcp]" {
+		t.Errorf("ManualPorts = %v", result.ManualPorts)
+	}
+
+	if got := result.ExitCode(false); got != 2 {
+		t.Errorf("ExitCode(false) = %d, want 2", got)
+	}
+	if got := result.ExitCode(true); got != 1 {
+		t.Errorf("ExitCode(true) = %d, want 1", got)
+	}
+
+	allOpen := evaluateFirewallRules(config, []FirewallRule{{Name: "Any", Enabled: true, LocalPort: "Any", Action: "Allow"}})
+	if got := allOpen.ExitCode(true); got != 0 {
+		t.Errorf("ExitCode with all ports allowed = %d, want 0", got)
+	}
+
+	// udp ports are only judged by rules for UDP (or any protocol)
+	udpConfig := &Config{Instances: []Instance{
+		{Name: "Ubuntu-Dev", Ports: []Port{{Port: 53, Protocol: "udp", Firewall: "local"}, {Port: 53}, {Port: 5353, Protocol: "udp"}, {Port: 6000, Protocol: "udp"}}},
+	}}
+	udpRules := parseFirewallRules(`
+Rule Name:                            Allow DNS over TCP
+Enabled:                              Yes
+Protocol:                             TCP
+LocalPort:                            53
+Action:                               Allow
+
+Rule Name:                            Allow mDNS
+Enabled:                              Yes
+Protocol:                             UDP
+LocalPort:                            5353
+Action:                               Allow
+
+Rule Name:                            Block X11
+Enabled:                              Yes
+Protocol:                             Any
+LocalPort:                            6000
+Action:                               Block
+`)
+	udpResult := evaluateFirewallRules(udpConfig, udpRules)
+	if fmt.Sprint(udpResult.CheckedPorts) != "[53/tcp 53/udp 5353/udp 6000/udp]" {
+		t.Errorf("CheckedPorts = %v", udpResult.CheckedPorts)
+	}
+	if fmt.Sprint(udpResult.AllowedPorts) != "[53/tcp 5353/udp]" {
+		t.Errorf("AllowedPorts = %v, a TCP rule must not allow the udp port", udpResult.AllowedPorts)
+	}
+	if udpResult.AutoManagedPorts[FirewallPort{53, "udp"}] != "local" || len(udpResult.AutoManagedPorts) != 1 {
+		t.Errorf("AutoManagedPorts = %v", udpResult.AutoManagedPorts)
+	}
+	if udpResult.ExplicitlyBlocked[FirewallPort{6000, "udp"}] != "Block X11" || len(udpResult.ExplicitlyBlocked) != 1 {
+		t.Errorf("ExplicitlyBlocked = %v", udpResult.ExplicitlyBlocked)
+	}
+}
+
+func TestSelectInterfaceAddress(t *testing.T) {
+	output := `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet6 fe80::215:5dff:fe01:2/64 scope link \       valid_lft forever preferred_lft forever
+3: br0    inet 10.0.3.1/24 brd 10.0.3.255 scope global br0\       valid_lft forever preferred_lft forever
+4: eth1    inet6 2001:db8::5/64 scope global \       valid_lft forever preferred_lft forever
+4: eth1    inet 172.20.0.2/20 brd 172.20.15.255 scope global eth1\       valid_lft forever preferred_lft forever
+`
+	addresses := parseInterfaceAddresses(output)
+
+	tests := []struct {
+		name       string
+		priority   []string
+		expectOK   bool
+		expectedIF string
+		expectedIP string
+	}{
+		{"First preferred interface missing", []string{"eth0", "eth1"}, true, "eth1", "172.20.0.2"},
+		{"Bridge preferred explicitly", []string{"br0", "eth1"}, true, "br0", "10.0.3.1"},
+		{"No preferred interface present", []string{"eth5"}, false, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface, ip, ok := selectInterfaceAddress(addresses, tt.priority, "")
+			if ok != tt.expectOK || iface != tt.expectedIF || ip != tt.expectedIP {
+				t.Errorf("selectInterfaceAddress(%v) = %s, %s, %v; want %s, %s, %v",
+					tt.priority, iface, ip, ok, tt.expectedIF, tt.expectedIP, tt.expectOK)
+			}
+		})
+	}
+
+	// address_family picks within the interface, and skips interfaces without one
+	if iface, ip, ok := selectInterfaceAddress(addresses, []string{"eth1"}, addressFamilyIPv6); !ok || iface != "eth1" || ip != "2001:db8::5" {
+		t.Errorf("ipv6 on eth1 = %s, %s, %v; want eth1, 2001:db8::5", iface, ip, ok)
+	}
+	if iface, ip, ok := selectInterfaceAddress(addresses, []string{"br0", "eth1"}, addressFamilyIPv6); !ok || iface != "eth1" {
+		t.Errorf("ipv6 should skip br0, got %s, %s, %v", iface, ip, ok)
+	}
+}
+
+func TestSelectHostnameIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		family    string
+		expectErr bool
+		expected  string
+	}{
+		{"Single IP", "172.20.0.2\n", "", false, "172.20.0.2"},
+		{"Trailing whitespace", "  172.20.0.2 \r\n", "", false, "172.20.0.2"},
+		{"Multiple IPs take the first", "172.20.0.2 10.0.3.1 2001:db8::5\n", "", false, "172.20.0.2"},
+		{"IPv6 first", "2001:db8::5 172.20.0.2\n", "", false, "2001:db8::5"},
+		{"Loopback skipped", "127.0.0.1 172.20.0.2\n", "", false, "172.20.0.2"},
+		{"Link-local skipped", "169.254.10.1 fe80::1%eth0 172.20.0.2\n", "", false, "172.20.0.2"},
+		{"Link-local as a last resort", "127.0.0.1 fe80::1%eth0\n", "", false, "fe80::1%eth0"},
+		{"Invalid octets", "999.1.2.3\n", "", true, ""},
+		{"Invalid skipped", "999.1.2.3 172.20.0.2\n", "", false, "172.20.0.2"},
+		{"Only loopback", "127.0.0.1 ::1\n", "", true, ""},
+		{"Empty output", "\n", "", true, ""},
+		{"IPv4 wanted", "2001:db8::5 172.20.0.2\n", "ipv4", false, "172.20.0.2"},
+		{"IPv6 wanted", "172.20.0.2 fe80::1%eth0 2001:db8::5\n", "ipv6", false, "2001:db8::5"},
+		{"IPv6 wanted but missing", "172.20.0.2\n", "ipv6", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := selectHostnameIP(tt.output, tt.family)
+			if (err != nil) != tt.expectErr || ip != tt.expected {
+				t.Errorf("selectHostnameIP(%q) = %q, %v; want %q, error %v", tt.output, ip, err, tt.expected, tt.expectErr)
+			}
+		})
+	}
+}
+
+func TestManagedInstancesAllowlist(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		ManagedInstances:     []string{"Ubuntu-Dev"},
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 8080}}},
+			{Name: "Tenant-B", Ports: []Port{{Port: 9090}}},
+		},
+	}
+
+	if !config.IsManagedInstance("Ubuntu-Dev") || config.IsManagedInstance("Tenant-B") {
+		t.Error("IsManagedInstance() does not honour the allowlist")
+	}
+	if !(&Config{ManagedInstances: []string{"ubuntu-dev"}}).IsManagedInstance("Ubuntu-Dev") {
+		t.Error("IsManagedInstance() should match names regardless of case")
+	}
+
+	managed := config.ManagedConfig()
+	if len(managed.Instances) != 1 || managed.Instances[0].Name != "Ubuntu-Dev" {
+		t.Fatalf("ManagedConfig() instances = %+v", managed.Instances)
+	}
+	if len(config.Instances) != 2 {
+		t.Error("ManagedConfig() must not modify the original config")
+	}
+
+	// An excluded instance's existing mapping is neither desired nor ours to remove
+	snapshot := newReconcileSnapshot(managed, map[string]string{"Ubuntu-Dev": "172.20.0.2", "Tenant-B": "172.20.0.3"}, nil)
+	desired, _ := snapshot.DesiredMappings()
+	if _, exists := desired[9090]; exists {
+		t.Error("excluded instance should not be forwarded")
+	}
+
+	open := &Config{Instances: config.Instances}
+	if !open.IsManagedInstance("anything") || open.ManagedConfig() != open {
+		t.Error("empty allowlist should manage every instance")
+	}
+
+	service := &ServiceState{}
+	config.ManagedInstances = []string{""}
+	if err := service.validateConfiguration(config); err == nil {
+		t.Error("expected validation error for empty managed_instances entry")
+	}
+}
+
+func TestPendingRegistryWrites(t *testing.T) {
+	service := &ServiceState{registryManager: &RegistryManager{}}
+
+	attempts := 0
+	failUntil := 2
+	service.deferRegistryWrite("proxy:8080", "register port proxy 8080", fmt.Errorf("registry locked"),
+		func(rm *RegistryManager) error {
+			attempts++
+			if attempts < failUntil {
+				return fmt.Errorf("still locked")
+			}
+			return nil
+		})
+	service.deferRegistryWrite("proxy:9090", "register port proxy 9090", fmt.Errorf("registry locked"),
+		func(rm *RegistryManager) error { return nil })
+
+	// A port removed before its write succeeded must not be registered later
+	service.dropPendingRegistryWrites("proxy:9090")
+	if len(service.pendingWrites) != 1 {
+		t.Fatalf("expected 1 pending write after drop, got %d", len(service.pendingWrites))
+	}
+
+	service.retryPendingRegistryWrites()
+	if len(service.pendingWrites) != 1 || attempts != 1 {
+		t.Fatalf("failed retry should stay queued (pending=%d, attempts=%d)", len(service.pendingWrites), attempts)
+	}
+
+	service.retryPendingRegistryWrites()
+	if len(service.pendingWrites) != 0 || attempts != 2 {
+		t.Errorf("successful retry should be dequeued (pending=%d, attempts=%d)", len(service.pendingWrites), attempts)
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	oldConfig := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 2201, InternalPort: 22, Firewall: "local"}, {Port: 3000}, {Port: 8080, InternalPort: 8080}}},
+			{Name: "Ubuntu-Old", Ports: []Port{{Port: 9000}}},
+		},
+	}
+	newConfig := &Config{
+		CheckIntervalSeconds: 10,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 2201, InternalPort: 22, Firewall: "full"}, {Port: 8080}, {Port: 5000}}},
+			{Name: "Ubuntu-ML", Ports: []Port{{Port: 5000}}},
+		},
+	}
+
+	diff := diffConfigs(oldConfig, newConfig)
+
+	if fmt.Sprint(diff.SettingsChanged) != "[check_interval_seconds 5 -> 10]" {
+		t.Errorf("SettingsChanged = %v", diff.SettingsChanged)
+	}
+	if fmt.Sprint(diff.InstancesAdded) != "[Ubuntu-ML]" || fmt.Sprint(diff.InstancesRemoved) != "[Ubuntu-Old]" {
+		t.Errorf("instances added %v, removed %v", diff.InstancesAdded, diff.InstancesRemoved)
+	}
+
+	var changes []string
+	for _, change := range diff.PortChanges {
+		changes = append(changes, fmt.Sprintf("%s %s %d %v", change.Change, change.Instance, change.Port, change.Details))
+	}
+	expected := []string{
+		"changed Ubuntu-Dev 2201 [firewall local -> full]",
+		"removed Ubuntu-Dev 3000 [internal_port 3000]",
+		"added Ubuntu-Dev 5000 [internal_port 5000]",
+		"added Ubuntu-ML 5000 [internal_port 5000]",
+		"removed Ubuntu-Old 9000 [internal_port 9000]",
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("PortChanges =\n%v\nwant\n%v", changes, expected)
+	}
+
+	// Explicit internal_port equal to the external port is not a change
+	if len(diff.NewConflicts) != 1 || diff.NewConflicts[0].Port != 5000 {
+		t.Errorf("NewConflicts = %+v, want port 5000", diff.NewConflicts)
+	}
+
+	if !diffConfigs(oldConfig, oldConfig).IsEmpty() {
+		t.Error("diff of a config with itself should be empty")
+	}
+}
+
+func TestDiffConfigsSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new Config
+		expected string
+	}{
+		{"Syslog address", Config{}, Config{SyslogAddress: "udp://logs:514"}, `syslog_address "" -> "udp://logs:514"`},
+		{"Strict port conflicts", Config{}, Config{StrictPortConflicts: true}, "strict_port_conflicts false -> true"},
+		{"Log file", Config{LogFile: `C:\logs\forwarder.log`}, Config{LogFile: `D:\logs\forwarder.log`}, `log_file "C:\\logs\\forwarder.log" -> "D:\\logs\\forwarder.log"`},
+		{"Log rotation", Config{LogMaxSizeMB: 10}, Config{LogMaxSizeMB: 10, LogMaxBackups: 5}, "log_max_size_mb/log_max_backups 10/3 -> 10/5"},
+		{"Explicit default log backups", Config{LogMaxSizeMB: 10, LogMaxBackups: 3}, Config{LogMaxSizeMB: 10}, ""},
+		{"Reconcile registry on start", Config{ReconcileRegistry: true}, Config{}, "reconcile_registry_on_start true -> false"},
+		{"Command timeout", Config{}, Config{CommandTimeoutSeconds: 60}, "command_timeout_seconds 30 -> 60"},
+		{"Explicit default command timeout", Config{CommandTimeoutSeconds: 30}, Config{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffConfigs(&tt.old, &tt.new)
+			if tt.expected == "" {
+				if !diff.IsEmpty() {
+					t.Errorf("SettingsChanged = %q, want no differences", diff.SettingsChanged)
+				}
+				return
+			}
+			if len(diff.SettingsChanged) != 1 || diff.SettingsChanged[0] != tt.expected {
+				t.Errorf("SettingsChanged = %q, want [%q]", diff.SettingsChanged, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDiffConfigsInstances(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new Instance
+		expected string
+	}{
+		{"Pinned IP", Instance{}, Instance{IP: "172.20.0.5"}, "ip (auto) -> 172.20.0.5"},
+		{"Pinned IP changed", Instance{IP: "172.20.0.5"}, Instance{IP: "172.20.0.6"}, "ip 172.20.0.5 -> 172.20.0.6"},
+		{"Address family", Instance{}, Instance{AddressFamily: "ipv6"}, "address_family (auto) -> ipv6"},
+		{"Address family changed", Instance{AddressFamily: "ipv6"}, Instance{AddressFamily: "ipv4"}, "address_family ipv6 -> ipv4"},
+		{"Alias added", Instance{Aliases: []string{"Ubuntu-22.04"}}, Instance{Aliases: []string{"Ubuntu-22.04", "Ubuntu-24.04"}}, "aliases [Ubuntu-22.04] -> [Ubuntu-22.04 Ubuntu-24.04]"},
+		{"Aliases reordered", Instance{Aliases: []string{"Ubuntu-24.04", "Ubuntu-22.04"}}, Instance{Aliases: []string{"Ubuntu-22.04", "Ubuntu-24.04"}}, ""},
+		{"Interface priority reordered", Instance{InterfacePriority: []string{"eth0", "eth1"}}, Instance{InterfacePriority: []string{"eth1", "eth0"}}, "interface_priority [eth0 eth1] -> [eth1 eth0]"},
+		{"Startup delay", Instance{}, Instance{StartupDelaySeconds: 10}, "startup_delay_seconds 0 -> 10"},
+		{"Boot probe", Instance{BootProbe: true}, Instance{}, "boot_probe true -> false"},
+		{"Tags", Instance{Tags: []string{"web"}}, Instance{Tags: []string{"web", "team-x"}}, "tags [web] -> [team-x web]"},
+		{"Tags reordered", Instance{Tags: []string{"web", "db"}}, Instance{Tags: []string{"db", "web"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.old.Name, tt.new.Name = "Ubuntu", "Ubuntu"
+			diff := diffConfigs(&Config{Instances: []Instance{tt.old}}, &Config{Instances: []Instance{tt.new}})
+			if tt.expected == "" {
+				if !diff.IsEmpty() {
+					t.Errorf("InstanceChanges = %+v, want no differences", diff.InstanceChanges)
+				}
+				return
+			}
+			if len(diff.InstanceChanges) != 1 || len(diff.InstanceChanges[0].Details) != 1 || diff.InstanceChanges[0].Details[0] != tt.expected {
+				t.Errorf("InstanceChanges = %+v, want [%q]", diff.InstanceChanges, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDiffConfigsPortSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new Port
+		expected string
+	}{
+		{"Connect fallback", Port{Port: 8080}, Port{Port: 8080, ConnectFallback: true}, "connect_fallback false -> true"},
+		{"Probe", Port{Port: 8080, Probe: true}, Port{Port: 8080}, "probe true -> false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffConfigs(&Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{tt.old}}}},
+				&Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{tt.new}}}})
+			if len(diff.PortChanges) != 1 || fmt.Sprint(diff.PortChanges[0].Details) != fmt.Sprint([]string{tt.expected}) {
+				t.Errorf("PortChanges = %+v, want [%q]", diff.PortChanges, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDiffConfigsEnabled(t *testing.T) {
+	disabled, enabled := false, true
+	oldConfig := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080}, {Port: 9000, Enabled: &disabled}}}}}
+	newConfig := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, Enabled: &disabled}, {Port: 9000, Enabled: &enabled}}}}}
+
+	diff := diffConfigs(oldConfig, newConfig)
+	var changes []string
+	for _, change := range diff.PortChanges {
+		changes = append(changes, fmt.Sprintf("%s %d %v", change.Change, change.Port, change.Details))
+	}
+	expected := []string{"changed 8080 [enabled true -> false]", "changed 9000 [enabled false -> true]"}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("PortChanges = %v, want %v", changes, expected)
+	}
+
+	// A disabled duplicate claims nothing, so adding one is not a new conflict
+	withDuplicate := &Config{Instances: append(append([]Instance{}, oldConfig.Instances...),
+		Instance{Name: "Debian", Ports: []Port{{Port: 8080, Enabled: &disabled}}})}
+	if diff := diffConfigs(oldConfig, withDuplicate); len(diff.NewConflicts) != 0 {
+		t.Errorf("NewConflicts = %+v, want none for a disabled port", diff.NewConflicts)
+	}
+
+	// An explicit "enabled": true is the default
+	explicit := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, Enabled: &enabled}, {Port: 9000, Enabled: &disabled}}}}}
+	if diff := diffConfigs(oldConfig, explicit); !diff.IsEmpty() {
+		t.Errorf("expected no differences, got %+v", diff.PortChanges)
+	}
+}
+
+func TestDiffConfigsProtocol(t *testing.T) {
+	oldConfig := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 53}, {Port: 81}, {Port: 443}, {Port: 5000}, {Port: 5000, Protocol: "udp"}}},
+	}}
+	newConfig := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 53, Protocol: "udp", InternalPort: 5353}, {Port: 81}, {Port: 81, Protocol: "udp"}, {Port: 443, Protocol: "tcp"}, {Port: 5000, Protocol: "udp"}}},
+	}}
+
+	diff := diffConfigs(oldConfig, newConfig)
+	var changes []string
+	for _, change := range diff.PortChanges {
+		changes = append(changes, fmt.Sprintf("%s %d/%s %v", change.Change, change.Port, change.Protocol, change.Details))
+	}
+	expected := []string{
+		"changed 53/udp [protocol tcp -> udp internal_port 53 -> 5353]",
+		"added 81/udp [internal_port 81]",
+		"removed 5000/tcp [internal_port 5000]",
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("PortChanges =\n%v\nwant\n%v", changes, expected)
+	}
+}
+
+func TestResolveRunningInstance(t *testing.T) {
+	running := map[string]bool{"Ubuntu-22.04": true, "debian": true}
+
+	tests := []struct {
+		configName string
+		expected   string
+		expectOK   bool
+	}{
+		{"Ubuntu-22.04", "Ubuntu-22.04", true},
+		{"ubuntu-22.04", "Ubuntu-22.04", true},
+		{"Debian", "debian", true},
+		{"Alpine", "", false},
+	}
+
+	for _, tt := range tests {
+		name, ok := resolveRunningInstance(tt.configName, running)
+		if name != tt.expected || ok != tt.expectOK {
+			t.Errorf("resolveRunningInstance(%s) = %s, %v; want %s, %v", tt.configName, name, ok, tt.expected, tt.expectOK)
+		}
+	}
+}
+
+func TestResolveInstanceDistroAliases(t *testing.T) {
+	running := map[string]bool{"Ubuntu-22.04": true}
+
+	tests := []struct {
+		name     string
+		instance Instance
+		expected string
+		expectOK bool
+	}{
+		{"Primary name", Instance{Name: "Ubuntu-22.04"}, "Ubuntu-22.04", true},
+		{"Alias", Instance{Name: "Ubuntu", Aliases: []string{"Ubuntu-20.04", "Ubuntu-22.04"}}, "Ubuntu-22.04", true},
+		{"Alias by case", Instance{Name: "Ubuntu", Aliases: []string{"ubuntu-22.04"}}, "Ubuntu-22.04", true},
+		{"No match", Instance{Name: "Ubuntu", Aliases: []string{"Ubuntu-20.04"}}, "", false},
+	}
+
+	for _, tt := range tests {
+		name, ok := resolveInstanceDistro(tt.instance, running)
+		if name != tt.expected || ok != tt.expectOK {
+			t.Errorf("%s: resolveInstanceDistro() = %s, %v; want %s, %v", tt.name, name, ok, tt.expected, tt.expectOK)
+		}
+	}
+}
+
+func TestAliasCollisions(t *testing.T) {
+	tests := []struct {
+		name        string
+		instances   []Instance
+		expectError bool
+	}{
+		{"Distinct aliases", []Instance{{Name: "Ubuntu", Aliases: []string{"Ubuntu-22.04"}}, {Name: "Debian", Aliases: []string{"Debian-12"}}}, false},
+		{"Alias is another instance", []Instance{{Name: "Ubuntu", Aliases: []string{"debian"}}, {Name: "Debian"}}, true},
+		{"Alias shared by two instances", []Instance{{Name: "Ubuntu", Aliases: []string{"Dev"}}, {Name: "Debian", Aliases: []string{"DEV"}}}, true},
+		{"Alias repeats own name", []Instance{{Name: "Ubuntu", Aliases: []string{"ubuntu"}}}, false},
+		{"Names differ only by case", []Instance{{Name: "Ubuntu"}, {Name: "UBUNTU"}}, true},
+		{"Overlapping aliases", []Instance{{Name: "Web", Aliases: []string{"Ubuntu-22.04", "Ubuntu"}}, {Name: "Db", Aliases: []string{"Ubuntu-20.04", "ubuntu-22.04"}}}, true},
+	}
+
+	for _, tt := range tests {
+		err := distroOverlapError(&Config{Instances: tt.instances})
+		if (err != nil) != tt.expectError {
+			t.Errorf("%s: distroOverlapError() error = %v, expectError %v", tt.name, err, tt.expectError)
+		}
+	}
+
+	err := distroOverlapError(&Config{Instances: []Instance{{Name: "Web", Aliases: []string{"Ubuntu-22.04"}}, {Name: "Db", Aliases: []string{"ubuntu-22.04"}}}})
+	if err == nil || err.Error() != "instances Web and Db both match distro ubuntu-22.04" {
+		t.Errorf("unexpected overlap error: %v", err)
+	}
+}
+
+func TestParseSyslogAddress(t *testing.T) {
+	tests := []struct {
+		addr            string
+		expectedNetwork string
+		expectedAddress string
+		expectError     bool
+	}{
+		{"logs.example.com:514", "udp", "logs.example.com:514", false},
+		{"udp://10.0.0.5:514", "udp", "10.0.0.5:514", false},
+		{"TCP://logs:601", "tcp", "logs:601", false},
+		{"http://logs:80", "", "", true},
+		{"logs.example.com", "", "", true},
+	}
+
+	for _, tt := range tests {
+		network, address, err := parseSyslogAddress(tt.addr)
+		if (err != nil) != tt.expectError || network != tt.expectedNetwork || address != tt.expectedAddress {
+			t.Errorf("parseSyslogAddress(%s) = %s, %s, %v", tt.addr, network, address, err)
+		}
+	}
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	now := time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		msg      string
+		expected string
+	}{
+		{
+			"2025/03/01 10:30:00 Warning: Failed to get IP for instance Ubuntu-Dev",
+			"<28>1 2025-03-01T10:30:00Z host1 wsl2-port-forwarder 42 - - Warning: Failed to get IP for instance Ubuntu-Dev",
+		},
+		{
+			"Error adding port mapping 8080->80: exit status 1",
+			"<27>1 2025-03-01T10:30:00Z host1 wsl2-port-forwarder 42 - - Error adding port mapping 8080->80: exit status 1",
+		},
+		{
+			"Registry manager initialized successfully",
+			"<30>1 2025-03-01T10:30:00Z host1 wsl2-port-forwarder 42 - - Registry manager initialized successfully",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := formatSyslogMessage(now, "host1", 42, tt.msg); got != tt.expected {
+			t.Errorf("formatSyslogMessage(%q) =\n%s\nwant\n%s", tt.msg, got, tt.expected)
+		}
+	}
+}
+
+func TestValidationStrictPortConflicts(t *testing.T) {
+	service := &ServiceState{}
+
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		StrictPortConflicts:  true,
+		Instances: []Instance{
+			{Name: "Ubuntu-Dev", Ports: []Port{{Port: 8080}, {Port: 2201, InternalPort: 22}}},
+			{Name: "Ubuntu-Staging", Ports: []Port{{Port: 8080}, {Port: 2201, InternalPort: 22}}},
+		},
+	}
+
+	err := service.validateConfiguration(config)
+	if err == nil {
+		t.Fatal("expected validation error for duplicate external ports with strict_port_conflicts")
+	}
+	expected := "port 2201 (Ubuntu-Dev, Ubuntu-Staging); port 8080 (Ubuntu-Dev, Ubuntu-Staging)"
+	if !contains(err.Error(), expected) {
+		t.Errorf("expected error listing conflicts %q, got: %v", expected, err)
+	}
+
+	config.StrictPortConflicts = false
+	if err := service.validateConfiguration(config); err != nil {
+		t.Errorf("expected duplicates to be allowed by default, got: %v", err)
+	}
+
+	// A disabled duplicate is never forwarded, so it doesn't conflict
+	disabled := false
+	config.StrictPortConflicts = true
+	config.Instances[1].Ports = []Port{{Port: 8080, Enabled: &disabled}, {Port: 2201, InternalPort: 22, Enabled: &disabled}}
+	if err := service.validateConfiguration(config); err != nil {
+		t.Errorf("expected disabled duplicates to be accepted with strict_port_conflicts, got: %v", err)
+	}
+}
+
+func TestChooseFallbackTarget(t *testing.T) {
+	candidates := []string{"172.20.0.2", "10.0.3.5", "192.168.50.7"}
+	up := func(ips ...string) func(string, int) bool {
+		return func(ip string, port int) bool {
+			for _, u := range ips {
+				if u == ip {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	tests := []struct {
+		name      string
+		currentIP string
+		reachable func(string, int) bool
+		expected  string
+	}{
+		{"Primary reachable, nothing mapped yet", "", up("172.20.0.2", "10.0.3.5"), "172.20.0.2"},
+		{"Primary down, first reachable fallback", "", up("192.168.50.7"), "192.168.50.7"},
+		{"Current fallback still answering, no flap back to primary", "10.0.3.5", up("172.20.0.2", "10.0.3.5"), "10.0.3.5"},
+		{"Current target stopped answering", "10.0.3.5", up("192.168.50.7"), "192.168.50.7"},
+		{"Nothing answering, use primary", "10.0.3.5", up(), "172.20.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chooseFallbackTarget(candidates, tt.currentIP, 22, tt.reachable); got != tt.expected {
+				t.Errorf("chooseFallbackTarget() = %s, want %s", got, tt.expected)
+			}
+		})
+	}
+
+	if got := orderCandidateIPs("10.0.3.5", []string{"172.20.0.2", "10.0.3.5", "bogus", "fe80::1%eth0"}); fmt.Sprint(got) != "[10.0.3.5 172.20.0.2 fe80::1%eth0]" {
+		t.Errorf("orderCandidateIPs() = %v", got)
+	}
+}
+
+func TestConfigCheckOnlyMode(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	valid := write("valid.json", `{"check_interval_seconds": 5, "instances": [{"name": "Ubuntu-Dev", "ports": [{"port": 8080}]}]}`)
+	conflicts := write("conflicts.json", `{"check_interval_seconds": 5, "instances": [
+		{"name": "Ubuntu-Dev", "ports": [{"port": 8080}]},
+		{"name": "Ubuntu-Staging", "ports": [{"port": 8080}]}]}`)
+	invalid := write("invalid.json", `{"check_interval_seconds": -1, "instances": []}`)
+
+	tests := []struct {
+		name     string
+		opts     CommandLineOptions
+		expected int
+	}{
+		{"Valid config", CommandLineOptions{ConfigFile: valid}, 0},
+		{"Conflicts are warnings", CommandLineOptions{ConfigFile: conflicts}, 2},
+		{"Conflicts are errors with --strict", CommandLineOptions{ConfigFile: conflicts, Strict: true}, 1},
+		{"Invalid config", CommandLineOptions{ConfigFile: invalid}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.ValidateOnly = true
+			opts.ConfigCheckOnly = true
+			if got := validateConfiguration(&opts); got != tt.expected {
+				t.Errorf("validateConfiguration() = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+
+	if opts, err := parseCommandLine([]string{"--config-check-only", "cfg.json"}); err != nil || !opts.ConfigCheckOnly || !opts.ValidateOnly {
+		t.Errorf("--config-check-only should imply --validate, got %+v, %v", opts, err)
+	}
+}
+
+func TestMergeExitCode(t *testing.T) {
+	tests := []struct{ a, b, expected int }{
+		{0, 0, 0}, {0, 2, 2}, {2, 0, 2}, {1, 2, 1}, {2, 1, 1}, {1, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := mergeExitCode(tt.a, tt.b); got != tt.expected {
+			t.Errorf("mergeExitCode(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestBuildMappingSnapshot(t *testing.T) {
+	mappings := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", ListenAddress: "0.0.0.0"},
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.3", ListenAddress: "0.0.0.0"},
+	}
+	rules := []FirewallRule{
+		{Name: "WSL2-Port-8080-1234", Enabled: true, Action: "Allow", LocalPort: "8080", RemoteIP: "LocalSubnet"},
+		{Name: "WSL2-Port-2222-5678", Enabled: true, Action: "Allow", LocalPort: "2222", RemoteIP: "Any"},
+		{Name: "WSL2-Port-9000-1111", Enabled: true, Action: "Allow", LocalPort: "9000", RemoteIP: "10.0.0.0/8"},
+		{Name: "Allow Web", Enabled: true, Action: "Allow", LocalPort: "443", RemoteIP: "Any"},
+	}
+	proxyInstances := map[int]string{8080: "Ubuntu"}
+	ruleInstances := map[string]string{"WSL2-Port-2222-5678": "Debian"}
+
+	snapshot, warnings := buildMappingSnapshot(mappings, rules, proxyInstances, ruleInstances)
+
+	if len(snapshot.Mappings) != 2 || snapshot.Mappings[0].ListenPort != 2222 || snapshot.Mappings[1].Instance != "Ubuntu" {
+		t.Errorf("unexpected mappings: %+v", snapshot.Mappings)
+	}
+	if len(snapshot.FirewallRules) != 2 {
+		t.Fatalf("expected 2 managed firewall rules, got %+v", snapshot.FirewallRules)
+	}
+	if rule := snapshot.FirewallRules[0]; rule.Port != 2222 || rule.Mode != "full" || rule.Instance != "Debian" {
+		t.Errorf("unexpected first rule: %+v", rule)
+	}
+	if rule := snapshot.FirewallRules[1]; rule.Port != 8080 || rule.Mode != "local" || rule.Instance != "Ubuntu" {
+		t.Errorf("unexpected second rule (instance should fall back to the proxy's): %+v", rule)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected a warning for the rule with an unknown remote IP, got %v", warnings)
+	}
+	if err := validateMappingSnapshot(snapshot); err != nil {
+		t.Errorf("built snapshot should validate: %v", err)
+	}
+}
+
+func TestValidateMappingSnapshot(t *testing.T) {
+	valid := func() *MappingSnapshot {
+		return &MappingSnapshot{
+			Version:       mappingSnapshotVersion,
+			Mappings:      []SnapshotMapping{{ListenPort: 8080, ConnectAddress: "172.20.0.2", ConnectPort: 80}},
+			FirewallRules: []SnapshotFirewallRule{{Name: "WSL2-Port-8080-1234", Port: 8080, Mode: "local"}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *MappingSnapshot)
+		valid  bool
+	}{
+		{"Valid", func(s *MappingSnapshot) {}, true},
+		{"Wrong version", func(s *MappingSnapshot) { s.Version = 99 }, false},
+		{"Bad listen port", func(s *MappingSnapshot) { s.Mappings[0].ListenPort = 0 }, false},
+		{"Bad connect address", func(s *MappingSnapshot) { s.Mappings[0].ConnectAddress = "not-an-ip" }, false},
+		{"Duplicate listen port", func(s *MappingSnapshot) { s.Mappings = append(s.Mappings, s.Mappings[0]) }, false},
+		{"Bad firewall mode", func(s *MappingSnapshot) { s.FirewallRules[0].Mode = "open" }, false},
+		{"Missing rule name", func(s *MappingSnapshot) { s.FirewallRules[0].Name = "" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot := valid()
+			tt.modify(snapshot)
+			err := validateMappingSnapshot(snapshot)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestWaitForRoutable(t *testing.T) {
+	tests := []struct {
+		name      string
+		readyAt   int // probe attempt that first succeeds (0 = never)
+		attempts  int
+		expected  bool
+		wantCalls int
+	}{
+		{"Immediately routable", 1, 5, true, 1},
+		{"Routable after boot delay", 3, 5, true, 3},
+		{"Never routable", 0, 5, false, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			routable := func(ip string, port int) bool {
+				calls++
+				return tt.readyAt != 0 && calls >= tt.readyAt
+			}
+			if got := waitForRoutable("172.20.0.2", 22, tt.attempts, 0, routable); got != tt.expected {
+				t.Errorf("waitForRoutable() = %v, want %v", got, tt.expected)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d probes, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestQosThrottleValidation(t *testing.T) {
+	service := &ServiceState{}
+	tests := []struct {
+		name  string
+		kbps  int
+		valid bool
+	}{
+		{"Omitted", 0, true},
+		{"Typical", 2048, true},
+		{"Maximum", maxQosThrottleKbps, true},
+		{"Negative", -1, false},
+		{"Too large", maxQosThrottleKbps + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				CheckIntervalSeconds: 5,
+				Instances:            []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, QosThrottleKbps: tt.kbps}}}},
+			}
+			err := service.validateConfiguration(config)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestUnprotectedFullPorts(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{
+			{Port: 80, Firewall: "full"},
+			{Port: 443, Firewall: "full", QosThrottleKbps: 1024},
+			{Port: 22, Firewall: "local"},
+		}},
+	}}
+
+	got := unprotectedFullPorts(config)
+	if len(got) != 1 || got[0] != "Ubuntu:80" {
+		t.Errorf("unprotectedFullPorts() = %v, want [Ubuntu:80]", got)
+	}
+
+	script := qosPolicyScript(443, 1024)
+	if !strings.Contains(script, "-IPSrcPortMatchCondition 443") || !strings.Contains(script, "-ThrottleRateActionBitsPerSecond 1024000") {
+		t.Errorf("unexpected QoS policy script: %s", script)
+	}
+}
+
+func TestReconcileSnapshotPlan(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22}, {Port: 3000}}},
+			{Name: "Debian", Ports: []Port{{Port: 3000}, {Port: 5432}}},
+		},
+	}
+	current := map[int]PortMapping{
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2"},   // in sync
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.9"}, // stale IP
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}, // Debian stopped
+		9999: {ExternalPort: 9999, InternalPort: 9999, TargetIP: "10.0.0.1"},   // not ours
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+
+	plan := snapshot.Plan()
+
+	expected := []PlanAction{
+		{Action: "update", Port: 3000, Instance: "Ubuntu", From: "172.20.0.9:3000", To: "172.20.0.2:3000"},
+		{Action: "add", Port: 8080, Instance: "Ubuntu", To: "172.20.0.2:80"},
+		{Action: "remove", Port: 5432, From: "172.20.0.3:5432"},
+	}
+	if len(plan.Actions) != len(expected) {
+		t.Fatalf("expected %d actions, got %+v", len(expected), plan.Actions)
+	}
+	for i, action := range expected {
+		if plan.Actions[i] != action {
+			t.Errorf("action %d = %+v, want %+v", i, plan.Actions[i], action)
+		}
+	}
+	if len(plan.Current) != 4 || len(plan.Desired) != 3 {
+		t.Errorf("unexpected current/desired sizes: %d/%d", len(plan.Current), len(plan.Desired))
+	}
+	if len(plan.Conflicts) != 0 {
+		t.Errorf("no conflicts expected with only Ubuntu running, got %+v", plan.Conflicts)
+	}
+
+	// Both running: port 3000 conflicts and Debian loses
+	snapshot = newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2", "Debian": "172.20.0.3"}, current)
+	plan = snapshot.Plan()
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Port != 3000 || plan.Conflicts[0].Instances[0] != "Ubuntu" {
+		t.Errorf("unexpected conflicts: %+v", plan.Conflicts)
+	}
+	if plan.IsEmpty() {
+		t.Error("plan should not be empty")
+	}
+}
+
+func TestReconcileSnapshotStatus(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22}, {Port: 3000}, {Port: 5353, Protocol: "udp"}}},
+			{Name: "Debian", Ports: []Port{{Port: 5432}}},
+			{Name: "Alpine", Ports: []Port{{Port: 2222, InternalPort: 22}}},
+		},
+	}
+	current := map[int]PortMapping{
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2"},   // in sync
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.9"}, // stale IP
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}, // Debian stopped
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2", "Alpine": "172.20.0.4"}, current)
+
+	report := snapshot.Status("wsl2-config.json")
+	expected := &StatusReport{
+		ConfigFile: "wsl2-config.json",
+		Instances: []StatusInstance{
+			{Name: "Ubuntu", Running: true, IP: "172.20.0.2", Ports: []StatusPort{
+				{Port: 8080, InternalPort: 80, Protocol: "tcp", State: "missing", Desired: "172.20.0.2:80"},
+				{Port: 2222, InternalPort: 22, Protocol: "tcp", State: "active", Desired: "172.20.0.2:22", Actual: "172.20.0.2:22"},
+				{Port: 3000, InternalPort: 3000, Protocol: "tcp", State: "wrong", Desired: "172.20.0.2:3000", Actual: "172.20.0.9:3000"},
+				{Port: 5353, InternalPort: 5353, Protocol: "udp", State: "relayed", Desired: "172.20.0.2:5353"},
+			}},
+			{Name: "Debian", Ports: []StatusPort{
+				{Port: 5432, InternalPort: 5432, Protocol: "tcp", State: "stopped", Actual: "172.20.0.3:5432"},
+			}},
+			{Name: "Alpine", Running: true, IP: "172.20.0.4", Ports: []StatusPort{
+				{Port: 2222, InternalPort: 22, Protocol: "tcp", State: "superseded", Actual: "172.20.0.2:22"},
+			}},
+		},
+		Unexpected: []StatusPort{{Port: 5432, InternalPort: 5432, Protocol: "tcp", State: "unexpected", Actual: "172.20.0.3:5432"}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		got, _ := json.MarshalIndent(report, "", "  ")
+		t.Errorf("status = %s", got)
+	}
+}
+
+func TestPortEnabled(t *testing.T) {
+	enabled, disabled := true, false
+	for _, tt := range []struct {
+		config string
+		want   bool
+	}{
+		{`{"port": 8080}`, true},
+		{`{"port": 8080, "enabled": true}`, true},
+		{`{"port": 8080, "enabled": false}`, false},
+	} {
+		var port Port
+		if err := json.Unmarshal([]byte(tt.config), &port); err != nil {
+			t.Fatal(err)
+		}
+		if port.IsEnabled() != tt.want {
+			t.Errorf("%s: IsEnabled = %v, want %v", tt.config, port.IsEnabled(), tt.want)
+		}
+	}
+
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22, Enabled: &enabled}, {Port: 3000, Enabled: &disabled}}},
+	}}
+	current := map[int]PortMapping{
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.2", ListenAddress: "0.0.0.0"}, // forwarded before it was disabled
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+
+	desired, _ := snapshot.DesiredMappings()
+	if _, ok := desired[3000]; ok || len(desired) != 2 {
+		t.Errorf("disabled port should not be desired: %+v", desired)
+	}
+	if explanation := snapshot.ExplainPort("Ubuntu", config.Instances[0].Ports[2], desired); explanation != "disabled, existing forward to 172.20.0.2:3000 will be removed" {
+		t.Errorf("unexpected explanation: %q", explanation)
+	}
+	if state := snapshot.Status("").Instances[0].Ports[2].State; state != "disabled" {
+		t.Errorf("status state = %q, want disabled", state)
+	}
+
+	// The next pass removes the forward
+	runner := &fakeRunner{}
+	service := &ServiceState{config: config, runner: runner, currentMappings: current}
+	service.reconcilePortForwarding(snapshot)
+	removed := false
+	for _, command := range runner.portproxyCommands() {
+		if command == "delete v4tov4 listenport=3000" {
+			removed = true
+		}
+		if strings.Contains(command, "listenport=3000") && strings.HasPrefix(command, "add ") {
+			t.Errorf("disabled port should not be forwarded: %s", command)
+		}
+	}
+	if !removed {
+		t.Error("the disabled port's forward should be removed")
+	}
+}
+
+func TestReconcileSnapshotDrift(t *testing.T) {
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances: []Instance{
+			{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22}, {Port: 3000}}},
+			{Name: "Debian", Ports: []Port{{Port: 5432}}},
+		},
+	}
+	current := map[int]PortMapping{
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2"},   // in sync
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.9"}, // stale IP
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}, // Debian stopped
+		9999: {ExternalPort: 9999, InternalPort: 9999, TargetIP: "10.0.0.1"},   // not ours
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+
+	report := snapshot.Drift()
+	expected := []DriftEntry{
+		{Port: 3000, Kind: "wrong", Instance: "Ubuntu", Expected: "172.20.0.2:3000", Actual: "172.20.0.9:3000"},
+		{Port: 8080, Kind: "missing", Instance: "Ubuntu", Expected: "172.20.0.2:80"},
+		{Port: 5432, Kind: "unexpected", Actual: "172.20.0.3:5432"},
+	}
+	if report.InSync || !reflect.DeepEqual(report.Drift, expected) {
+		t.Errorf("drift = %+v, want %+v", report.Drift, expected)
+	}
+
+	// additive_only keeps stopped instances' forwards on purpose, so they aren't drift
+	config.AdditiveOnly = true
+	if report := snapshot.Drift(); len(report.Drift) != 2 {
+		t.Errorf("additive_only drift = %+v, want only the missing and wrong ports", report.Drift)
+	}
+
+	inSync := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, map[int]PortMapping{
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2"},
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.2"},
+		8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2"},
+	})
+	if report := inSync.Drift(); !report.InSync || len(report.Drift) != 0 {
+		t.Errorf("expected no drift, got %+v", report.Drift)
+	}
+}
+
+func TestRenderTerraformPlan(t *testing.T) {
+	plan := &ReconcilePlan{Actions: []PlanAction{
+		{Action: "update", Port: 3000, Instance: "Ubuntu", From: "172.20.0.9:3000", To: "172.20.0.2:3000"},
+		{Action: "add", Port: 8080, Instance: "Ubuntu", To: "172.20.0.2:80"},
+		{Action: "remove", Port: 5432, From: "172.20.0.3:5432"},
+	}}
+
+	expected := "Port forwarding will be changed as follows:\n\n" +
+		"  ~ port 3000: 172.20.0.9:3000 -> 172.20.0.2:3000 (Ubuntu)\n" +
+		"  + port 8080 -> 172.20.0.2:80 (Ubuntu)\n" +
+		"  - port 5432 -> 172.20.0.3:5432\n" +
+		"\nPlan: 1 to add, 1 to change, 1 to destroy.\n"
+	if got := renderTerraformPlan(plan, false); got != expected {
+		t.Errorf("renderTerraformPlan() =\n%s\nwant\n%s", got, expected)
+	}
+
+	if got := renderTerraformPlan(plan, true); !strings.Contains(got, ansiGreen+"  + port 8080") || !strings.Contains(got, ansiRed+"  - port 5432") {
+		t.Errorf("expected colored add/remove lines, got %q", got)
+	}
+	if got := renderTerraformPlan(&ReconcilePlan{}, false); !strings.HasPrefix(got, "No changes.") {
+		t.Errorf("unexpected empty plan rendering: %q", got)
+	}
+}
+
+func TestExpandConfigStrings(t *testing.T) {
+	vars := map[string]string{"DISTRO": "Ubuntu-22.04", "QUOTED": `say "hi" in C:\wsl`}
+	env := func(name string) (string, bool) {
+		if name == "DISTRO" || name == "LAN_IP" {
+			return "from-env-" + name, true
+		}
+		return "", false
+	}
+
+	config := &Config{
+		LogFile: "${QUOTED}",
+		Instances: []Instance{{
+			Name:    "${DISTRO}",
+			Aliases: []string{"${DISTRO}-alt"},
+			Comment: "$${LITERAL}",
+			Ports:   []Port{{Port: 8080, ListenAddress: "${LAN_IP}"}},
+		}},
+	}
+	if err := expandConfigStrings(config, vars, env); err != nil {
+		t.Fatalf("expandConfigStrings failed: %v", err)
+	}
+	instance := config.Instances[0]
+	got := []string{config.LogFile, instance.Name, instance.Aliases[0], instance.Comment, instance.Ports[0].ListenAddress}
+	expected := []string{`say "hi" in C:\wsl`, "Ubuntu-22.04", "Ubuntu-22.04-alt", "${LITERAL}", "from-env-LAN_IP"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expanded values = %q, want %q", got, expected)
+	}
+
+	undefined := &Config{LogFile: "${NOPE}", Instances: []Instance{{Name: "${ALSO_NOPE}", Comment: "${NOPE}"}}}
+	if err := expandConfigStrings(undefined, vars, env); err == nil || !strings.Contains(err.Error(), "${ALSO_NOPE}, ${NOPE}") {
+		t.Errorf("expected an error naming both undefined variables, got %v", err)
+	}
+}
+
+func TestLoadConfigFileExpandEnv(t *testing.T) {
+	defer func(previous map[string]string) { configVars = previous }(configVars)
+	configVars = map[string]string{"DISTRO": `Ubuntu "22.04"`}
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Off by default: literal ${...} in values and comments is left alone
+	literal := write("literal.jsonc", `{
+		// uses ${UNDEFINED} on purpose
+		"instances": [{"name": "Ubuntu", "comment": "costs ${PRICE}", "ports": [{"port": 8080}]}]
+	}`)
+	config, err := loadConfigFile(literal, false)
+	if err != nil {
+		t.Fatalf("config without expand_env: %v", err)
+	}
+	if config.Instances[0].Comment != "costs ${PRICE}" {
+		t.Errorf("comment = %q, want it unexpanded", config.Instances[0].Comment)
+	}
+
+	// With expand_env a value containing quotes can't break the document
+	expanded := write("expanded.json", `{"expand_env": true, "instances": [{"name": "${DISTRO}", "ports": [{"port": 8080}]}]}`)
+	config, err = loadConfigFile(expanded, false)
+	if err != nil {
+		t.Fatalf("config with expand_env: %v", err)
+	}
+	if config.Instances[0].Name != `Ubuntu "22.04"` {
+		t.Errorf("name = %q, want the --var value", config.Instances[0].Name)
+	}
+
+	undefined := write("undefined.json", `{"expand_env": true, "instances": [{"name": "${NOPE_NOT_SET}", "ports": [{"port": 8080}]}]}`)
+	if _, err := loadConfigFile(undefined, false); err == nil || !errors.Is(err, ErrConfig) {
+		t.Errorf("expected a config error for an undefined variable, got %v", err)
+	}
+}
+
+func TestExtractConfigVars(t *testing.T) {
+	args, vars, err := extractConfigVars([]string{"plan", "--var", "BASE_PORT=8000", "--json", "--var=CIDR=10.0.0.0/8", "cfg.json"})
+	if err != nil {
+		t.Fatalf("extractConfigVars() error = %v", err)
+	}
+	if strings.Join(args, " ") != "plan --json cfg.json" || vars["BASE_PORT"] != "8000" || vars["CIDR"] != "10.0.0.0/8" {
+		t.Errorf("extractConfigVars() = %v, %v", args, vars)
+	}
+
+	for _, bad := range [][]string{{"--var"}, {"--var", "NOVALUE"}, {"--var=1X=2"}} {
+		if _, _, err := extractConfigVars(bad); err == nil {
+			t.Errorf("extractConfigVars(%v) expected an error", bad)
+		}
+	}
+}
+
+func TestLoadConfigurationFallback(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("known-good.json", `{"check_interval_seconds": 30, "instances": [{"name": "Ubuntu", "ports": [{"port": 22}]}]}`)
+	primary := write("config.json", `{"check_interval_seconds": 5, "fallback_config": "known-good.json", "instances": []}`)
+
+	service := &ServiceState{configFile: primary}
+	if err := service.loadConfiguration(); err != nil {
+		t.Fatalf("valid primary: %v", err)
+	}
+	if service.fallbackActive || service.config.CheckIntervalSeconds != 5 {
+		t.Errorf("expected primary config, got fallbackActive=%v interval=%d", service.fallbackActive, service.config.CheckIntervalSeconds)
+	}
+
+	// A botched edit that no longer parses still names its fallback
+	write("config.json", `{"check_interval_seconds": 5, "fallback_config": "known-good.json", "instances": [}`)
+	if err := service.loadConfiguration(); err != nil {
+		t.Fatalf("broken primary with fallback: %v", err)
+	}
+	if !service.fallbackActive || service.config.CheckIntervalSeconds != 30 {
+		t.Errorf("expected fallback config, got fallbackActive=%v interval=%d", service.fallbackActive, service.config.CheckIntervalSeconds)
+	}
+
+	// After a restart the fallback is found without any in-memory state
+	restarted := &ServiceState{configFile: primary}
+	if err := restarted.loadConfiguration(); err != nil || !restarted.fallbackActive {
+		t.Errorf("restart with broken primary: fallbackActive=%v, err=%v", restarted.fallbackActive, err)
+	}
+
+	// Fixing the primary switches back
+	write("config.json", `{"check_interval_seconds": 10, "fallback_config": "known-good.json", "instances": []}`)
+	if err := service.loadConfiguration(); err != nil || service.fallbackActive || service.config.CheckIntervalSeconds != 10 {
+		t.Errorf("fixed primary: fallbackActive=%v, err=%v", service.fallbackActive, err)
+	}
+
+	// Without a fallback the error is returned as before
+	noFallback := write("plain.json", `{"check_interval_seconds": -1, "instances": []}`)
+	if err := (&ServiceState{configFile: noFallback}).loadConfiguration(); err == nil {
+		t.Error("expected an error for an invalid config without fallback_config")
+	}
+}
+
+func TestExtractFallbackConfigPath(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{`{"fallback_config": "good.json"}`, "good.json"},
+		{`{"fallback_config" : "C:\\wsl\\good.json", "instances": [}`, `C:\wsl\good.json`},
+		{`{"instances": []}`, ""},
+	}
+	for _, tt := range tests {
+		if got := extractFallbackConfigPath([]byte(tt.data)); got != tt.expected {
+			t.Errorf("extractFallbackConfigPath(%s) = %q, want %q", tt.data, got, tt.expected)
+		}
+	}
+}
+
+func TestExportFirewallScripts(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, Firewall: "local"}, {Port: 22}}},
+		{Name: "Debian", Ports: []Port{{Port: 443, Firewall: "full", QosThrottleKbps: 512}}},
+	}}
+
+	rules, err := desiredFirewallRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Port != 443 || rules[1].Port != 8080 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if rules[1].Name != generateFirewallRuleName(8080, "Ubuntu") || rules[1].RemoteIP != "LocalSubnet" {
+		t.Errorf("rule should match what addFirewallRule creates: %+v", rules[1])
+	}
+
+	netsh := renderNetshScript("wsl2-config.json", rules)
+	expectedLine := fmt.Sprintf(`netsh advfirewall firewall add rule name=%s dir=in action=allow protocol=TCP localport=8080 remoteip=LocalSubnet "description=WSL2 port forwarding for Ubuntu"`,
+		generateFirewallRuleName(8080, "Ubuntu"))
+	if !strings.Contains(netsh, expectedLine) {
+		t.Errorf("netsh script missing %q:\n%s", expectedLine, netsh)
+	}
+
+	ps := renderPowerShellScript("wsl2-config.json", rules)
+	if !strings.Contains(ps, "-LocalPort 443 -RemoteAddress any -Description 'WSL2 port forwarding for Debian [qos_throttle_kbps=512]'") {
+		t.Errorf("unexpected PowerShell script:\n%s", ps)
+	}
+
+	if got := quoteCmdArg("name=100%"); got != "name=100%%" {
+		t.Errorf("quoteCmdArg should escape %%, got %s", got)
+	}
+}
+
+func TestOutboundFirewallRules(t *testing.T) {
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{
+			{Port: 8080, InternalPort: 80, Firewall: "local", FirewallDir: "both"},
+			{Port: 2222, InternalPort: 22, Firewall: "full", FirewallDir: "out"},
+			{Port: 3000, Firewall: "local"},
+		}},
+	}}
+
+	rules, err := desiredFirewallRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]FirewallRuleSpec)
+	for _, rule := range rules {
+		names[rule.Name] = rule
+	}
+	expected := []string{
+		outboundFirewallRuleName(2222, "Ubuntu"),
+		generateFirewallRuleName(3000, "Ubuntu"),
+		generateFirewallRuleName(8080, "Ubuntu"),
+		outboundFirewallRuleName(8080, "Ubuntu"),
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %+v", len(expected), rules)
+	}
+	for _, name := range expected {
+		if _, ok := names[name]; !ok {
+			t.Errorf("missing rule %s in %+v", name, rules)
+		}
+	}
+	if _, ok := names[generateFirewallRuleName(2222, "Ubuntu")]; ok {
+		t.Error("firewall_direction out should not create an inbound rule")
+	}
+
+	out := names[outboundFirewallRuleName(8080, "Ubuntu")]
+	expectedArgs := "advfirewall firewall add rule name=" + out.Name + " dir=out action=allow protocol=TCP remoteport=80 remoteip=LocalSubnet description=WSL2 port forwarding for Ubuntu (outbound to the WSL network)"
+	if got := strings.Join(out.NetshArgs(), " "); got != expectedArgs {
+		t.Errorf("outbound NetshArgs() = %q, want %q", got, expectedArgs)
+	}
+	if ps := renderPowerShellScript("wsl2-config.json", []FirewallRuleSpec{out}); !strings.Contains(ps, "-Direction Outbound -Action Allow -Protocol TCP -RemotePort 80 -RemoteAddress LocalSubnet") {
+		t.Errorf("unexpected PowerShell script:\n%s", ps)
+	}
+
+	service := &ServiceState{}
+	for _, port := range []Port{{Port: 80, Firewall: "local", FirewallDir: "sideways"}, {Port: 80, FirewallDir: "out"}} {
+		invalid := &Config{CheckIntervalSeconds: 5, Instances: []Instance{{Name: "Ubuntu", Ports: []Port{port}}}}
+		if err := service.validateConfiguration(invalid); err == nil {
+			t.Errorf("expected validation error for %+v", port)
+		}
+	}
+}
+
+func TestUDPPorts(t *testing.T) {
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{
+			{Port: 53, Firewall: "local"},
+			{Port: 53, Protocol: "udp", Firewall: "local"},
+			{Port: 27015, InternalPort: 27016, Protocol: "udp"},
+		}},
+	}}
+	if err := (&ServiceState{}).validateConfiguration(config); err != nil {
+		t.Fatalf("tcp and udp on one port should be valid: %v", err)
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, map[int]PortMapping{})
+
+	tcp, conflicts := snapshot.DesiredMappings()
+	if len(tcp) != 1 || tcp[53].Protocol != "tcp" || len(conflicts) != 0 {
+		t.Errorf("TCP mappings = %+v, conflicts = %+v", tcp, conflicts)
+	}
+	udp := snapshot.DesiredUDPMappings()
+	if len(udp) != 2 || udp[53].Protocol != "udp" || udp[27015].InternalPort != 27016 {
+		t.Errorf("UDP mappings = %+v", udp)
+	}
+
+	rules, err := desiredFirewallRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Name == rules[1].Name {
+		t.Fatalf("expected separate TCP and UDP rules for port 53, got %+v", rules)
+	}
+	for _, rule := range rules {
+		args := strings.Join(rule.NetshArgs(), " ")
+		wantUDP := strings.HasSuffix(rule.Name, "-udp")
+		if wantUDP != strings.Contains(args, "protocol=UDP") || wantUDP == strings.Contains(args, "protocol=TCP") {
+			t.Errorf("rule %s has args %q", rule.Name, args)
+		}
+	}
+
+	service := &ServiceState{}
+	for _, port := range []Port{{Port: 53, Protocol: "sctp"}, {Port: 53, Protocol: "udp", UPnP: true}, {Port: 53, Protocol: "udp", QosThrottleKbps: 100}} {
+		invalid := &Config{CheckIntervalSeconds: 5, Instances: []Instance{{Name: "Ubuntu", Ports: []Port{port}}}}
+		if err := service.validateConfiguration(invalid); err == nil {
+			t.Errorf("expected validation error for %+v", port)
+		}
+	}
+}
+
+func TestReconcileUDPRelays(t *testing.T) {
+	originalStart := startUDPRelay
+	defer func() { startUDPRelay = originalStart }()
+	var started []string
+	startUDPRelay = func(mapping PortMapping) (*UDPRelay, error) {
+		started = append(started, fmt.Sprintf("%d->%s:%d", mapping.ExternalPort, mapping.TargetIP, mapping.InternalPort))
+		return &UDPRelay{mapping: mapping, sessions: make(map[string]*udpSession)}, nil
+	}
+
+	service := &ServiceState{}
+	desired := map[int]PortMapping{53: {ExternalPort: 53, InternalPort: 53, TargetIP: "172.20.0.2", Protocol: "udp"}}
+	if result := service.reconcileUDPRelays(desired); !result.Changed || len(started) != 1 {
+		t.Fatalf("first pass should start the relay, started %v", started)
+	}
+	if result := service.reconcileUDPRelays(desired); result.Changed || len(started) != 1 {
+		t.Errorf("unchanged relay should be left running, started %v", started)
+	}
+
+	desired[53] = PortMapping{ExternalPort: 53, InternalPort: 53, TargetIP: "172.20.0.9", Protocol: "udp"}
+	first := service.udpRelays[53]
+	if result := service.reconcileUDPRelays(desired); !result.Changed || len(started) != 2 || !first.isClosed() {
+		t.Errorf("IP change should restart the relay, started %v", started)
+	}
+
+	if result := service.reconcileUDPRelays(map[int]PortMapping{}); !result.Changed || len(service.udpRelays) != 0 {
+		t.Errorf("relay should stop when no longer desired, got %+v", service.udpRelays)
+	}
+
+	service.dryRun = true
+	if service.reconcileUDPRelays(desired); len(started) != 2 || len(service.udpRelays) != 0 {
+		t.Errorf("dry run should not start relays, started %v", started)
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	relay := &UDPRelay{sessions: make(map[string]*udpSession)}
+	service := &ServiceState{udpRelays: map[int]*UDPRelay{53: relay}}
+	service.shutdown()
+	if !relay.isClosed() || len(service.udpRelays) != 0 || service.registryManager != nil {
+		t.Error("shutdown should stop the relays and release the registry")
+	}
+	service.shutdown() // safe to repeat
+}
+
+// fakeRunner is a CommandRunner for tests. It records each command line and answers
+// with handler if set, otherwise with the output of the longest matching prefix in
+// outputs (no output if none matches). A `netsh -f` script is run as the netsh
+// commands it holds, so tests see the same commands batched or not.
+type fakeRunner struct {
+	mu         sync.Mutex
+	commands   []string
+	outputs    map[string]string // command line prefix -> stdout
+	handler    func(name string, args ...string) ([]byte, error)
+	scripts    int   // netsh -f scripts run
+	scriptFail error // if set, netsh -f fails with it without running anything
+}
+
+func (f *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	if name == "netsh" && len(args) == 2 && args[0] == "-f" {
+		f.mu.Lock()
+		f.scripts++
+		f.mu.Unlock()
+		if f.scriptFail != nil {
+			return nil, f.scriptFail
+		}
+		script, err := os.ReadFile(args[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(script), "\r\n") {
+			if line == "" {
+				continue
+			}
+			if output, err := f.Run("netsh", strings.Fields(line)...); err != nil {
+				return output, err
+			}
+		}
+		return nil, nil
+	}
+
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	f.commands = append(f.commands, line)
+	f.mu.Unlock()
+	if f.handler != nil {
+		return f.handler(name, args...)
+	}
+
+	match := ""
+	for prefix := range f.outputs {
+		if strings.HasPrefix(line, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return nil, nil
+	}
+	return []byte(f.outputs[match]), nil
+}
+
+// portproxyCommands returns the netsh portproxy commands run so far, without the
+// "netsh interface portproxy" prefix, and forgets them
+func (f *fakeRunner) portproxyCommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var commands []string
+	for _, line := range f.commands {
+		if rest, ok := strings.CutPrefix(line, "netsh interface portproxy "); ok {
+			commands = append(commands, rest)
+		}
+	}
+	f.commands = nil
+	return commands
+}
+
+func TestCaptureSnapshotWithFakeRunner(t *testing.T) {
+	// wsl lists running distros in UTF-16LE
+	var distros []byte
+	for _, r := range "Ubuntu\r\nDocker-Desktop\r\n" {
+		distros = append(distros, byte(r), 0)
+	}
+	runner := &fakeRunner{outputs: map[string]string{
+		"wsl --list --running --quiet": string(distros),
+		"wsl -d Ubuntu -- hostname -I": "172.20.0.2 \n",
+		"netsh interface portproxy show v4tov4": "Address         Port        Address         Port\r\n" +
+			"--------------- ----------  --------------- ----------\r\n" +
+			"0.0.0.0         2222        172.20.0.9      22\r\n",
+	}}
+
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432}}},
+	}}
+	service := &ServiceState{config: config, runner: runner}
+	snapshot, err := service.captureSnapshot(config)
+	if err != nil {
+		t.Fatalf("captureSnapshot failed: %v", err)
+	}
+	if !reflect.DeepEqual(snapshot.InstanceIPs, map[string]string{"Ubuntu": "172.20.0.2"}) || snapshot.RunningDistros != 2 {
+		t.Errorf("unexpected instances: %+v (%d running)", snapshot.InstanceIPs, snapshot.RunningDistros)
+	}
+
+	service.currentMappings = snapshot.CurrentMappings
+	service.reconcilePortForwarding(snapshot)
+	var changes []string
+	for _, command := range runner.portproxyCommands() {
+		if !strings.HasPrefix(command, "show ") {
+			changes = append(changes, command)
+		}
+	}
+	// Ports are reconciled in map order; each port's own commands keep theirs
+	sort.SliceStable(changes, func(i, j int) bool {
+		return strings.Fields(changes[i])[2] < strings.Fields(changes[j])[2]
+	})
+	expected := []string{
+		"delete v4tov4 listenport=2222",
+		"add v4tov4 listenport=2222 listenaddress=0.0.0.0 connectport=22 connectaddress=172.20.0.2",
+		"add v4tov4 listenport=8080 listenaddress=0.0.0.0 connectport=80 connectaddress=172.20.0.2",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("netsh changes = %q, want %q", changes, expected)
+	}
+}
+
+func TestCaptureSnapshotPinnedIP(t *testing.T) {
+	var distros []byte
+	for _, r := range "Ubuntu\r\n" {
+		distros = append(distros, byte(r), 0)
+	}
+	runner := &fakeRunner{outputs: map[string]string{
+		"wsl --list --running --quiet": string(distros),
+		"wsl -d Ubuntu -- hostname -I": "172.20.0.2 \n",
+	}}
+
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", IP: "192.168.50.10", Ports: []Port{{Port: 8080}}},
+		{Name: "Debian", IP: "192.168.50.11", Ports: []Port{{Port: 5432}}},
+	}}
+	service := &ServiceState{config: config, runner: runner}
+	snapshot, err := service.captureSnapshot(config)
+	if err != nil {
+		t.Fatalf("captureSnapshot failed: %v", err)
+	}
+	// Only running instances are forwarded, pinned or not
+	if !reflect.DeepEqual(snapshot.InstanceIPs, map[string]string{"Ubuntu": "192.168.50.10"}) {
+		t.Errorf("unexpected instances: %+v", snapshot.InstanceIPs)
+	}
+	for _, command := range runner.commands {
+		if strings.HasPrefix(command, "wsl -d ") {
+			t.Errorf("pinned instance IP should not be looked up, ran %q", command)
+		}
+	}
+
+	config.Instances[0].IP = "not-an-ip"
+	if err := service.validateConfiguration(config); err == nil || !contains(err.Error(), "invalid ip 'not-an-ip'") {
+		t.Errorf("expected invalid ip to be rejected, got %v", err)
+	}
+}
+
+func TestRunningInstanceNameWithSpaces(t *testing.T) {
+	var distros []byte
+	for _, r := range "Ubuntu 22.04 LTS\r\r\nmy distro (work)\r\n" {
+		distros = append(distros, byte(r), 0)
+	}
+	var lookups [][]string
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		switch {
+		case len(args) > 0 && args[0] == "--list":
+			return distros, nil
+		case len(args) > 1 && args[0] == "-d":
+			lookups = append(lookups, args)
+			return []byte("172.20.0.2\n"), nil
+		}
+		return nil, nil
+	}}
+
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu 22.04 LTS", Ports: []Port{{Port: 8080}}},
+	}}
+	service := &ServiceState{config: config, runner: runner}
+	running, err := service.getRunningWSLInstances()
+	if err != nil {
+		t.Fatalf("getRunningWSLInstances failed: %v", err)
+	}
+	if !reflect.DeepEqual(running, map[string]bool{"Ubuntu 22.04 LTS": true, "my distro (work)": true}) {
+		t.Errorf("unexpected running instances: %v", running)
+	}
+
+	snapshot, err := service.captureSnapshot(config)
+	if err != nil {
+		t.Fatalf("captureSnapshot failed: %v", err)
+	}
+	if snapshot.InstanceIPs["Ubuntu 22.04 LTS"] != "172.20.0.2" {
+		t.Errorf("unexpected instances: %+v", snapshot.InstanceIPs)
+	}
+	// The name is passed to wsl -d as one argument, without the \r
+	if len(lookups) != 1 || lookups[0][1] != "Ubuntu 22.04 LTS" {
+		t.Errorf("unexpected wsl -d calls: %q", lookups)
+	}
+}
+
+func TestRunningInstanceDecodeArtifacts(t *testing.T) {
+	// Raw UTF-16LE as wsl prints it, with a BOM, NUL padding, stray CRs and
+	// zero-width characters around the names
+	var distros []byte
+	for _, r := range "\ufeffUbuntu\x00\r\r\nDebian\u200b\r\n\u200dAlpine\x00\x00\r\n\x00\r\n" {
+		distros = append(distros, byte(r), byte(r>>8))
+	}
+	runner := &fakeRunner{outputs: map[string]string{"wsl --list --running --quiet": string(distros)}}
+	service := &ServiceState{runner: runner}
+
+	running, err := service.getRunningWSLInstances()
+	if err != nil {
+		t.Fatalf("getRunningWSLInstances failed: %v", err)
+	}
+	expected := map[string]bool{"Ubuntu": true, "Debian": true, "Alpine": true}
+	if !reflect.DeepEqual(running, expected) {
+		t.Errorf("getRunningWSLInstances() = %v, want %v", running, expected)
+	}
+	if got := trimDistroName("Ubuntu 22.04 LTS\x00\r"); got != "Ubuntu 22.04 LTS" {
+		t.Errorf("trimDistroName() = %q", got)
+	}
+}
+
+func TestBatchedPortProxyChanges(t *testing.T) {
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}, {Port: 2222, InternalPort: 22}, {Port: 3000}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432}}},
+	}}
+	current := map[int]PortMapping{
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.9", ListenAddress: "0.0.0.0"},
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3", ListenAddress: "0.0.0.0"},
+	}
+	expected := []string{
+		"delete v4tov4 listenport=2222",
+		"delete v4tov4 listenport=5432",
+		"add v4tov4 listenport=2222 listenaddress=0.0.0.0 connectport=22 connectaddress=172.20.0.2",
+		"add v4tov4 listenport=3000 listenaddress=0.0.0.0 connectport=3000 connectaddress=172.20.0.2",
+		"add v4tov4 listenport=8080 listenaddress=0.0.0.0 connectport=80 connectaddress=172.20.0.2",
+	}
+
+	tests := []struct {
+		name       string
+		scriptFail error
+	}{
+		{"Batched", nil},
+		{"Script fails, one at a time", errors.New("netsh -f failed")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{scriptFail: tt.scriptFail}
+			service := &ServiceState{config: config, runner: runner, currentMappings: current}
+			snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+
+			result := service.reconcilePortForwarding(snapshot)
+			if !result.Changed || result.Failures != 0 {
+				t.Errorf("unexpected result %+v", result)
+			}
+			if runner.scripts != 1 {
+				t.Errorf("expected one netsh -f script, got %d", runner.scripts)
+			}
+
+			// Batched or not, every change is made exactly once
+			commands := runner.portproxyCommands()
+			sort.Strings(commands)
+			want := append([]string(nil), expected...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(commands, want) {
+				t.Errorf("netsh changes = %q, want %q", commands, want)
+			}
+			if len(service.createdMappings) != 3 {
+				t.Errorf("expected the 3 added forwards to be tracked, got %+v", service.createdMappings)
+			}
+		})
+	}
+
+	// The script runs deletes before adds, so an update replaces the forward in place
+	service := &ServiceState{config: config, currentMappings: current}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+	desired, _ := snapshot.DesiredMappings()
+	var planned []string
+	for _, args := range service.plannedPortProxyCommands(snapshot, desired) {
+		planned = append(planned, strings.TrimPrefix(strings.Join(args, " "), "interface portproxy "))
+	}
+	if !reflect.DeepEqual(planned, expected) {
+		t.Errorf("planned = %q, want %q", planned, expected)
+	}
+}
+
+func TestCleanupOnExit(t *testing.T) {
+	runner := &fakeRunner{}
+	service := &ServiceState{runner: runner, currentMappings: map[int]PortMapping{
+		22: {ExternalPort: 22, InternalPort: 22, TargetIP: "172.20.0.2"}, // there before this run
+	}}
+	service.addPortMapping(8080, 80, "172.20.0.2", "Ubuntu", "192.168.1.20")
+	service.addPortMapping(3000, 3000, "172.20.0.2", "Ubuntu", "")
+	service.removePortMapping(3000)
+	runner.portproxyCommands()
+
+	service.cleanupOnExit(time.Second)
+	expected := []string{"delete v4tov4 listenport=8080 listenaddress=192.168.1.20"}
+	if commands := runner.portproxyCommands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("cleanup ran %q, want %q", commands, expected)
+	}
+	if len(service.createdMappings) != 0 {
+		t.Errorf("removed forwards should no longer be tracked: %+v", service.createdMappings)
+	}
+
+	// A hung netsh doesn't hold up the exit
+	release := make(chan struct{})
+	defer close(release)
+	hung := &ServiceState{
+		runner: &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+			<-release
+			return nil, nil
+		}},
+		createdMappings: map[int]PortMapping{8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2"}},
+	}
+	start := time.Now()
+	hung.cleanupOnExit(50 * time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Error("cleanup on exit should give up after its timeout")
+	}
+}
+
+func TestUDPRelayForwardsDatagrams(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("can't bind UDP: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	relay, err := startUDPRelay(PortMapping{ListenAddress: "127.0.0.1", TargetIP: "127.0.0.1", InternalPort: echo.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	client, err := net.DialUDP("udp", nil, relay.listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "echo:ping" {
+		t.Errorf("relayed reply = %q, %v", buf[:n], err)
+	}
+}
+
+func TestUDPRelaySessionCap(t *testing.T) {
+	relay, err := startUDPRelay(PortMapping{ListenAddress: "127.0.0.1", TargetIP: "127.0.0.1", InternalPort: 9})
+	if err != nil {
+		t.Skipf("can't bind UDP: %v", err)
+	}
+	defer relay.Close()
+	relay.mu.Lock()
+	relay.maxSessions = 2
+	relay.mu.Unlock()
+
+	client := func(port int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port} }
+	for _, port := range []int{1001, 1002, 1001, 1003} {
+		if _, err := relay.session(client(port)); err != nil {
+			t.Fatalf("session(%d): %v", port, err)
+		}
+		time.Sleep(time.Millisecond) // distinct activity times
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	var keys []string
+	for key := range relay.sessions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// 1002 was the least recently active when 1003 arrived
+	if want := []string{"192.0.2.1:1001", "192.0.2.1:1003"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("sessions = %v, want %v", keys, want)
+	}
+}
+
+func TestPlanCleanup(t *testing.T) {
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{
+			{Port: 8080, InternalPort: 80, Firewall: "local", QosThrottleKbps: 500},
+			{Port: 53, Protocol: "udp", Firewall: "local"},
+		}},
+	}}
+	mappings := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2"},
+		3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.0.2"},   // registered, no longer configured
+		4000: {ExternalPort: 4000, InternalPort: 4000, TargetIP: "10.0.0.5"},     // port reused by someone else
+		9999: {ExternalPort: 9999, InternalPort: 9999, TargetIP: "192.168.65.2"}, // Docker Desktop
+	}
+	proxies := []RegistryPortProxy{
+		{Key: "3000", ListenPort: 3000, ConnectAddress: "172.20.0.2", ConnectPort: 3000},
+		{Key: "4000", ListenPort: 4000, ConnectAddress: "172.20.0.7", ConnectPort: 4000},
+	}
+	rules := []RegistryFirewallRule{{Key: "old", RuleName: "WSL2-Port-3000-1"}, {Key: "gone", RuleName: "WSL2-Port-5000-1"}}
+	existing := map[string]bool{
+		generateFirewallRuleName(8080, "Ubuntu"):          true,
+		generateFirewallRuleName(53, "Ubuntu") + "-udp":   true,
+		"WSL2-Port-3000-1":                                true,
+		outboundFirewallRuleName(8080, "Ubuntu") + "-udp": true, // not ours: 8080 is tcp
+	}
+
+	plan := planCleanup(config, mappings, proxies, rules, func(name string) bool { return existing[name] })
+
+	if !reflect.DeepEqual(plan.ProxyPorts, []int{3000, 8080}) {
+		t.Errorf("ProxyPorts = %v, want [3000 8080]", plan.ProxyPorts)
+	}
+	expectedRules := []string{"WSL2-Port-3000-1", generateFirewallRuleName(53, "Ubuntu") + "-udp", generateFirewallRuleName(8080, "Ubuntu")}
+	sort.Strings(expectedRules)
+	if !reflect.DeepEqual(plan.RuleNames, expectedRules) {
+		t.Errorf("RuleNames = %v, want %v", plan.RuleNames, expectedRules)
+	}
+	if !reflect.DeepEqual(plan.QosPorts, []int{8080}) {
+		t.Errorf("QosPorts = %v, want [8080]", plan.QosPorts)
+	}
+}
+
+func TestDrainMarker(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "wsl2-config.json")
+	service := &ServiceState{configFile: configFile}
+
+	if _, drained := drainedSince(configFile); drained || service.checkDrained() {
+		t.Fatal("should not be drained without a marker")
+	}
+
+	since := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(drainMarkerPath(configFile), []byte(since.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, drained := drainedSince(configFile); !drained || !got.Equal(since) {
+		t.Errorf("drainedSince() = %v, %v; want %v, true", got, drained, since)
+	}
+	if !service.checkDrained() || !service.drained {
+		t.Error("service should skip reconcile while drained")
+	}
+
+	if code := runDrain("resume", []string{configFile}); code != 0 {
+		t.Errorf("resume exit code = %d, want 0", code)
+	}
+	if service.checkDrained() || service.drained {
+		t.Error("service should reconcile again after resume")
+	}
+}
+
+func TestRunningInstanceNames(t *testing.T) {
+	running := map[string]bool{"Ubuntu-Dev": true, "debian": true}
+	got := runningInstanceNames(&Config{}, []string{"Ubuntu-Dev", "Ubuntu-Staging", "Debian"}, running)
+	if len(got) != 2 || got[0] != "Ubuntu-Dev" || got[1] != "Debian" {
+		t.Errorf("runningInstanceNames() = %v, want [Ubuntu-Dev Debian]", got)
+	}
+}
+
+func TestJSONStyle(t *testing.T) {
+	value := map[string]int{"port": 8080}
+
+	var style jsonStyle
+	if style.forFile() {
+		t.Error("files should default to compact output")
+	}
+	style.set("--pretty")
+	if !style.forFile() || !style.forStdout() {
+		t.Error("--pretty should apply to files and stdout")
+	}
+	style.set("--compact")
+	if style.forFile() || style.forStdout() {
+		t.Error("--compact should apply to files and stdout")
+	}
+
+	pretty, _ := marshalJSON(value, true)
+	compact, _ := marshalJSON(value, false)
+	if string(pretty) != "{\n  \"port\": 8080\n}" || string(compact) != `{"port":8080}` {
+		t.Errorf("unexpected encodings: %q, %q", pretty, compact)
+	}
+}
+
+func TestDryRunSkipsNetsh(t *testing.T) {
+	runner := &fakeRunner{}
+
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}}}}}
+	current := map[int]PortMapping{5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}}
+	snapshot := newReconcileSnapshot(&Config{CheckIntervalSeconds: 5, Instances: append(config.Instances, Instance{Name: "Debian", Ports: []Port{{Port: 5432}}})},
+		map[string]string{"Ubuntu": "172.20.0.2"}, current)
+	service := &ServiceState{config: config, dryRun: true, currentMappings: current, runner: runner}
+	service.reconcilePortForwarding(snapshot)
+
+	if ran := runner.portproxyCommands(); len(ran) != 0 {
+		t.Errorf("dry run ran netsh commands: %q", ran)
+	}
+
+	service.dryRun = false
+	err := service.addPortMapping(8080, 80, "172.20.0.2", "Ubuntu", "")
+	if ran := runner.portproxyCommands(); err != nil || len(ran) != 1 {
+		t.Errorf("without dry run netsh should run once, ran %q (err %v)", ran, err)
+	}
+}
+
+func TestFormatCommandLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"Plain", []string{"interface", "portproxy", "delete", "v4tov4", "listenport=8080"}, "netsh interface portproxy delete v4tov4 listenport=8080"},
+		{"Quoted", []string{"advfirewall", "firewall", "delete", "rule", "name=WSL2 Port 8080"}, `netsh advfirewall firewall delete rule "name=WSL2 Port 8080"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatCommandLine("netsh", tt.args); got != tt.expected {
+				t.Errorf("formatCommandLine() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReconcileInstanceStopStartLifecycle(t *testing.T) {
+	// Fake netsh that records commands and keeps the portproxy table
+	var commands []string
+	table := make(map[int]PortMapping)
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args[:3], " "))
+		values := make(map[string]string)
+		for _, arg := range args[4:] {
+			if key, value, ok := strings.Cut(arg, "="); ok {
+				values[key] = value
+			}
+		}
+		var port, internalPort int
+		fmt.Sscanf(values["listenport"], "%d", &port)
+		fmt.Sscanf(values["connectport"], "%d", &internalPort)
+		if args[2] == "add" {
+			table[port] = PortMapping{ExternalPort: port, InternalPort: internalPort, TargetIP: values["connectaddress"]}
+		} else {
+			delete(table, port)
+		}
+		return nil, nil
+	}}
+
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances:            []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}}}},
+	}
+	service := &ServiceState{config: config, runner: runner}
+	pass := func(instanceIPs map[string]string, held map[string]string) []string {
+		commands = nil
+		snapshot := newReconcileSnapshot(config, instanceIPs, table)
+		snapshot.Held = held
+		service.currentMappings = snapshot.CurrentMappings
+		service.reconcilePortForwarding(snapshot)
+		return commands
+	}
+
+	steps := []struct {
+		name       string
+		ips        map[string]string
+		held       map[string]string
+		expected   []string
+	}{
+		{"Instance starts", map[string]string{"Ubuntu": "172.20.0.2"}, nil, []string{"interface portproxy add"}},
+		{"Instance still running", map[string]string{"Ubuntu": "172.20.0.2"}, nil, nil},
+		{"Instance stops", nil, nil, []string{"interface portproxy delete"}},
+		{"Instance still stopped", nil, nil, nil},
+		{"Instance returns", map[string]string{"Ubuntu": "172.20.0.7"}, nil, []string{"interface portproxy add"}},
+		{"IP lookup fails while running", nil, map[string]string{"Ubuntu": "its IP couldn't be read"}, nil},
+	}
+
+	for _, step := range steps {
+		got := pass(step.ips, step.held)
+		if strings.Join(got, ";") != strings.Join(step.expected, ";") {
+			t.Errorf("%s: netsh commands = %v, want %v", step.name, got, step.expected)
+		}
+	}
+
+	if mapping, ok := table[8080]; !ok || mapping.TargetIP != "172.20.0.7" || mapping.InternalPort != 80 {
+		t.Errorf("expected forward to the returned instance to survive an IP lookup failure, got %+v", table)
+	}
+}
+
+func TestListenAddressRebindsWhenHostIPChanges(t *testing.T) {
+	var commands []string
+	table := make(map[int]PortMapping)
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args[2:], " "))
+		values := make(map[string]string)
+		for _, arg := range args[4:] {
+			if key, value, ok := strings.Cut(arg, "="); ok {
+				values[key] = value
+			}
+		}
+		var port int
+		fmt.Sscanf(values["listenport"], "%d", &port)
+		if args[2] == "add" {
+			table[port] = PortMapping{ExternalPort: port, InternalPort: port, TargetIP: values["connectaddress"], ListenAddress: values["listenaddress"]}
+		} else {
+			delete(table, port)
+		}
+		return nil, nil
+	}}
+
+	lanIP := ""
+	originalResolve := resolveListenAddress
+	defer func() { resolveListenAddress = originalResolve }()
+	resolveListenAddress = func(token string) (string, error) {
+		if token != "lan" || lanIP == "" {
+			return "", fmt.Errorf("no default route")
+		}
+		return lanIP, nil
+	}
+
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances:            []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, ListenAddress: "lan"}}}},
+	}
+	service := &ServiceState{config: config, runner: runner}
+
+	steps := []struct {
+		name     string
+		lanIP    string
+		expected []string
+	}{
+		{"Bind to LAN IP", "192.168.1.10", []string{"add v4tov4 listenport=8080 listenaddress=192.168.1.10 connectport=8080 connectaddress=172.20.0.2"}},
+		{"LAN IP unchanged", "192.168.1.10", nil},
+		{"Roamed to new network", "10.0.0.5", []string{"delete v4tov4 listenport=8080 listenaddress=192.168.1.10",
+			"add v4tov4 listenport=8080 listenaddress=10.0.0.5 connectport=8080 connectaddress=172.20.0.2"}},
+		{"Adapter gone", "", []string{"delete v4tov4 listenport=8080 listenaddress=10.0.0.5"}},
+	}
+
+	for _, step := range steps {
+		commands = nil
+		lanIP = step.lanIP
+		snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, table)
+		snapshot.ListenAddresses = service.resolveListenAddresses(config)
+		service.currentMappings = snapshot.CurrentMappings
+		service.reconcilePortForwarding(snapshot)
+		if strings.Join(commands, ";") != strings.Join(step.expected, ";") {
+			t.Errorf("%s: netsh commands = %v, want %v", step.name, commands, step.expected)
+		}
+	}
+}
+
+func TestValidateListenAddress(t *testing.T) {
+	tests := []struct {
+		value       string
+		expectError bool
+	}{
+		{"", false},
+		{"192.168.1.10", false},
+		{"::", false},
+		{"lan", false},
+		{"Wi-Fi", false},
+		{"Ethernet 2", false},
+		{" Wi-Fi", true},
+		{"Wi\"Fi", true},
+	}
+
+	for _, test := range tests {
+		err := validateListenAddress(test.value)
+		if (err != nil) != test.expectError {
+			t.Errorf("validateListenAddress(%q) error = %v, expectError %v", test.value, err, test.expectError)
+		}
+	}
+}
+
+func TestReconcileCorrectsWrongInternalPort(t *testing.T) {
+	runner := &fakeRunner{}
+	config := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080, InternalPort: 80}}}}}
+	current := map[int]PortMapping{8080: {ExternalPort: 8080, InternalPort: 8000, TargetIP: "172.20.0.2", ListenAddress: "0.0.0.0"}}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+	service := &ServiceState{config: config, currentMappings: snapshot.CurrentMappings, runner: runner}
+	service.reconcilePortForwarding(snapshot)
+	commands := runner.portproxyCommands()
+
+	expected := []string{
+		"delete v4tov4 listenport=8080",
+		"add v4tov4 listenport=8080 listenaddress=0.0.0.0 connectport=80 connectaddress=172.20.0.2",
+	}
+	if strings.Join(commands, ";") != strings.Join(expected, ";") {
+		t.Errorf("netsh commands = %v, want %v", commands, expected)
+	}
+}
+
+func TestReconcileAdditiveOnly(t *testing.T) {
+	runner := &fakeRunner{}
+
+	// Ubuntu moved to a new IP and Debian stopped
+	config := &Config{AdditiveOnly: true, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432}}},
+	}}
+	current := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 8080, TargetIP: "172.20.0.2", ListenAddress: "0.0.0.0"},
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3", ListenAddress: "0.0.0.0"},
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.9"}, current)
+	service := &ServiceState{config: config, currentMappings: snapshot.CurrentMappings, runner: runner}
+	service.reconcilePortForwarding(snapshot)
+	commands := runner.portproxyCommands()
+
+	expected := []string{
+		"delete v4tov4 listenport=8080",
+		"add v4tov4 listenport=8080 listenaddress=0.0.0.0 connectport=8080 connectaddress=172.20.0.9",
+	}
+	if strings.Join(commands, ";") != strings.Join(expected, ";") {
+		t.Errorf("netsh commands = %v, want %v (update only, no removal)", commands, expected)
+	}
+
+	for _, action := range snapshot.Plan().Actions {
+		if action.Action == "remove" {
+			t.Errorf("plan should not remove anything with additive_only, got %+v", action)
+		}
+	}
+}
+
+func TestAnnounceLivePorts(t *testing.T) {
+	web := PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", Instance: "Ubuntu"}
+	ssh := PortMapping{ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.2", Instance: "Ubuntu"}
+	moved := web
+	moved.TargetIP = "172.20.0.9"
+
+	steps := []struct {
+		name     string
+		desired  map[int]PortMapping
+		failed   map[int]bool
+		expected []int
+	}{
+		{"First add", map[int]PortMapping{8080: web, 2222: ssh}, map[int]bool{2222: true}, []int{8080}},
+		{"Steady state, failed port recovers", map[int]PortMapping{8080: web, 2222: ssh}, nil, []int{2222}},
+		{"Steady state", map[int]PortMapping{8080: web, 2222: ssh}, nil, nil},
+		{"Retargeted", map[int]PortMapping{8080: moved, 2222: ssh}, nil, []int{8080}},
+		{"Instance stopped", map[int]PortMapping{}, nil, nil},
+		{"Instance back", map[int]PortMapping{8080: moved}, nil, []int{8080}},
+	}
+
+	service := &ServiceState{}
+	for _, step := range steps {
+		got := service.announceLivePorts(step.desired, step.failed)
+		if fmt.Sprint(got) != fmt.Sprint(step.expected) {
+			t.Errorf("%s: announced %v, want %v", step.name, got, step.expected)
+		}
+	}
+}
+
+func TestNextIntervalAdaptive(t *testing.T) {
+	service := &ServiceState{config: &Config{CheckIntervalSeconds: 10, AdaptiveInterval: true, MinIntervalSeconds: 2, MaxIntervalSeconds: 30}}
+
+	steps := []struct {
+		name     string
+		result   ReconcileResult
+		expected time.Duration
+	}{
+		{"First quiet pass", ReconcileResult{}, 10 * time.Second},
+		{"Quiet, growing", ReconcileResult{}, 20 * time.Second},
+		{"Quiet, capped at max", ReconcileResult{}, 30 * time.Second},
+		{"Change detected", ReconcileResult{Changed: true}, 2 * time.Second},
+		{"Quiet after change", ReconcileResult{}, 4 * time.Second},
+		{"Failure", ReconcileResult{Failures: 1}, 2 * time.Second},
+	}
+
+	for _, step := range steps {
+		if got := service.nextInterval(step.result); got != step.expected {
+			t.Errorf("%s: nextInterval() = %v, want %v", step.name, got, step.expected)
+		}
+	}
+
+	service.config.AdaptiveInterval = false
+	if got := service.nextInterval(ReconcileResult{Changed: true}); got != 10*time.Second {
+		t.Errorf("fixed interval: nextInterval() = %v, want 10s", got)
+	}
+}
+
+func TestFindWANConnection(t *testing.T) {
+	response := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\nST: upnp:rootdevice\r\n\r\n"
+	location, err := parseSSDPLocation([]byte(response))
+	if err != nil || location != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Fatalf("parseSSDPLocation() = %q, %v", location, err)
+	}
+
+	description := `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList><device>
+        <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+        <serviceList><service>
+          <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+          <controlURL>/ctl/IPConn</controlURL>
+        </service></serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device>
+</root>`
+	gateway, err := findWANConnection([]byte(description), location)
+	if err != nil {
+		t.Fatalf("findWANConnection() error = %v", err)
+	}
+	if gateway.controlURL != "http://192.168.1.1:5000/ctl/IPConn" || gateway.serviceType != "urn:schemas-upnp-org:service:WANIPConnection:1" {
+		t.Errorf("findWANConnection() = %+v", gateway)
+	}
+
+	if _, err := findWANConnection([]byte(`<root><device></device></root>`), location); err == nil {
+		t.Error("expected an error for a device without a WAN connection service")
+	}
+}
+
+func TestReconcileUPnPMappings(t *testing.T) {
+	var actions []string
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		actions = append(actions, action[strings.Index(action, "#")+1:len(action)-1])
+		if strings.Contains(action, "GetExternalIPAddress") {
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		} else if !strings.Contains(string(body), "<NewExternalPort>8080</NewExternalPort>") {
+			t.Errorf("unexpected request body: %s", body)
+		}
+	}))
+	defer router.Close()
+
+	originalDiscover := discoverUPnPGateway
+	defer func() { discoverUPnPGateway = originalDiscover }()
+	discoverUPnPGateway = func() (*upnpGateway, error) {
+		return &upnpGateway{controlURL: router.URL, serviceType: "urn:schemas-upnp-org:service:WANIPConnection:1"}, nil
+	}
+
+	web := PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", Instance: "Ubuntu", ListenAddress: "192.168.1.10", UPnP: true}
+	steps := []struct {
+		name     string
+		desired  map[int]PortMapping
+		expected []string
+	}{
+		{"Port comes up", map[int]PortMapping{8080: web}, []string{"AddPortMapping", "GetExternalIPAddress"}},
+		{"Already mapped", map[int]PortMapping{8080: web}, nil},
+		{"Port torn down", map[int]PortMapping{}, []string{"DeletePortMapping"}},
+	}
+
+	service := &ServiceState{}
+	for _, step := range steps {
+		actions = nil
+		service.reconcileUPnPMappings(step.desired)
+		if strings.Join(actions, ";") != strings.Join(step.expected, ";") {
+			t.Errorf("%s: UPnP actions = %v, want %v", step.name, actions, step.expected)
+		}
+	}
+}
+
+func TestStaleMappings(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080}, {Port: 2222}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432}}},
+		{Name: "Alpine", Ports: []Port{{Port: 6379}}},
+	}}
+	current := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 8080, TargetIP: "172.20.0.2"},  // in sync
+		2222: {ExternalPort: 2222, InternalPort: 2222, TargetIP: "172.20.0.99"}, // missed IP update
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.50"}, // Debian stopped
+		6379: {ExternalPort: 6379, InternalPort: 6379, TargetIP: "172.20.0.60"}, // Alpine held
+		9000: {ExternalPort: 9000, InternalPort: 9000, TargetIP: "10.0.0.1"},    // not ours
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2"}, current)
+	snapshot.Held = map[string]string{"Alpine": "its IP couldn't be read"}
+
+	stale := snapshot.StaleMappings()
+	expected := []StaleMapping{
+		{Port: 2222, TargetIP: "172.20.0.99", Instance: "Ubuntu", NewIP: "172.20.0.2"},
+		{Port: 5432, TargetIP: "172.20.0.50"},
+	}
+	if fmt.Sprint(stale) != fmt.Sprint(expected) {
+		t.Errorf("StaleMappings() = %+v, want %+v", stale, expected)
+	}
+}
+
+func TestPlanRegistrySync(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, Firewall: "local"}, {Port: 2222, Firewall: "full"}}},
+		{Name: "Debian", Ports: []Port{{Port: 8080}, {Port: 5432}}},
+	}}
+	mappings := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2"},
+		5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "172.20.0.3"}, // live, unregistered
+		9000: {ExternalPort: 9000, InternalPort: 9000, TargetIP: "172.20.0.4"}, // someone else's
+	}
+	proxies := []RegistryPortProxy{
+		{Key: "proxy_8080_old", ListenPort: 8080, ConnectAddress: "172.20.0.2", ConnectPort: 80, Timestamp: "2025-01-01 10:00:00"},
+		{Key: "proxy_8080_new", ListenPort: 8080, ConnectAddress: "172.20.0.2", ConnectPort: 80, Timestamp: "2025-02-01 10:00:00"},
+		{Key: "proxy_3000", ListenPort: 3000, ConnectAddress: "172.20.0.2", ConnectPort: 3000, Timestamp: "2025-01-01 10:00:00"}, // gone
+	}
+	actualRules := []FirewallRule{
+		{Name: generateFirewallRuleName(8080, "Ubuntu")},
+		{Name: generateFirewallRuleName(2222, "Ubuntu")}, // live, unregistered
+		{Name: "Remote Desktop"},
+	}
+	rules := []RegistryFirewallRule{
+		{Key: "fw_8080", RuleName: generateFirewallRuleName(8080, "Ubuntu"), Timestamp: "2025-01-01 10:00:00"},
+		{Key: "fw_6379", RuleName: generateFirewallRuleName(6379, "Debian"), Timestamp: "2025-01-01 10:00:00"}, // gone
+	}
+
+	plan := planRegistrySync(config, proxies, rules, mappings, actualRules)
+
+	if len(plan.RegisterProxies) != 1 || plan.RegisterProxies[0].ExternalPort != 5432 || plan.RegisterProxies[0].Instance != "Debian" {
+		t.Errorf("RegisterProxies = %+v, want only port 5432 for Debian", plan.RegisterProxies)
+	}
+	if strings.Join(plan.DropProxyKeys, ",") != "proxy_3000,proxy_8080_old" {
+		t.Errorf("DropProxyKeys = %v, want the dead entry and the older duplicate", plan.DropProxyKeys)
+	}
+	if len(plan.RegisterRules) != 1 || plan.RegisterRules[0].Name != generateFirewallRuleName(2222, "Ubuntu") || plan.RegisterRules[0].Port != 2222 {
+		t.Errorf("RegisterRules = %+v, want only the 2222 rule", plan.RegisterRules)
+	}
+	if strings.Join(plan.DropRuleKeys, ",") != "fw_6379" {
+		t.Errorf("DropRuleKeys = %v, want fw_6379", plan.DropRuleKeys)
+	}
+
+	// Once applied, a second pass has nothing left to do
+	synced := planRegistrySync(config,
+		[]RegistryPortProxy{proxies[1], {Key: "proxy_5432", ListenPort: 5432, ConnectAddress: "172.20.0.3", ConnectPort: 5432}},
+		[]RegistryFirewallRule{rules[0], {Key: "fw_2222", RuleName: generateFirewallRuleName(2222, "Ubuntu")}},
+		mappings, actualRules)
+	if !synced.IsEmpty() {
+		t.Errorf("expected an in-sync registry to need no changes, got %+v", synced)
+	}
+}
+
+func TestBuildResourceInventory(t *testing.T) {
+	proxies := []RegistryPortProxy{
+		{ListenPort: 8080, ConnectAddress: "172.20.0.2", ConnectPort: 80},
+		{ListenPort: 2222, ConnectAddress: "172.20.0.2", ConnectPort: 22},   // retargeted since
+		{ListenPort: 5432, ConnectAddress: "172.20.0.3", ConnectPort: 5432}, // gone
+	}
+	rules := []RegistryFirewallRule{{RuleName: "WSL2-Port-8080-Ubuntu"}, {RuleName: "WSL2-Port-5432-Debian"}}
+	mappings := map[int]PortMapping{
+		8080: {ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2"},
+		2222: {ExternalPort: 2222, InternalPort: 22, TargetIP: "172.20.0.9"},
+	}
+	actualRules := []FirewallRule{{Name: "WSL2-Port-8080-Ubuntu"}, {Name: "Unrelated"}}
+
+	inv := buildResourceInventory(proxies, rules, mappings, actualRules)
+	expected := ResourceInventory{PortProxies: 3, LivePortProxies: 1, FirewallRules: 2, LiveFirewallRules: 1}
+	if inv != expected {
+		t.Errorf("buildResourceInventory() = %+v, want %+v", inv, expected)
+	}
+	if inv.Orphaned() != 3 {
+		t.Errorf("Orphaned() = %d, want 3", inv.Orphaned())
+	}
+}
+
+func TestDockerMappingsLeftAlone(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080}, {Port: 3000}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432}}},
+	}}
+	snapshot := newReconcileSnapshot(config,
+		map[string]string{"Ubuntu": "172.20.1.2"},
+		map[int]PortMapping{
+			8080: {ExternalPort: 8080, InternalPort: 8080, TargetIP: "192.168.65.3"}, // Docker Desktop
+			5432: {ExternalPort: 5432, InternalPort: 5432, TargetIP: "192.168.65.3"}, // Docker, instance stopped
+			9000: {ExternalPort: 9000, InternalPort: 9000, TargetIP: "192.168.65.3"}, // Docker, not configured
+			3000: {ExternalPort: 3000, InternalPort: 3000, TargetIP: "172.20.9.9"},
+		})
+
+	owned := snapshot.DockerMappings()
+	if len(owned) != 2 || owned[8080].TargetIP == "" || owned[5432].TargetIP == "" {
+		t.Errorf("expected the Docker forwards on configured ports 8080 and 5432, got %v", owned)
+	}
+
+	desired, _ := snapshot.DesiredMappings()
+	if _, ok := desired[8080]; ok {
+		t.Error("a port Docker Desktop forwards should not be desired")
+	}
+	if desired[3000].TargetIP != "172.20.1.2" {
+		t.Errorf("expected port 3000 to still be corrected, got %+v", desired[3000])
+	}
+	for _, port := range []int{8080, 5432} {
+		if snapshot.ShouldRemove(port, desired) {
+			t.Errorf("Docker's forward on port %d should not be removed", port)
+		}
+	}
+	if stale := snapshot.StaleMappings(); len(stale) != 1 || stale[0].Port != 3000 {
+		t.Errorf("expected only port 3000 to be stale, got %+v", stale)
+	}
+	if !strings.Contains(snapshot.ExplainPort("Ubuntu", Port{Port: 8080}, desired), "Docker Desktop") {
+		t.Error("expected --explain to name Docker Desktop as the owner")
+	}
+}
+
+func TestIsDockerFirewallRule(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"Docker Desktop Backend": true,
+		"com.docker.backend":     true,
+		"vpnkit":                 true,
+		"WSL2 Port 8080 Ubuntu":  false,
+		"Remote Desktop":         false,
+	} {
+		if got := isDockerFirewallRule(name); got != expected {
+			t.Errorf("isDockerFirewallRule(%q) = %v, expected %v", name, got, expected)
+		}
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		name        string
+		answer      string
+		expected    []Port
+		expectError bool
+	}{
+		{"single port", "8080", []Port{{Port: 8080}}, false},
+		{"mapped and plain", "2222:22, 8080", []Port{{Port: 2222, InternalPort: 22}, {Port: 8080}}, false},
+		{"space separated", "3000 3001", []Port{{Port: 3000}, {Port: 3001}}, false},
+		{"same port both sides", "80:80", []Port{{Port: 80}}, false},
+		{"empty", "", nil, false},
+		{"not a number", "ssh", nil, true},
+		{"out of range", "70000", nil, true},
+		{"bad internal port", "2222:x", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, err := parsePortList(tt.answer)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error for %q, got %+v", tt.answer, ports)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(ports) != fmt.Sprint(tt.expected) {
+				t.Errorf("parsePortList(%q) = %+v, expected %+v", tt.answer, ports, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetupWizardBuildConfig(t *testing.T) {
+	// Skip Debian, forward two ports to Ubuntu (after a typo), firewall local, default interval
+	answers := "n\ny\nssh\n2222:22, 8080\n\n\n"
+	wizard := &setupWizard{in: bufio.NewReader(strings.NewReader(answers)), out: io.Discard}
+
+	config, err := wizard.buildConfig([]string{"Debian", "Ubuntu"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.CheckIntervalSeconds != 5 || len(config.Instances) != 1 || config.Instances[0].Name != "Ubuntu" {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	ports := config.Instances[0].Ports
+	if len(ports) != 2 || ports[0].Port != 2222 || ports[0].InternalPort != 22 || ports[1].Port != 8080 {
+		t.Errorf("unexpected ports: %+v", ports)
+	}
+	for _, port := range ports {
+		if port.Firewall != "local" {
+			t.Errorf("expected firewall local for port %d, got %q", port.Port, port.Firewall)
+		}
+	}
+	if err := (&ServiceState{}).validateConfiguration(config); err != nil {
+		t.Errorf("wizard config doesn't validate: %v", err)
+	}
+
+	// Running out of answers cancels rather than looping
+	wizard = &setupWizard{in: bufio.NewReader(strings.NewReader("y\n")), out: io.Discard}
+	if _, err := wizard.buildConfig([]string{"Ubuntu"}); err == nil {
+		t.Error("expected an error when input ends mid-setup")
+	}
+}
+
+func TestRotatingFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwarder.log")
+	writer, err := NewRotatingFileWriter(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	// Each line is just under half the 1 MB limit, so every third line rotates
+	line := []byte(strings.Repeat("x", 400*1024) + "\n")
+	for i := 0; i < 7; i++ {
+		if _, err := writer.Write(line); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 1024*1024 {
+			t.Errorf("%s is %d bytes, over the 1 MB limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept, found %s.3", path)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Size() != int64(len(line)) {
+		t.Errorf("expected the live file to hold the last line only, got %d bytes", info.Size())
+	}
+}
+
+func TestParseLocalhostForwarding(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected bool
+	}{
+		{"empty file", "", true},
+		{"not set", "[wsl2]\nmemory=8GB\n", true},
+		{"disabled", "[wsl2]\nlocalhostForwarding=false\n", false},
+		{"disabled with spaces and case", "[WSL2]\n  LocalhostForwarding = False\n", false},
+		{"explicitly enabled", "[wsl2]\nlocalhostForwarding=true\n", true},
+		{"trailing comment", "[wsl2]\nlocalhostForwarding=false # keep ports apart\n", false},
+		{"commented out", "[wsl2]\n# localhostForwarding=false\n", true},
+		{"other section", "[experimental]\nlocalhostForwarding=false\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLocalhostForwarding(tt.data); got != tt.expected {
+				t.Errorf("parseLocalhostForwarding(%q) = %v, expected %v", tt.data, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoopbackForwards(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, ListenAddress: "127.0.0.1"}, {Port: 2222}, {Port: 3000, ListenAddress: "lan"}}},
+		{Name: "Debian", Ports: []Port{{Port: 5432, ListenAddress: "192.168.1.10"}}},
+	}}
+	forwards := loopbackForwards(config)
+	if len(forwards) != 1 || forwards[0] != "Ubuntu port 8080 (127.0.0.1)" {
+		t.Errorf("expected only the 127.0.0.1 forward, got %v", forwards)
+	}
+}
+
+func TestRemoveUnconfiguredFirewallRules(t *testing.T) {
+	disabled := false
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{
+			{Port: 8080, Firewall: "local"},
+			{Port: 3000, Firewall: "local", Enabled: &disabled},
+			{Port: 2222},
+		}},
+		{Name: "Debian", Ports: []Port{{Port: 5432, Firewall: "full", FirewallDir: "both"}}},
+	}}
+
+	kept := []string{
+		generateFirewallRuleName(8080, "Ubuntu"),
+		generateFirewallRuleName(5432, "Debian"),
+		outboundFirewallRuleName(5432, "Debian"),
+	}
+	removedPort := generateFirewallRuleName(6379, "Ubuntu")
+	disabledPort := generateFirewallRuleName(3000, "Ubuntu")
+	legacy := legacyFirewallRuleName(8080, "Ubuntu")
+	tracked := append(append([]string(nil), kept...), removedPort, disabledPort, legacy, removedPort)
+
+	stale, err := unconfiguredFirewallRules(config, tracked)
+	if err != nil {
+		t.Fatalf("unconfiguredFirewallRules failed: %v", err)
+	}
+	expected := []string{removedPort, disabledPort, legacy}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(stale, expected) {
+		t.Errorf("unconfiguredFirewallRules() = %q, want %q", stale, expected)
+	}
+
+	// A stale rule that no longer exists is only forgotten
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		if len(args) == 5 && args[2] == "show" && args[4] == "name="+legacy {
+			return nil, errors.New("No rules match the specified criteria")
+		}
+		return nil, nil
+	}}
+	service := &ServiceState{config: config, runner: runner, dryRun: true, createdRules: map[string]bool{}}
+	for _, name := range tracked {
+		service.createdRules[name] = true
+	}
+	service.removeUnconfiguredFirewallRules()
+
+	var shown []string
+	for _, command := range runner.commands {
+		shown = append(shown, strings.TrimPrefix(command, "netsh advfirewall firewall show rule name="))
+	}
+	if !reflect.DeepEqual(shown, expected) {
+		t.Errorf("checked rules %q, want %q", shown, expected)
+	}
+	if service.createdRules[legacy] || !service.createdRules[removedPort] {
+		t.Errorf("only the missing rule should be forgotten in a dry run, tracking %v", service.createdRules)
+	}
+
+	// pre_provision_firewall removes unconfigured rules itself
+	runner.commands = nil
+	config.PreProvisionFirewall = true
+	service.removeUnconfiguredFirewallRules()
+	if len(runner.commands) != 0 {
+		t.Errorf("expected nothing to run with pre_provision_firewall, ran %q", runner.commands)
+	}
+}
+
+func TestForwarderFirewallRules(t *testing.T) {
+	actual := []string{
+		"Core Networking - DNS (UDP-Out)",
+		generateFirewallRuleName(8080, "Ubuntu"),
+		"WSL2-Port-2222-4815",
+		generateFirewallRuleName(8080, "Ubuntu"), // netsh lists a name once per rule
+		"Custom forward rule",
+		"Remote Desktop - User Mode (TCP-In)",
+	}
+	tracked := []string{"Custom forward rule", "WSL2-Port-9999-1"}
+
+	expected := []string{"Custom forward rule", "WSL2-Port-2222-4815", generateFirewallRuleName(8080, "Ubuntu")}
+	sort.Strings(expected)
+	if got := forwarderFirewallRules(actual, tracked); !reflect.DeepEqual(got, expected) {
+		t.Errorf("forwarderFirewallRules() = %q, want %q", got, expected)
+	}
+	if got := forwarderFirewallRules([]string{"Remote Desktop - User Mode (TCP-In)"}, nil); len(got) != 0 {
+		t.Errorf("expected no forwarder rules, got %q", got)
+	}
+}
+
+func TestFirewallProvisioningChanges(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 8080, Firewall: "full"}, {Port: 2222, Firewall: "local"}, {Port: 3000}}},
+	}}
+	desired, err := desiredFirewallRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := map[string]bool{}
+	for _, rule := range desired {
+		configured[rule.Name] = true
+	}
+
+	existing := []FirewallRule{
+		{Name: generateFirewallRuleName(8080, "Ubuntu")},
+		{Name: generateFirewallRuleName(5432, "Debian")}, // port removed from the config
+		{Name: "Someone else's rule"},
+	}
+	tracked := []string{generateFirewallRuleName(8080, "Ubuntu"), generateFirewallRuleName(5432, "Debian"), generateFirewallRuleName(6379, "Debian")}
+
+	toAdd, toRemove := firewallProvisioningChanges(desired, existing, tracked, configured)
+	if len(toAdd) != 1 || toAdd[0].Name != generateFirewallRuleName(2222, "Ubuntu") || toAdd[0].RemoteIP != "LocalSubnet" {
+		t.Errorf("expected only the missing 2222 rule to be created, got %+v", toAdd)
+	}
+	if len(toRemove) != 1 || toRemove[0] != generateFirewallRuleName(5432, "Debian") {
+		t.Errorf("expected only the unconfigured tracked rule to be removed, got %v", toRemove)
+	}
+}
+
+func TestApplyStartupDelays(t *testing.T) {
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", StartupDelaySeconds: 10, Ports: []Port{{Port: 8080}}},
+		{Name: "Debian", Ports: []Port{{Port: 2222}}},
+	}}
+	service := &ServiceState{}
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	running := map[string]string{"Ubuntu": "172.20.0.2", "Debian": "172.20.0.3"}
+
+	steps := []struct {
+		name       string
+		at         time.Duration
+		ips        map[string]string
+		expectHeld bool
+	}{
+		{"First seen", 0, running, true},
+		{"Still in delay", 5 * time.Second, running, true},
+		{"Delay elapsed", 10 * time.Second, running, false},
+		{"Stopped", 20 * time.Second, map[string]string{"Debian": "172.20.0.3"}, false},
+		{"Restarted, delayed again", 30 * time.Second, running, true},
+	}
+
+	for _, step := range steps {
+		snapshot := newReconcileSnapshot(config, step.ips, nil)
+		service.applyStartupDelays(snapshot, start.Add(step.at))
+
+		_, held := snapshot.Held["Ubuntu"]
+		_, forwarded := snapshot.InstanceIPs["Ubuntu"]
+		if held != step.expectHeld || (held && forwarded) {
+			t.Errorf("%s: Ubuntu held=%v forwarded=%v, want held=%v", step.name, held, forwarded, step.expectHeld)
+		}
+		if _, ok := snapshot.InstanceIPs["Debian"]; !ok {
+			t.Errorf("%s: Debian has no startup delay and should always be forwarded", step.name)
+		}
+	}
+}
+
+func TestReleaseUnreadableInstances(t *testing.T) {
+	config := &Config{Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080}}}}}
+	current := map[int]PortMapping{8080: {ExternalPort: 8080, InternalPort: 8080, TargetIP: "172.20.0.2", Instance: "Ubuntu"}}
+	service := &ServiceState{}
+
+	steps := []struct {
+		name         string
+		readable     bool
+		expectRemove bool
+	}{
+		{"First failure keeps the forward", false, false},
+		{"Second failure keeps the forward", false, false},
+		{"Third failure removes it", false, true},
+		{"Still failing, still removed", false, true},
+		{"Readable again", true, false},
+		{"Failing again, count restarted", false, false},
+	}
+
+	for _, step := range steps {
+		ips := map[string]string{"Ubuntu": "172.20.0.2"}
+		if !step.readable {
+			ips = nil
+		}
+		snapshot := newReconcileSnapshot(config, ips, current)
+		if !step.readable {
+			snapshot.Held = map[string]string{"Ubuntu": heldIPUnreadable}
+		}
+		service.releaseUnreadableInstances(snapshot)
+
+		desired, _ := snapshot.DesiredMappings()
+		if got := snapshot.ShouldRemove(8080, desired); got != step.expectRemove {
+			t.Errorf("%s: ShouldRemove = %v, want %v", step.name, got, step.expectRemove)
+		}
+	}
+}
+
+func TestCheckParsedOutputCountsEmptyParses(t *testing.T) {
+	tests := []struct {
+		name     string
+		decoded  string
+		entries  int
+		expected int64
+	}{
+		{"Parsed entries", "Rule Name: A\nAction: Allow\n", 1, 0},
+		{"Empty output", "", 0, 0},
+		{"Single line nothing-found message", "No rules match the specified criteria.\r\n", 0, 0},
+		{"Multi-line output parsed to nothing", "L\x00i\x00s\x00t\x00\ne\x00n\x00\n", 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := decodeStats.emptyParses.Load()
+			checkParsedOutput("test", []byte(tt.decoded), tt.decoded, tt.entries)
+			if got := decodeStats.emptyParses.Load() - before; got != tt.expected {
+				t.Errorf("empty parses counted = %d, want %d", got, tt.expected)
+			}
+		})
+	}
+
+	before := decodeStats.utf16.Load()
+	if _, err := decodeCommandOutput([]byte{0xFF, 0xFE, 'O', 0, 'k', 0}); err != nil || decodeStats.utf16.Load() != before+1 {
+		t.Errorf("UTF-16 decode should be counted, err=%v", err)
+	}
+}
+
+func TestTransientEmptyReading(t *testing.T) {
+	tests := []struct {
+		name     string
+		grace    int
+		readings []int  // running distros reported by each pass
+		expected []bool // whether each pass is skipped
+	}{
+		{"Grace disabled", 0, []int{2, 0, 0}, []bool{false, false, false}},
+		{"Never saw running distros", 2, []int{0, 0}, []bool{false, false}},
+		{"Transient blip", 2, []int{2, 0, 2, 0}, []bool{false, true, false, true}},
+		{"Empty reading persists", 2, []int{2, 0, 0, 0, 0}, []bool{false, true, true, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &ServiceState{}
+			for i, running := range tt.readings {
+				snapshot := &ReconcileSnapshot{RunningDistros: running}
+				if got := service.isTransientEmptyReading(snapshot, tt.grace); got != tt.expected[i] {
+					t.Errorf("pass %d (%d running): skipped = %v, want %v", i, running, got, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		sentinel error
+		kind     ErrorKind
+	}{
+		{"Privilege", withKind(KindPrivilege, fmt.Errorf("admin privileges required")), ErrPrivilege, KindPrivilege},
+		{"Netsh failure", commandError(KindNetsh, fmt.Errorf("netsh add command failed: %w", fmt.Errorf("exit status 1"))), ErrNetsh, KindNetsh},
+		{"WSL failure", commandError(KindWSL, fmt.Errorf("exit status 1")), ErrWSL, KindWSL},
+		{"Command not found", commandError(KindWSL, fmt.Errorf("failed to execute wsl: %w", &exec.Error{Name: "wsl", Err: exec.ErrNotFound})), ErrCommandNotFound, KindCommandNotFound},
+		{"Command timeout", commandError(KindNetsh, fmt.Errorf("netsh: %w", context.DeadlineExceeded)), ErrCommandTimeout, KindCommandTimeout},
+		{"Wrapped again", fmt.Errorf("failed to remove existing mapping: %w", commandError(KindNetsh, fmt.Errorf("exit status 1"))), ErrNetsh, KindNetsh},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !errors.Is(tt.err, tt.sentinel) {
+				t.Errorf("errors.Is(%v, %v) = false", tt.err, tt.sentinel)
+			}
+			var classified *ForwarderError
+			if !errors.As(tt.err, &classified) || classified.Kind != tt.kind {
+				t.Errorf("errors.As kind = %v, want %v", classified, tt.kind)
+			}
+			if kind, ok := errorKind(tt.err); !ok || kind != tt.kind {
+				t.Errorf("errorKind = %v, %v, want %v", kind, ok, tt.kind)
+			}
+			for _, other := range []error{ErrConfig, ErrPrivilege, ErrCommandNotFound, ErrCommandTimeout, ErrNetsh, ErrWSL} {
+				if other != tt.sentinel && errors.Is(tt.err, other) {
+					t.Errorf("%v should not match %v", tt.err, other)
+				}
+			}
+		})
+	}
+
+	if withKind(KindNetsh, nil) != nil || commandError(KindNetsh, nil) != nil {
+		t.Error("classifying a nil error should stay nil")
+	}
+	if _, ok := errorKind(fmt.Errorf("plain")); ok {
+		t.Error("an unclassified error should have no kind")
+	}
+	if err := commandError(KindNetsh, fmt.Errorf("exit status 1")); err.Error() != "exit status 1" {
+		t.Errorf("classifying should keep the message, got %q", err.Error())
+	}
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"instances": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigFile(configFile, false); !errors.Is(err, ErrConfig) {
+		t.Errorf("invalid config should be a config error, got %v", err)
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	var out bytes.Buffer
+	now := func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	writer := jsonLogWriter{out: &out, now: now}
+
+	lines := []string{
+		"Warning: Failed to reload configuration: bad json\n",
+		encodeLogEntry("info", "mapping_added", EventFields{Port: 8080, Instance: "Ubuntu", TargetIP: "172.20.0.2"}, "Port 8080->80 now forwarded to 172.20.0.2:80") + "\n",
+		encodeLogEntry("error", "mapping_add_failed", EventFields{Port: 8080}, "Error adding port mapping 8080->80: exit status 1") + " (repeated 3 times)\n",
+	}
+	for _, line := range lines {
+		if n, err := writer.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+
+	expected := []logEntry{
+		{TS: "2024-05-01T12:00:00Z", Level: "warning", Event: "log", Message: "Warning: Failed to reload configuration: bad json"},
+		{TS: "2024-05-01T12:00:00Z", Level: "info", Event: "mapping_added", Message: "Port 8080->80 now forwarded to 172.20.0.2:80", Port: 8080, Instance: "Ubuntu", TargetIP: "172.20.0.2"},
+		{TS: "2024-05-01T12:00:00Z", Level: "error", Event: "mapping_add_failed", Message: "Error adding port mapping 8080->80: exit status 1", Port: 8080, Repeated: 3},
+	}
+	written := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(written) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), out.String())
+	}
+	for i, line := range written {
+		var entry logEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %d is not JSON: %q", i, line)
+		}
+		if entry != expected[i] {
+			t.Errorf("line %d = %+v, want %+v", i, entry, expected[i])
+		}
+	}
+
+	for line, want := range map[string]string{
+		"    ✓ Port 8080->80 now forwarded to 172.20.0.2:80":  "Port 8080->80 now forwarded to 172.20.0.2:80",
+		"  ⚠️  Port conflict: Instance 'Debian' port 22":      "Port conflict: Instance 'Debian' port 22",
+		"    (dry-run) netsh interface portproxy show v4tov4": "(dry-run) netsh interface portproxy show v4tov4",
+		"\nReceived shutdown signal. Exiting gracefully...":   "Received shutdown signal. Exiting gracefully...",
+	} {
+		if got := eventMessage(line); got != want {
+			t.Errorf("eventMessage(%q) = %q, want %q", line, got, want)
+		}
+	}
+
+	// Errors logged as events still count towards the --max-runtime exit status
+	defer func(flags int, output io.Writer) {
+		jsonLogging = false
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	out.Reset()
+	jsonLogging = true
+	setLogOutput(&out)
+	service := &ServiceState{}
+	service.logEventf("mapping_remove_failed", EventFields{Port: 2222}, "Error removing port mapping %d: %v", 2222, "exit status 1")
+	consoleEvent("info", "in_sync", EventFields{}, "  All port mappings are in sync")
+	say("Waiting %d seconds...", 5)
+	if service.runExitCode() != 1 {
+		t.Errorf("a logged error should make the exit status 1, got %d", service.runExitCode())
+	}
+	written = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(written) != 2 || !strings.Contains(written[0], `"event":"mapping_remove_failed"`) || !strings.Contains(written[0], `"port":2222`) ||
+		!strings.Contains(written[1], `"message":"All port mappings are in sync"`) {
+		t.Errorf("unexpected JSON log: %q", out.String())
+	}
+}
+
+// fakeEventLog records what would be written to the Windows Event Log
+type fakeEventLog struct {
+	events []string
+}
+
+func (f *fakeEventLog) record(level string, eid uint32, msg string) error {
+	f.events = append(f.events, fmt.Sprintf("%s %d %s", level, eid, msg))
+	return nil
+}
+
+func (f *fakeEventLog) Info(eid uint32, msg string) error    { return f.record("info", eid, msg) }
+func (f *fakeEventLog) Warning(eid uint32, msg string) error { return f.record("warning", eid, msg) }
+func (f *fakeEventLog) Error(eid uint32, msg string) error   { return f.record("error", eid, msg) }
+
+func TestEventLog(t *testing.T) {
+	sink := &fakeEventLog{}
+	eventLogSink = sink
+	defer func(flags int, output io.Writer) {
+		eventLogSink = nil
+		jsonLogging = false
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+
+	for _, jsonMode := range []bool{false, true} {
+		sink.events = nil
+		jsonLogging = jsonMode
+		log.SetFlags(log.LstdFlags)
+		service := &ServiceState{}
+		setLogOutput(eventLogWriter{})
+
+		consoleEvent("info", "mapping_added", EventFields{Port: 8080}, "    ✓ Port 8080->80 now forwarded to 172.20.0.2:80")
+		consoleEvent("info", "in_sync", EventFields{}, "  All port mappings are in sync")
+		service.logEventf("mapping_add_failed", EventFields{Port: 2222}, "Error adding port mapping %d->%d: %v", 2222, 22, "exit status 1")
+		log.Printf("Warning: Failed to get IP for instance Ubuntu")
+		log.Printf("Registry manager initialized successfully")
+
+		expected := []string{
+			"info 100 Port 8080->80 now forwarded to 172.20.0.2:80",
+			"error 400 Error adding port mapping 2222->22: exit status 1",
+			"warning 300 Warning: Failed to get IP for instance Ubuntu",
+		}
+		if !reflect.DeepEqual(sink.events, expected) {
+			t.Errorf("json %v: events = %q, want %q", jsonMode, sink.events, expected)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	service := &ServiceState{}
+	for seconds, valid := range map[int]bool{0: true, 1: true, 600: true, -1: false, 601: false} {
+		config := &Config{CheckIntervalSeconds: 5, CommandTimeoutSeconds: seconds}
+		if err := service.validateConfiguration(config); (err == nil) != valid {
+			t.Errorf("command_timeout_seconds %d: valid = %v, got error %v", seconds, valid, err)
+		}
+	}
+	if timeout := (&Config{}).CommandTimeout(); timeout != defaultCommandTimeout {
+		t.Errorf("default timeout = %v, want %v", timeout, defaultCommandTimeout)
+	}
+	if timeout := (&Config{CommandTimeoutSeconds: 5}).CommandTimeout(); timeout != 5*time.Second {
+		t.Errorf("timeout = %v, want 5s", timeout)
+	}
+
+	// Commands are bounded by the config the service is using, whatever else was loaded
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"check_interval_seconds": 5, "command_timeout_seconds": 5, "instances": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	applied := &ServiceState{configFile: path}
+	if err := applied.loadConfiguration(); err != nil {
+		t.Fatalf("loadConfiguration failed: %v", err)
+	}
+	if _, err := loadConfigFile(path, false); err != nil {
+		t.Fatalf("loadConfigFile failed: %v", err)
+	}
+	if timeout := applied.commands().(execRunner).timeout; timeout != 5*time.Second {
+		t.Errorf("service command timeout = %v, want 5s", timeout)
+	}
+	if timeout := (&ServiceState{config: &Config{}}).commands().(execRunner).timeout; timeout != defaultCommandTimeout {
+		t.Errorf("another service's command timeout = %v, want %v", timeout, defaultCommandTimeout)
+	}
+
+	// A hung wsl fails the snapshot as a timeout, which the loop retries
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("%s timed out after 30s: %w", name, context.DeadlineExceeded)
+	}}
+	config := &Config{CheckIntervalSeconds: 5, Instances: []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 8080}}}}}
+	snapshotService := &ServiceState{config: config, runner: runner}
+	if _, err := snapshotService.captureSnapshot(config); !errors.Is(err, ErrCommandTimeout) {
+		t.Errorf("a killed command should be a timeout error, got %v", err)
+	}
+
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	start := time.Now()
+	_, err := runCommand(100*time.Millisecond, false, "sleep", "5")
+	if !errors.Is(err, context.DeadlineExceeded) || !contains(err.Error(), "sleep timed out after 100ms") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("sleep should have been killed, took %v", elapsed)
+	}
+}
+
+func TestCommandFailure(t *testing.T) {
+	exitErr := fmt.Errorf("exit status 1")
+	var utf16 []byte
+	for _, r := range "There is no distribution with the supplied name.\r\n" {
+		utf16 = append(utf16, byte(r), 0)
+	}
+
+	tests := []struct {
+		name           string
+		stdout, stderr []byte
+		want           string
+	}{
+		{"netsh on stdout", []byte("The requested operation requires elevation (Run as administrator).\r\n\r\n"), nil,
+			"exit status 1: The requested operation requires elevation (Run as administrator)."},
+		{"wsl in UTF-16 on stderr", nil, utf16, "exit status 1: There is no distribution with the supplied name."},
+		{"both", []byte("Ok.\r\n"), []byte("usage:\n  netsh add\n"), "exit status 1: Ok. usage: netsh add"},
+		{"nothing printed", nil, []byte("\r\n"), "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := commandFailure(exitErr, tt.stdout, tt.stderr)
+			if err.Error() != tt.want {
+				t.Errorf("got %q, want %q", err.Error(), tt.want)
+			}
+			if !errors.Is(err, exitErr) {
+				t.Error("the command's error should stay wrapped")
+			}
+		})
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	_, err := runCommand(defaultCommandTimeout, false, "sh", "-c", "echo 'No rules match the specified criteria.' >&2; exit 1")
+	var exitError *exec.ExitError
+	if !errors.As(err, &exitError) || !contains(err.Error(), "exit status 1: No rules match the specified criteria.") {
+		t.Errorf("expected the command's stderr in the error, got %v", err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "wsl2-config.json")
+	if err := os.WriteFile(configFile, []byte(`{"instances": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unwatched configs are re-read every pass
+	service := &ServiceState{configFile: configFile}
+	if !service.configNeedsReload() || !service.configNeedsReload() {
+		t.Error("an unwatched config should be reloaded every pass")
+	}
+
+	service.startConfigWatch()
+	if service.configChanged == nil {
+		t.Fatal("expected the config to be watched")
+	}
+	defer service.shutdown()
+	if service.configNeedsReload() {
+		t.Error("an unchanged watched config should not be reloaded")
+	}
+
+	// Other files in the directory don't count
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-service.configChanged:
+		t.Fatal("a change to another file should not trigger a reload")
+	case <-time.After(2 * configWatchDebounce):
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"instances": [], "additive_only": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-service.configChanged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a config change to wake the service loop")
+	}
+	if !service.configNeedsReload() || service.configNeedsReload() {
+		t.Error("a changed config should be reloaded once")
+	}
+}
+
+func TestLookupInstancesConcurrently(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		instance := args[1]
+		if args[3] == "ip" {
+			return nil, fmt.Errorf("no ip command")
+		}
+
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		time.Sleep(delay) // a wsl -d spawn
+		if instance == "Broken" {
+			return nil, fmt.Errorf("exit status 1")
+		}
+		return []byte("172.20.0." + strings.TrimPrefix(instance, "Ubuntu-") + " 10.0.0.1\n"), nil
+	}}
+
+	var lookups []instanceLookup
+	for i := 1; i <= 12; i++ {
+		instance := Instance{Name: fmt.Sprintf("Ubuntu-%d", i), InterfacePriority: []string{"eth0"}}
+		if i == 3 {
+			instance.Name = "Broken"
+		}
+		if i == 5 {
+			instance.Ports = []Port{{Port: 8080, ConnectFallback: true}}
+		}
+		lookups = append(lookups, instanceLookup{instance: instance, distro: instance})
+	}
+
+	start := time.Now()
+	results := lookupInstances(runner, lookups)
+	elapsed := time.Since(start)
+
+	if maxRunning > instanceLookupConcurrency || maxRunning < 2 {
+		t.Errorf("ran %d lookups at once, want 2-%d", maxRunning, instanceLookupConcurrency)
+	}
+	if serial := time.Duration(len(lookups)) * delay; elapsed >= serial {
+		t.Errorf("lookups took %s, no faster than running them one by one (%s)", elapsed, serial)
+	}
+	for i, result := range results {
+		name := lookups[i].instance.Name
+		want := []string{fmt.Sprintf("Warning: Failed to list interfaces for %s, falling back to hostname -I: no ip command", name)}
+		if !reflect.DeepEqual(result.messages, want) {
+			t.Errorf("%s: messages = %q, want %q", name, result.messages, want)
+		}
+		switch {
+		case name == "Broken":
+			if result.err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		case result.ip != fmt.Sprintf("172.20.0.%d", i+1):
+			t.Errorf("%s: ip = %s, results out of order", name, result.ip)
+		case (i == 4) != (len(result.candidates) == 2):
+			t.Errorf("%s: candidates = %v, only connect_fallback instances should have them", name, result.candidates)
+		}
+	}
+}
+
+func TestProbeMapping(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+	defer listener.Close()
+	openPort := listener.Addr().(*net.TCPAddr).Port
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on loopback: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	var out bytes.Buffer
+	log.SetFlags(0)
+	log.SetOutput(&out)
+
+	tests := []struct {
+		name     string
+		mapping  PortMapping
+		wantWarn bool
+	}{
+		{"Listening", PortMapping{ExternalPort: 8080, InternalPort: openPort, TargetIP: "127.0.0.1", Probe: true}, false},
+		{"Nothing listening", PortMapping{ExternalPort: 8080, InternalPort: closedPort, TargetIP: "127.0.0.1", Probe: true}, true},
+		{"Not a probe port", PortMapping{ExternalPort: 8080, InternalPort: closedPort, TargetIP: "127.0.0.1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			service := &ServiceState{}
+			service.probeMapping(tt.mapping)
+			warned := strings.Contains(out.String(), "nothing is listening")
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v, want %v (log: %q)", warned, tt.wantWarn, out.String())
+			}
+			if service.runExitCode() == 1 {
+				t.Errorf("a failed probe must only warn, not count as an error")
+			}
+		})
+	}
+
+	// Probes are TCP dials, so udp ports can't ask for one
+	config := &Config{
+		CheckIntervalSeconds: 5,
+		Instances:            []Instance{{Name: "Ubuntu", Ports: []Port{{Port: 5353, Protocol: "udp", Probe: true}}}},
+	}
+	if err := (&ServiceState{}).validateConfiguration(config); err == nil {
+		t.Error("expected probe on a udp port to be rejected")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	// A listener that keeps connections open stands in for a proxy that reached WSL,
+	// one that closes them straight away for a proxy with nothing behind it
+	serve := func(hold bool) (int, func()) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skipf("can't listen on loopback: %v", err)
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				if !hold {
+					conn.Close()
+				}
+			}
+		}()
+		return listener.Addr().(*net.TCPAddr).Port, func() { listener.Close() }
+	}
+	forwarded, stopForwarded := serve(true)
+	defer stopForwarded()
+	dropped, stopDropped := serve(false)
+	defer stopDropped()
+	closed, stopClosed := serve(true)
+	stopClosed()
+
+	config := &Config{Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: forwarded, ListenAddress: "127.0.0.1"}, {Port: dropped, ListenAddress: "127.0.0.1"}, {Port: closed, ListenAddress: "127.0.0.1"}}},
+		{Name: "Debian", Ports: []Port{{Port: 40001}, {Port: 40002}, {Port: 40003, Protocol: "udp"}}},
+	}}
+	current := map[int]PortMapping{
+		forwarded: {ExternalPort: forwarded, InternalPort: forwarded, TargetIP: "172.20.0.2", ListenAddress: "127.0.0.1"},
+		dropped:   {ExternalPort: dropped, InternalPort: dropped, TargetIP: "172.20.0.2", ListenAddress: "127.0.0.1"},
+		closed:    {ExternalPort: closed, InternalPort: closed, TargetIP: "172.20.0.2", ListenAddress: "127.0.0.1"},
+		40002:     {ExternalPort: 40002, InternalPort: 40002, TargetIP: "172.20.0.99", ListenAddress: "0.0.0.0"},
+	}
+	snapshot := newReconcileSnapshot(config, map[string]string{"Ubuntu": "172.20.0.2", "Debian": "172.20.0.3"}, current)
+
+	results := runSelfTests(selfTests(snapshot), time.Second)
+	if len(results) != 5 {
+		t.Fatalf("expected the 5 TCP ports of running instances to be tested, got %+v", results)
+	}
+
+	want := map[int]string{
+		forwarded: "",
+		dropped:   "nothing answered inside WSL",
+		closed:    "refused",
+		40001:     "no port proxy installed",
+		40002:     "forwards to 172.20.0.99:40002 instead",
+	}
+	for _, result := range results {
+		detail, ok := want[result.Port]
+		switch {
+		case !ok:
+			t.Errorf("unexpected test of port %d", result.Port)
+		case result.Passed != (detail == ""):
+			t.Errorf("port %d: passed = %v (%s)", result.Port, result.Passed, result.Detail)
+		case !strings.Contains(result.Detail, detail):
+			t.Errorf("port %d: detail %q, want it to mention %q", result.Port, result.Detail, detail)
+		}
+	}
+
+	for listenAddress, want := range map[string]string{
+		"0.0.0.0":      "127.0.0.1:8080",
+		"::":           "[::1]:8080",
+		"192.168.1.20": "192.168.1.20:8080",
+	} {
+		if got := selfTestAddress(listenAddress, 8080); got != want {
+			t.Errorf("selfTestAddress(%q) = %q, want %q", listenAddress, got, want)
+		}
+	}
+}
+
+func TestHandleFirewallFailure(t *testing.T) {
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	var out bytes.Buffer
+	log.SetFlags(0)
+	log.SetOutput(&out)
+
+	mapping := PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", Instance: "Ubuntu", FirewallMode: "local", ListenAddress: "0.0.0.0"}
+	tests := []struct {
+		name          string
+		transactional bool
+		err           error
+		wantRollback  bool
+		wantLog       string
+	}{
+		{"Transactional rolls the forward back", true, fmt.Errorf("netsh failed"), true, "Rolled back port mapping 8080"},
+		{"Non-transactional keeps the forward", false, fmt.Errorf("netsh failed"), false, "forwarded but its firewall rule is missing"},
+		{"Missing privileges never roll back", true, withKind(KindPrivilege, fmt.Errorf("admin privileges required")), false, "can't be created without Administrator rights"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			runner := &fakeRunner{}
+			service := &ServiceState{config: &Config{Transactional: tt.transactional}, runner: runner}
+			service.handleFirewallFailure(mapping, tt.err)
+
+			var wantCommands []string
+			if tt.wantRollback {
+				wantCommands = []string{"delete v4tov4 listenport=8080"}
+			}
+			if got := runner.portproxyCommands(); !reflect.DeepEqual(got, wantCommands) {
+				t.Errorf("portproxy commands = %q, want %q", got, wantCommands)
+			}
+			if !strings.Contains(out.String(), tt.wantLog) {
+				t.Errorf("expected log to mention %q, got %q", tt.wantLog, out.String())
+			}
+		})
+	}
+}
+
+func TestFirewallFailureRollbackArgs(t *testing.T) {
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	log.SetOutput(io.Discard)
+
+	tests := []struct {
+		name     string
+		mapping  PortMapping
+		expected string
+	}{
+		{"IPv6 target", PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "fd00::2", ListenAddress: "0.0.0.0"}, "delete v4tov6 listenport=8080"},
+		{"Specific listen address", PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "172.20.0.2", ListenAddress: "192.168.1.20"}, "delete v4tov4 listenport=8080 listenaddress=192.168.1.20"},
+		{"IPv6 listener", PortMapping{ExternalPort: 8080, InternalPort: 80, TargetIP: "fd00::2", ListenAddress: "::"}, "delete v6tov6 listenport=8080 listenaddress=::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The forward was just added, so the mappings read this pass don't list it
+			runner := &fakeRunner{}
+			service := &ServiceState{config: &Config{Transactional: true}, runner: runner, currentMappings: map[int]PortMapping{}}
+			service.handleFirewallFailure(tt.mapping, fmt.Errorf("netsh failed"))
+
+			if got := runner.portproxyCommands(); !reflect.DeepEqual(got, []string{tt.expected}) {
+				t.Errorf("portproxy commands = %q, want [%q]", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProvisionFirewallRulesUDP(t *testing.T) {
+	config := &Config{PreProvisionFirewall: true, Instances: []Instance{
+		{Name: "Ubuntu", Ports: []Port{{Port: 53, Protocol: "udp", Firewall: "local"}}},
+	}}
+	desired, err := desiredFirewallRules(config)
+	if err != nil || len(desired) != 1 {
+		t.Fatalf("desiredFirewallRules() = %v, %v", desired, err)
+	}
+	existingName := desired[0].Name
+	staleName := generateFirewallRuleName(54, "Ubuntu") + "-udp"
+
+	runner := &fakeRunner{handler: func(name string, args ...string) ([]byte, error) {
+		if strings.Join(args, " ") == "advfirewall firewall show rule name=all dir=in" {
+			return []byte(fmt.Sprintf("Rule Name: %s\r\nEnabled: Yes\r\nProtocol: UDP\r\nLocalPort: 53\r\nAction: Allow\r\n\r\n"+
+				"Rule Name: %s\r\nEnabled: Yes\r\nProtocol: UDP\r\nLocalPort: 54\r\nAction: Allow\r\n", existingName, staleName)), nil
+		}
+		return nil, nil
+	}}
+
+	defer func(flags int, output io.Writer) {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}(log.Flags(), log.Writer())
+	var out bytes.Buffer
+	log.SetOutput(&out)
+
+	service := &ServiceState{config: config, runner: runner, dryRun: true, provisionedRules: map[string]bool{staleName: true}}
+	service.provisionFirewallRules(config)
+
+	if strings.Contains(out.String(), "firewall add rule") {
+		t.Errorf("the existing -udp rule should not be provisioned again:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "delete rule name="+staleName) || service.provisionedRules[staleName] {
+		t.Errorf("the stale -udp rule should be removed:\n%s", out.String())
+	}
+	for _, command := range runner.commands {
+		if strings.Contains(command, "protocol=tcp") {
+			t.Errorf("firewall rules should be read for every protocol, ran %q", command)
+		}
+	}
+}
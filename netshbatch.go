@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// minNetshBatch is the fewest portproxy changes worth a script; a single change is
+// one netsh process either way
+const minNetshBatch = 2
+
+// plannedPortProxyCommands returns the netsh portproxy commands reconcilePortForwarding
+// will run for the snapshot: deletes first, so an updated forward is replaced in place,
+// then adds
+func (s *ServiceState) plannedPortProxyCommands(snapshot *ReconcileSnapshot, desiredMappings map[int]PortMapping) [][]string {
+	var deletes, adds [][]string
+	for _, port := range sortedMappingPorts(desiredMappings) {
+		desired := desiredMappings[port]
+		addArgs := addPortMappingArgs(desired.ExternalPort, desired.InternalPort, desired.TargetIP, desired.ListenAddress)
+		if current, exists := snapshot.CurrentMappings[port]; !exists {
+			adds = append(adds, addArgs)
+		} else if mappingNeedsUpdate(current, desired) {
+			deletes = append(deletes, s.removePortMappingArgs(port))
+			adds = append(adds, addArgs)
+		}
+	}
+	if !snapshot.Config.AdditiveOnly {
+		for _, port := range sortedMappingPorts(snapshot.CurrentMappings) {
+			if snapshot.ShouldRemove(port, desiredMappings) {
+				deletes = append(deletes, s.removePortMappingArgs(port))
+			}
+		}
+	}
+	return append(deletes, adds...)
+}
+
+// batchPortProxyChanges runs the pass's portproxy changes as one `netsh -f` script
+// instead of a netsh process each, and remembers them so runPortProxyCommand doesn't
+// run them again. If the script fails, nothing is remembered and every change runs on
+// its own as before; anything the script did apply shows up in the next snapshot.
+func (s *ServiceState) batchPortProxyChanges(snapshot *ReconcileSnapshot, desiredMappings map[int]PortMapping) {
+	s.batchedNetsh = nil
+	if s.dryRun {
+		return
+	}
+	commands := s.plannedPortProxyCommands(snapshot, desiredMappings)
+	if len(commands) < minNetshBatch {
+		return
+	}
+
+	if err := s.runNetshScript(commands); err != nil {
+		s.logf("Warning: Batched netsh run failed, applying %d portproxy changes one at a time: %v", len(commands), err)
+		return
+	}
+	s.batchedNetsh = make(map[string]int, len(commands))
+	for _, args := range commands {
+		s.batchedNetsh[strings.Join(args, " ")]++
+	}
+	log.Printf("Applied %d portproxy changes with 1 netsh process instead of %d", len(commands), len(commands))
+}
+
+// clearPortProxyBatch forgets the pass's batch once reconcile is done with it
+func (s *ServiceState) clearPortProxyBatch() {
+	s.batchedNetsh = nil
+}
+
+// runNetshScript runs the commands through a single `netsh -f <script>`
+func (s *ServiceState) runNetshScript(commands [][]string) error {
+	script, err := os.CreateTemp("", "wsl2-portproxy-*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create netsh script: %w", err)
+	}
+	defer os.Remove(script.Name())
+
+	for _, args := range commands {
+		if _, err := fmt.Fprintf(script, "%s\r\n", strings.Join(args, " ")); err != nil {
+			script.Close()
+			return fmt.Errorf("failed to write netsh script: %w", err)
+		}
+	}
+	if err := script.Close(); err != nil {
+		return fmt.Errorf("failed to write netsh script: %w", err)
+	}
+
+	if _, err := s.commands().Run("netsh", "-f", script.Name()); err != nil {
+		return commandError(KindNetsh, err)
+	}
+	return nil
+}
+
+// runPortProxyCommand runs a netsh portproxy command, unless this pass's batch
+// already did
+func (s *ServiceState) runPortProxyCommand(args []string) error {
+	key := strings.Join(args, " ")
+	if s.batchedNetsh[key] > 0 {
+		s.batchedNetsh[key]--
+		return nil
+	}
+	_, err := s.commands().Run("netsh", args...)
+	return err
+}
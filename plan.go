@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReconcilePlan is the set of changes a reconcile pass would make, without making them
+type ReconcilePlan struct {
+	Current   []PlannedMapping `json:"current"`
+	Desired   []PlannedMapping `json:"desired"`
+	Actions   []PlanAction     `json:"actions"`
+	Conflicts []PortConflict   `json:"conflicts,omitempty"`
+	Stale     []StaleMapping   `json:"stale,omitempty"`
+}
+
+// PlannedMapping is one port forward in the current or desired state
+type PlannedMapping struct {
+	Port          int    `json:"port"`
+	InternalPort  int    `json:"internal_port"`
+	TargetIP      string `json:"target_ip"`
+	Instance      string `json:"instance,omitempty"`
+	ListenAddress string `json:"listen_address,omitempty"`
+}
+
+// PlanAction is a single pending change
+type PlanAction struct {
+	Action   string `json:"action"` // "add", "update" or "remove"
+	Port     int    `json:"port"`
+	Instance string `json:"instance,omitempty"`
+	From     string `json:"from,omitempty"` // ip:port currently forwarded to
+	To       string `json:"to,omitempty"`   // ip:port that will be forwarded to
+}
+
+// IsEmpty returns true if reconcile has nothing to do
+func (p *ReconcilePlan) IsEmpty() bool {
+	return len(p.Actions) == 0
+}
+
+// Plan works out what reconcilePortForwarding would change for this snapshot.
+// connect_fallback retargeting is not included since it needs live reachability probes.
+func (snap *ReconcileSnapshot) Plan() *ReconcilePlan {
+	desiredMappings, conflictedPorts := snap.DesiredMappings()
+	plan := &ReconcilePlan{
+		Current: plannedMappings(snap.CurrentMappings),
+		Desired: plannedMappings(desiredMappings),
+		Actions: []PlanAction{},
+		Stale:   snap.StaleMappings(),
+	}
+
+	for _, desired := range plan.Desired {
+		to := fmt.Sprintf("%s:%d", desired.TargetIP, desired.InternalPort)
+		current, exists := snap.CurrentMappings[desired.Port]
+		if !exists {
+			plan.Actions = append(plan.Actions, PlanAction{Action: "add", Port: desired.Port, Instance: desired.Instance, To: to})
+		} else if mappingNeedsUpdate(current, desiredMappings[desired.Port]) {
+			plan.Actions = append(plan.Actions, PlanAction{Action: "update", Port: desired.Port, Instance: desired.Instance,
+				From: fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort), To: to})
+		}
+	}
+
+	for _, current := range plan.Current {
+		if snap.ShouldRemove(current.Port, desiredMappings) && !snap.Config.AdditiveOnly {
+			plan.Actions = append(plan.Actions, PlanAction{Action: "remove", Port: current.Port,
+				From: fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort)})
+		}
+	}
+
+	for _, port := range sortedPorts(conflictedPorts) {
+		plan.Conflicts = append(plan.Conflicts, PortConflict{Port: port, Instances: conflictedPorts[port]})
+	}
+
+	return plan
+}
+
+// plannedMappings flattens a port -> mapping table into a list sorted by port
+func plannedMappings(mappings map[int]PortMapping) []PlannedMapping {
+	planned := make([]PlannedMapping, 0, len(mappings))
+	for port, mapping := range mappings {
+		planned = append(planned, PlannedMapping{
+			Port:         port,
+			InternalPort: mapping.InternalPort,
+			TargetIP:     mapping.TargetIP,
+			Instance:     mapping.Instance,
+		})
+	}
+	sort.Slice(planned, func(i, j int) bool { return planned[i].Port < planned[j].Port })
+	return planned
+}
+
+// runPlan implements the `plan` subcommand, a read-only preview of the next reconcile.
+// Exit codes: 0=in sync, 1=error, 2=changes pending
+func runPlan(args []string) int {
+	var jsonOutput, allowComments, strict bool
+	var style jsonStyle
+	var files []string
+	format := "plain"
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--json":
+			jsonOutput = true
+		case arg == "--plan-format" || strings.HasPrefix(arg, "--plan-format="):
+			value, hasValue := strings.CutPrefix(arg, "--plan-format=")
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if value != "plain" && value != "tf" {
+				fmt.Printf("Invalid --plan-format %q (must be plain or tf)\n", value)
+				return 1
+			}
+			format = value
+		case isJSONStyleFlag(arg):
+			style.set(arg)
+		case arg == "--allow-comments":
+			allowComments = true
+		case arg == "--strict":
+			strict = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) != 1 {
+		fmt.Println("Usage: wsl2-port-forwarder.exe plan [--json [--pretty|--compact] | --plan-format plain|tf] [--allow-comments] [--strict] <config-file.json>")
+		return 1
+	}
+	if jsonOutput && format != "plain" {
+		fmt.Println("--plan-format can't be combined with --json")
+		return 1
+	}
+
+	config, err := loadConfigFile(files[0], allowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", files[0], err)
+		return 1
+	}
+
+	service := &ServiceState{config: config, strict: strict}
+	snapshot, err := service.captureSnapshot(config.ManagedConfig())
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	plan := snapshot.Plan()
+
+	if jsonOutput {
+		data, err := marshalJSON(plan, style.forStdout())
+		if err != nil {
+			fmt.Printf("❌ Failed to encode plan: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+	} else if format == "tf" {
+		colors, restoreColors := enableANSIColors()
+		fmt.Print(renderTerraformPlan(plan, colors))
+		restoreColors()
+	} else {
+		printReconcilePlan(plan)
+	}
+
+	if plan.IsEmpty() {
+		return 0
+	}
+	return 2
+}
+
+// printReconcilePlan prints the human readable form of a reconcile plan
+func printReconcilePlan(plan *ReconcilePlan) {
+	if plan.IsEmpty() {
+		fmt.Println("✅ All port mappings are in sync, nothing to do")
+	}
+
+	for _, action := range plan.Actions {
+		switch action.Action {
+		case "add":
+			fmt.Printf("+ port %d -> %s (%s)\n", action.Port, action.To, action.Instance)
+		case "update":
+			fmt.Printf("~ port %d %s -> %s (%s)\n", action.Port, action.From, action.To, action.Instance)
+		case "remove":
+			fmt.Printf("- port %d -> %s\n", action.Port, action.From)
+		}
+	}
+
+	for _, stale := range plan.Stale {
+		fmt.Printf("⚠️  Stale mapping: %s\n", stale.describe())
+	}
+
+	if len(plan.Conflicts) > 0 {
+		fmt.Println("\n⚠️  External port conflicts (first instance wins):")
+		for _, conflict := range plan.Conflicts {
+			fmt.Printf("  Port %d: %s\n", conflict.Port, strings.Join(conflict.Instances, ", "))
+		}
+	}
+}
+
+// ANSI colors for the tf plan format
+const (
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiRed    = "\x1b[31m"
+	ansiBold   = "\x1b[1m"
+	ansiReset  = "\x1b[0m"
+)
+
+// renderTerraformPlan renders a plan the way infrastructure tools show one: +/~/-
+// lines, optionally colored, and an "N to add, N to change, N to destroy" summary
+func renderTerraformPlan(plan *ReconcilePlan, colors bool) string {
+	paint := func(color, text string) string {
+		if !colors {
+			return text
+		}
+		return color + text + ansiReset
+	}
+
+	var b strings.Builder
+	if plan.IsEmpty() {
+		b.WriteString(paint(ansiBold, "No changes.") + " Port forwarding matches the configuration.\n")
+		return b.String()
+	}
+
+	b.WriteString("Port forwarding will be changed as follows:\n\n")
+	adds, changes, destroys := 0, 0, 0
+	for _, action := range plan.Actions {
+		switch action.Action {
+		case "add":
+			adds++
+			b.WriteString(paint(ansiGreen, fmt.Sprintf("  + port %d -> %s (%s)", action.Port, action.To, action.Instance)) + "\n")
+		case "update":
+			changes++
+			b.WriteString(paint(ansiYellow, fmt.Sprintf("  ~ port %d: %s -> %s (%s)", action.Port, action.From, action.To, action.Instance)) + "\n")
+		case "remove":
+			destroys++
+			b.WriteString(paint(ansiRed, fmt.Sprintf("  - port %d -> %s", action.Port, action.From)) + "\n")
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%s %d to add, %d to change, %d to destroy.\n", paint(ansiBold, "Plan:"), adds, changes, destroys)
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import "sort"
+
+// firewallProvisioningChanges works out what pre_provision_firewall has to do: create
+// every configured rule that doesn't exist, and remove tracked rules (ones the forwarder
+// created) that no port in the config asks for any more
+func firewallProvisioningChanges(desired []FirewallRuleSpec, existing []FirewallRule, tracked []string, configured map[string]bool) ([]FirewallRuleSpec, []string) {
+	present := make(map[string]bool)
+	for _, rule := range existing {
+		present[rule.Name] = true
+	}
+
+	var toAdd []FirewallRuleSpec
+	for _, rule := range desired {
+		if !present[rule.Name] {
+			toAdd = append(toAdd, rule)
+		}
+	}
+
+	var toRemove []string
+	seen := make(map[string]bool)
+	for _, name := range tracked {
+		if present[name] && !configured[name] && !seen[name] {
+			seen[name] = true
+			toRemove = append(toRemove, name)
+		}
+	}
+	sort.Strings(toRemove)
+	return toAdd, toRemove
+}
+
+// provisionFirewallRules keeps a firewall rule open for every configured port whether
+// or not its instance is running (pre_provision_firewall), so a forward is never live
+// before the firewall allows it. Rules are only removed once their port leaves the config.
+func (s *ServiceState) provisionFirewallRules(config *Config) {
+	if s.noFirewall {
+		return
+	}
+
+	desired, err := desiredFirewallRules(config)
+	if err != nil {
+		s.logf("Warning: Unable to pre-provision firewall rules: %v", err)
+		return
+	}
+	existing, err := s.getForwarderDirectionRules()
+	if err != nil {
+		s.logf("Warning: Unable to pre-provision firewall rules: %v", err)
+		return
+	}
+
+	// Rules for instances outside managed_instances are still configured, so kept
+	all, err := desiredFirewallRules(s.config)
+	if err != nil {
+		s.logf("Warning: Unable to pre-provision firewall rules: %v", err)
+		return
+	}
+	configured := make(map[string]bool)
+	for _, rule := range all {
+		configured[rule.Name] = true
+	}
+
+	var tracked []string
+	for name := range s.provisionedRules {
+		tracked = append(tracked, name)
+	}
+	if s.registryManager != nil {
+		if registered, err := s.registryManager.GetRegisteredFirewallRules(); err == nil {
+			for _, rule := range registered {
+				tracked = append(tracked, rule.RuleName)
+			}
+		}
+	}
+
+	toAdd, toRemove := firewallProvisioningChanges(desired, existing, tracked, configured)
+	if s.provisionedRules == nil {
+		s.provisionedRules = make(map[string]bool)
+	}
+
+	for _, rule := range toAdd {
+		if err := s.createFirewallRule(rule); err != nil {
+			s.logf("Warning: Failed to pre-provision firewall rule %s: %v", rule.Name, err)
+			continue
+		}
+		s.provisionedRules[rule.Name] = true
+		consoleEvent("info", "firewall_rule_created", EventFields{Port: rule.Port, Instance: rule.Instance}, "  🔥 Firewall rule pre-provisioned: %s", rule.Name)
+	}
+
+	for _, name := range toRemove {
+		if err := s.removeFirewallRuleByName(name); err != nil {
+			s.logf("Warning: Failed to remove firewall rule %s for a port no longer configured: %v", name, err)
+			continue
+		}
+		delete(s.provisionedRules, name)
+		consoleEvent("info", "firewall_rule_removed", EventFields{}, "  🔥 Firewall rule removed (port no longer configured): %s", name)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// probeDialTimeout bounds the TCP dial made for probe ports
+const probeDialTimeout = 2 * time.Second
+
+// dialConnectPort dials ip:port over TCP; overridable in tests
+var dialConnectPort = func(ip string, port int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), probeDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// describeProbeFailure says why a probe dial failed, telling a closed port (most often
+// a mistyped internal_port) apart from an address that didn't answer at all
+func describeProbeFailure(err error) string {
+	if isConnectionRefused(err) {
+		return "nothing is listening"
+	}
+	return fmt.Sprintf("no answer within %v", probeDialTimeout)
+}
+
+// probeMapping dials the connect port of a probe port that was just forwarded and warns
+// if nothing answers. The forward stays either way: the service may just not be up yet.
+func (s *ServiceState) probeMapping(mapping PortMapping) {
+	if !mapping.Probe {
+		return
+	}
+
+	err := dialConnectPort(mapping.TargetIP, mapping.InternalPort)
+	if err == nil {
+		return
+	}
+
+	reason := describeProbeFailure(err)
+	s.logEventf("probe_failed", EventFields{Port: mapping.ExternalPort, Instance: mapping.Instance, TargetIP: mapping.TargetIP},
+		"Warning: Port %d forwarded to %s:%d, but %s there (check internal_port): %v", mapping.ExternalPort, mapping.TargetIP, mapping.InternalPort, reason, err)
+	say("    ⚠️  Probe: %s at %s:%d - is internal_port right?", reason, mapping.TargetIP, mapping.InternalPort)
+}
+
+// checkProbePorts implements the probe part of --validate: dial the connect port of
+// every probe port of a running instance. Exit codes: 0=ok, 2=warnings
+func checkProbePorts(config *Config) int {
+	probed := make(map[string][]Port)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if port.Probe && port.IsEnabled() && !port.IsUDP() {
+				probed[instance.Name] = append(probed[instance.Name], port)
+			}
+		}
+	}
+	if len(probed) == 0 {
+		return 0
+	}
+
+	fmt.Println("\nℹ️  Probing connect ports of probe ports...")
+
+	service := &ServiceState{config: config}
+	running, err := service.getRunningWSLInstances()
+	if err != nil {
+		fmt.Printf("⚠️  Unable to list running instances: %v\n", err)
+		return 2
+	}
+
+	exitCode := 0
+	for _, instance := range config.Instances {
+		ports := probed[instance.Name]
+		if len(ports) == 0 {
+			continue
+		}
+
+		distroName, isRunning := resolveInstanceDistro(instance, running)
+		if !isRunning {
+			fmt.Printf("ℹ️  [%s] not running, skipped\n", instance.Name)
+			continue
+		}
+
+		distro := instance
+		distro.Name = distroName
+		ip, err := service.getWSLInstanceIP(distro)
+		if err != nil {
+			fmt.Printf("⚠️  [%s] unable to get IP: %v\n", instance.Name, err)
+			exitCode = 2
+			continue
+		}
+
+		sort.Slice(ports, func(i, j int) bool { return ports[i].ExternalPortEffective() < ports[j].ExternalPortEffective() })
+		for _, port := range ports {
+			label := fmt.Sprintf("[%s] port %d -> %s:%d", instance.Name, port.ExternalPortEffective(), ip, port.InternalPortEffective())
+			if err := dialConnectPort(ip, port.InternalPortEffective()); err != nil {
+				fmt.Printf("⚠️  %s: %s\n", label, describeProbeFailure(err))
+				exitCode = 2
+				continue
+			}
+			fmt.Printf("✅ %s: listening\n", label)
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,96 @@
+package main
+
+import "fmt"
+
+// maxQosThrottleKbps caps qos_throttle_kbps at 10 Gbit/s
+const maxQosThrottleKbps = 10000000
+
+// generateQosPolicyName names the QoS policy throttling a forwarded port
+func generateQosPolicyName(port int) string {
+	return fmt.Sprintf("WSL2-QoS-%d", port)
+}
+
+// qosPolicyScript builds the PowerShell that (re)creates the throttle policy for a port.
+// The policy matches traffic sent from the listen port, i.e. responses to remote clients.
+func qosPolicyScript(port, kbps int) string {
+	name := generateQosPolicyName(port)
+	return fmt.Sprintf("Remove-NetQosPolicy -Name '%s' -Confirm:$false -ErrorAction SilentlyContinue; "+
+		"New-NetQosPolicy -Name '%s' -IPProtocolMatchCondition TCP -IPSrcPortMatchCondition %d -ThrottleRateActionBitsPerSecond %d | Out-Null",
+		name, name, port, int64(kbps)*1000)
+}
+
+// runPowerShell runs a non-interactive PowerShell command
+func (s *ServiceState) runPowerShell(script string) error {
+	_, err := runCommand(s.commandTimeout(), true, "powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	return err
+}
+
+// applyQosPolicy throttles a forwarded port to the given rate
+func (s *ServiceState) applyQosPolicy(port, kbps int) error {
+	if s.skipForDryRun("powershell", "-Command", qosPolicyScript(port, kbps)) {
+		return nil
+	}
+	if err := s.runPowerShell(qosPolicyScript(port, kbps)); err != nil {
+		return fmt.Errorf("failed to create QoS policy: %v", err)
+	}
+	return nil
+}
+
+// removeQosPolicy deletes the throttle policy for a port, if any
+func (s *ServiceState) removeQosPolicy(port int) error {
+	script := fmt.Sprintf("Remove-NetQosPolicy -Name '%s' -Confirm:$false -ErrorAction SilentlyContinue", generateQosPolicyName(port))
+	if s.skipForDryRun("powershell", "-Command", script) {
+		return nil
+	}
+	if err := s.runPowerShell(script); err != nil {
+		return fmt.Errorf("failed to remove QoS policy: %v", err)
+	}
+	return nil
+}
+
+// reconcileQosPolicies brings the QoS throttle policies in line with qos_throttle_kbps
+// for the desired mappings. Applied rates are recorded so each policy is only rewritten
+// when its rate changes, and policies for ports no longer forwarded are removed.
+func (s *ServiceState) reconcileQosPolicies(desiredMappings map[int]PortMapping) {
+	if s.qosPolicies == nil {
+		s.qosPolicies = make(map[int]int)
+	}
+
+	for port, desired := range desiredMappings {
+		if desired.QosThrottleKbps == 0 || s.qosPolicies[port] == desired.QosThrottleKbps {
+			continue
+		}
+		if err := s.applyQosPolicy(port, desired.QosThrottleKbps); err != nil {
+			s.logf("Warning: Failed to throttle port %d to %d kbps: %v", port, desired.QosThrottleKbps, err)
+			continue
+		}
+		s.qosPolicies[port] = desired.QosThrottleKbps
+		consoleEvent("info", "qos_applied", EventFields{Port: port, Instance: desired.Instance}, "  🚦 Port %d throttled to %d kbps%s", port, desired.QosThrottleKbps, s.dryRunTag())
+	}
+
+	for port := range s.qosPolicies {
+		if desired, forwarding := desiredMappings[port]; forwarding && desired.QosThrottleKbps != 0 {
+			continue
+		}
+		if err := s.removeQosPolicy(port); err != nil {
+			s.logf("Warning: Failed to remove QoS throttle for port %d: %v", port, err)
+			continue
+		}
+		delete(s.qosPolicies, port)
+		consoleEvent("info", "qos_removed", EventFields{Port: port}, "  🚦 Port %d throttle removed%s", port, s.dryRunTag())
+	}
+}
+
+// unprotectedFullPorts lists "full" firewall ports that have no qos_throttle_kbps, as
+// "instance:port" entries. These are reachable from any address with no rate protection.
+func unprotectedFullPorts(config *Config) []string {
+	var ports []string
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			if port.FirewallMode() == "full" && port.QosThrottleKbps == 0 {
+				ports = append(ports, fmt.Sprintf("%s:%d", instance.Name, port.ExternalPortEffective()))
+			}
+		}
+	}
+	return ports
+}
@@ -1,13 +1,15 @@
+//go:build windows
+
 package main
 
 import (
 	"fmt"
 	"log"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -18,32 +20,22 @@ const (
 	firewallRulesPath   = registryBasePath + "\\FirewallRules"
 )
 
-// RegistryPortProxy represents a port proxy entry in the registry
-type RegistryPortProxy struct {
-	Key            string
-	ListenPort     int
-	ConnectAddress string
-	ConnectPort    int
-	Instance       string
-	Timestamp      string
-}
-
-// RegistryFirewallRule represents a firewall rule entry in the registry
-type RegistryFirewallRule struct {
-	Key       string
-	RuleName  string
-	Port      string
-	Instance  string
-	Timestamp string
-}
-
 // RegistryManager handles all Windows Registry operations for tracking resources
 type RegistryManager struct {
+	root            registry.Key // LOCAL_MACHINE, or CURRENT_USER without Administrator rights
 	baseKey         registry.Key
 	portProxyKey    registry.Key
 	firewallRuleKey registry.Key
 }
 
+// registryRootName names a registry root for messages
+func registryRootName(root registry.Key) string {
+	if root == registry.CURRENT_USER {
+		return "HKEY_CURRENT_USER"
+	}
+	return "HKEY_LOCAL_MACHINE"
+}
+
 // NewRegistryManager creates and initializes a new registry manager
 func NewRegistryManager() (*RegistryManager, error) {
 	rm := &RegistryManager{}
@@ -55,33 +47,88 @@ func NewRegistryManager() (*RegistryManager, error) {
 	return rm, nil
 }
 
-// initialize creates the registry structure if it doesn't exist
+// OpenRegistryManagerReadOnly opens the registry tracking for reading only, so it
+// works without Administrator rights. Nothing is created: if the forwarder never
+// tracked anything, the manager simply lists no entries. Tracking under
+// LOCAL_MACHINE is preferred; CURRENT_USER is read when only that one exists.
+func OpenRegistryManagerReadOnly() (*RegistryManager, error) {
+	rm := &RegistryManager{root: registry.LOCAL_MACHINE}
+	if key, err := registry.OpenKey(registry.LOCAL_MACHINE, registryBasePath, registry.READ); err == nil {
+		key.Close()
+	} else if key, err := registry.OpenKey(registry.CURRENT_USER, registryBasePath, registry.READ); err == nil {
+		key.Close()
+		rm.root = registry.CURRENT_USER
+	}
+	
+	for _, k := range []struct {
+		path string
+		key  *registry.Key
+	}{
+		{registryBasePath, &rm.baseKey},
+		{portProxyPath, &rm.portProxyKey},
+		{firewallRulesPath, &rm.firewallRuleKey},
+	} {
+		key, err := registry.OpenKey(rm.root, k.path, registry.READ)
+		if err == registry.ErrNotExist {
+			continue
+		}
+		if err != nil {
+			rm.Close()
+			return nil, fmt.Errorf("failed to open registry key %s\\%s: %v", registryRootName(rm.root), k.path, err)
+		}
+		*k.key = key
+	}
+	
+	return rm, nil
+}
+
+// initialize creates the registry structure if it doesn't exist. LOCAL_MACHINE needs
+// Administrator rights, so on access denied the tracking lives under CURRENT_USER
+// instead; every later operation goes through the keys opened here, so it stays there.
 func (rm *RegistryManager) initialize() error {
+	root := registry.LOCAL_MACHINE
+	err := rm.createKeys(root)
+	if err == windows.ERROR_ACCESS_DENIED {
+		log.Printf("Warning: No access to HKEY_LOCAL_MACHINE\\%s, tracking resources under HKEY_CURRENT_USER instead", registryBasePath)
+		root = registry.CURRENT_USER
+		err = rm.createKeys(root)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create registry keys under %s\\%s: %v", registryRootName(root), registryBasePath, err)
+	}
+	
+	log.Printf("Registry manager initialized successfully (%s\\%s)", registryRootName(rm.root), registryBasePath)
+	return nil
+}
+
+// createKeys opens or creates the tracking keys under root. The error is returned
+// unwrapped so initialize can tell access denied apart.
+func (rm *RegistryManager) createKeys(root registry.Key) error {
 	// Open or create the base registry key
-	baseKey, _, err := registry.CreateKey(registry.LOCAL_MACHINE, registryBasePath, registry.ALL_ACCESS)
+	baseKey, _, err := registry.CreateKey(root, registryBasePath, registry.ALL_ACCESS)
 	if err != nil {
-		return fmt.Errorf("failed to create base registry key: %v", err)
+		return err
 	}
-	rm.baseKey = baseKey
 	
 	// Open or create the port proxy tracking key
-	portProxyKey, _, err := registry.CreateKey(registry.LOCAL_MACHINE, portProxyPath, registry.ALL_ACCESS)
+	portProxyKey, _, err := registry.CreateKey(root, portProxyPath, registry.ALL_ACCESS)
 	if err != nil {
 		baseKey.Close()
-		return fmt.Errorf("failed to create port proxy registry key: %v", err)
+		return err
 	}
-	rm.portProxyKey = portProxyKey
 	
 	// Open or create the firewall rules tracking key
-	firewallRuleKey, _, err := registry.CreateKey(registry.LOCAL_MACHINE, firewallRulesPath, registry.ALL_ACCESS)
+	firewallRuleKey, _, err := registry.CreateKey(root, firewallRulesPath, registry.ALL_ACCESS)
 	if err != nil {
 		baseKey.Close()
 		portProxyKey.Close()
-		return fmt.Errorf("failed to create firewall rules registry key: %v", err)
+		return err
 	}
-	rm.firewallRuleKey = firewallRuleKey
 	
-	log.Printf("Registry manager initialized successfully")
+	rm.root = root
+	rm.baseKey = baseKey
+	rm.portProxyKey = portProxyKey
+	rm.firewallRuleKey = firewallRuleKey
 	return nil
 }
 
@@ -238,9 +285,28 @@ func (rm *RegistryManager) UnregisterFirewallRule(ruleName string) error {
 	return nil
 }
 
+// DeletePortProxyEntry removes a single port proxy registry entry by its key
+func (rm *RegistryManager) DeletePortProxyEntry(key string) error {
+	if err := registry.DeleteKey(rm.portProxyKey, key); err != nil {
+		return fmt.Errorf("failed to delete port proxy registry entry %s: %v", key, err)
+	}
+	return nil
+}
+
+// DeleteFirewallRuleEntry removes a single firewall rule registry entry by its key
+func (rm *RegistryManager) DeleteFirewallRuleEntry(key string) error {
+	if err := registry.DeleteKey(rm.firewallRuleKey, key); err != nil {
+		return fmt.Errorf("failed to delete firewall rule registry entry %s: %v", key, err)
+	}
+	return nil
+}
+
 // GetRegisteredPortProxies retrieves all registered port proxy entries
 func (rm *RegistryManager) GetRegisteredPortProxies() ([]RegistryPortProxy, error) {
 	entries := []RegistryPortProxy{}
+	if rm.portProxyKey == 0 {
+		return entries, nil // opened read-only before anything was tracked
+	}
 	
 	subkeys, err := rm.portProxyKey.ReadSubKeyNames(-1)
 	if err != nil {
@@ -287,6 +353,9 @@ func (rm *RegistryManager) GetRegisteredPortProxies() ([]RegistryPortProxy, erro
 // GetRegisteredFirewallRules retrieves all registered firewall rule entries
 func (rm *RegistryManager) GetRegisteredFirewallRules() ([]RegistryFirewallRule, error) {
 	entries := []RegistryFirewallRule{}
+	if rm.firewallRuleKey == 0 {
+		return entries, nil // opened read-only before anything was tracked
+	}
 	
 	subkeys, err := rm.firewallRuleKey.ReadSubKeyNames(-1)
 	if err != nil {
@@ -334,16 +403,20 @@ func (rm *RegistryManager) AuditRegistryState() (bool, error) {
 	
 	// Audit port proxies
 	fmt.Println("\n--- Port Proxy Audit ---")
-	if err := rm.auditPortProxies(); err != nil {
+	if mismatches, err := rm.auditPortProxies(); err != nil {
 		fmt.Printf("Error auditing port proxies: %v\n", err)
 		allGood = false
+	} else if mismatches > 0 {
+		allGood = false
 	}
 	
 	// Audit firewall rules
 	fmt.Println("\n--- Firewall Rules Audit ---")
-	if err := rm.auditFirewallRules(); err != nil {
+	if mismatches, err := rm.auditFirewallRules(); err != nil {
 		fmt.Printf("Error auditing firewall rules: %v\n", err)
 		allGood = false
+	} else if mismatches > 0 {
+		allGood = false
 	}
 	
 	if allGood {
@@ -355,18 +428,19 @@ func (rm *RegistryManager) AuditRegistryState() (bool, error) {
 	return allGood, nil
 }
 
-// auditPortProxies checks port proxy registry vs actual netsh state
-func (rm *RegistryManager) auditPortProxies() error {
+// auditPortProxies checks port proxy registry vs actual netsh state and returns the
+// number of mismatches
+func (rm *RegistryManager) auditPortProxies() (int, error) {
 	registered, err := rm.GetRegisteredPortProxies()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	
 	// Get actual port proxies from the system (reuse existing logic)
 	service := &ServiceState{}
 	actual, err := service.getCurrentPortMappings()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	
 	// Check for orphaned registry entries
@@ -413,20 +487,21 @@ func (rm *RegistryManager) auditPortProxies() error {
 		fmt.Printf("  Found %d orphaned and %d unregistered port proxy entries\n", orphaned, unregistered)
 	}
 	
-	return nil
+	return orphaned + unregistered, nil
 }
 
-// auditFirewallRules checks firewall rule registry vs actual Windows Firewall state
-func (rm *RegistryManager) auditFirewallRules() error {
+// auditFirewallRules checks firewall rule registry vs actual Windows Firewall state and
+// returns the number of mismatches
+func (rm *RegistryManager) auditFirewallRules() (int, error) {
 	registered, err := rm.GetRegisteredFirewallRules()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	
 	// Get actual firewall rules using netsh (similar to existing validation logic)
 	actualRules, err := getActualFirewallRules()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	
 	// Check for orphaned registry entries
@@ -469,7 +544,7 @@ func (rm *RegistryManager) auditFirewallRules() error {
 		fmt.Printf("  Found %d orphaned and %d unregistered firewall rule entries\n", orphaned, unregistered)
 	}
 	
-	return nil
+	return orphaned + unregistered, nil
 }
 
 // CleanupOrphanedEntries removes registry entries that don't have corresponding system resources
@@ -566,35 +641,3 @@ func (rm *RegistryManager) cleanupOrphanedFirewallRules() (int, error) {
 	
 	return cleaned, nil
 }
-
-// getActualFirewallRules retrieves the names of all existing firewall rules
-func getActualFirewallRules() ([]string, error) {
-	rules := []string{}
-	
-	// This is a simplified version - in practice you might want to use the same
-	// netsh parsing logic as in the existing checkFirewallRules function
-	cmd := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=all")
-	output, err := cmd.Output()
-	if err != nil {
-		return rules, fmt.Errorf("failed to get firewall rules: %v", err)
-	}
-	
-	outputStr, err := decodeCommandOutput(output)
-	if err != nil {
-		return rules, fmt.Errorf("failed to decode firewall rules output: %v", err)
-	}
-	
-	lines := strings.Split(outputStr, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Rule Name:") {
-			ruleName := strings.TrimPrefix(line, "Rule Name:")
-			ruleName = strings.TrimSpace(ruleName)
-			if ruleName != "" {
-				rules = append(rules, ruleName)
-			}
-		}
-	}
-	
-	return rules, nil
-}
\ No newline at end of file
@@ -0,0 +1,20 @@
+package main
+
+// RegistryPortProxy represents a port proxy entry in the registry
+type RegistryPortProxy struct {
+	Key            string `json:"key"`
+	ListenPort     int    `json:"listen_port"`
+	ConnectAddress string `json:"connect_address"`
+	ConnectPort    int    `json:"connect_port"`
+	Instance       string `json:"instance"`
+	Timestamp      string `json:"timestamp"`
+}
+
+// RegistryFirewallRule represents a firewall rule entry in the registry
+type RegistryFirewallRule struct {
+	Key       string `json:"key"`
+	RuleName  string `json:"rule_name"`
+	Port      string `json:"port"`
+	Instance  string `json:"instance"`
+	Timestamp string `json:"timestamp"`
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// errRegistryUnsupported is returned on platforms without a Windows registry
+var errRegistryUnsupported = errors.New("registry tracking is only supported on Windows")
+
+// RegistryManager is a no-op stand-in so the package builds and tests off Windows
+type RegistryManager struct{}
+
+// NewRegistryManager always fails off Windows; callers already treat this as
+// "registry tracking disabled"
+func NewRegistryManager() (*RegistryManager, error) {
+	return nil, errRegistryUnsupported
+}
+
+// OpenRegistryManagerReadOnly always fails off Windows
+func OpenRegistryManagerReadOnly() (*RegistryManager, error) {
+	return nil, errRegistryUnsupported
+}
+
+func (rm *RegistryManager) Close() error { return nil }
+
+func (rm *RegistryManager) RegisterPortProxy(listenPort int, connectAddress string, connectPort int, instance string) error {
+	return errRegistryUnsupported
+}
+
+func (rm *RegistryManager) UnregisterPortProxy(listenPort int) error { return errRegistryUnsupported }
+
+func (rm *RegistryManager) RegisterFirewallRule(ruleName string, port int, instance string) error {
+	return errRegistryUnsupported
+}
+
+func (rm *RegistryManager) UnregisterFirewallRule(ruleName string) error {
+	return errRegistryUnsupported
+}
+
+func (rm *RegistryManager) DeletePortProxyEntry(key string) error { return errRegistryUnsupported }
+
+func (rm *RegistryManager) DeleteFirewallRuleEntry(key string) error { return errRegistryUnsupported }
+
+func (rm *RegistryManager) GetRegisteredPortProxies() ([]RegistryPortProxy, error) {
+	return nil, errRegistryUnsupported
+}
+
+func (rm *RegistryManager) GetRegisteredFirewallRules() ([]RegistryFirewallRule, error) {
+	return nil, errRegistryUnsupported
+}
+
+func (rm *RegistryManager) AuditRegistryState() (bool, error) { return false, errRegistryUnsupported }
+
+func (rm *RegistryManager) CleanupOrphanedEntries() error { return errRegistryUnsupported }
@@ -0,0 +1,49 @@
+package main
+
+import "fmt"
+
+// runRegistryAudit implements --audit: compare the registry tracking with the live
+// port proxies and firewall rules. Read-only, so no Administrator rights are needed.
+// Exit codes: 0=consistent, 1=error, 2=inconsistencies found
+func runRegistryAudit() int {
+	registryManager, err := OpenRegistryManagerReadOnly()
+	if err != nil {
+		fmt.Printf("❌ Registry tracking unavailable: %v\n", err)
+		return 1
+	}
+	defer registryManager.Close()
+
+	allGood, err := registryManager.AuditRegistryState()
+	if err != nil {
+		fmt.Printf("❌ Registry audit failed: %v\n", err)
+		return 1
+	}
+	if !allGood {
+		fmt.Println("\n💡 Tip: --cleanup-registry removes entries whose resources no longer exist")
+		return 2
+	}
+	return 0
+}
+
+// runRegistryCleanup implements --cleanup-registry: remove registry entries whose port
+// proxy or firewall rule no longer exists. Exit codes: 0=success, 1=error
+func runRegistryCleanup() int {
+	if !isRunningAsAdmin() {
+		fmt.Println("❌ --cleanup-registry requires Administrator privileges to change the registry")
+		fmt.Println("💡 Run it from an elevated prompt, or use --audit to only report the orphaned entries")
+		return 1
+	}
+
+	registryManager, err := NewRegistryManager()
+	if err != nil {
+		fmt.Printf("❌ Registry tracking unavailable: %v\n", err)
+		return 1
+	}
+	defer registryManager.Close()
+
+	if err := registryManager.CleanupOrphanedEntries(); err != nil {
+		fmt.Printf("❌ Registry cleanup failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import "sort"
+
+// RegistrySyncPlan is what reconcile_registry_on_start changes so that the registry
+// tracks exactly the forwarder's live resources
+type RegistrySyncPlan struct {
+	RegisterProxies []PortMapping      // live forwards on configured ports the registry doesn't track
+	RegisterRules   []FirewallRuleSpec // live forwarder firewall rules the registry doesn't track
+	DropProxyKeys   []string           // entries for forwards that no longer exist, or duplicates
+	DropRuleKeys    []string           // entries for rules that no longer exist, or duplicates
+}
+
+// IsEmpty returns true if the registry already matches the live state
+func (p RegistrySyncPlan) IsEmpty() bool {
+	return len(p.RegisterProxies) == 0 && len(p.RegisterRules) == 0 && len(p.DropProxyKeys) == 0 && len(p.DropRuleKeys) == 0
+}
+
+// planRegistrySync compares registry entries with the live forwards and firewall rules.
+// Only forwards on configured ports and rules with the forwarder's naming are adopted,
+// so other tools' resources are never claimed. A live forward is attributed to the
+// first instance configuring its port. Of duplicate entries, the newest is kept.
+func planRegistrySync(config *Config, proxies []RegistryPortProxy, rules []RegistryFirewallRule, mappings map[int]PortMapping, actualRules []FirewallRule) RegistrySyncPlan {
+	var plan RegistrySyncPlan
+
+	// Newest entries first, so the first one seen for a resource is the one kept
+	proxies = append([]RegistryPortProxy(nil), proxies...)
+	sort.SliceStable(proxies, func(i, j int) bool { return proxies[i].Timestamp > proxies[j].Timestamp })
+	tracked := make(map[int]bool)
+	for _, proxy := range proxies {
+		mapping, live := mappings[proxy.ListenPort]
+		if !live || mapping.TargetIP != proxy.ConnectAddress || mapping.InternalPort != proxy.ConnectPort || tracked[proxy.ListenPort] {
+			plan.DropProxyKeys = append(plan.DropProxyKeys, proxy.Key)
+			continue
+		}
+		tracked[proxy.ListenPort] = true
+	}
+	for _, port := range sortedMappingPorts(mappings) {
+		mapping := mappings[port]
+		if tracked[port] || isDockerDesktopIP(mapping.TargetIP) {
+			continue
+		}
+		for _, instance := range config.Instances {
+			if instanceConfiguresPort(instance, port) {
+				mapping.Instance = instance.Name
+				plan.RegisterProxies = append(plan.RegisterProxies, mapping)
+				break
+			}
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, rule := range actualRules {
+		present[rule.Name] = true
+	}
+	rules = append([]RegistryFirewallRule(nil), rules...)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Timestamp > rules[j].Timestamp })
+	trackedRules := make(map[string]bool)
+	for _, rule := range rules {
+		if !present[rule.RuleName] || trackedRules[rule.RuleName] {
+			plan.DropRuleKeys = append(plan.DropRuleKeys, rule.Key)
+			continue
+		}
+		trackedRules[rule.RuleName] = true
+	}
+	seen := make(map[string]bool)
+	for _, instance := range config.Instances {
+		for _, port := range instance.Ports {
+			for _, name := range []string{generateFirewallRuleName(port.ExternalPortEffective(), instance.Name), outboundFirewallRuleName(port.ExternalPortEffective(), instance.Name)} {
+				if present[name] && !trackedRules[name] && !seen[name] {
+					seen[name] = true
+					plan.RegisterRules = append(plan.RegisterRules, FirewallRuleSpec{Name: name, Port: port.ExternalPortEffective(), Instance: instance.Name})
+				}
+			}
+		}
+	}
+
+	sort.Strings(plan.DropProxyKeys)
+	sort.Strings(plan.DropRuleKeys)
+	return plan
+}
+
+// reconcileRegistryOnStart makes the registry match the live system before the first
+// reconcile, so resource tracking can be trusted from the start
+func (s *ServiceState) reconcileRegistryOnStart() {
+	if s.registryManager == nil {
+		return
+	}
+
+	proxies, err := s.registryManager.GetRegisteredPortProxies()
+	if err != nil {
+		s.logf("Warning: Registry reconciliation skipped: %v", err)
+		return
+	}
+	rules, err := s.registryManager.GetRegisteredFirewallRules()
+	if err != nil {
+		s.logf("Warning: Registry reconciliation skipped: %v", err)
+		return
+	}
+	mappings, err := s.getCurrentPortMappings()
+	if err != nil {
+		s.logf("Warning: Registry reconciliation skipped: %v", err)
+		return
+	}
+	actualRules, err := s.getForwarderDirectionRules()
+	if err != nil {
+		s.logf("Warning: Registry reconciliation skipped: %v", err)
+		return
+	}
+
+	plan := planRegistrySync(s.config, proxies, rules, mappings, actualRules)
+	if plan.IsEmpty() {
+		consoleEvent("info", "registry_sync", EventFields{}, "Registry reconciliation: registry matches the live state")
+		return
+	}
+	if s.dryRun {
+		consoleEvent("info", "registry_sync", EventFields{}, "Registry reconciliation (dry-run): would register %d port proxies and %d firewall rules, and remove %d stale or duplicate entries",
+			len(plan.RegisterProxies), len(plan.RegisterRules), len(plan.DropProxyKeys)+len(plan.DropRuleKeys))
+		return
+	}
+
+	failures := 0
+	for _, key := range plan.DropProxyKeys {
+		if err := s.registryManager.DeletePortProxyEntry(key); err != nil {
+			s.logf("Warning: %v", err)
+			failures++
+		}
+	}
+	for _, key := range plan.DropRuleKeys {
+		if err := s.registryManager.DeleteFirewallRuleEntry(key); err != nil {
+			s.logf("Warning: %v", err)
+			failures++
+		}
+	}
+	for _, mapping := range plan.RegisterProxies {
+		if err := s.registryManager.RegisterPortProxy(mapping.ExternalPort, mapping.TargetIP, mapping.InternalPort, mapping.Instance); err != nil {
+			s.logf("Warning: Failed to register live port proxy %d: %v", mapping.ExternalPort, err)
+			failures++
+		}
+	}
+	for _, rule := range plan.RegisterRules {
+		if err := s.registryManager.RegisterFirewallRule(rule.Name, rule.Port, rule.Instance); err != nil {
+			s.logf("Warning: Failed to register live firewall rule %s: %v", rule.Name, err)
+			failures++
+		}
+	}
+
+	s.logf("Registry reconciled with live state: %d port proxies and %d firewall rules registered, %d stale or duplicate entries removed (%d failures)",
+		len(plan.RegisterProxies), len(plan.RegisterRules), len(plan.DropProxyKeys)+len(plan.DropRuleKeys), failures)
+}
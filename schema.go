@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// JSONSchema is the subset of JSON Schema (draft 2020-12) --print-schema emits
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Maximum              *int                   `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	Defs                 map[string]*JSONSchema `json:"$defs,omitempty"`
+}
+
+// schemaConstraint is what validateConfiguration checks about a field beyond its type.
+// Bounds of fields where 0 means "default" or "off" start at 0.
+type schemaConstraint struct {
+	enum     []string
+	min, max *int
+	nonEmpty bool // strings (or array entries) can't be empty
+}
+
+func schemaBounds(min, max int) schemaConstraint {
+	return schemaConstraint{min: &min, max: &max}
+}
+
+// schemaConstraints mirrors validateConfiguration, keyed by JSON field name (the same
+// name means the same rules wherever the field appears, e.g. firewall in defaults)
+var schemaConstraints = map[string]schemaConstraint{
+	"check_interval_seconds":  schemaBounds(0, 3600),
+	"log_dedup_seconds":       schemaBounds(0, 86400),
+	"empty_reading_grace":     schemaBounds(0, maxEmptyReadingGrace),
+	"min_interval":            schemaBounds(0, 3600),
+	"max_interval":            schemaBounds(0, 3600),
+	"command_timeout_seconds": schemaBounds(0, 600),
+	"log_max_size_mb":         schemaBounds(0, 10240),
+	"log_max_backups":         schemaBounds(0, 100),
+	"managed_instances":       {nonEmpty: true},
+	"name":                    {nonEmpty: true},
+	"aliases":                 {nonEmpty: true},
+	"tags":                    {nonEmpty: true},
+	"interface_priority":      {nonEmpty: true},
+	"startup_delay_seconds":   schemaBounds(0, maxStartupDelaySeconds),
+	"address_family":          {enum: []string{addressFamilyIPv4, addressFamilyIPv6}},
+	"port":                    schemaBounds(1, 65535),
+	"internal_port":           schemaBounds(0, 65535),
+	"firewall":                {enum: []string{"local", "full", firewallOff}},
+	"firewall_direction":      {enum: []string{"in", "out", "both"}},
+	"protocol":                {enum: []string{"tcp", "udp"}},
+	"qos_throttle_kbps":       schemaBounds(0, maxQosThrottleKbps),
+}
+
+// schemaRequired lists the fields validateConfiguration requires, per struct
+var schemaRequired = map[string][]string{
+	"Instance": {"name"},
+	"Port":     {"port"},
+}
+
+// configSchema derives the JSON Schema of the config file from the Config structs, so
+// every field is covered as soon as it is added; schemaConstraints adds the checks
+func configSchema() *JSONSchema {
+	defs := make(map[string]*JSONSchema)
+	root := structSchema(reflect.TypeOf(Config{}), defs)
+	root.Schema = "https://json-schema.org/draft/2020-12/schema"
+	root.Title = "WSL2 Port Forwarder configuration"
+	// Lets a config point editors at the saved schema
+	root.Properties["$schema"] = &JSONSchema{Type: "string"}
+	root.Defs = defs
+	return root
+}
+
+// structSchema returns the object schema of a struct, adding the structs it refers to
+// to defs
+func structSchema(t reflect.Type, defs map[string]*JSONSchema) *JSONSchema {
+	closed := false
+	schema := &JSONSchema{Type: "object", Properties: make(map[string]*JSONSchema), AdditionalProperties: &closed, Required: schemaRequired[t.Name()]}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		property := typeSchema(field.Type, defs)
+		if constraint, ok := schemaConstraints[name]; ok {
+			applySchemaConstraint(property, constraint)
+		}
+		schema.Properties[name] = property
+	}
+	return schema
+}
+
+// typeSchema returns the schema of a field type
+func typeSchema(t reflect.Type, defs map[string]*JSONSchema) *JSONSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return &JSONSchema{Type: "integer"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice:
+		return &JSONSchema{Type: "array", Items: typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, done := defs[t.Name()]; !done {
+			defs[t.Name()] = nil // placeholder, in case the struct refers to itself
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return &JSONSchema{Ref: "#/$defs/" + t.Name()}
+	}
+	panic(fmt.Sprintf("configSchema: unsupported field type %s", t))
+}
+
+// applySchemaConstraint adds a field's checks to its schema (to the entries, for arrays)
+func applySchemaConstraint(schema *JSONSchema, constraint schemaConstraint) {
+	if schema.Type == "array" {
+		schema = schema.Items
+	}
+	schema.Enum = constraint.enum
+	schema.Minimum = constraint.min
+	schema.Maximum = constraint.max
+	if constraint.nonEmpty {
+		minLength := 1
+		schema.MinLength = &minLength
+	}
+}
+
+// runPrintSchema implements --print-schema: print the config file's JSON Schema, for
+// editors to complete and check configs against. Exit codes: 0=ok, 1=error
+func runPrintSchema(opts *CommandLineOptions) int {
+	data, err := marshalJSON(configSchema(), opts.JSONStyle.forStdout())
+	if err != nil {
+		fmt.Printf("❌ Failed to encode schema: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSelfTestTimeout bounds each --test dial unless --test-timeout says otherwise
+const defaultSelfTestTimeout = 3 * time.Second
+
+// selfTestHold is how long a --test connection must stay open. netsh's portproxy
+// accepts the connection before it connects to the instance, and drops it straight
+// away when nothing answers there, so a connection that survives this long reached WSL.
+const selfTestHold = 500 * time.Millisecond
+
+// SelfTestResult is the outcome of one --test connection
+type SelfTestResult struct {
+	Instance string
+	Port     int
+	Address  string // host address dialed
+	Target   string // connect address of the forward
+	Passed   bool
+	Elapsed  time.Duration // time to connect, or until the failure
+	Detail   string        // why it failed
+}
+
+// dialThroughProxy connects to address and waits selfTestHold for the proxy to drop the
+// connection, returning how long the connect took; overridable in tests
+var dialThroughProxy = func(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, err
+	}
+	defer conn.Close()
+
+	// Greeting protocols (e.g. SSH) send a banner; everything else just waits for us
+	conn.SetReadDeadline(time.Now().Add(selfTestHold))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		var netErr net.Error
+		if !(errors.As(err, &netErr) && netErr.Timeout()) {
+			if err == io.EOF {
+				err = fmt.Errorf("connection closed by the proxy, nothing answered inside WSL")
+			}
+			return time.Since(start), err
+		}
+	}
+	return elapsed, nil
+}
+
+// selfTestAddress returns the host address to dial for a forward bound to listenAddress:
+// wildcard binds are reached over loopback, anything else at the address itself
+func selfTestAddress(listenAddress string, port int) string {
+	host := listenAddress
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// selfTests works out what --test dials: one connection per port forwarded to a running
+// instance. Ports without a portproxy entry fail without dialing, as do entries pointing
+// somewhere other than the instance.
+func selfTests(snapshot *ReconcileSnapshot) []SelfTestResult {
+	desiredMappings, _ := snapshot.DesiredMappings()
+
+	var tests []SelfTestResult
+	for _, port := range sortedMappingPorts(desiredMappings) {
+		desired := desiredMappings[port]
+		test := SelfTestResult{
+			Instance: desired.Instance,
+			Port:     port,
+			Address:  selfTestAddress(desired.ListenAddress, port),
+			Target:   net.JoinHostPort(desired.TargetIP, strconv.Itoa(desired.InternalPort)),
+		}
+
+		current, exists := snapshot.CurrentMappings[port]
+		switch {
+		case !exists:
+			test.Detail = "no port proxy installed (is the service running?)"
+		case current.InternalPort != desired.InternalPort || !isInstanceAddress(snapshot, desired, current.TargetIP):
+			test.Detail = fmt.Sprintf("port proxy forwards to %s:%d instead", current.TargetIP, current.InternalPort)
+		}
+		if exists {
+			test.Address = selfTestAddress(current.ListenAddress, port)
+			test.Target = net.JoinHostPort(current.TargetIP, strconv.Itoa(current.InternalPort))
+		}
+		tests = append(tests, test)
+	}
+	return tests
+}
+
+// isInstanceAddress returns true if ip is the instance's address, or one of its
+// connect_fallback candidates
+func isInstanceAddress(snapshot *ReconcileSnapshot, desired PortMapping, ip string) bool {
+	if ip == desired.TargetIP {
+		return true
+	}
+	for _, candidate := range snapshot.CandidateIPs[desired.Instance] {
+		if candidate == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// runSelfTests dials every test that hasn't already failed, concurrently
+func runSelfTests(tests []SelfTestResult, timeout time.Duration) []SelfTestResult {
+	var wg sync.WaitGroup
+	for i := range tests {
+		if tests[i].Detail != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(test *SelfTestResult) {
+			defer wg.Done()
+			elapsed, err := dialThroughProxy(test.Address, timeout)
+			test.Elapsed = elapsed
+			if err != nil {
+				test.Detail = err.Error()
+				return
+			}
+			test.Passed = true
+		}(&tests[i])
+	}
+	wg.Wait()
+	return tests
+}
+
+// runSelfTest implements --test: connect to every forwarded port through the host's
+// port proxy, checking that the connection reaches the instance, and report each
+// port's result. Exit codes: 0=all passed (or nothing to test), 1=a test failed or error
+func runSelfTest(opts *CommandLineOptions) int {
+	config, err := loadConfigFile(opts.ConfigFile, opts.AllowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", opts.ConfigFile, err)
+		return 1
+	}
+
+	service := &ServiceState{config: config, configFile: opts.ConfigFile, strict: opts.Strict}
+	snapshot, err := service.captureSnapshot(config.ManagedConfig().TaggedConfig(opts.Tags))
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	timeout := opts.TestTimeout
+	if timeout == 0 {
+		timeout = defaultSelfTestTimeout
+	}
+
+	tests := selfTests(snapshot)
+	if len(tests) == 0 {
+		fmt.Println("ℹ️  No TCP ports of running instances to test")
+		return 0
+	}
+
+	fmt.Printf("Testing %d forwarded port(s) through the port proxy (timeout %v)...\n", len(tests), timeout)
+	failures := 0
+	for _, test := range runSelfTests(tests, timeout) {
+		label := fmt.Sprintf("[%s] port %d: %s -> %s", test.Instance, test.Port, test.Address, test.Target)
+		if test.Passed {
+			fmt.Printf("✅ PASS %s (%v)\n", label, test.Elapsed.Round(time.Millisecond))
+			continue
+		}
+		failures++
+		if test.Elapsed > 0 {
+			fmt.Printf("❌ FAIL %s (%v): %s\n", label, test.Elapsed.Round(time.Millisecond), test.Detail)
+		} else {
+			fmt.Printf("❌ FAIL %s: %s\n", label, test.Detail)
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d failed\n", len(tests)-failures, failures)
+	if failures > 0 {
+		fmt.Println("    → --validate --deep shows whether the connect ports are listening inside each instance")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultSetupConfigFile is where `setup` writes the config unless told otherwise
+const defaultSetupConfigFile = "wsl2-config.json"
+
+// stdinIsTerminal returns true if stdin is an interactive console rather than a pipe,
+// a file, or nothing at all (e.g. running under a service manager)
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// listInstalledDistros returns every installed WSL distro, running or not; overridable in tests
+var listInstalledDistros = func() ([]string, error) {
+	output, err := runCommand(defaultCommandTimeout, false, "wsl", "--list", "--quiet")
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute wsl --list: %v", err)
+	}
+	text, err := decodeCommandOutput(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wsl output: %v", err)
+	}
+
+	var distros []string
+	for _, line := range strings.Split(text, "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			distros = append(distros, name)
+		}
+	}
+	return distros, nil
+}
+
+// parsePortList parses the wizard's port answer: comma or space separated entries of
+// "port" or "external:internal", e.g. "2222:22, 8080"
+func parsePortList(answer string) ([]Port, error) {
+	var ports []Port
+	fields := strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	for _, field := range fields {
+		external, internal, mapped := strings.Cut(field, ":")
+		port, err := strconv.Atoi(external)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("'%s' is not a port number (1-65535)", external)
+		}
+		entry := Port{Port: port}
+		if mapped {
+			internalPort, err := strconv.Atoi(internal)
+			if err != nil || internalPort < 1 || internalPort > 65535 {
+				return nil, fmt.Errorf("'%s' is not a port number (1-65535)", internal)
+			}
+			if internalPort != port {
+				entry.InternalPort = internalPort
+			}
+		}
+		ports = append(ports, entry)
+	}
+	return ports, nil
+}
+
+// setupWizard asks the setup questions on in and writes prompts to out
+type setupWizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a prompt and returns the trimmed answer, or def if the answer is empty
+func (w *setupWizard) ask(prompt string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", prompt, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", prompt)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("setup cancelled: no answer")
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+// askYesNo asks a yes/no question until it gets an answer it understands
+func (w *setupWizard) askYesNo(prompt string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		answer, err := w.ask(prompt+" ("+hint+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintln(w.out, "  Please answer y or n")
+	}
+}
+
+// buildConfig walks through the distros and returns the config the answers describe
+func (w *setupWizard) buildConfig(distros []string) (*Config, error) {
+	config := &Config{CheckIntervalSeconds: 5}
+
+	for _, distro := range distros {
+		forward, err := w.askYesNo(fmt.Sprintf("\nForward ports to %s?", distro), false)
+		if err != nil {
+			return nil, err
+		}
+		if !forward {
+			continue
+		}
+
+		var ports []Port
+		for {
+			answer, err := w.ask("  Ports (e.g. 2222:22, 8080 - external:internal, or one port for both)", "")
+			if err != nil {
+				return nil, err
+			}
+			if ports, err = parsePortList(answer); err != nil {
+				fmt.Fprintf(w.out, "  ❌ %v\n", err)
+				continue
+			}
+			if len(ports) > 0 {
+				break
+			}
+		}
+
+		var firewall string
+		for {
+			answer, err := w.ask("  Open the Windows Firewall for these ports? none, local (LAN only) or full (any address)", "local")
+			if err != nil {
+				return nil, err
+			}
+			if answer = strings.ToLower(answer); answer == "none" || answer == "local" || answer == "full" {
+				if answer != "none" {
+					firewall = answer
+				}
+				break
+			}
+			fmt.Fprintln(w.out, "  Please answer none, local or full")
+		}
+		for i := range ports {
+			ports[i].Firewall = firewall
+		}
+
+		config.Instances = append(config.Instances, Instance{Name: distro, Ports: ports})
+	}
+
+	if len(config.Instances) == 0 {
+		return nil, fmt.Errorf("no distros selected, nothing to forward")
+	}
+
+	for {
+		answer, err := w.ask("\nCheck for IP changes every N seconds", "5")
+		if err != nil {
+			return nil, err
+		}
+		if seconds, err := strconv.Atoi(answer); err == nil && seconds >= 1 && seconds <= 3600 {
+			config.CheckIntervalSeconds = seconds
+			break
+		}
+		fmt.Fprintln(w.out, "  Please enter a number of seconds between 1 and 3600")
+	}
+
+	return config, nil
+}
+
+// printSetupInstructions explains how to configure the forwarder by hand, for when
+// there's no console to run the wizard on
+func printSetupInstructions(configFile string) {
+	fmt.Println("ℹ️  setup is interactive and needs a console; stdin is not a terminal.")
+	fmt.Println("To configure the forwarder without it:")
+	fmt.Printf("  1. Copy wsl2-config.example.json to %s and edit the instances and ports\n", configFile)
+	fmt.Printf("  2. Check it: wsl2-port-forwarder.exe --validate %s\n", configFile)
+	fmt.Println("  3. Install the service: run install-service.bat as Administrator")
+}
+
+// runSetup implements the `setup` subcommand, an interactive first-run wizard that
+// writes and validates a config and can install the service. Exit codes: 0=ok, 1=error
+func runSetup(args []string) int {
+	var force bool
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "--"):
+			fmt.Printf("Unknown option: %s\n", arg)
+			return 1
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) > 1 {
+		fmt.Println("Usage: wsl2-port-forwarder.exe setup [--force] [config-file.json]")
+		return 1
+	}
+	configFile := defaultSetupConfigFile
+	if len(files) == 1 {
+		configFile = files[0]
+	}
+
+	if !stdinIsTerminal() {
+		printSetupInstructions(configFile)
+		return 1
+	}
+	if _, err := os.Stat(configFile); err == nil && !force {
+		fmt.Printf("❌ %s already exists; use --force to overwrite it, or edit it by hand\n", configFile)
+		return 1
+	}
+
+	fmt.Println("WSL2 Port Forwarder - Setup")
+	fmt.Println("===========================")
+	distros, err := listInstalledDistros()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	if len(distros) == 0 {
+		fmt.Println("❌ No WSL distros are installed (see 'wsl --install')")
+		return 1
+	}
+	fmt.Printf("Found %d WSL distro(s): %s\n", len(distros), strings.Join(distros, ", "))
+
+	wizard := &setupWizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	config, err := wizard.buildConfig(distros)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	data, err := marshalJSON(config, true)
+	if err != nil {
+		fmt.Printf("❌ Failed to encode config: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(configFile, append(data, '\n'), 0644); err != nil {
+		fmt.Printf("❌ Failed to write %s: %v\n", configFile, err)
+		return 1
+	}
+	fmt.Printf("\n✅ Wrote %s\n\n", configFile)
+
+	if validateConfiguration(&CommandLineOptions{ConfigFile: configFile}) == 1 {
+		return 1
+	}
+
+	fmt.Println()
+	install, err := wizard.askYesNo("Install the Windows service now? (runs install-service.bat, needs Administrator)", false)
+	if err != nil || !install {
+		fmt.Printf("ℹ️  To run it later: wsl2-port-forwarder.exe %s, or install-service.bat as Administrator\n", configFile)
+		return 0
+	}
+	return installService(configFile)
+}
+
+// installService runs install-service.bat from the executable's directory. The script
+// expects wsl2-config.json next to the executable, so other config paths are refused.
+func installService(configFile string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("❌ Can't locate the executable: %v\n", err)
+		return 1
+	}
+	dir := filepath.Dir(exe)
+	if absConfig, err := filepath.Abs(configFile); err != nil || !strings.EqualFold(absConfig, filepath.Join(dir, defaultSetupConfigFile)) {
+		fmt.Printf("⚠️  install-service.bat uses %s; copy %s there, then run the script as Administrator\n",
+			filepath.Join(dir, defaultSetupConfigFile), configFile)
+		return 1
+	}
+
+	cmd := exec.Command("cmd", "/c", filepath.Join(dir, "install-service.bat"))
+	cmd.Dir = dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("❌ Service installation failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mappingSnapshotVersion is bumped whenever the snapshot file format changes incompatibly
+const mappingSnapshotVersion = 1
+
+// managedFirewallRulePrefix is the name prefix of rules created by generateFirewallRuleName
+const managedFirewallRulePrefix = "WSL2-Port-"
+
+// MappingSnapshot is the on-disk form of the live portproxy and managed firewall state
+type MappingSnapshot struct {
+	Version       int                    `json:"version"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Host          string                 `json:"host,omitempty"`
+	Mappings      []SnapshotMapping      `json:"mappings"`
+	FirewallRules []SnapshotFirewallRule `json:"firewall_rules"`
+}
+
+// SnapshotMapping is a single portproxy entry
+type SnapshotMapping struct {
+	ListenPort     int    `json:"listen_port"`
+	ListenAddress  string `json:"listen_address,omitempty"`
+	ConnectAddress string `json:"connect_address"`
+	ConnectPort    int    `json:"connect_port"`
+	Instance       string `json:"instance,omitempty"`
+}
+
+// SnapshotFirewallRule is a firewall rule created by this service
+type SnapshotFirewallRule struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Instance string `json:"instance,omitempty"`
+	Mode     string `json:"mode"` // "local" or "full"
+}
+
+// firewallModeFromRemoteIP maps a rule's RemoteIP back to the firewall mode that created it
+func firewallModeFromRemoteIP(remoteIP string) (string, bool) {
+	switch {
+	case strings.EqualFold(remoteIP, "LocalSubnet"):
+		return "local", true
+	case strings.EqualFold(remoteIP, "Any"):
+		return "full", true
+	default:
+		return "", false
+	}
+}
+
+// buildMappingSnapshot assembles a snapshot from the live state. proxyInstances and
+// ruleInstances come from registry tracking and may be empty. Managed rules whose
+// RemoteIP doesn't correspond to a firewall mode are returned as warnings.
+func buildMappingSnapshot(mappings map[int]PortMapping, rules []FirewallRule,
+	proxyInstances map[int]string, ruleInstances map[string]string) (*MappingSnapshot, []string) {
+	snapshot := &MappingSnapshot{
+		Version:       mappingSnapshotVersion,
+		Mappings:      []SnapshotMapping{},
+		FirewallRules: []SnapshotFirewallRule{},
+	}
+	var warnings []string
+
+	for port, mapping := range mappings {
+		snapshot.Mappings = append(snapshot.Mappings, SnapshotMapping{
+			ListenPort:     port,
+			ListenAddress:  mapping.ListenAddress,
+			ConnectAddress: mapping.TargetIP,
+			ConnectPort:    mapping.InternalPort,
+			Instance:       proxyInstances[port],
+		})
+	}
+	sort.Slice(snapshot.Mappings, func(i, j int) bool {
+		return snapshot.Mappings[i].ListenPort < snapshot.Mappings[j].ListenPort
+	})
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Name, managedFirewallRulePrefix) || rule.IsBlock() {
+			continue
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(rule.LocalPort))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("rule %s: unexpected local port %q, skipped", rule.Name, rule.LocalPort))
+			continue
+		}
+		mode, ok := firewallModeFromRemoteIP(rule.RemoteIP)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("rule %s: remote IP %q doesn't match a firewall mode, skipped", rule.Name, rule.RemoteIP))
+			continue
+		}
+		instance := ruleInstances[rule.Name]
+		if instance == "" {
+			instance = proxyInstances[port]
+		}
+		snapshot.FirewallRules = append(snapshot.FirewallRules, SnapshotFirewallRule{
+			Name:     rule.Name,
+			Port:     port,
+			Instance: instance,
+			Mode:     mode,
+		})
+	}
+	sort.Slice(snapshot.FirewallRules, func(i, j int) bool {
+		return snapshot.FirewallRules[i].Name < snapshot.FirewallRules[j].Name
+	})
+
+	return snapshot, warnings
+}
+
+// validateMappingSnapshot checks a snapshot read from disk before anything is restored
+func validateMappingSnapshot(snapshot *MappingSnapshot) error {
+	if snapshot.Version != mappingSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (expected %d)", snapshot.Version, mappingSnapshotVersion)
+	}
+
+	seenPorts := make(map[int]bool)
+	for i, mapping := range snapshot.Mappings {
+		if mapping.ListenPort < 1 || mapping.ListenPort > 65535 {
+			return fmt.Errorf("mapping %d: invalid listen port %d", i, mapping.ListenPort)
+		}
+		if mapping.ConnectPort < 1 || mapping.ConnectPort > 65535 {
+			return fmt.Errorf("mapping %d: invalid connect port %d", i, mapping.ConnectPort)
+		}
+		if !isValidIPAddress(mapping.ConnectAddress) {
+			return fmt.Errorf("mapping %d: invalid connect address %q", i, mapping.ConnectAddress)
+		}
+		if seenPorts[mapping.ListenPort] {
+			return fmt.Errorf("mapping %d: duplicate listen port %d", i, mapping.ListenPort)
+		}
+		seenPorts[mapping.ListenPort] = true
+	}
+
+	seenRules := make(map[string]bool)
+	for i, rule := range snapshot.FirewallRules {
+		if rule.Name == "" {
+			return fmt.Errorf("firewall rule %d: name is required", i)
+		}
+		if rule.Port < 1 || rule.Port > 65535 {
+			return fmt.Errorf("firewall rule %s: invalid port %d", rule.Name, rule.Port)
+		}
+		if rule.Mode != "local" && rule.Mode != "full" {
+			return fmt.Errorf("firewall rule %s: invalid mode %q (must be 'local' or 'full')", rule.Name, rule.Mode)
+		}
+		if seenRules[rule.Name] {
+			return fmt.Errorf("firewall rule %s: duplicate name", rule.Name)
+		}
+		seenRules[rule.Name] = true
+	}
+
+	return nil
+}
+
+// runSnapshot implements the `snapshot save|restore <file>` subcommand. Exit codes: 0=ok, 1=error
+func runSnapshot(args []string) int {
+	var style jsonStyle
+	var positional []string
+	for _, arg := range args {
+		if isJSONStyleFlag(arg) {
+			style.set(arg)
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 || (positional[0] != "save" && positional[0] != "restore") {
+		fmt.Println("Usage: wsl2-port-forwarder.exe snapshot save [--pretty|--compact] <file>")
+		fmt.Println("       wsl2-port-forwarder.exe snapshot restore <file>")
+		return 1
+	}
+
+	service := &ServiceState{
+		currentMappings: make(map[int]PortMapping),
+	}
+	if registryManager, err := NewRegistryManager(); err != nil {
+		fmt.Printf("⚠️  Registry tracking unavailable: %v\n", err)
+	} else {
+		service.registryManager = registryManager
+		defer registryManager.Close()
+	}
+
+	if positional[0] == "save" {
+		return service.saveSnapshot(positional[1], style.forFile())
+	}
+	return service.restoreSnapshot(positional[1])
+}
+
+// saveSnapshot writes the live portproxy and managed firewall state to file
+func (s *ServiceState) saveSnapshot(file string, pretty bool) int {
+	mappings, err := s.getCurrentPortMappings()
+	if err != nil {
+		fmt.Printf("❌ Failed to read port mappings: %v\n", err)
+		return 1
+	}
+	rules, err := s.getInboundFirewallRules()
+	if err != nil {
+		fmt.Printf("❌ Failed to read firewall rules: %v\n", err)
+		return 1
+	}
+
+	// Instance names aren't recoverable from netsh, only from registry tracking
+	proxyInstances := make(map[int]string)
+	ruleInstances := make(map[string]string)
+	if s.registryManager != nil {
+		if proxies, err := s.registryManager.GetRegisteredPortProxies(); err == nil {
+			for _, proxy := range proxies {
+				proxyInstances[proxy.ListenPort] = proxy.Instance
+			}
+		}
+		if registered, err := s.registryManager.GetRegisteredFirewallRules(); err == nil {
+			for _, rule := range registered {
+				ruleInstances[rule.RuleName] = rule.Instance
+			}
+		}
+	}
+
+	snapshot, warnings := buildMappingSnapshot(mappings, rules, proxyInstances, ruleInstances)
+	snapshot.CreatedAt = time.Now().UTC()
+	snapshot.Host, _ = os.Hostname()
+	for _, warning := range warnings {
+		fmt.Printf("⚠️  %s\n", warning)
+	}
+
+	data, err := marshalJSON(snapshot, pretty)
+	if err != nil {
+		fmt.Printf("❌ Failed to encode snapshot: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		fmt.Printf("❌ Failed to write snapshot: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("✅ Saved %d port mappings and %d firewall rules to %s\n",
+		len(snapshot.Mappings), len(snapshot.FirewallRules), file)
+	return 0
+}
+
+// restoreSnapshot recreates the mappings and firewall rules from a snapshot file.
+// Existing mappings and rules are never overwritten; they're reported as skipped.
+func (s *ServiceState) restoreSnapshot(file string) int {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Printf("❌ Failed to read snapshot: %v\n", err)
+		return 1
+	}
+	var snapshot MappingSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		fmt.Printf("❌ Failed to parse snapshot: %v\n", err)
+		return 1
+	}
+	if err := validateMappingSnapshot(&snapshot); err != nil {
+		fmt.Printf("❌ Invalid snapshot: %v\n", err)
+		return 1
+	}
+
+	current, err := s.getCurrentPortMappings()
+	if err != nil {
+		fmt.Printf("❌ Failed to read port mappings: %v\n", err)
+		return 1
+	}
+	s.currentMappings = current
+	rules, err := s.getInboundFirewallRules()
+	if err != nil {
+		fmt.Printf("❌ Failed to read firewall rules: %v\n", err)
+		return 1
+	}
+	existingRules := make(map[string]bool)
+	for _, rule := range rules {
+		existingRules[rule.Name] = true
+	}
+
+	fmt.Printf("Restoring snapshot from %s", file)
+	if snapshot.Host != "" {
+		fmt.Printf(" (taken on %s at %s)", snapshot.Host, snapshot.CreatedAt.Format(time.RFC3339))
+	}
+	fmt.Println()
+
+	created, skipped, failed := 0, 0, 0
+	for _, mapping := range snapshot.Mappings {
+		if existing, exists := current[mapping.ListenPort]; exists {
+			if existing.TargetIP == mapping.ConnectAddress && existing.InternalPort == mapping.ConnectPort {
+				fmt.Printf("  ⏭️  Port %d: already forwarded to %s:%d\n", mapping.ListenPort, existing.TargetIP, existing.InternalPort)
+			} else {
+				fmt.Printf("  ⏭️  Port %d: in use by %s:%d, not overwritten\n", mapping.ListenPort, existing.TargetIP, existing.InternalPort)
+			}
+			skipped++
+			continue
+		}
+		if err := s.addPortMapping(mapping.ListenPort, mapping.ConnectPort, mapping.ConnectAddress, mapping.Instance, mapping.ListenAddress); err != nil {
+			fmt.Printf("  ❌ Port %d: %v\n", mapping.ListenPort, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  ✅ Port %d -> %s:%d\n", mapping.ListenPort, mapping.ConnectAddress, mapping.ConnectPort)
+		created++
+	}
+
+	for _, rule := range snapshot.FirewallRules {
+		if existingRules[rule.Name] {
+			fmt.Printf("  ⏭️  Firewall rule %s: already exists\n", rule.Name)
+			skipped++
+			continue
+		}
+		if err := s.addFirewallRule(rule.Port, rule.Instance, rule.Mode, 0, "tcp"); err != nil {
+			fmt.Printf("  ❌ Firewall rule %s: %v\n", rule.Name, err)
+			failed++
+			continue
+		}
+		if name := generateFirewallRuleName(rule.Port, rule.Instance); name != rule.Name {
+			fmt.Printf("  ✅ Firewall rule %s (port %d, %s), recreated as %s\n", rule.Name, rule.Port, rule.Mode, name)
+		} else {
+			fmt.Printf("  ✅ Firewall rule %s (port %d, %s)\n", rule.Name, rule.Port, rule.Mode)
+		}
+		created++
+	}
+
+	fmt.Printf("\nCreated %d, skipped %d, failed %d\n", created, skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
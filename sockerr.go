@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isConnectionRefused returns true if a dial failed because the peer actively
+// refused it, which proves the address is routable even though nothing listens
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
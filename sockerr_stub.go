@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnectionRefused returns true if a dial failed because the peer actively
+// refused it, which proves the address is routable even though nothing listens
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
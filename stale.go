@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StaleMapping is an installed forward on a managed port whose target IP belongs to no
+// running configured instance, e.g. because an earlier update failed
+type StaleMapping struct {
+	Port     int    `json:"port"`
+	TargetIP string `json:"target_ip"`
+	Instance string `json:"instance,omitempty"` // running instance the port re-resolves to, if any
+	NewIP    string `json:"new_ip,omitempty"`   // that instance's current IP
+}
+
+// StaleMappings finds installed forwards pointing at an IP no running configured
+// instance has, and re-resolves each by matching its port back to the first running
+// instance that configures it. Ports with a held claimant are skipped, since that
+// instance's IP is unknown this pass. Docker Desktop's forwards aren't stale, just not ours.
+func (snap *ReconcileSnapshot) StaleMappings() []StaleMapping {
+	knownIPs := make(map[string]bool)
+	for name, ip := range snap.InstanceIPs {
+		knownIPs[ip] = true
+		for _, candidate := range snap.CandidateIPs[name] {
+			knownIPs[candidate] = true
+		}
+	}
+
+	var stale []StaleMapping
+	for _, port := range sortedMappingPorts(snap.CurrentMappings) {
+		current := snap.CurrentMappings[port]
+		if knownIPs[current.TargetIP] || !snap.Config.configuresExternalPort(port) || isDockerDesktopIP(current.TargetIP) {
+			continue
+		}
+
+		entry := StaleMapping{Port: port, TargetIP: current.TargetIP}
+		held := false
+		for _, instance := range snap.Config.Instances {
+			if !instanceConfiguresPort(instance, port) {
+				continue
+			}
+			if _, isHeld := snap.Held[instance.Name]; isHeld {
+				held = true
+				break
+			}
+			if ip, running := snap.InstanceIPs[instance.Name]; running && entry.Instance == "" {
+				entry.Instance, entry.NewIP = instance.Name, ip
+			}
+		}
+		if !held {
+			stale = append(stale, entry)
+		}
+	}
+	return stale
+}
+
+// sortedMappingPorts returns the ports of a mapping table in ascending order
+func sortedMappingPorts(mappings map[int]PortMapping) []int {
+	ports := make([]int, 0, len(mappings))
+	for port := range mappings {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// instanceConfiguresPort returns true if the instance forwards the given external port
+func instanceConfiguresPort(instance Instance, port int) bool {
+	for _, configPort := range instance.Ports {
+		if configPort.ExternalPortEffective() == port {
+			return true
+		}
+	}
+	return false
+}
+
+// describe explains a stale mapping and how it will be corrected
+func (m StaleMapping) describe() string {
+	if m.Instance == "" {
+		return fmt.Sprintf("port %d -> %s matches no running instance, no running instance configures it (will be removed)", m.Port, m.TargetIP)
+	}
+	return fmt.Sprintf("port %d -> %s matches no running instance, re-resolved to %s at %s (will be updated)", m.Port, m.TargetIP, m.Instance, m.NewIP)
+}
+
+// checkStaleMappings reports stale forwards on the live system for --validate
+func checkStaleMappings(config *Config, strict bool) int {
+	fmt.Println("\nℹ️  Checking for stale port mappings...")
+	service := &ServiceState{config: config, strict: strict}
+	snapshot, err := service.captureSnapshot(config.ManagedConfig())
+	if err != nil {
+		fmt.Printf("⚠️  Unable to check port mappings: %v\n", err)
+		return 2
+	}
+
+	stale := snapshot.StaleMappings()
+	if len(stale) == 0 {
+		fmt.Println("✅ Every managed port mapping targets a running instance")
+		return 0
+	}
+	for _, mapping := range stale {
+		fmt.Printf("⚠️  Stale mapping: %s\n", mapping.describe())
+	}
+	fmt.Println("    → The running service corrects these on its next check")
+	return 2
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxStartupDelaySeconds bounds startup_delay_seconds
+const maxStartupDelaySeconds = 3600
+
+// applyStartupDelays holds back instances whose startup_delay_seconds hasn't elapsed
+// since they were first seen running. Held instances keep any existing forwards but
+// get no new ones; the wait never blocks the loop, later passes just pick them up.
+func (s *ServiceState) applyStartupDelays(snapshot *ReconcileSnapshot, now time.Time) {
+	if s.firstSeen == nil {
+		s.firstSeen = make(map[string]time.Time)
+	}
+
+	// Forget instances that stopped, so their next start is delayed again
+	for name := range s.firstSeen {
+		_, running := snapshot.InstanceIPs[name]
+		_, held := snapshot.Held[name]
+		if !running && !held {
+			delete(s.firstSeen, name)
+		}
+	}
+
+	for _, instance := range snapshot.Config.Instances {
+		if _, running := snapshot.InstanceIPs[instance.Name]; !running {
+			continue
+		}
+
+		firstSeen, seen := s.firstSeen[instance.Name]
+		if !seen {
+			firstSeen = now
+			s.firstSeen[instance.Name] = now
+		}
+
+		delay := time.Duration(instance.StartupDelaySeconds) * time.Second
+		remaining := firstSeen.Add(delay).Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+
+		if !seen {
+			s.logf("Instance %s started, deferring forwarding for %v (startup_delay_seconds)", instance.Name, delay)
+		}
+		if snapshot.Held == nil {
+			snapshot.Held = make(map[string]string)
+		}
+		snapshot.Held[instance.Name] = fmt.Sprintf("in its startup delay (%v left)", remaining.Round(time.Second))
+		delete(snapshot.InstanceIPs, instance.Name)
+	}
+}
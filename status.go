@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StatusReport is the --status snapshot: every configured instance with its IP and the
+// state of each of its ports, plus live forwards no running instance should have
+type StatusReport struct {
+	ConfigFile string           `json:"config_file"`
+	InSync     bool             `json:"in_sync"` // no port is "missing" or "wrong" and nothing is unexpected
+	Instances  []StatusInstance `json:"instances"`
+	Unexpected []StatusPort     `json:"unexpected"`
+}
+
+// StatusInstance is one configured instance in a StatusReport
+type StatusInstance struct {
+	Name    string       `json:"name"`
+	Running bool         `json:"running"`
+	IP      string       `json:"ip,omitempty"`
+	Held    string       `json:"held,omitempty"` // why a running instance isn't being forwarded
+	Ports   []StatusPort `json:"ports"`
+}
+
+// StatusPort is one port in a StatusReport. State is one of:
+//
+//	active     forwarded as configured
+//	missing    should be forwarded, but isn't
+//	wrong      forwarded, but to the wrong target
+//	stopped    the instance isn't running (or is held)
+//	superseded another instance has the port, or it isn't forwarded for a reason
+//	           --explain gives (e.g. blocked by a firewall rule with --strict)
+//	relayed    a udp port, relayed by the running service rather than netsh
+//	disabled   switched off with "enabled": false
+//	unexpected (Unexpected only) forwarded, but no running instance should have it
+type StatusPort struct {
+	Port         int    `json:"port"`
+	InternalPort int    `json:"internal_port,omitempty"`
+	Protocol     string `json:"protocol"`
+	State        string `json:"state"`
+	Desired      string `json:"desired,omitempty"` // ip:port the config forwards to
+	Actual       string `json:"actual,omitempty"`  // ip:port currently forwarded to
+}
+
+// Status describes the snapshot for --status
+func (snap *ReconcileSnapshot) Status(configFile string) *StatusReport {
+	desiredMappings, _ := snap.DesiredMappings()
+	report := &StatusReport{ConfigFile: configFile, InSync: true, Instances: []StatusInstance{}, Unexpected: []StatusPort{}}
+
+	for _, instance := range snap.Config.Instances {
+		ip, running := snap.InstanceIPs[instance.Name]
+		held, isHeld := snap.Held[instance.Name]
+		status := StatusInstance{Name: instance.Name, Running: running || isHeld, IP: ip, Held: held, Ports: []StatusPort{}}
+
+		for _, port := range instance.Ports {
+			externalPort := port.ExternalPortEffective()
+			entry := StatusPort{Port: externalPort, InternalPort: port.InternalPortEffective(), Protocol: port.ProtocolEffective()}
+			if current, exists := snap.CurrentMappings[externalPort]; exists && !port.IsUDP() {
+				entry.Actual = fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort)
+			}
+
+			desired, forwarded := desiredMappings[externalPort]
+			switch {
+			case !port.IsEnabled():
+				entry.State = "disabled"
+			case !running:
+				entry.State = "stopped"
+			case port.IsUDP():
+				entry.State = "relayed"
+				entry.Desired = fmt.Sprintf("%s:%d", ip, entry.InternalPort)
+			case !forwarded || desired.Instance != instance.Name:
+				entry.State = "superseded"
+			default:
+				entry.Desired = fmt.Sprintf("%s:%d", desired.TargetIP, desired.InternalPort)
+				current, exists := snap.CurrentMappings[externalPort]
+				switch {
+				case !exists:
+					entry.State = "missing"
+				case mappingNeedsUpdate(current, desired):
+					entry.State = "wrong"
+				default:
+					entry.State = "active"
+				}
+			}
+			if entry.State == "missing" || entry.State == "wrong" {
+				report.InSync = false
+			}
+			status.Ports = append(status.Ports, entry)
+		}
+		report.Instances = append(report.Instances, status)
+	}
+
+	ports := make([]int, 0, len(snap.CurrentMappings))
+	for port := range snap.CurrentMappings {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		// Like drift, forwards additive_only keeps aren't unexpected
+		if snap.Config.AdditiveOnly || !snap.ShouldRemove(port, desiredMappings) {
+			continue
+		}
+		current := snap.CurrentMappings[port]
+		report.Unexpected = append(report.Unexpected, StatusPort{Port: port, InternalPort: current.InternalPort, Protocol: "tcp",
+			State: "unexpected", Actual: fmt.Sprintf("%s:%d", current.TargetIP, current.InternalPort)})
+		report.InSync = false
+	}
+
+	return report
+}
+
+// runStatus implements --status: print a JSON StatusReport of the live forwards against
+// the config, for scripts and monitoring. Exit codes: 0=ok (in sync or not), 1=error
+func runStatus(opts *CommandLineOptions) int {
+	config, err := loadConfigFile(opts.ConfigFile, opts.AllowComments)
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", opts.ConfigFile, err)
+		return 1
+	}
+
+	service := &ServiceState{config: config, configFile: opts.ConfigFile, strict: opts.Strict}
+	snapshot, err := service.captureSnapshot(config.ManagedConfig().TaggedConfig(opts.Tags))
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	data, err := marshalJSON(snapshot.Status(opts.ConfigFile), true)
+	if err != nil {
+		fmt.Printf("❌ Failed to encode status: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities (RFC 5424 section 6.2.1)
+const (
+	syslogSeverityError   = 3
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+
+	syslogFacilityDaemon = 3
+	syslogAppName        = "wsl2-port-forwarder"
+	syslogQueueSize      = 256
+)
+
+// SyslogWriter forwards log lines to a remote collector in RFC 5424 format. Writes
+// never block: lines are queued and sent by a background goroutine, and dropped if
+// the queue is full or the collector is unreachable, so reconcile is never held up.
+type SyslogWriter struct {
+	network  string // "udp" or "tcp"
+	address  string
+	hostname string
+	queue    chan string
+	done     chan struct{}
+	once     sync.Once
+}
+
+// parseSyslogAddress splits "udp://host:514", "tcp://host:601" or "host:514" (UDP)
+func parseSyslogAddress(addr string) (string, string, error) {
+	network, address := "udp", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, address = strings.ToLower(addr[:i]), addr[i+3:]
+	}
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("unsupported syslog protocol %q (must be udp or tcp)", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %v", address, err)
+	}
+	return network, address, nil
+}
+
+// NewSyslogWriter starts a writer for the given syslog_address
+func NewSyslogWriter(addr string) (*SyslogWriter, error) {
+	network, address, err := parseSyslogAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	w := &SyslogWriter{
+		network:  network,
+		address:  address,
+		hostname: hostname,
+		queue:    make(chan string, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write implements io.Writer for use with log.SetOutput; each call is one log line
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	select {
+	case w.queue <- formatSyslogMessage(time.Now(), w.hostname, os.Getpid(), msg):
+	default:
+		// Queue full (collector slow or down) - drop rather than block
+	}
+	return len(p), nil
+}
+
+// Close stops the background sender
+func (w *SyslogWriter) Close() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *SyslogWriter) run() {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case line := <-w.queue:
+			if conn == nil {
+				c, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+				if err != nil {
+					continue // collector unreachable; drop and retry on the next line
+				}
+				conn = c
+			}
+
+			frame := line
+			if w.network == "tcp" {
+				// RFC 6587 octet-counting framing
+				frame = fmt.Sprintf("%d %s", len(line), line)
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(conn, frame); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// syslogSeverity maps our log message prefixes onto syslog severities
+func syslogSeverity(msg string) int {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(lower, "error"), strings.HasPrefix(lower, "fatal"):
+		return syslogSeverityError
+	case strings.HasPrefix(lower, "warning"):
+		return syslogSeverityWarning
+	default:
+		return syslogSeverityInfo
+	}
+}
+
+// stripLogTimestamp strips the standard log package date/time prefix if present
+func stripLogTimestamp(msg string) string {
+	if len(msg) > 20 && msg[4] == '/' && msg[7] == '/' && msg[10] == ' ' && msg[19] == ' ' {
+		return msg[20:]
+	}
+	return msg
+}
+
+// formatSyslogMessage renders an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func formatSyslogMessage(now time.Time, hostname string, pid int, msg string) string {
+	msg = stripLogTimestamp(msg)
+	pri := syslogFacilityDaemon*8 + syslogSeverity(msg)
+	return fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, now.UTC().Format(time.RFC3339Nano), hostname, syslogAppName, pid, msg)
+}
+
+// configureSyslog (re)points remote logging at the configured syslog_address,
+// keeping local log output unchanged
+func (s *ServiceState) configureSyslog(addr string) {
+	if addr == s.syslogAddress {
+		return
+	}
+
+	if s.syslogWriter != nil {
+		s.syslogWriter.Close()
+		s.syslogWriter = nil
+	}
+	s.syslogAddress = addr
+	s.applyLogOutput()
+
+	if addr == "" {
+		return
+	}
+
+	writer, err := NewSyslogWriter(addr)
+	if err != nil {
+		log.Printf("Warning: Remote syslog disabled: %v", err)
+		return
+	}
+	s.syslogWriter = writer
+	s.applyLogOutput()
+	log.Printf("Forwarding logs to syslog collector %s", addr)
+}
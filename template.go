@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// configVars holds --var NAME=value definitions for ${NAME} references in configs
+// with expand_env. They take precedence over environment variables of the same name.
+var configVars = map[string]string{}
+
+// configVarPattern matches ${NAME} references, and $${ which escapes a literal ${
+var configVarPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configVarName matches a valid variable name
+var configVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandConfigStrings substitutes ${NAME} in every string value of a parsed config
+// (expand_env), from vars and then the environment. Working on parsed values leaves
+// the file's syntax and comments alone, so a value may contain quotes or backslashes.
+// Every undefined variable is reported at once.
+func expandConfigStrings(config *Config, vars map[string]string, lookupEnv func(string) (string, bool)) error {
+	missing := make(map[string]bool)
+	expandStringValues(reflect.ValueOf(config).Elem(), func(value string) string {
+		return configVarPattern.ReplaceAllStringFunc(value, func(match string) string {
+			if match == "$${" {
+				return "${"
+			}
+			name := match[2 : len(match)-1]
+			if value, ok := vars[name]; ok {
+				return value
+			}
+			if value, ok := lookupEnv(name); ok {
+				return value
+			}
+			missing[name] = true
+			return match
+		})
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, "${"+name+"}")
+		}
+		sort.Strings(names)
+		return fmt.Errorf("undefined config variables %s (set them in the environment or with --var NAME=value)", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// expandStringValues applies expand to every string reachable from value: fields,
+// list entries and pointed-to values
+func expandStringValues(value reflect.Value, expand func(string) string) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(expand(value.String()))
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() {
+				expandStringValues(value.Field(i), expand)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			expandStringValues(value.Index(i), expand)
+		}
+	case reflect.Pointer:
+		if !value.IsNil() {
+			expandStringValues(value.Elem(), expand)
+		}
+	}
+}
+
+// extractConfigVars removes --var NAME=value (or --var=NAME=value) options from the
+// command line, so every command accepts them, and returns the remaining arguments
+func extractConfigVars(args []string) ([]string, map[string]string, error) {
+	vars := make(map[string]string)
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		definition, isVar := strings.CutPrefix(args[i], "--var=")
+		if !isVar && args[i] == "--var" {
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--var requires NAME=value")
+			}
+			i++
+			definition, isVar = args[i], true
+		}
+		if !isVar {
+			rest = append(rest, args[i])
+			continue
+		}
+
+		name, value, ok := strings.Cut(definition, "=")
+		if !ok || !configVarName.MatchString(name) {
+			return nil, nil, fmt.Errorf("Invalid --var %q (expected NAME=value)", definition)
+		}
+		vars[name] = value
+	}
+	return rest, vars, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+// maxEmptyReadingGrace bounds empty_reading_grace
+const maxEmptyReadingGrace = 100
+
+// isTransientEmptyReading guards against `wsl --list --running` briefly reporting no
+// distros at all (e.g. during `wsl --shutdown` or a WSL service restart). After a
+// reading with running distros, an empty one must persist for more than
+// empty_reading_grace passes before forwards are torn down; until then the pass is
+// skipped so mappings don't flap when the instances reappear seconds later.
+func (s *ServiceState) isTransientEmptyReading(snapshot *ReconcileSnapshot, grace int) bool {
+	if snapshot.RunningDistros > 0 {
+		s.emptyReadings = 0
+		s.sawRunning = true
+		return false
+	}
+	if !s.sawRunning || grace == 0 {
+		return false
+	}
+
+	s.emptyReadings++
+	if s.emptyReadings <= grace {
+		s.logf("Warning: wsl reported no running distros (%d of %d allowed readings), suspected transient; keeping existing forwards",
+			s.emptyReadings, grace)
+		say("⏳ No running distros reported, waiting to confirm before removing forwards")
+		return true
+	}
+
+	s.logf("No running distros for %d consecutive readings, removing forwards", s.emptyReadings)
+	s.emptyReadings = 0
+	s.sawRunning = false
+	return false
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpSessionIdleTimeout is how long a client's relay session lives without traffic
+const udpSessionIdleTimeout = 2 * time.Minute
+
+// udpRelayBufferSize fits any UDP datagram
+const udpRelayBufferSize = 64 * 1024
+
+// udpMaxSessions caps the sessions of one relay. Every session holds a socket and a
+// goroutine for udpSessionIdleTimeout, so without a cap a spray of (spoofed) source
+// addresses would exhaust file descriptors; the least recently active session makes
+// room for a new client instead.
+const udpMaxSessions = 256
+
+// UDPRelay forwards UDP datagrams from a host port to an instance, since netsh
+// portproxy only handles TCP. Each client gets its own upstream socket so replies
+// find their way back, and sessions idle for udpSessionIdleTimeout are closed.
+type UDPRelay struct {
+	mapping     PortMapping
+	listener    *net.UDPConn
+	target      *net.UDPAddr
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession // client address -> session
+	closed   bool
+}
+
+// udpSession is one client's upstream socket
+type udpSession struct {
+	upstream   *net.UDPConn
+	lastActive time.Time // last datagram from the client
+}
+
+// startUDPRelay binds the mapping's listen address and external port and starts relaying
+// to its target. It is a variable so tests can run without binding ports.
+var startUDPRelay = func(mapping PortMapping) (*UDPRelay, error) {
+	listenAddress := mapping.ListenAddress
+	if listenAddress == "" {
+		listenAddress = defaultListenAddress
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(listenAddress, strconv.Itoa(mapping.ExternalPort)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %v", err)
+	}
+	target, err := net.ResolveUDPAddr("udp", net.JoinHostPort(mapping.TargetIP, strconv.Itoa(mapping.InternalPort)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	}
+	listener, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP port %d: %v", mapping.ExternalPort, err)
+	}
+
+	relay := &UDPRelay{mapping: mapping, listener: listener, target: target, maxSessions: udpMaxSessions, sessions: make(map[string]*udpSession)}
+	go relay.serve()
+	return relay, nil
+}
+
+// serve reads client datagrams until the relay is closed
+func (r *UDPRelay) serve() {
+	buf := make([]byte, udpRelayBufferSize)
+	for {
+		n, client, err := r.listener.ReadFromUDP(buf)
+		if err != nil {
+			if r.isClosed() {
+				return
+			}
+			continue
+		}
+		upstream, err := r.session(client)
+		if err != nil {
+			continue
+		}
+		upstream.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+		upstream.Write(buf[:n])
+	}
+}
+
+// session returns the upstream socket for a client, dialing a new one on first contact
+// and evicting the least recently active session if the relay is at its cap
+func (r *UDPRelay) session(client *net.UDPAddr) (*net.UDPConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	key := client.String()
+	if session, exists := r.sessions[key]; exists {
+		session.lastActive = time.Now()
+		return session.upstream, nil
+	}
+	if len(r.sessions) >= r.maxSessions {
+		r.evictIdlestSession()
+	}
+	upstream, err := net.DialUDP("udp", nil, r.target)
+	if err != nil {
+		return nil, err
+	}
+	r.sessions[key] = &udpSession{upstream: upstream, lastActive: time.Now()}
+	go r.reply(key, client, upstream)
+	return upstream, nil
+}
+
+// evictIdlestSession closes the least recently active session; r.mu must be held
+func (r *UDPRelay) evictIdlestSession() {
+	var idlest string
+	for key, session := range r.sessions {
+		if idlest == "" || session.lastActive.Before(r.sessions[idlest].lastActive) {
+			idlest = key
+		}
+	}
+	if idlest != "" {
+		r.sessions[idlest].upstream.Close()
+		delete(r.sessions, idlest)
+	}
+}
+
+// reply copies the instance's responses back to the client until the session idles out
+func (r *UDPRelay) reply(key string, client *net.UDPAddr, upstream *net.UDPConn) {
+	defer func() {
+		r.mu.Lock()
+		if session, exists := r.sessions[key]; exists && session.upstream == upstream {
+			delete(r.sessions, key)
+		}
+		r.mu.Unlock()
+		upstream.Close()
+	}()
+
+	buf := make([]byte, udpRelayBufferSize)
+	upstream.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+	for {
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		upstream.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+		if _, err := r.listener.WriteToUDP(buf[:n], client); err != nil && r.isClosed() {
+			return
+		}
+	}
+}
+
+func (r *UDPRelay) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Close stops the relay and all of its sessions
+func (r *UDPRelay) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	for _, session := range r.sessions {
+		session.upstream.Close()
+	}
+	r.mu.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	return r.listener.Close()
+}
+
+// udpRelayNeedsRestart returns true if a running relay no longer matches the desired
+// forward; a relay can't be retargeted in place
+func udpRelayNeedsRestart(current, desired PortMapping) bool {
+	return current.TargetIP != desired.TargetIP ||
+		current.InternalPort != desired.InternalPort ||
+		!sameListenAddress(current.ListenAddress, desired.ListenAddress)
+}
+
+// reconcileUDPRelays starts, restarts and stops the in-process relays for udp ports.
+// Relays live as long as the service does, so they go away when it stops.
+func (s *ServiceState) reconcileUDPRelays(desired map[int]PortMapping) ReconcileResult {
+	if s.udpRelays == nil {
+		s.udpRelays = make(map[int]*UDPRelay)
+	}
+	var result ReconcileResult
+
+	running := make([]int, 0, len(s.udpRelays))
+	for port := range s.udpRelays {
+		running = append(running, port)
+	}
+	sort.Ints(running)
+	for _, port := range running {
+		relay := s.udpRelays[port]
+		if want, forwarding := desired[port]; forwarding && !udpRelayNeedsRestart(relay.mapping, want) {
+			continue
+		}
+		relay.Close()
+		delete(s.udpRelays, port)
+		consoleEvent("info", "udp_relay_stopped", EventFields{Port: port, Instance: relay.mapping.Instance, TargetIP: relay.mapping.TargetIP}, "  Stopped UDP relay for port %d -> %s:%d", port, relay.mapping.TargetIP, relay.mapping.InternalPort)
+		result.Changed = true
+	}
+
+	ports := make([]int, 0, len(desired))
+	for port := range desired {
+		if _, running := s.udpRelays[port]; !running {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		mapping := desired[port]
+		say("  Adding UDP port %d -> %d: None -> %s:%d%s", port, mapping.InternalPort, mapping.TargetIP, mapping.InternalPort, s.dryRunTag())
+		if !s.dryRun {
+			relay, err := startUDPRelay(mapping)
+			if err != nil {
+				s.logf("Error starting UDP relay for port %d: %v", port, err)
+				result.Failures++
+				continue
+			}
+			s.udpRelays[port] = relay
+			consoleEvent("info", "udp_relay_started", EventFields{Port: port, Instance: mapping.Instance, TargetIP: mapping.TargetIP}, "    ✓ UDP port %d->%d now relayed to %s:%d", port, mapping.InternalPort, mapping.TargetIP, mapping.InternalPort)
+			result.Changed = true
+		}
+
+		if err := s.handleFirewallRule(mapping); err != nil {
+			s.logf("Warning: UDP port %d is relayed but its firewall rule is missing: %v", port, err)
+			result.Failures++
+		}
+	}
+
+	return result
+}
+
+// stopUDPRelays closes every relay, e.g. when forwarding is drained
+func (s *ServiceState) stopUDPRelays() {
+	for port, relay := range s.udpRelays {
+		relay.Close()
+		delete(s.udpRelays, port)
+	}
+}
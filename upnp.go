@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UPnP IGD discovery and control. Only the three actions the forwarder needs are
+// implemented, with the standard library, to keep the single-executable build.
+const (
+	upnpDiscoveryAddress = "239.255.255.250:1900"
+	upnpDiscoveryTimeout = 3 * time.Second
+	upnpRequestTimeout   = 5 * time.Second
+	upnpSearchTarget     = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+// upnpGateway is the WAN connection service of the router's Internet Gateway Device
+type upnpGateway struct {
+	controlURL  string
+	serviceType string // WANIPConnection or WANPPPConnection
+}
+
+// upnpDevice is the part of an IGD device description the forwarder reads
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// parseSSDPLocation returns the LOCATION header of an SSDP search response
+func parseSSDPLocation(response []byte) (string, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(response)))
+	if _, err := reader.ReadLine(); err != nil {
+		return "", fmt.Errorf("empty SSDP response")
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", fmt.Errorf("malformed SSDP response: %v", err)
+	}
+	location := header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("SSDP response has no LOCATION")
+	}
+	return location, nil
+}
+
+// findWANConnection finds the WAN connection service in a device description and
+// resolves its control URL against the description's location
+func findWANConnection(description []byte, location string) (*upnpGateway, error) {
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(description, &root); err != nil {
+		return nil, fmt.Errorf("invalid device description: %v", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device location %q: %v", location, err)
+	}
+	if root.URLBase != "" {
+		if parsed, err := url.Parse(root.URLBase); err == nil {
+			base = parsed
+		}
+	}
+
+	pending := []upnpDevice{root.Device}
+	for len(pending) > 0 {
+		device := pending[0]
+		pending = append(pending[1:], device.Devices...)
+		for _, service := range device.Services {
+			if !strings.Contains(service.ServiceType, ":WANIPConnection:") && !strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+				continue
+			}
+			control, err := base.Parse(strings.TrimSpace(service.ControlURL))
+			if err != nil {
+				return nil, fmt.Errorf("invalid control URL %q: %v", service.ControlURL, err)
+			}
+			return &upnpGateway{controlURL: control.String(), serviceType: service.ServiceType}, nil
+		}
+	}
+	return nil, fmt.Errorf("gateway has no WAN connection service")
+}
+
+// discoverUPnPGateway finds the router's IGD with an SSDP search; overridable in tests
+var discoverUPnPGateway = func() (*upnpGateway, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open discovery socket: %v", err)
+	}
+	defer conn.Close()
+
+	target, err := net.ResolveUDPAddr("udp4", upnpDiscoveryAddress)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + upnpDiscoveryAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), target); err != nil {
+		return nil, fmt.Errorf("failed to send discovery request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(upnpDiscoveryTimeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("no UPnP gateway answered within %v", upnpDiscoveryTimeout)
+		}
+		location, err := parseSSDPLocation(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		client := &http.Client{Timeout: upnpRequestTimeout}
+		resp, err := client.Get(location)
+		if err != nil {
+			continue
+		}
+		description, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if gateway, err := findWANConnection(description, location); err == nil {
+			return gateway, nil
+		}
+	}
+}
+
+// soapRequest invokes an action on the gateway's WAN connection service
+func (g *upnpGateway) soapRequest(action string, arguments [][2]string) ([]byte, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, g.serviceType)
+	for _, argument := range arguments {
+		fmt.Fprintf(&body, "<%s>", argument[0])
+		xml.EscapeText(&body, []byte(argument[1]))
+		fmt.Fprintf(&body, "</%s>", argument[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", g.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.serviceType, action))
+
+	client := &http.Client{Timeout: upnpRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s response unreadable: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s rejected by gateway: %s %s", action, resp.Status, soapFaultDescription(response))
+	}
+	return response, nil
+}
+
+// soapFaultDescription extracts the UPnP error description from a SOAP fault, if any
+func soapFaultDescription(response []byte) string {
+	var fault struct {
+		Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+	if xml.Unmarshal(response, &fault) != nil || fault.Description == "" {
+		return ""
+	}
+	return fmt.Sprintf("(%d %s)", fault.Code, fault.Description)
+}
+
+// addPortMapping asks the router to forward a TCP port to the host. The lease is
+// permanent; the mapping is removed when the forward is torn down.
+func (g *upnpGateway) addPortMapping(port int, hostIP string, description string) error {
+	_, err := g.soapRequest("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(port)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", fmt.Sprint(port)},
+		{"NewInternalClient", hostIP},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", description},
+		{"NewLeaseDuration", "0"},
+	})
+	return err
+}
+
+// deletePortMapping removes the router's TCP forward for a port
+func (g *upnpGateway) deletePortMapping(port int) error {
+	_, err := g.soapRequest("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(port)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// externalIPAddress returns the router's public address
+func (g *upnpGateway) externalIPAddress() (string, error) {
+	response, err := g.soapRequest("GetExternalIPAddress", nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Address string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(response, &result); err != nil || result.Address == "" {
+		return "", fmt.Errorf("gateway returned no external IP")
+	}
+	return result.Address, nil
+}
+
+// upnpHostIP is the LAN address the router should forward a port to
+func upnpHostIP(mapping PortMapping) (string, error) {
+	if mapping.ListenAddress != "" && !sameListenAddress(mapping.ListenAddress, defaultListenAddress) {
+		return mapping.ListenAddress, nil
+	}
+	return defaultRouteIPv4()
+}
+
+// gateway returns the cached UPnP gateway, discovering it if needed
+func (s *ServiceState) gateway() (*upnpGateway, error) {
+	if s.upnpGateway != nil {
+		return s.upnpGateway, nil
+	}
+	gateway, err := discoverUPnPGateway()
+	if err != nil {
+		return nil, err
+	}
+	s.upnpGateway = gateway
+	return gateway, nil
+}
+
+// reconcileUPnPMappings keeps router port mappings in line with the desired forwards
+// that have upnp set. This is best-effort: failures are logged and retried next check,
+// and never affect the local forward.
+func (s *ServiceState) reconcileUPnPMappings(desiredMappings map[int]PortMapping) {
+	if s.upnpMappings == nil {
+		s.upnpMappings = make(map[int]string)
+	}
+
+	ports := make([]int, 0, len(desiredMappings))
+	for port, desired := range desiredMappings {
+		if desired.UPnP {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		hostIP, err := upnpHostIP(desiredMappings[port])
+		if err != nil {
+			s.logf("Warning: UPnP mapping for port %d skipped, no LAN address: %v", port, err)
+			continue
+		}
+		if s.upnpMappings[port] == hostIP {
+			continue
+		}
+		if s.dryRun {
+			consoleEvent("info", "upnp_mapped", EventFields{Port: port, TargetIP: hostIP}, "  🌐 Port %d would be forwarded by the router to %s:%d (dry-run)", port, hostIP, port)
+			continue
+		}
+		gateway, err := s.gateway()
+		if err != nil {
+			s.logf("Warning: UPnP mapping for port %d not created (best-effort): %v", port, err)
+			continue
+		}
+		description := fmt.Sprintf("WSL2 %s port %d", desiredMappings[port].Instance, port)
+		if err := gateway.addPortMapping(port, hostIP, description); err != nil {
+			s.logf("Warning: UPnP mapping for port %d not created (best-effort): %v", port, err)
+			s.upnpGateway = nil // rediscover next time, the router may have changed
+			continue
+		}
+		s.upnpMappings[port] = hostIP
+		if externalIP, err := gateway.externalIPAddress(); err == nil {
+			s.logf("UPnP: router now forwards %s:%d to %s:%d", externalIP, port, hostIP, port)
+			say("  🌐 Port %d forwarded by the router: %s:%d (from inside the LAN use %s:%d)", port, externalIP, port, hostIP, port)
+		} else {
+			s.logf("UPnP: router now forwards port %d to %s:%d", port, hostIP, port)
+			say("  🌐 Port %d forwarded by the router to %s:%d", port, hostIP, port)
+		}
+	}
+
+	for port := range s.upnpMappings {
+		if desired, forwarding := desiredMappings[port]; forwarding && desired.UPnP {
+			continue
+		}
+		gateway, err := s.gateway()
+		if err == nil {
+			err = gateway.deletePortMapping(port)
+		}
+		if err != nil {
+			s.logf("Warning: UPnP mapping for port %d not removed (best-effort): %v", port, err)
+			continue
+		}
+		delete(s.upnpMappings, port)
+		s.logf("UPnP: router mapping for port %d removed", port)
+		say("  🌐 Port %d router mapping removed", port)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogSources are the levels the registered event source may log
+const eventLogSources = eventlog.Error | eventlog.Warning | eventlog.Info
+
+// openEventLog points eventLogSink at the Application log under the service's event
+// source and returns a function that closes it again
+func openEventLog() (func(), error) {
+	l, err := eventlog.Open(windowsServiceName)
+	if err != nil {
+		return nil, err
+	}
+	eventLogSink = l
+	return func() {
+		eventLogSink = nil
+		l.Close()
+	}, nil
+}
+
+// registerEventSource registers the service's event source, so Event Viewer shows
+// its messages without a "description cannot be found" note. EventCreate.exe serves
+// as the message file, which is why event IDs stay within 1-1000.
+func registerEventSource() error {
+	err := eventlog.InstallAsEventCreate(windowsServiceName, eventLogSources)
+	if err != nil && strings.Contains(err.Error(), "registry key already exists") {
+		return nil
+	}
+	return err
+}
+
+// deregisterEventSource removes the service's event source
+func deregisterEventSource() error {
+	return eventlog.Remove(windowsServiceName)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EventLogSink is where events for the Windows Event Log go; *eventlog.Log from
+// golang.org/x/sys/windows/svc/eventlog implements it
+type EventLogSink interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Error(eid uint32, msg string) error
+}
+
+// eventLogSink receives the important events when --eventlog is given or the service
+// runs under the SCM; nil otherwise
+var eventLogSink EventLogSink
+
+// Event IDs of warnings and errors logged without an ID of their own
+const (
+	eventIDWarning = 300
+	eventIDError   = 400
+)
+
+// eventLogEventIDs are the events written to the Event Log whatever their level, with
+// their event IDs. Warnings and errors are written too, see eventLogWriter.
+var eventLogEventIDs = map[string]uint32{
+	"service_start":         1,
+	"service_stop":          2,
+	"fallback_config":       3,
+	"mapping_added":         100,
+	"mapping_updated":       101,
+	"mapping_removed":       102,
+	"firewall_rule_created": 200,
+	"firewall_rule_removed": 201,
+}
+
+// reportEvent writes an event to the Event Log, if it is in use
+func reportEvent(level, event, message string) {
+	if eventLogSink == nil || message == "" {
+		return
+	}
+	id, ok := eventLogEventIDs[event]
+	switch level {
+	case "error":
+		if !ok {
+			id = eventIDError
+		}
+		eventLogSink.Error(id, message)
+	case "warning":
+		if !ok {
+			id = eventIDWarning
+		}
+		eventLogSink.Warning(id, message)
+	default:
+		eventLogSink.Info(id, message)
+	}
+}
+
+// eventLogWriter is a standard logger output passing its warnings and errors on to
+// the Event Log. Events consoleEvent already reported are skipped.
+type eventLogWriter struct{}
+
+func (eventLogWriter) Write(p []byte) (int, error) {
+	line := stripLogTimestamp(strings.TrimRight(string(p), "\r\n"))
+
+	// With --log-format=json, lines are the entries jsonLogWriter encoded
+	level, event, message := logLevel(line), "log", line
+	var entry logEntry
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &entry) == nil && entry.Event != "" {
+		level, event, message = entry.Level, entry.Event, entry.Message
+		if entry.Repeated > 0 {
+			message = fmt.Sprintf("%s (repeated %d times)", message, entry.Repeated)
+		}
+	}
+
+	if _, reported := eventLogEventIDs[event]; !reported && level != "info" {
+		reportEvent(level, event, message)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// openEventLog fails off Windows, which has no Event Log
+func openEventLog() (func(), error) {
+	return nil, errors.New("the Windows Event Log is only available on Windows")
+}
@@ -0,0 +1,185 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout bounds how long --uninstall-service waits for a running service to stop
+const serviceStopTimeout = 30 * time.Second
+
+// installWindowsService registers the executable with the SCM as an automatic-start
+// service running the --install-service command line with --run-service instead
+func installWindowsService(opts *CommandLineOptions, args []string) int {
+	if !isRunningAsAdmin() {
+		fmt.Println("❌ --install-service requires Administrator privileges")
+		return 1
+	}
+	if _, err := loadConfigFile(opts.ConfigFile, opts.AllowComments); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("❌ Failed to find the executable path: %v\n", err)
+		return 1
+	}
+	serviceArgs, err := serviceCommandLine(args, opts.ConfigFile, configVars)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve config file path: %v\n", err)
+		return 1
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("❌ Failed to connect to the service manager: %v\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	if existing, err := m.OpenService(windowsServiceName); err == nil {
+		existing.Close()
+		fmt.Printf("❌ Service %s already exists; run --uninstall-service first\n", windowsServiceName)
+		return 1
+	}
+
+	s, err := m.CreateService(windowsServiceName, exe, mgr.Config{
+		DisplayName: "WSL2 Port Forwarder",
+		Description: "Forwards Windows ports to WSL2 instances as they start and stop",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs...)
+	if err != nil {
+		fmt.Printf("❌ Failed to create service %s: %v\n", windowsServiceName, err)
+		return 1
+	}
+	defer s.Close()
+
+	// Come back after a crash, as the NSSM wrapper did
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 24*60*60); err != nil {
+		fmt.Printf("⚠️  Failed to set restart-on-failure for %s: %v\n", windowsServiceName, err)
+	}
+
+	if err := registerEventSource(); err != nil {
+		fmt.Printf("⚠️  Failed to register the %s event source: %v\n", windowsServiceName, err)
+	}
+
+	fmt.Printf("✅ Service %s installed: %s %v\n", windowsServiceName, exe, serviceArgs)
+	fmt.Printf("💡 Start it with: sc start %s\n", windowsServiceName)
+	return 0
+}
+
+// uninstallWindowsService stops the service if it is running and removes it from the SCM
+func uninstallWindowsService() int {
+	if !isRunningAsAdmin() {
+		fmt.Println("❌ --uninstall-service requires Administrator privileges")
+		return 1
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Printf("❌ Failed to connect to the service manager: %v\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		fmt.Printf("❌ Service %s is not installed\n", windowsServiceName)
+		return 1
+	}
+	defer s.Close()
+
+	if status, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+		if status.State != svc.Stopped {
+			fmt.Printf("⚠️  Service %s did not stop within %s; it is removed once it does\n", windowsServiceName, serviceStopTimeout)
+		}
+	} else if err != windows.ERROR_SERVICE_NOT_ACTIVE {
+		fmt.Printf("⚠️  Failed to stop service %s: %v\n", windowsServiceName, err)
+	}
+
+	if err := s.Delete(); err != nil {
+		fmt.Printf("❌ Failed to remove service %s: %v\n", windowsServiceName, err)
+		return 1
+	}
+	if err := deregisterEventSource(); err != nil {
+		fmt.Printf("⚠️  Failed to remove the %s event source: %v\n", windowsServiceName, err)
+	}
+	fmt.Printf("✅ Service %s removed\n", windowsServiceName)
+	return 0
+}
+
+// runWindowsService runs the forwarder under the SCM. Started any other way, e.g. by
+// hand with the installed command line, it runs in the console as usual.
+func runWindowsService(opts *CommandLineOptions) int {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("Warning: Failed to detect the service manager, running in the console: %v", err)
+	}
+	if !isService {
+		return runInConsole(opts)
+	}
+
+	// Console output goes nowhere under the SCM
+	opts.EventLog = true
+	handler := &forwarderService{opts: opts}
+	if err := svc.Run(windowsServiceName, handler); err != nil {
+		log.Printf("Service %s failed: %v", windowsServiceName, err)
+		return 1
+	}
+	return handler.exitCode
+}
+
+// forwarderService is the svc.Handler running the forwarding loop under the SCM
+type forwarderService struct {
+	opts     *CommandLineOptions
+	exitCode int
+}
+
+// Execute runs the forwarding loop until the SCM sends Stop or Shutdown, which end
+// it the way Ctrl+C does in the console: between passes, with the usual shutdown
+func (f *forwarderService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan int, 1)
+	go func() {
+		done <- runForwarder(f.opts, stop)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case f.exitCode = <-done:
+			// Startup failed or --max-runtime passed
+			changes <- svc.Status{State: svc.StopPending}
+			return f.exitCode != 0, uint32(f.exitCode)
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				f.exitCode = <-done
+				return f.exitCode != 0, uint32(f.exitCode)
+			}
+		}
+	}
+}
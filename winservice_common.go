@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// windowsServiceName is the name the forwarder is registered under with the SCM,
+// the same one install-service.bat gives the NSSM-wrapped service
+const windowsServiceName = "WSL2PortForwarder"
+
+// serviceCommandLine builds the arguments the SCM starts the service with from the
+// --install-service command line: --run-service in place of --install-service, the
+// config file as an absolute path (services start in System32) and every --var
+// definition, since those were taken out of the arguments before parsing
+func serviceCommandLine(args []string, configFile string, vars map[string]string) ([]string, error) {
+	absConfig, err := filepath.Abs(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceArgs := []string{"--run-service"}
+	for _, arg := range args {
+		switch arg {
+		case "--install-service":
+		case configFile:
+			serviceArgs = append(serviceArgs, absConfig)
+		default:
+			serviceArgs = append(serviceArgs, arg)
+		}
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		serviceArgs = append(serviceArgs, "--var", name+"="+vars[name])
+	}
+	return serviceArgs, nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// installWindowsService is only supported on Windows
+func installWindowsService(opts *CommandLineOptions, args []string) int {
+	fmt.Println("❌ --install-service is only supported on Windows")
+	return 1
+}
+
+// uninstallWindowsService is only supported on Windows
+func uninstallWindowsService() int {
+	fmt.Println("❌ --uninstall-service is only supported on Windows")
+	return 1
+}
+
+// runWindowsService runs in the console, since there is no service manager off Windows
+func runWindowsService(opts *CommandLineOptions) int {
+	return runInConsole(opts)
+}